@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/daemon"
+	"udp_mirror/pkg/logging"
+)
+
+// Коды завершения status, как у LSB init скриптов
+const (
+	exitNotRunning = 3
+	exitUnknown    = 4
+)
+
+const waitPollInterval = 100 * time.Millisecond
+
+// controlCommands - подкоманды управления запущенным экземпляром
+var controlCommands = map[string]func(paths daemon.Paths, opts controlOptions) int{
+	"status":  cmdStatus,
+	"reload":  cmdReload,
+	"quit":    cmdQuit,
+	"stop":    cmdStop,
+	"restart": cmdRestart,
+	"upgrade": cmdUpgrade,
+}
+
+type controlOptions struct {
+	configFile string
+	runDir     string
+	timeout    time.Duration
+}
+
+// runControl выполняет подкоманду управления и возвращает код завершения
+func runControl(cmd string, args []string) int {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	configFile := fs.String("f", "config.yml", "Path to the config file")
+	runDir := fs.String("run-dir", "", "Directory for the PID file and control socket")
+	timeout := fs.Duration("timeout", 30*time.Second, "How long to wait for the process to stop or start")
+	_ = fs.Parse(args)
+
+	return controlCommand(cmd, controlOptions{configFile: *configFile, runDir: *runDir, timeout: *timeout})
+}
+
+func controlCommand(cmd string, opts controlOptions) int {
+	run, ok := controlCommands[cmd]
+	if !ok {
+		flag.Usage()
+		return 1
+	}
+
+	opts.runDir = resolveRunDir(opts.runDir, opts.configFile, nil)
+	paths, err := daemon.NewPaths(opts.runDir, opts.configFile)
+	if err != nil {
+		logger.Error("Ошибка определения каталога запуска", logging.Err(err))
+		return 1
+	}
+	return run(paths, opts)
+}
+
+// resolveRunDir выбирает каталог запуска: флаг -run-dir, run_dir из конфига или каталог по умолчанию.
+// Если cfg не передан, конфиг читается из файла; ошибки чтения игнорируются.
+func resolveRunDir(flagDir, configFile string, cfg *config.Config) string {
+	if flagDir != "" {
+		return flagDir
+	}
+	if cfg == nil {
+		if c, err := config.GetConfig(configFile); err == nil {
+			cfg = &c
+		}
+	}
+	if cfg != nil && cfg.RunDir != "" {
+		return cfg.RunDir
+	}
+	return daemon.DefaultRunDir()
+}
+
+// running возвращает PID запущенного экземпляра или пишет, что он не запущен.
+// Устаревшие PID файл и сокет удаляются.
+func running(paths daemon.Paths) (int, bool) {
+	pid, err := daemon.Running(paths.PIDFile)
+	if errors.Is(err, daemon.ErrNotRunning) {
+		// сокет мог остаться после аварийного завершения
+		_ = os.Remove(paths.Socket)
+		fmt.Println("udp_mirror не запущен")
+		return 0, false
+	}
+	if err != nil {
+		logger.Error("Ошибка проверки PID файла", "file", paths.PIDFile, logging.Err(err))
+		return 0, false
+	}
+	return pid, true
+}
+
+func cmdStatus(paths daemon.Paths, _ controlOptions) int {
+	pid, ok := running(paths)
+	if !ok {
+		return exitNotRunning
+	}
+
+	var st daemon.Status
+	if err := daemon.Call(paths.Socket, "status", &st); err != nil {
+		fmt.Printf("udp_mirror запущен, PID %d, но управляющий сокет недоступен: %v\n", pid, err)
+		return exitUnknown
+	}
+	st.Print(os.Stdout)
+	return 0
+}
+
+func cmdReload(paths daemon.Paths, _ controlOptions) int {
+	pid, ok := running(paths)
+	if !ok {
+		return 1
+	}
+	if err := syscall.Kill(pid, syscall.SIGHUP); err != nil {
+		logger.Error("Ошибка отправки сигнала", "pid", pid, logging.Err(err))
+		return 1
+	}
+
+	logger.Info("Конфиг успешно перезагружается!", "pid", pid)
+	return 0
+}
+
+func cmdQuit(paths daemon.Paths, opts controlOptions) int {
+	pid, ok := running(paths)
+	if !ok {
+		return 1
+	}
+	if err := quit(pid, opts.timeout); err != nil {
+		logger.Error("Ошибка завершения", "pid", pid, logging.Err(err))
+		return 1
+	}
+
+	logger.Info("Приложение завершено!", "pid", pid)
+	return 0
+}
+
+func cmdStop(paths daemon.Paths, opts controlOptions) int {
+	pid, ok := running(paths)
+	if !ok {
+		return 1
+	}
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		logger.Error("Ошибка отправки сигнала", "pid", pid, logging.Err(err))
+		return 1
+	}
+	if !waitExit(pid, opts.timeout) {
+		logger.Error("Процесс не завершился", "pid", pid)
+		return 1
+	}
+
+	// процесс не успел убрать за собой
+	_ = os.Remove(paths.PIDFile)
+	_ = os.Remove(paths.Socket)
+
+	logger.Info("Приложение принудительно завершено!", "pid", pid)
+	return 0
+}
+
+// cmdRestart штатно завершает запущенный экземпляр и запускает новый в фоне
+func cmdRestart(paths daemon.Paths, opts controlOptions) int {
+	if pid, err := daemon.Running(paths.PIDFile); err == nil {
+		if err := quit(pid, opts.timeout); err != nil {
+			logger.Error("Ошибка завершения", "pid", pid, logging.Err(err))
+			return 1
+		}
+		logger.Info("Приложение завершено", "pid", pid)
+	}
+
+	if err := startBackground(opts.configFile, opts.runDir); err != nil {
+		logger.Error("Ошибка запуска в фоне", logging.Err(err))
+		return 1
+	}
+
+	deadline := time.Now().Add(opts.timeout)
+	for time.Now().Before(deadline) {
+		if pid, err := daemon.Running(paths.PIDFile); err == nil {
+			logger.Info("Приложение перезапущено", "pid", pid)
+			return 0
+		}
+		time.Sleep(waitPollInterval)
+	}
+
+	logger.Error("Новый процесс не запустился", "timeout", opts.timeout.String())
+	return 1
+}
+
+// quit отправляет SIGTERM и ждет завершения процесса
+func quit(pid int, timeout time.Duration) error {
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+	if !waitExit(pid, timeout) {
+		return fmt.Errorf("процесс не завершился за %v", timeout)
+	}
+	return nil
+}
+
+// waitExit ждет, пока процесс pid завершится
+func waitExit(pid int, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	for daemon.Alive(pid) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// startBackground запускает новый процесс в отдельной сессии, чтобы он не
+// завершился вместе с терминалом
+func startBackground(configFile, runDir string, args ...string) error {
+	cmd := exec.Command(os.Args[0], append([]string{"-f", configFile, "-run-dir", runDir}, args...)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
@@ -2,78 +2,107 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
 	"flag"
 	"fmt"
-	"log"
-	"log/slog"
+	"net"
 	"os"
-	"os/exec"
 	"os/signal"
-	"path/filepath"
-	"strconv"
-	"strings"
 	"sync"
 	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
 
 	"udp_mirror/config"
+	"udp_mirror/internal/capture"
+	"udp_mirror/internal/daemon"
+	"udp_mirror/internal/handoff"
+	"udp_mirror/internal/health"
+	"udp_mirror/internal/otlp"
 	"udp_mirror/internal/pipeline"
+	"udp_mirror/internal/replay"
+	"udp_mirror/internal/resolver"
 
+	"udp_mirror/pkg/adminhttp"
+	"udp_mirror/pkg/logging"
 	"udp_mirror/pkg/metrics"
 	"udp_mirror/pkg/pprofhttp"
+	"udp_mirror/pkg/systemd"
 )
 
-func initLog() {
-	level := slog.LevelInfo
-	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
-	case "debug":
-		level = slog.LevelDebug
-	case "warn":
-		level = slog.LevelWarn
-	case "error":
-		level = slog.LevelError
-	}
-
-	// Создаем логгер с обычным текстовым выводом
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+var logger = logging.For("main")
 
-	// Делаем этот логгер дефолтным
-	slog.SetDefault(logger)
+// fatal пишет ошибку в журнал и завершает процесс
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
 }
 
 func main() {
-	initLog()
+	// до загрузки конфига журнал текстовый, уровень из LOG_LEVEL
+	if err := logging.Setup(nil); err != nil {
+		fatal("Ошибка настройки журнала", logging.Err(err))
+	}
+
+	// Подкоманды управления запущенным экземпляром: udp_mirror status -f config.yml
+	if len(os.Args) > 1 {
+		if _, ok := controlCommands[os.Args[1]]; ok {
+			os.Exit(runControl(os.Args[1], os.Args[2:]))
+		}
+		if os.Args[1] == "validate" {
+			os.Exit(runValidate(os.Args[2:]))
+		}
+		if os.Args[1] == "config" {
+			os.Exit(runConfig(os.Args[2:]))
+		}
+	}
 
 	// Парсим флаги
 	configFilePtr := flag.String("f", "config.yml", "Path to the config file")
 	backgroundFlag := flag.Bool("d", false, "Run in background mode")
-	signalFlag := flag.String("s", "", "Send signal to running process (reload, stop, quit)")
+	signalFlag := flag.String("s", "", "Send signal to running process (reload, stop, quit); same as the subcommands")
+	runDirFlag := flag.String("run-dir", "", "Directory for the PID file and control socket")
+	upgradeFlag := flag.Bool("upgrade", false, "Take over sockets from the running instance and replace it (used by the upgrade command)")
+
+	replayFile := flag.String("replay", "", "Replay UDP datagrams from a pcap/pcapng file instead of listening")
+	replaySpeed := flag.Float64("replay-speed", 1, "Replay speed multiplier (0 - as fast as possible)")
+	replayRate := flag.Float64("replay-rate", 0, "Max replay rate in packets per second (0 - unlimited)")
+	replayLoop := flag.Int("replay-loop", 1, "Number of passes over the replay file (0 - infinite)")
+	replayRewrite := flag.Bool("replay-rewrite-port", false, "Feed all datagrams to the pipeline regardless of their destination port")
+	replayPipeline := flag.String("replay-pipeline", "", "Replay only into the pipeline with this name")
 	flag.Parse()
 
-	slog.Debug(fmt.Sprintf("Используемый config файл: %s", *configFilePtr))
-	pidFile := generatePIDFileName(*configFilePtr)
+	logger.Debug("Используемый config файл", "file", *configFilePtr)
 
-	if *signalFlag == "reload" {
-		sendReloadSignal(pidFile)
-		return
-	} else if *signalFlag == "quit" {
-		sendQuitSignal(pidFile)
-		return
-	} else if *signalFlag == "stop" {
-		sendStopSignal(pidFile)
-		return
-	} else if *signalFlag != "" {
-		flag.Usage()
-		os.Exit(1)
+	if *signalFlag != "" {
+		os.Exit(controlCommand(*signalFlag, controlOptions{
+			configFile: *configFilePtr,
+			runDir:     *runDirFlag,
+			timeout:    30 * time.Second,
+		}))
 	}
 
-	if *backgroundFlag {
-		runInBackground(*configFilePtr, flag.Args())
+	if *replayFile != "" {
+		opts := replay.Options{
+			File:        *replayFile,
+			Speed:       *replaySpeed,
+			MaxRate:     *replayRate,
+			Loop:        *replayLoop,
+			RewritePort: *replayRewrite,
+		}
+		runReplay(*configFilePtr, *replayPipeline, opts)
+		return
 	}
 
-	writePIDFile(pidFile)
-	defer deletePIDFile(pidFile)
+	// под systemd (Type=notify) процесс не должен уходить в фон
+	if *backgroundFlag && systemd.Enabled() {
+		logger.Warn("Запущен systemd, флаг -d игнорируется")
+	} else if *backgroundFlag {
+		if err := startBackground(*configFilePtr, resolveRunDir(*runDirFlag, *configFilePtr, nil)); err != nil {
+			fatal("Ошибка запуска в фоне", logging.Err(err))
+		}
+		os.Exit(0)
+	}
 
 	// Загружаем конфигурацию
 	// cfg := config.GetConfig(*configFilePtr)
@@ -81,23 +110,56 @@ func main() {
 	reloader := &config.ConfigReloader{}
 	err := reloader.LoadConfig(*configFilePtr)
 	if err != nil {
-		msg := fmt.Sprintf("Ошибка загрузки конфига: %v", err)
-		slog.Error(msg)
+		logConfigErrors("Ошибка загрузки конфига", err)
 		return
 	}
 
 	cfg := reloader.GetConfigCopy()
-	log.Println("Config:", cfg)
+	if err := logging.Setup(cfg.Logging); err != nil {
+		logger.Error("Ошибка настройки журнала", logging.Err(err))
+		return
+	}
+	logger.Info("Конфигурация загружена", "config", cfg)
+
+	paths, err := daemon.NewPaths(resolveRunDir(*runDirFlag, *configFilePtr, &cfg), *configFilePtr)
+	if err != nil {
+		logger.Error("Ошибка определения каталога запуска", logging.Err(err))
+		return
+	}
+
+	// При обновлении PID файл и управляющий сокет занимаются после завершения старого процесса
+	var oldPID int
+	var inherited map[string][]*net.UDPConn
+	if *upgradeFlag {
+		oldPID, inherited = inheritSockets(paths, cfg)
+	} else if err := daemon.WritePIDFile(paths.PIDFile); err != nil {
+		logger.Error("Ошибка записи PID файла", "file", paths.PIDFile, logging.Err(err))
+		return
+	}
+	defer removePIDFile(paths.PIDFile)
 
 	// Создаем контекст с отменой
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel() // Гарантируем отмену контекста при выходе
 
+	if !*upgradeFlag {
+		startControl(ctx, cancel, paths.Socket, *configFilePtr)
+	}
+
 	go handleShutdown(cancel)
-	go handleReload(reloader, *configFilePtr)
+	go handleReload(reloader, *configFilePtr, watchConfig(ctx, reloader, cfg.Reload))
+
+	// Сокеты, переданные systemd при активации (LISTEN_FDS) или старым процессом при обновлении
+	activated := activatedSockets(cfg)
+	for name, conns := range inherited {
+		activated[name] = conns
+	}
 
 	// Регистрируем метрики
 	metrics.Register()
+	metrics.ConfigLoaded(reloader.Hash())
+	configureHealth(cfg.Health)
+	resolver.Configure(cfg.DNS)
 
 	// Запускаем pprof, если включено
 	if cfg.Pprof != nil && cfg.Pprof.Enabled {
@@ -106,9 +168,36 @@ func main() {
 
 	// Запускаем Prometheus, если включено
 	if cfg.Prom != nil && cfg.Prom.Enabled {
+		metrics.ConfigureSources(cfg.Prom.SourceLabels, cfg.Prom.TopSources)
+		metrics.Handle("/healthz", health.HealthzHandler())
+		metrics.Handle("/readyz", health.ReadyzHandler())
 		go metrics.StartPrometheus(cfg.Prom.Listen)
 	}
 
+	// Экспорт метрик и трасс по OTLP, если включен
+	if cfg.OTLP != nil && cfg.OTLP.Enabled {
+		exp, err := otlp.Start(ctx, *cfg.OTLP)
+		if err != nil {
+			logger.Error("Ошибка запуска OTLP экспорта", logging.Err(err))
+		} else {
+			defer shutdownOTLP(exp)
+		}
+	}
+
+	// Запись трафика в pcapng, если включена в конфиге
+	if err := capture.Configure(cfg.Capture); err != nil {
+		logger.Error("Ошибка запуска записи трафика", logging.Err(err))
+	}
+
+	// Запускаем административный сервер, если включено
+	if cfg.Admin != nil && cfg.Admin.Enabled {
+		adminhttp.Handle("/capture", capture.Handler())
+		adminhttp.Handle("/capture/", capture.Handler())
+		adminhttp.Handle("/healthz", health.HealthzHandler())
+		adminhttp.Handle("/readyz", health.ReadyzHandler())
+		go adminhttp.Start(cfg.Admin.Listen)
+	}
+
 	// p_cfg := cfg.Pipeline[0]
 	// pl := pipeline.NewPipeline(ctx, p_cfg)
 	// pl.Start(ctx)
@@ -120,154 +209,167 @@ func main() {
 		go func(pСfg *config.Pipeline) {
 			defer wgPl.Done()
 			pl := pipeline.NewPipeline(*pСfg)
+			pl.Conns = activated[pСfg.Name]
 			pl.Start(ctx)
 		}(&plСfg)
 	}
 
+	if *upgradeFlag {
+		go completeUpgrade(ctx, cancel, paths, oldPID, len(cfg.Pipeline), *configFilePtr)
+	}
+	go notifyReady(ctx, len(cfg.Pipeline))
+	startWatchdog(ctx)
+
 	// Ожидаем завершения контекста (когда вызовем cancel)
 	<-ctx.Done()
-	log.Println("[Main] Остановка сервера...")
+	logger.Info("Остановка сервера...")
 
 	wgPl.Wait()
-	log.Println("[Main] Все Pipeline завершены...")
+	logger.Info("Все Pipeline завершены")
 
 	// workerManager.Shutdown()
-	log.Println("[Main] Сервер завершил работу")
+	logging.DefaultLimiter().Flush()
+	logger.Info("Сервер завершил работу")
 }
 
-func generatePIDFileName(configPath string) string {
-	absPath, err := filepath.Abs(configPath)
-	if err != nil {
-		log.Fatalf("Ошибка получения абсолютного пути: %v", err)
+// configureHealth задает порог ошибок целей для /healthz
+func configureHealth(cfg *config.HealthConfig) {
+	if cfg == nil {
+		health.SetErrorThreshold(0)
+		return
 	}
-
-	// Вариант 2: MD5-хэш пути (если путь слишком длинный)
-	hash := md5.Sum([]byte(absPath))
-	return "udp_mirror_" + hex.EncodeToString(hash[:8]) + ".pid"
+	health.SetErrorThreshold(cfg.ErrorThreshold)
 }
 
-func processExists(pidFile string) error {
-
-	_, err := os.Stat(pidFile)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Fatalf("Ошибка c pid файлом, %s\n", err)
-			return err
-		}
-		return nil
-	}
-
-	pid := readPidFile(pidFile)
-
-	process, _ := os.FindProcess(pid)
-	if process == nil {
-		deletePIDFile(pidFile)
+// logConfigErrors пишет ошибки конфига по одной записи на ошибку
+func logConfigErrors(msg string, err error) {
+	for _, e := range config.Errors(err) {
+		logger.Error(msg, logging.Err(e))
 	}
-
-	return nil
-
 }
 
-func writePIDFile(pidFile string) {
-	pid := os.Getpid()
+// runValidate проверяет конфиг без запуска: udp_mirror validate -f config.yml
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := fs.String("f", "config.yml", "Path to the config file")
+	_ = fs.Parse(args)
 
-	err := processExists(pidFile)
-	if err != nil {
-		log.Fatalln("Просесс udp_mirror уже запущен")
+	if _, err := config.GetConfig(*configFile); err != nil {
+		for _, e := range config.Errors(err) {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return 1
 	}
 
-	err = os.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0o644)
-	if err != nil {
-		log.Fatalf("Ошибка записи PID файла: %v", err)
-	}
+	fmt.Printf("%s: конфиг корректен\n", *configFile)
+	return 0
 }
 
-func deletePIDFile(pidFile string) {
-	err := os.Remove(pidFile)
-	if err != nil {
-		log.Fatalln(err)
+// runConfig выполняет команды над конфигом: udp_mirror config dump -f config.yml
+// выводит объединенный конфиг после подстановки переменных и включения файлов, без секретов
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintln(os.Stderr, "использование: udp_mirror config dump [-f config.yml]")
+		return 2
 	}
-}
 
-func readPidFile(pidFile string) int {
-	pid, err := os.ReadFile(pidFile) // Читаем PID из файла
-	if err != nil {
-		log.Fatalf("Ошибка чтения PID файла: %v", err)
-	}
+	fs := flag.NewFlagSet("config dump", flag.ExitOnError)
+	configFile := fs.String("f", "config.yml", "Path to the config file")
+	_ = fs.Parse(args[1:])
 
-	cleaned := strings.TrimSpace(string(pid))
-	pidInt, err := strconv.Atoi(cleaned)
+	cfg, err := config.GetConfig(*configFile)
 	if err != nil {
-		log.Fatalf("Ошибка конвертации PID: %v", err)
+		for _, e := range config.Errors(err) {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return 1
 	}
 
-	return pidInt
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg.Redacted()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
 }
 
-func sendQuitSignal(pidFile string) {
-	pidInt := readPidFile(pidFile)
+// shutdownOTLP отправляет накопленные метрики и трассы перед выходом
+func shutdownOTLP(exp *otlp.Exporter) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	err := syscall.Kill(pidInt, syscall.SIGTERM)
-	if err != nil {
-		log.Fatalf("Ошибка отправки сигнала: %v", err)
+	if err := exp.Shutdown(ctx); err != nil {
+		logger.Error("Ошибка остановки OTLP экспорта", logging.Err(err))
 	}
-
-	log.Println("Приложение завершено!")
 }
 
-func sendStopSignal(pidFile string) {
-	defer deletePIDFile(pidFile)
-	pid, err := os.ReadFile(pidFile) // Читаем PID из файла
+// runReplay воспроизводит pcap файл в pipeline из конфига и завершается по окончании
+func runReplay(configFile, plName string, opts replay.Options) {
+	cfg, err := config.GetConfig(configFile)
 	if err != nil {
-		slog.Error("Приложение не запущено")
+		logConfigErrors("Ошибка загрузки конфига", err)
 		return
 	}
-
-	pidInt, err := strconv.Atoi(string(pid))
-	if err != nil {
-		msg := fmt.Sprintf("Ошибка конвертации PID: %v", err)
-		slog.Error(msg)
+	if err := logging.Setup(cfg.Logging); err != nil {
+		logger.Error("Ошибка настройки журнала", logging.Err(err))
 		return
 	}
+	resolver.Configure(cfg.DNS)
 
-	err = syscall.Kill(pidInt, syscall.SIGKILL)
-	if err != nil {
-		msg := fmt.Sprintf("Ошибка отправки сигнала: %v", err)
-		slog.Error(msg)
-		return
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	slog.Info("Приложение принудительно завершено!")
-}
+	go handleShutdown(cancel)
 
-func sendReloadSignal(pidFile string) {
-	log.Println("Получен сигнал на перезапуск...")
-	pid, err := os.ReadFile(pidFile) // Читаем PID из файла
-	if err != nil {
-		log.Fatalf("Приложение не запущено")
+	if err := capture.Configure(cfg.Capture); err != nil {
+		logger.Error("Ошибка запуска записи трафика", logging.Err(err))
 	}
+	defer func() { _ = capture.Default().Stop() }()
 
-	pidInt, err := strconv.Atoi(string(pid))
-	if err != nil {
-		log.Fatalf("Ошибка конвертации PID: %v", err)
-	}
+	var wgPl sync.WaitGroup
 
-	err = syscall.Kill(pidInt, syscall.SIGHUP) // Отправляем `SIGHUP`
-	if err != nil {
-		log.Fatalf("Ошибка отправки сигнала: %v", err)
+	for _, plCfg := range cfg.Pipeline {
+		if plName != "" && plCfg.Name != plName {
+			continue
+		}
+
+		wgPl.Add(1)
+		go func(pCfg config.Pipeline) {
+			defer wgPl.Done()
+			pl := pipeline.NewPipeline(pCfg)
+			pl.StartReplay(ctx, opts)
+		}(plCfg)
 	}
 
-	log.Println("Конфиг успешно перезагружается!")
+	wgPl.Wait()
+	logger.Info("Воспроизведение завершено")
+}
+
+// removePIDFile удаляет PID файл при завершении
+func removePIDFile(pidFile string) {
+	if err := daemon.RemovePIDFile(pidFile); err != nil {
+		logger.Error("Ошибка удаления PID файла", "file", pidFile, logging.Err(err))
+	}
 }
 
-func runInBackground(configFile string, args []string) {
-	cmdArgs := append([]string{"-f", configFile}, args...)
-	cmd := exec.Command(os.Args[0], cmdArgs...)
-	err := cmd.Start()
+// startControl открывает управляющий сокет для команд status, handoff и drain
+func startControl(ctx context.Context, cancel context.CancelFunc, socket, configFile string) {
+	srv, err := daemon.Listen(socket)
 	if err != nil {
-		log.Fatalln(err)
+		logger.Error("Ошибка запуска управляющего сокета", logging.Err(err))
+		return
 	}
-	os.Exit(0)
+
+	started := time.Now()
+	srv.Handle("status", func(context.Context) (any, error) {
+		return daemon.CurrentStatus(configFile, started), nil
+	})
+	srv.HandleConn(handoff.Command, func(_ context.Context, conn *net.UnixConn) error {
+		return handoff.Send(conn)
+	})
+	srv.Handle(drainCommand, handleDrain(cancel))
+	go srv.Serve(ctx)
 }
 
 // handleShutdown ловит SIGINT/SIGTERM и вызывает cancel()
@@ -276,28 +378,78 @@ func handleShutdown(cancel context.CancelFunc) {
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
 	<-sigChan // Ждём SIGINT (Ctrl+C) или SIGTERM (kill <PID>)
-	log.Println("[Main] Получен сигнал завершения, останавливаем сервер...")
+	logger.Info("Получен сигнал завершения, останавливаем сервер...")
+	notify(systemd.Stopping)
 	cancel() // Отправляем сигнал остановки всем горутинам
 }
 
-func handleReload(reloader *config.ConfigReloader, configFile string) {
+// handleReload перезагружает конфиг по SIGHUP и по изменению файлов конфига (changes)
+func handleReload(reloader *config.ConfigReloader, configFile string, changes <-chan struct{}) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP)
 
-	for sig := range sigChan {
-		if sig != syscall.SIGHUP {
-			continue
+	for {
+		select {
+		case <-sigChan:
+			logger.Info("Получен SIGHUP, обновляем конфиг...")
+			reloadConfig(reloader, configFile, false)
+		case <-changes:
+			logger.Info("Файлы конфига изменены, обновляем конфиг...")
+			reloadConfig(reloader, configFile, true)
 		}
+	}
+}
 
-		log.Println("[Config] Получен SIGHUP, обновляем конфиг...")
-		err := reloader.LoadConfig(configFile)
-		if err != nil {
-			log.Printf("Ошибка обновления конфига: %v", err)
-		}
+// reloadConfig перечитывает конфиг и применяет изменения, которые можно применить на ходу.
+// onlyChanged - не применять конфиг, если его содержимое не изменилось.
+func reloadConfig(reloader *config.ConfigReloader, configFile string, onlyChanged bool) {
+	notify(systemd.Reloading)
+	defer notify(systemd.Ready)
+
+	prev := reloader.Hash()
+	// конфиг с ошибками не применяется, продолжаем работать с текущим
+	if err := reloader.LoadConfig(configFile); err != nil {
+		metrics.ConfigReload(metrics.ReloadFailure)
+		logConfigErrors("Конфиг с ошибками не применен", err)
+		return
+	}
+	metrics.ConfigReload(metrics.ReloadSuccess)
+	metrics.ConfigLoaded(reloader.Hash())
 
-		cfg := reloader.GetConfigCopy()
-		log.Println("Config:", cfg)
+	if onlyChanged && reloader.Hash() == prev {
+		logger.Info("Содержимое конфига не изменилось")
+		return
+	}
 
+	cfg := reloader.GetConfigCopy()
+	logger.Info("Конфигурация загружена", "config", cfg)
+
+	// формат и вывод журнала меняются только при запуске, уровни - сразу
+	if err := logging.SetLevels(cfg.Logging); err != nil {
+		logger.Error("Ошибка настройки уровней журнала", logging.Err(err))
+	}
+
+	if err := capture.Configure(cfg.Capture); err != nil {
+		logger.Error("Ошибка запуска записи трафика", logging.Err(err))
 	}
 
+	if cfg.Prom != nil {
+		metrics.ConfigureSources(cfg.Prom.SourceLabels, cfg.Prom.TopSources)
+	}
+	configureHealth(cfg.Health)
+}
+
+// watchConfig включает перезагрузку по изменению файлов конфига, если она задана в конфиге
+func watchConfig(ctx context.Context, reloader *config.ConfigReloader, cfg *config.ReloadConfig) <-chan struct{} {
+	if cfg == nil || !cfg.Watch {
+		return nil
+	}
+
+	changes, err := reloader.Watch(ctx, cfg.Debounce)
+	if err != nil {
+		logger.Error("Ошибка наблюдения за файлами конфига, доступна перезагрузка по SIGHUP", logging.Err(err))
+		return nil
+	}
+	logger.Info("Включена перезагрузка конфига при изменении файлов", "files", reloader.Files())
+	return changes
 }
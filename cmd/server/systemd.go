@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/health"
+	"udp_mirror/pkg/logging"
+	"udp_mirror/pkg/systemd"
+)
+
+const readyPollInterval = 100 * time.Millisecond
+
+// activatedSockets возвращает сокеты, переданные systemd, по именам pipeline.
+// Сокеты, имени которых нет в конфиге, закрываются; адрес и число сокетов
+// сверяет с конфигом сам pipeline.
+func activatedSockets(cfg config.Config) map[string][]*net.UDPConn {
+	conns, err := systemd.UDPListeners()
+	if err != nil {
+		fatal("Ошибка получения сокетов systemd", logging.Err(err))
+	}
+	if conns == nil {
+		return map[string][]*net.UDPConn{}
+	}
+
+	names := map[string]bool{}
+	for _, pl := range cfg.Pipeline {
+		names[pl.Name] = true
+	}
+
+	for name, list := range conns {
+		if names[name] {
+			continue
+		}
+		logger.Warn("Сокет systemd не соответствует ни одному pipeline", "name", name, "count", len(list))
+		for _, c := range list {
+			c.Close()
+		}
+		delete(conns, name)
+	}
+	return conns
+}
+
+// notifyReady сообщает systemd о готовности, когда все pipeline открыли сокеты и запустили воркеры
+func notifyReady(ctx context.Context, pipelines int) {
+	if !systemd.Enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+
+	for !health.Ready(pipelines) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	if _, err := systemd.Ready(); err != nil {
+		logger.Error("Ошибка уведомления systemd", logging.Err(err))
+		return
+	}
+	logger.Info("systemd уведомлен о готовности")
+}
+
+// startWatchdog отправляет пинги watchdog, пока все pipeline исправны
+func startWatchdog(ctx context.Context) {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		logger.Error("Ошибка настройки watchdog", logging.Err(err))
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	logger.Info("Watchdog systemd включен", "interval", interval.String())
+	go systemd.RunWatchdog(ctx, interval, health.Healthy, func(err error) {
+		logger.Error("Ошибка отправки пинга watchdog", logging.Err(err))
+	})
+}
+
+// notify отправляет состояние systemd и пишет ошибку в журнал
+func notify(send func() (bool, error)) {
+	if _, err := send(); err != nil {
+		logger.Error("Ошибка уведомления systemd", logging.Err(err))
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/daemon"
+	"udp_mirror/internal/handoff"
+	"udp_mirror/internal/health"
+	"udp_mirror/pkg/logging"
+)
+
+// Команда управляющего сокета: новый процесс готов, старый завершает работу
+const drainCommand = "drain"
+
+// Ожидания нового процесса при обновлении
+const (
+	readyTimeout = 60 * time.Second // готовность pipeline, иначе обновление отменяется
+	drainTimeout = 60 * time.Second // завершение старого процесса после drain, затем SIGTERM
+	killTimeout  = 10 * time.Second // завершение после SIGTERM, затем SIGKILL
+)
+
+// cmdUpgrade запускает новый бинарник, который принимает сокеты у запущенного
+// экземпляра, и ждет, пока старый процесс передаст работу и завершится
+func cmdUpgrade(paths daemon.Paths, opts controlOptions) int {
+	oldPID, ok := running(paths)
+	if !ok {
+		return 1
+	}
+	if underSystemd(oldPID) {
+		logger.Error("Экземпляр запущен systemd, обновление без простоя не поддерживается: используйте systemctl restart", "pid", oldPID)
+		return 1
+	}
+
+	if err := startBackground(opts.configFile, opts.runDir, "-upgrade"); err != nil {
+		logger.Error("Ошибка запуска нового процесса", logging.Err(err))
+		return 1
+	}
+
+	deadline := time.Now().Add(opts.timeout)
+	for time.Now().Before(deadline) {
+		pid, err := daemon.Running(paths.PIDFile)
+		if err == nil && pid != oldPID {
+			logger.Info("Приложение обновлено", "old_pid", oldPID, "pid", pid)
+			return 0
+		}
+		time.Sleep(waitPollInterval)
+	}
+
+	logger.Error("Обновление не завершено", "old_pid", oldPID, "timeout", opts.timeout.String())
+	return 1
+}
+
+// inheritSockets принимает сокеты pipeline у запущенного экземпляра.
+// Если передать сокеты не удалось, pipeline откроют свои с SO_REUSEPORT рядом со старыми.
+// Сокеты pipeline, которых нет в новом конфиге, закрываются; адрес и число сокетов
+// остальных сверяет с новым конфигом сам pipeline.
+func inheritSockets(paths daemon.Paths, cfg config.Config) (oldPID int, conns map[string][]*net.UDPConn) {
+	oldPID, err := daemon.Running(paths.PIDFile)
+	if errors.Is(err, daemon.ErrNotRunning) {
+		logger.Warn("Запущенный экземпляр не найден, обычный запуск")
+		return 0, nil
+	}
+	if err != nil {
+		fatal("Ошибка проверки PID файла", "file", paths.PIDFile, logging.Err(err))
+	}
+
+	conns, err = handoff.Receive(paths.Socket)
+	if err != nil {
+		logger.Error("Ошибка получения сокетов, открываем свои", "old_pid", oldPID, logging.Err(err))
+		return oldPID, nil
+	}
+
+	names := map[string]bool{}
+	for _, pl := range cfg.Pipeline {
+		names[pl.Name] = true
+	}
+
+	count := 0
+	for name, list := range conns {
+		if !names[name] {
+			for _, c := range list {
+				c.Close()
+			}
+			delete(conns, name)
+			continue
+		}
+		count += len(list)
+	}
+	logger.Info("Получены сокеты запущенного экземпляра", "old_pid", oldPID, "count", count)
+	return oldPID, conns
+}
+
+// completeUpgrade дожидается готовности pipeline, просит старый процесс
+// завершиться и занимает его PID файл и управляющий сокет.
+// Если новый процесс не стал готов, он завершается, а старый продолжает работу.
+// После drain старый процесс уже останавливается, поэтому новый работает дальше
+// в любом случае, а затянувшийся старый завершает сигналами.
+func completeUpgrade(ctx context.Context, cancel context.CancelFunc, paths daemon.Paths, oldPID, pipelines int, configFile string) {
+	if oldPID != 0 {
+		if !waitReady(ctx, pipelines, readyTimeout) {
+			if ctx.Err() == nil {
+				logger.Error("Новый процесс не готов, обновление отменено", "old_pid", oldPID)
+				cancel()
+			}
+			return
+		}
+
+		if err := daemon.Call(paths.Socket, drainCommand, nil); err != nil {
+			logger.Error("Ошибка остановки старого процесса", "old_pid", oldPID, logging.Err(err))
+		}
+		if !waitOld(ctx, oldPID, drainTimeout) && ctx.Err() == nil {
+			logger.Warn("Старый процесс не завершился, отправляем SIGTERM", "old_pid", oldPID, "timeout", drainTimeout.String())
+			_ = syscall.Kill(oldPID, syscall.SIGTERM)
+			if !waitOld(ctx, oldPID, killTimeout) && ctx.Err() == nil {
+				logger.Warn("Старый процесс не завершился, отправляем SIGKILL", "old_pid", oldPID)
+				_ = syscall.Kill(oldPID, syscall.SIGKILL)
+				if !waitOld(ctx, oldPID, killTimeout) && ctx.Err() == nil {
+					logger.Error("Старый процесс не завершается, занимаем PID файл", "old_pid", oldPID)
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Info("Старый процесс завершен", "old_pid", oldPID)
+	}
+
+	if err := daemon.WritePIDFile(paths.PIDFile); err != nil {
+		logger.Error("Ошибка записи PID файла", "file", paths.PIDFile, logging.Err(err))
+		cancel()
+		return
+	}
+	startControl(ctx, cancel, paths.Socket, configFile)
+}
+
+// waitReady ждет готовности всех pipeline не дольше timeout
+func waitReady(ctx context.Context, pipelines int, timeout time.Duration) bool {
+	wait, stop := context.WithTimeout(ctx, timeout)
+	defer stop()
+
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+
+	for !health.Ready(pipelines) {
+		select {
+		case <-wait.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// waitOld ждет завершения старого процесса не дольше timeout
+func waitOld(ctx context.Context, pid int, timeout time.Duration) bool {
+	wait, stop := context.WithTimeout(ctx, timeout)
+	defer stop()
+
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+
+	for daemon.Alive(pid) {
+		select {
+		case <-wait.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// underSystemd сообщает, что процесс pid запущен systemd с Type=notify: systemd следит
+// за главным PID, и замена процесса остановила бы сервис. Если окружение процесса
+// прочитать нельзя, считается, что нет.
+func underSystemd(pid int) bool {
+	env, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return false
+	}
+	for _, kv := range bytes.Split(env, []byte{0}) {
+		if bytes.HasPrefix(kv, []byte("NOTIFY_SOCKET=")) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDrain передает работу новому процессу: отвечает и начинает штатную остановку,
+// при которой воркеры дописывают очереди
+func handleDrain(cancel context.CancelFunc) func(context.Context) (any, error) {
+	return func(context.Context) (any, error) {
+		logger.Info("Новый процесс принял работу, завершаемся", "pid", os.Getpid())
+		go cancel()
+		return "ok", nil
+	}
+}
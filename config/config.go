@@ -2,26 +2,85 @@ package config
 
 import (
 	"fmt"
-	"log"
 	"log/slog"
+	"maps"
 	"net"
-	"os"
+	"slices"
+	"time"
 
-	"gopkg.in/yaml.v3"
+	"udp_mirror/pkg/logging"
 )
 
 type Config struct {
+	// Include - файлы, каталоги (*.yml, *.yaml, *.json, *.toml) и шаблоны имен,
+	// pipeline из которых добавляются к pipeline этого файла
+	Include []string `yaml:"include,omitempty"`
+
 	Pipeline []Pipeline   `yaml:"pipeline"`
 	Pprof    *pprofConfig `yaml:"pprof,omitempty"`
 	Prom     *promConfig  `yaml:"prometheus,omitempty"`
+	OTLP     *OTLPConfig  `yaml:"otlp,omitempty"`
+	Admin    *adminConfig `yaml:"admin,omitempty"`
+
+	// RunDir - каталог PID файла и управляющего сокета
+	RunDir string `yaml:"run_dir,omitempty"`
+
+	Health *HealthConfig `yaml:"health,omitempty"`
+
+	Reload *ReloadConfig `yaml:"reload,omitempty"`
+
+	DNS *DNSConfig `yaml:"dns,omitempty"`
+
+	// Workers - настройки воркеров по умолчанию для всех целей
+	Workers *WorkersConfig `yaml:"workers,omitempty"`
+
+	Logging *logging.Config `yaml:"logging,omitempty"`
+
+	Capture *CaptureConfig `yaml:"capture,omitempty"`
 }
 
 type Pipeline struct {
 	Name    string         `yaml:"name"`
 	Input   AddrConfig     `yaml:"input"`
 	Targets []TargetConfig `yaml:"targets"`
+
+	// Workers - настройки воркеров для целей pipeline
+	Workers *WorkersConfig `yaml:"workers,omitempty"`
+
+	Listener *ListenerConfig `yaml:"listener,omitempty"`
 }
 
+// ListenerConfig настройки слушателей входа pipeline. Нулевые значения - по умолчанию.
+type ListenerConfig struct {
+	// Count - число слушателей, каждый со своим сокетом в группе SO_REUSEPORT, по умолчанию 2
+	Count int `yaml:"count,omitempty"`
+	// ReadBuffer - буфер приема сокета (SO_RCVBUF), байт, по умолчанию 32MB
+	ReadBuffer int `yaml:"read_buffer,omitempty"`
+	// ReadTimeout - таймаут чтения, с которым слушатель проверяет остановку, по умолчанию 300ms
+	ReadTimeout time.Duration `yaml:"read_timeout,omitempty"`
+	// MaxDatagram - размер буфера чтения, байт; длинные датаграммы обрезаются. По умолчанию 65508.
+	MaxDatagram int `yaml:"max_datagram,omitempty"`
+	// SteerBySource - направлять датаграммы одного источника всегда в один сокет группы
+	// (SO_ATTACH_REUSEPORT_CBPF), чтобы сохранить их порядок
+	SteerBySource bool `yaml:"steer_by_source,omitempty"`
+	// Truncated - что делать с датаграммой больше MaxDatagram: drop (по умолчанию) или forward
+	Truncated string `yaml:"truncated,omitempty"`
+	// Mode - socket (по умолчанию) или raw: прием с AF_PACKET сокета, фрагменты
+	// пересылаются UDP целям как есть, без сборки датаграммы
+	Mode string `yaml:"mode,omitempty"`
+	// Interface - интерфейс для режима raw, по умолчанию все
+	Interface string `yaml:"interface,omitempty"`
+}
+
+// Обработка обрезанных датаграмм и режимы приема
+const (
+	TruncatedDrop    = "drop"
+	TruncatedForward = "forward"
+
+	ListenerSocket = "socket"
+	ListenerRaw    = "raw"
+)
+
 type AddrConfig struct {
 	Host net.IP `yaml:"host"`
 	Port uint16 `yaml:"port"`
@@ -32,11 +91,141 @@ type AddrConfig struct {
 // 	Port uint16 `yaml:"port"`
 // }
 
+// Типы целей
+const (
+	TargetUDP   = "udp"
+	TargetFile  = "file"
+	TargetKafka = "kafka"
+	TargetHTTP  = "http"
+)
+
 type TargetConfig struct {
-	Host    net.IP `yaml:"host"`
+	Type    string `yaml:"type,omitempty"` // udp (по умолчанию), file, kafka, http
+	Host    string `yaml:"host"`           // IP адрес или имя узла
 	Port    uint16 `yaml:"port"`
 	SrcHost net.IP `yaml:"src_host,omitempty"`
 	SrcPort uint16 `yaml:"src_port,omitempty"`
+
+	// FanOut - отправлять копию на каждый адрес имени host, а не только на первый
+	FanOut bool `yaml:"fan_out,omitempty"`
+
+	// MTU - наибольший размер IP пакета до цели; 0 - MTU маршрута до адреса цели
+	MTU int `yaml:"mtu,omitempty"`
+	// DF - что делать с датаграммой больше MTU: fragment (по умолчанию), drop или icmp
+	DF string `yaml:"df,omitempty"`
+
+	// Workers - настройки воркеров цели. После загрузки конфига содержит
+	// настройки, унаследованные от pipeline и верхнего уровня.
+	Workers *WorkersConfig `yaml:"workers,omitempty"`
+
+	File  *FileTargetConfig  `yaml:"file,omitempty"`
+	Kafka *KafkaTargetConfig `yaml:"kafka,omitempty"`
+	HTTP  *HTTPTargetConfig  `yaml:"http,omitempty"`
+}
+
+// Обработка датаграмм больше MTU цели
+const (
+	DFFragment = "fragment" // фрагментировать
+	DFDrop     = "drop"     // отбросить; остальные пакеты уходят с флагом DF
+	DFICMP     = "icmp"     // отбросить и сообщить источнику ICMP "fragmentation needed"
+)
+
+// Форматы файловой цели
+const (
+	FileFormatRaw    = "raw"
+	FileFormatBinary = "binary"
+	FileFormatJSON   = "jsonl"
+	FileFormatPcap   = "pcap"
+)
+
+// FileTargetConfig настройки записи датаграмм в файлы
+type FileTargetConfig struct {
+	Path   string `yaml:"path"`
+	Format string `yaml:"format"` // raw, binary, jsonl, pcap
+
+	// Ротация
+	MaxSize  int64         `yaml:"max_size,omitempty"` // байт
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Сжатие закрытых сегментов: gzip, zstd
+	Compress string `yaml:"compress,omitempty"`
+
+	// Хранение закрытых сегментов
+	MaxFiles int           `yaml:"max_files,omitempty"`
+	MaxAge   time.Duration `yaml:"max_age,omitempty"`
+}
+
+// KafkaTargetConfig настройки отправки датаграмм в Kafka
+type KafkaTargetConfig struct {
+	Brokers  []string `yaml:"brokers"`
+	Topic    string   `yaml:"topic"`
+	ClientID string   `yaml:"client_id,omitempty"`
+
+	Compression string        `yaml:"compression,omitempty"` // none, gzip, snappy, lz4, zstd
+	Acks        string        `yaml:"acks,omitempty"`        // all (по умолчанию), leader, none
+	BatchBytes  int32         `yaml:"batch_bytes,omitempty"` // максимальный размер батча
+	Linger      time.Duration `yaml:"linger,omitempty"`      // ожидание наполнения батча
+
+	// Максимум записей в буфере клиента. При переполнении датаграммы отбрасываются.
+	BufferSize int `yaml:"buffer_size,omitempty"`
+}
+
+// Форматы тела HTTP запроса
+const (
+	HTTPFormatNDJSON   = "ndjson"
+	HTTPFormatTemplate = "template"
+)
+
+// HTTPTargetConfig настройки отправки датаграмм пачками в POST запросах
+type HTTPTargetConfig struct {
+	URL string `yaml:"url"`
+
+	Format      string `yaml:"format,omitempty"`   // ndjson (по умолчанию), template
+	Template    string `yaml:"template,omitempty"` // text/template для всей пачки
+	ContentType string `yaml:"content_type,omitempty"`
+
+	Headers map[string]string `yaml:"headers,omitempty"`
+	Token   string            `yaml:"token,omitempty"` // Authorization: Bearer <token>
+	Gzip    bool              `yaml:"gzip,omitempty"`
+
+	// Пачка отправляется по достижении любого из порогов
+	BatchSize     int           `yaml:"batch_size,omitempty"`  // записей
+	BatchBytes    int           `yaml:"batch_bytes,omitempty"` // байт данных
+	FlushInterval time.Duration `yaml:"flush_interval,omitempty"`
+
+	Timeout      time.Duration `yaml:"timeout,omitempty"`
+	MaxRetries   int           `yaml:"max_retries,omitempty"`
+	RetryBackoff time.Duration `yaml:"retry_backoff,omitempty"` // начальная задержка, удваивается
+	MaxBackoff   time.Duration `yaml:"max_backoff,omitempty"`
+
+	// Сколько пачек может ждать отправки. При переполнении пачка отбрасывается.
+	QueueSize int `yaml:"queue_size,omitempty"`
+}
+
+// Kind возвращает тип цели с учетом значения по умолчанию
+func (t TargetConfig) Kind() string {
+	if t.Type == "" {
+		return TargetUDP
+	}
+	return t.Type
+}
+
+// IP возвращает адрес цели, если host задан адресом, и nil для имени узла
+func (t TargetConfig) IP() net.IP {
+	return net.ParseIP(t.Host)
+}
+
+// Label возвращает имя цели для логов и метрик
+func (t TargetConfig) Label() string {
+	switch {
+	case t.Kind() == TargetFile && t.File != nil:
+		return t.File.Path
+	case t.Kind() == TargetKafka && t.Kafka != nil:
+		return "kafka:" + t.Kafka.Topic
+	case t.Kind() == TargetHTTP && t.HTTP != nil:
+		return t.HTTP.URL
+	}
+	return fmt.Sprintf("%s:%d", t.Host, t.Port)
 }
 
 type pprofConfig struct {
@@ -47,26 +236,208 @@ type pprofConfig struct {
 type promConfig struct {
 	Enabled bool   `yaml:"enabled"`
 	Listen  string `yaml:"listen"`
+
+	// Учет самых активных источников вместо метки на каждый IP
+	SourceLabels bool `yaml:"source_labels,omitempty"`
+	TopSources   int  `yaml:"top_sources,omitempty"`
 }
 
-func GetConfig(fileName string) (Config, error) {
-	f, err := os.Open(fileName)
-	if err != nil {
-		log.Fatalf("Ошибка открытия файла %s: %v", fileName, err)
+// OTLPConfig настройки экспорта метрик и трасс по OTLP/HTTP
+type OTLPConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Endpoint - адрес коллектора, например http://localhost:4318.
+	// Пути /v1/metrics и /v1/traces добавляются автоматически.
+	Endpoint    string            `yaml:"endpoint"`
+	Headers     map[string]string `yaml:"headers,omitempty"`
+	ServiceName string            `yaml:"service_name,omitempty"` // по умолчанию udp_mirror
+	Interval    time.Duration     `yaml:"interval,omitempty"`     // период отправки метрик, по умолчанию 10s
+
+	// TraceSampleRatio - доля принятых пакетов, для которых пишутся spans
+	// receive, enqueue и send. 0 - трассировка выключена.
+	TraceSampleRatio float64 `yaml:"trace_sample_ratio,omitempty"`
+}
+
+type adminConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Listen  string `yaml:"listen"`
+}
+
+// HealthConfig настройки проверок /healthz и /readyz
+type HealthConfig struct {
+	// ErrorThreshold - сколько все цели pipeline должны непрерывно отдавать
+	// ошибки, чтобы /healthz считал pipeline неисправным. По умолчанию 30s.
+	ErrorThreshold time.Duration `yaml:"error_threshold,omitempty"`
+}
+
+// WorkersConfig настройки воркеров, отправляющих датаграммы цели.
+// Задаются на верхнем уровне, в pipeline и в цели; заданные поля нижнего уровня
+// перекрывают верхний.
+type WorkersConfig struct {
+	// Count - воркеров на цель, по умолчанию четверть CPU, но не меньше одного
+	Count int `yaml:"count,omitempty"`
+	// CPUs - закрепить воркеры за CPU: воркер i работает на CPUs[i % len(CPUs)]
+	CPUs []int `yaml:"cpus,omitempty"`
+	// LockOSThread - закрепить каждый воркер за своим потоком ОС (включается и при CPUs)
+	LockOSThread *bool `yaml:"lock_os_thread,omitempty"`
+	// Order - сохранение порядка датаграмм источника: none (по умолчанию), source (IP и порт), source_ip
+	Order string `yaml:"order,omitempty"`
+}
+
+// Порядок отправки датаграмм воркерами цели
+const (
+	OrderNone     = "none"      // воркеры берут датаграммы из общей очереди
+	OrderSource   = "source"    // датаграммы одного IP и порта источника отправляет один воркер
+	OrderSourceIP = "source_ip" // датаграммы одного IP источника отправляет один воркер
+)
+
+// MergeWorkers объединяет настройки воркеров от верхнего уровня к нижнему
+func MergeWorkers(levels ...*WorkersConfig) *WorkersConfig {
+	var out *WorkersConfig
+	for _, l := range levels {
+		if l == nil {
+			continue
+		}
+		if out == nil {
+			out = &WorkersConfig{}
+		}
+		if l.Count > 0 {
+			out.Count = l.Count
+		}
+		if l.CPUs != nil {
+			out.CPUs = l.CPUs
+		}
+		if l.LockOSThread != nil {
+			out.LockOSThread = l.LockOSThread
+		}
+		if l.Order != "" {
+			out.Order = l.Order
+		}
 	}
-	defer f.Close()
-
-	var cfg Config
-	decoder := yaml.NewDecoder(f)
-	err = decoder.Decode(&cfg)
-	if err != nil {
-		msg := fmt.Sprintf("Ошибка парсинга файла %s: %v", fileName, err)
-		slog.Error(msg)
-		return cfg, err
+	return out
+}
+
+// inheritWorkers переносит настройки воркеров верхнего уровня и pipeline в цели
+func (c *Config) inheritWorkers() {
+	for i := range c.Pipeline {
+		pl := &c.Pipeline[i]
+		for j := range pl.Targets {
+			t := &pl.Targets[j]
+			t.Workers = MergeWorkers(c.Workers, pl.Workers, t.Workers)
+		}
 	}
-	return cfg, nil
+}
+
+// DNSConfig настройки разрешения имен целей
+type DNSConfig struct {
+	// Servers - DNS серверы (host или host:port), по умолчанию из /etc/resolv.conf
+	Servers []string `yaml:"servers,omitempty"`
+	// TTL ответа ограничивается снизу MinTTL и сверху MaxTTL, по умолчанию 5s и 5m.
+	// После ошибки запрос повторяется через MinTTL.
+	MinTTL time.Duration `yaml:"min_ttl,omitempty"`
+	MaxTTL time.Duration `yaml:"max_ttl,omitempty"`
+	// Timeout - время ожидания ответа сервера, по умолчанию 2s
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// ReloadConfig настройки автоматической перезагрузки конфига.
+// Читается только при запуске.
+type ReloadConfig struct {
+	// Watch - перечитывать конфиг при изменении его файлов (inotify), кроме SIGHUP
+	Watch bool `yaml:"watch"`
+	// Debounce - пауза после последнего изменения перед перезагрузкой, по умолчанию 500ms
+	Debounce time.Duration `yaml:"debounce,omitempty"`
+}
+
+// CaptureConfig настройки записи трафика в pcapng
+type CaptureConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+
+	// Фильтры: пустой список - без ограничений
+	Pipelines []string `yaml:"pipelines,omitempty"`
+	Targets   []string `yaml:"targets,omitempty"`   // в виде host:port
+	Direction string   `yaml:"direction,omitempty"` // in, out, both (по умолчанию)
+
+	Snaplen int `yaml:"snaplen,omitempty"`
+
+	// Ротация файлов
+	FileSize int64         `yaml:"file_size,omitempty"` // байт
+	FileAge  time.Duration `yaml:"file_age,omitempty"`
+	MaxFiles int           `yaml:"max_files,omitempty"`
+
+	// Ограничения всей записи, по достижении запись останавливается
+	MaxBytes int64         `yaml:"max_bytes,omitempty"`
+	Duration time.Duration `yaml:"duration,omitempty"`
+}
+
+// GetConfig читает конфиг из файла вместе с включаемыми файлами, проверяет его и возвращает
+// все найденные ошибки с номерами строк (ValidationErrors). Неизвестные ключи считаются ошибкой.
+func GetConfig(fileName string) (Config, error) {
+	cfg, _, err := LoadConfig(fileName)
+	return cfg, err
+}
+
+// ParseConfig разбирает и проверяет конфиг. fileName используется в сообщениях об ошибках
+// и как точка отсчета относительных путей include.
+func ParseConfig(fileName string, data []byte) (Config, error) {
+	return newLoader(fileName).run(fileName, data)
 }
 
 type ctxKey string
 
 const PlNameKey ctxKey = "pl_name"
+
+// InputKey - адрес входа pipeline (AddrConfig) в контексте воркеров
+const InputKey ctxKey = "input"
+
+// redactedValue заменяет секреты при выводе конфига
+const redactedValue = "***"
+
+// Redacted возвращает копию конфига для логов и config dump: token и значения
+// заголовков HTTP целей, значения заголовков OTLP заменены на ***
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Pipeline = slices.Clone(c.Pipeline)
+	for i := range r.Pipeline {
+		targets := slices.Clone(r.Pipeline[i].Targets)
+		for j, t := range targets {
+			if t.HTTP == nil {
+				continue
+			}
+			h := *t.HTTP
+			if h.Token != "" {
+				h.Token = redactedValue
+			}
+			h.Headers = redactHeaders(h.Headers)
+			targets[j].HTTP = &h
+		}
+		r.Pipeline[i].Targets = targets
+	}
+	if c.OTLP != nil {
+		o := *c.OTLP
+		o.Headers = redactHeaders(o.Headers)
+		r.OTLP = &o
+	}
+	return &r
+}
+
+// LogValue выводит конфиг в лог без секретов
+func (c *Config) LogValue() slog.Value {
+	if c == nil {
+		return slog.AnyValue(nil)
+	}
+	type plain Config // без LogValue, иначе slog вызовет его снова
+	return slog.AnyValue((*plain)(c.Redacted()))
+}
+
+// redactHeaders возвращает копию заголовков с замененными значениями
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	r := maps.Clone(headers)
+	for k := range r {
+		r[k] = redactedValue
+	}
+	return r
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedacted(t *testing.T) {
+	cfg := &Config{
+		Pipeline: []Pipeline{{Name: "dp", Targets: []TargetConfig{
+			{Host: "127.0.0.1", Port: 2089},
+			{Type: TargetHTTP, HTTP: &HTTPTargetConfig{
+				URL:     "http://collector/ingest",
+				Token:   "secret-token",
+				Headers: map[string]string{"Authorization": "Basic secret-basic"},
+			}},
+		}}},
+		OTLP: &OTLPConfig{Endpoint: "http://otel:4318", Headers: map[string]string{"X-Api-Key": "secret-key"}},
+	}
+
+	var out bytes.Buffer
+	slog.New(slog.NewJSONHandler(&out, nil)).Info("config", "config", cfg)
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("секреты в логе: %s", out.String())
+	}
+	for _, want := range []string{"collector/ingest", "Authorization", "X-Api-Key", "otel:4318"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("в логе нет %q: %s", want, out.String())
+		}
+	}
+
+	// исходный конфиг не изменяется
+	h := cfg.Pipeline[0].Targets[1].HTTP
+	if h.Token != "secret-token" || h.Headers["Authorization"] != "Basic secret-basic" ||
+		cfg.OTLP.Headers["X-Api-Key"] != "secret-key" {
+		t.Errorf("секреты исходного конфига изменены: %+v %+v", h, cfg.OTLP)
+	}
+}
@@ -0,0 +1,462 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// varNameRe - допустимое имя переменной окружения в подстановке
+var varNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// interpolate подставляет переменные окружения: ${VAR}, ${VAR:-default} (если переменная
+// не задана или пуста), ${VAR-default} (если не задана). $$ заменяется на $.
+// Значение вставляется с учетом места подстановки, чтобы не менять структуру документа:
+// в строке в кавычках оно экранируется, а простое значение YAML, в котором после
+// подстановки появились особые символы, заключается в двойные кавычки.
+// Комментарии не меняются.
+func interpolate(fileName string, data []byte) ([]byte, ValidationErrors) {
+	if !bytes.ContainsRune(data, '$') {
+		return data, nil
+	}
+
+	s := &scanner{file: fileName, data: data, line: 1}
+	if filepath.Ext(fileName) == ".toml" {
+		s.toml()
+	} else {
+		s.yaml()
+	}
+	return s.out.Bytes(), s.errs
+}
+
+// scanner разбирает текст конфига настолько, чтобы отличать комментарии, строки
+// в кавычках, простые и блочные значения, и выполняет в них подстановки
+type scanner struct {
+	file string
+	data []byte
+	i    int
+	line int
+	flow int // глубина [] и {} в YAML
+	out  bytes.Buffer
+	errs ValidationErrors
+}
+
+func (s *scanner) errorf(format string, args ...any) {
+	s.errs = append(s.errs, ValidationError{File: s.file, Line: s.line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// yaml выполняет подстановки в YAML (и JSON)
+func (s *scanner) yaml() {
+	d := s.data
+	expect := true // в этом месте может начинаться значение
+	lineStart := true
+	lineIndent := 0
+	block := -1 // отступ строки с заголовком блочного значения | или >; -1 - вне блока
+
+	for s.i < len(d) {
+		if lineStart {
+			lineStart = false
+			indent := 0
+			for s.i+indent < len(d) && d[s.i+indent] == ' ' {
+				indent++
+			}
+			end := s.i + indent
+			blank := end == len(d) || d[end] == '\n' || d[end] == '\r'
+			if block >= 0 && (blank || indent > block) {
+				s.blockLine(indent)
+				lineStart = true
+				continue
+			}
+			block = -1
+			lineIndent = indent
+		}
+
+		c := d[s.i]
+		switch {
+		case c == '\n':
+			s.line++
+			lineStart, expect = true, true
+			s.copyByte()
+		case c == ' ' || c == '\t' || c == '\r':
+			s.copyByte()
+		case c == '#' && s.afterSpace():
+			s.comment()
+		case expect && (c == '"' || c == '\''):
+			s.quoted(c)
+			expect = false
+			if s.flow > 0 && s.i < len(d) && d[s.i] == ':' {
+				// JSON: двоеточие сразу после ключа в кавычках
+				s.copyByte()
+				expect = true
+			}
+		case expect && s.flow == 0 && (c == '|' || c == '>'):
+			block = lineIndent
+			s.copyByte()
+			expect = false
+		case expect && (c == '&' || c == '!'):
+			// якорь или тег перед значением
+			for s.i < len(d) && !isSpace(d[s.i]) && !(s.flow > 0 && isFlowIndicator(d[s.i])) {
+				s.copyByte()
+			}
+		case expect && (c == '-' || c == '?') && s.indicator():
+			s.copyByte()
+		case c == ':' && s.indicator():
+			s.copyByte()
+			expect = true
+		case expect && (c == '[' || c == '{'):
+			s.flow++
+			s.copyByte()
+		case s.flow > 0 && (c == ']' || c == '}'):
+			s.flow--
+			s.copyByte()
+			expect = false
+		case s.flow > 0 && c == ',':
+			s.copyByte()
+			expect = true
+		case expect:
+			s.plain()
+			expect = false
+		default:
+			s.raw()
+		}
+	}
+}
+
+// plain выполняет подстановки в простом (без кавычек) значении YAML. Если после
+// подстановки значение изменило бы структуру документа, оно заключается в кавычки.
+func (s *scanner) plain() {
+	d := s.data
+	start, end := s.i, s.i
+	substituted := false
+	for j := s.i; j < len(d); {
+		c := d[j]
+		if c == '$' {
+			if n := substLen(d, j); n > 0 {
+				j += n
+				end = j
+				substituted = true
+				continue
+			}
+		}
+		if c == '\n' || c == '\r' ||
+			c == '#' && j > start && (d[j-1] == ' ' || d[j-1] == '\t') ||
+			c == ':' && (j+1 == len(d) || isSpace(d[j+1]) || s.flow > 0 && isFlowIndicator(d[j+1])) ||
+			s.flow > 0 && isFlowIndicator(c) {
+			break
+		}
+		j++
+		if c != ' ' && c != '\t' {
+			end = j
+		}
+	}
+
+	value := s.expandText(d[start:end])
+	s.i = end
+	if substituted && needsQuote(value, s.flow > 0) {
+		s.out.WriteByte('"')
+		escapeDouble(&s.out, value)
+		s.out.WriteByte('"')
+		return
+	}
+	s.out.WriteString(value)
+}
+
+// quoted выполняет подстановки в строке YAML в кавычках q, экранируя значения
+func (s *scanner) quoted(q byte) {
+	d := s.data
+	s.copyByte()
+	for s.i < len(d) {
+		c := d[s.i]
+		switch {
+		case q == '"' && c == '\\' && s.i+1 < len(d):
+			if d[s.i+1] == '\n' {
+				s.line++
+			}
+			s.out.Write(d[s.i : s.i+2])
+			s.i += 2
+			continue
+		case q == '\'' && c == '\'' && s.i+1 < len(d) && d[s.i+1] == '\'':
+			s.out.WriteString("''")
+			s.i += 2
+			continue
+		case c == q:
+			s.copyByte()
+			return
+		case c == '\n':
+			s.line++
+		case c == '$':
+			if value, n, ok := s.subst(d, s.i); ok {
+				s.insertQuoted(q, false, value)
+				s.i += n
+				continue
+			}
+		}
+		s.copyByte()
+	}
+}
+
+// blockLine копирует строку блочного значения YAML. Строки значения подстановки
+// продолжаются с отступом этой строки.
+func (s *scanner) blockLine(indent int) {
+	d := s.data
+	for s.i < len(d) {
+		c := d[s.i]
+		if c == '$' {
+			if value, n, ok := s.subst(d, s.i); ok {
+				s.out.WriteString(strings.ReplaceAll(value, "\n", "\n"+strings.Repeat(" ", indent)))
+				s.i += n
+				continue
+			}
+		}
+		s.copyByte()
+		if c == '\n' {
+			s.line++
+			return
+		}
+	}
+}
+
+// toml выполняет подстановки в TOML. Вне строк значение вставляется как есть,
+// например число; строковые значения должны быть в кавычках.
+func (s *scanner) toml() {
+	d := s.data
+	for s.i < len(d) {
+		switch c := d[s.i]; c {
+		case '#':
+			s.comment()
+		case '"', '\'':
+			s.tomlString(c)
+		case '\n':
+			s.line++
+			s.copyByte()
+		default:
+			s.raw()
+		}
+	}
+}
+
+// tomlString выполняет подстановки в строке TOML: обычной или многострочной
+func (s *scanner) tomlString(q byte) {
+	d := s.data
+	delim := []byte{q}
+	if bytes.HasPrefix(d[s.i:], []byte{q, q, q}) {
+		delim = []byte{q, q, q}
+	}
+	s.out.Write(delim)
+	s.i += len(delim)
+
+	for s.i < len(d) {
+		c := d[s.i]
+		switch {
+		case q == '"' && c == '\\' && s.i+1 < len(d):
+			if d[s.i+1] == '\n' {
+				s.line++
+			}
+			s.out.Write(d[s.i : s.i+2])
+			s.i += 2
+			continue
+		case bytes.HasPrefix(d[s.i:], delim):
+			s.out.Write(delim)
+			s.i += len(delim)
+			return
+		case c == '\n':
+			s.line++
+		case c == '$':
+			if value, n, ok := s.subst(d, s.i); ok {
+				s.insertQuoted(q, len(delim) == 3, value)
+				s.i += n
+				continue
+			}
+		}
+		s.copyByte()
+	}
+}
+
+// insertQuoted вставляет значение в строку в кавычках q. В строку в двойных кавычках
+// значение вставляется с экранированием, в одинарных (YAML) удваиваются кавычки.
+// В строку TOML в одинарных кавычках нельзя вставить кавычку, а в однострочную -
+// перевод строки.
+func (s *scanner) insertQuoted(q byte, multiline bool, value string) {
+	switch {
+	case q == '"':
+		escapeDouble(&s.out, value)
+	case strings.Contains(value, "\n") && !multiline:
+		s.errorf("значение с переводом строки нельзя подставить в строку в одинарных кавычках")
+	case filepath.Ext(s.file) == ".toml" && strings.Contains(value, "'"):
+		s.errorf("значение с кавычкой нельзя подставить в строку TOML в одинарных кавычках")
+	default:
+		s.out.WriteString(strings.ReplaceAll(value, "'", "''"))
+	}
+}
+
+// expandText возвращает текст с выполненными подстановками
+func (s *scanner) expandText(text []byte) string {
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		if text[i] == '$' {
+			if value, n, ok := s.subst(text, i); ok {
+				b.WriteString(value)
+				i += n
+				continue
+			}
+		}
+		b.WriteByte(text[i])
+		i++
+	}
+	return b.String()
+}
+
+// raw копирует символ, подстановка вставляется как есть
+func (s *scanner) raw() {
+	if s.data[s.i] == '$' {
+		if value, n, ok := s.subst(s.data, s.i); ok {
+			s.out.WriteString(value)
+			s.i += n
+			return
+		}
+	}
+	s.copyByte()
+}
+
+// comment копирует комментарий до конца строки
+func (s *scanner) comment() {
+	end := bytes.IndexByte(s.data[s.i:], '\n')
+	if end < 0 {
+		end = len(s.data) - s.i
+	}
+	s.out.Write(s.data[s.i : s.i+end])
+	s.i += end
+}
+
+func (s *scanner) copyByte() {
+	s.out.WriteByte(s.data[s.i])
+	s.i++
+}
+
+// afterSpace сообщает, что символ стоит в начале строки или после пробела
+func (s *scanner) afterSpace() bool {
+	return s.i == 0 || isSpace(s.data[s.i-1])
+}
+
+// indicator сообщает, что символ - индикатор YAML (-, ?, :), а не часть значения
+func (s *scanner) indicator() bool {
+	next := s.i + 1
+	return next == len(s.data) || isSpace(s.data[next]) ||
+		s.data[s.i] == ':' && s.flow > 0 && isFlowIndicator(s.data[next])
+}
+
+// subst разбирает подстановку в b[i:]. ok=false - $ не начинает подстановку
+// и копируется как есть.
+func (s *scanner) subst(b []byte, i int) (value string, n int, ok bool) {
+	n = substLen(b, i)
+	switch {
+	case n == 2:
+		return "$", n, true
+	case n > 0:
+		value, err := expand(string(b[i+2 : i+n-1]))
+		if err != nil {
+			s.errorf("%s", err)
+		}
+		return value, n, true
+	case i+1 < len(b) && b[i+1] == '{':
+		s.errorf("не закрыта подстановка ${")
+	}
+	return "", 0, false
+}
+
+// substLen возвращает длину подстановки $$ или ${...} в b[i:], 0 - подстановки нет
+func substLen(b []byte, i int) int {
+	if i+1 >= len(b) {
+		return 0
+	}
+	switch b[i+1] {
+	case '$':
+		return 2
+	case '{':
+		end := bytes.IndexByte(b[i+2:], '}')
+		if nl := bytes.IndexByte(b[i+2:], '\n'); end < 0 || (nl >= 0 && nl < end) {
+			return 0
+		}
+		return end + 3
+	}
+	return 0
+}
+
+// expand вычисляет выражение подстановки без ${}
+func expand(expr string) (string, error) {
+	name, def, hasDef := expr, "", false
+	emptyIsUnset := false
+	if i := strings.IndexByte(expr, '-'); i >= 0 {
+		name, def, hasDef = expr[:i], expr[i+1:], true
+		if strings.HasSuffix(name, ":") {
+			name, emptyIsUnset = name[:len(name)-1], true
+		}
+	}
+	if !varNameRe.MatchString(name) {
+		return "", fmt.Errorf("некорректная подстановка ${%s}", expr)
+	}
+
+	value, ok := os.LookupEnv(name)
+	switch {
+	case ok && (value != "" || !emptyIsUnset):
+		return value, nil
+	case hasDef:
+		return def, nil
+	default:
+		return "", fmt.Errorf("переменная окружения %s не задана", name)
+	}
+}
+
+// needsQuote сообщает, что простое значение YAML нужно заключить в кавычки,
+// чтобы оно осталось одним значением
+func needsQuote(v string, flow bool) bool {
+	if v == "" {
+		return false
+	}
+	if v[0] == ' ' || v[len(v)-1] == ' ' || strings.ContainsAny(v[:1], ",[]{}#&*!|>'\"%@`") ||
+		strings.ContainsAny(v[:1], "-?:") && (len(v) == 1 || v[1] == ' ') {
+		return true
+	}
+	if strings.Contains(v, ": ") || strings.HasSuffix(v, ":") || strings.Contains(v, " #") ||
+		flow && strings.ContainsAny(v, ",[]{}") {
+		return true
+	}
+	for _, r := range v {
+		if r < 0x20 || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeDouble дописывает v с экранированием для строки в двойных кавычках (YAML, JSON, TOML)
+func escapeDouble(b *bytes.Buffer, v string) {
+	for _, r := range v {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isFlowIndicator(c byte) bool {
+	return c == ',' || c == '[' || c == ']' || c == '{' || c == '}'
+}
@@ -0,0 +1,269 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// includeExts - расширения файлов, которые берутся из каталога include
+var includeExts = []string{".yml", ".yaml", ".json", ".toml"}
+
+// yamlSyntaxRe выделяет номер строки из синтаксических ошибок yaml.v3 вида "yaml: line 3: ..."
+var yamlSyntaxRe = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// loader собирает конфиг из главного файла и всех включаемых файлов
+type loader struct {
+	cfg    Config
+	src    origins
+	errs   ValidationErrors
+	files  []string        // прочитанные файлы и каталоги include
+	loaded map[string]bool // абсолютные пути прочитанных файлов
+	owners map[string]string
+}
+
+func newLoader(fileName string) *loader {
+	return &loader{
+		src:    origins{main: origin{file: fileName}, sections: map[string]origin{}},
+		loaded: map[string]bool{},
+		owners: map[string]string{},
+	}
+}
+
+// LoadConfig читает конфиг со всеми включаемыми файлами и проверяет его.
+// Кроме конфига возвращает список прочитанных файлов и каталогов include,
+// за изменениями которых нужно следить.
+func LoadConfig(fileName string) (Config, []string, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return Config{}, nil, fmt.Errorf("ошибка открытия файла %s: %w", fileName, err)
+	}
+	l := newLoader(fileName)
+	cfg, err := l.run(fileName, data)
+	return cfg, l.files, err
+}
+
+// run разбирает главный файл, включаемые файлы и проверяет объединенный конфиг
+func (l *loader) run(fileName string, data []byte) (Config, error) {
+	if err := l.load(fileName, data); err != nil {
+		// синтаксическая ошибка прерывает разбор, но выводится вместе с уже найденными
+		var errs ValidationErrors
+		if errors.As(err, &errs) {
+			return l.cfg, append(l.errs, errs...)
+		}
+		return l.cfg, err
+	}
+	l.errs = append(l.errs, validate(&l.cfg, &l.src)...)
+	if len(l.errs) > 0 {
+		return l.cfg, l.errs
+	}
+	l.cfg.inheritWorkers()
+	return l.cfg, nil
+}
+
+// load разбирает один файл и добавляет его в объединенный конфиг
+func (l *loader) load(fileName string, data []byte) error {
+	if abs, err := filepath.Abs(fileName); err == nil {
+		l.loaded[abs] = true
+		l.files = append(l.files, abs)
+	}
+
+	data, errs := interpolate(fileName, data)
+	l.errs = append(l.errs, errs...)
+
+	part, root, err := l.parse(fileName, data)
+	if err != nil {
+		return err
+	}
+	l.merge(fileName, &part, root)
+
+	dir := filepath.Dir(fileName)
+	for i, pattern := range part.Include {
+		files, err := l.expand(dir, pattern)
+		if err != nil {
+			l.errs = append(l.errs, ValidationError{
+				File: fileName,
+				Line: nodeLine(root, path{"include", i}),
+				Path: path{"include", i}.String(),
+				Msg:  err.Error(),
+			})
+			continue
+		}
+		for _, file := range files {
+			if err := l.include(fileName, root, path{"include", i}, file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// include читает включаемый файл, повторное включение считается ошибкой
+func (l *loader) include(parent string, root *yaml.Node, at path, file string) error {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	if l.loaded[abs] {
+		l.errs = append(l.errs, ValidationError{
+			File: parent,
+			Line: nodeLine(root, at),
+			Path: at.String(),
+			Msg:  fmt.Sprintf("файл %s уже включен", file),
+		})
+		return nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия файла %s: %w", file, err)
+	}
+	return l.load(file, data)
+}
+
+// expand раскрывает запись include: файл, каталог или шаблон имени
+func (l *loader) expand(dir, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+
+	if strings.ContainsAny(pattern, "*?[") {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("некорректный шаблон %s: %w", pattern, err)
+		}
+		if abs, err := filepath.Abs(filepath.Dir(pattern)); err == nil {
+			l.files = append(l.files, abs)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+
+	info, err := os.Stat(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("файл %s не найден", pattern)
+	}
+	if !info.IsDir() {
+		return []string{pattern}, nil
+	}
+
+	entries, err := os.ReadDir(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения каталога %s: %w", pattern, err)
+	}
+	if abs, err := filepath.Abs(pattern); err == nil {
+		l.files = append(l.files, abs)
+	}
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		for _, ext := range includeExts {
+			if filepath.Ext(e.Name()) == ext {
+				files = append(files, filepath.Join(pattern, e.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// parse разбирает файл по расширению: .toml - TOML, остальные - YAML (JSON его подмножество)
+func (l *loader) parse(fileName string, data []byte) (Config, *yaml.Node, error) {
+	var part Config
+
+	if filepath.Ext(fileName) == ".toml" {
+		var raw map[string]any
+		if _, err := toml.Decode(string(data), &raw); err != nil {
+			return part, nil, fmt.Errorf("ошибка парсинга файла %s: %w", fileName, err)
+		}
+		if len(raw) == 0 {
+			return part, nil, nil
+		}
+		// TOML приводится к YAML, чтобы разбор и проверка неизвестных ключей были общими.
+		// Номера строк в этом случае не известны.
+		data, err := yaml.Marshal(raw)
+		if err != nil {
+			return part, nil, fmt.Errorf("ошибка парсинга файла %s: %w", fileName, err)
+		}
+		errs, err := decodeStrict(fileName, data, &part)
+		for i := range errs {
+			errs[i].Line = 0
+		}
+		l.errs = append(l.errs, errs...)
+		return part, nil, err
+	}
+
+	errs, err := decodeStrict(fileName, data, &part)
+	l.errs = append(l.errs, errs...)
+	if err != nil {
+		return part, nil, err
+	}
+
+	var root yaml.Node
+	_ = yaml.Unmarshal(data, &root)
+	return part, &root, nil
+}
+
+// decodeStrict разбирает YAML, неизвестные ключи и ошибки типов возвращаются с номерами строк
+func decodeStrict(fileName string, data []byte, cfg *Config) (ValidationErrors, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(cfg)
+
+	var typeErr *yaml.TypeError
+	switch {
+	case errors.As(err, &typeErr):
+		// значения, которые удалось разобрать, проверяются дальше
+		return typeErrors(fileName, typeErr), nil
+	case errors.Is(err, io.EOF):
+		// пустой файл: ошибки покажет проверка
+	case err != nil:
+		if m := yamlSyntaxRe.FindStringSubmatch(err.Error()); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return nil, ValidationErrors{{File: fileName, Line: line, Msg: m[2]}}
+		}
+		return nil, fmt.Errorf("ошибка парсинга файла %s: %w", fileName, err)
+	}
+	return nil, nil
+}
+
+// merge добавляет разобранный файл в объединенный конфиг: pipeline дописываются в конец,
+// остальные секции могут быть заданы только в одном файле
+func (l *loader) merge(fileName string, part *Config, root *yaml.Node) {
+	for i := range part.Pipeline {
+		l.cfg.Pipeline = append(l.cfg.Pipeline, part.Pipeline[i])
+		l.src.pipelines = append(l.src.pipelines, origin{file: fileName, root: root, path: path{"pipeline", i}})
+	}
+
+	dst, src := reflect.ValueOf(&l.cfg).Elem(), reflect.ValueOf(part).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		key, _, _ := strings.Cut(src.Type().Field(i).Tag.Get("yaml"), ",")
+		if key == "pipeline" || key == "include" || key == "-" || src.Field(i).IsZero() {
+			continue
+		}
+		if owner, ok := l.owners[key]; ok {
+			l.errs = append(l.errs, ValidationError{
+				File: fileName,
+				Line: nodeLine(root, path{key}),
+				Path: key,
+				Msg:  fmt.Sprintf("секция уже задана в %s", owner),
+			})
+			continue
+		}
+		dst.Field(i).Set(src.Field(i))
+		l.owners[key] = fileName
+		l.src.sections[key] = origin{file: fileName, root: root}
+	}
+}
@@ -0,0 +1,279 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("UM_HOST", "10.0.0.1")
+	t.Setenv("UM_EMPTY", "")
+	t.Setenv("UM_COLON", "x: y")
+	t.Setenv("UM_HASH", " #x")
+	t.Setenv("UM_ALIAS", "*x")
+	t.Setenv("UM_NL", "1\n2")
+	t.Setenv("UM_QUOTE", `say "hi" \`)
+	t.Setenv("UM_APOS", "it's")
+	t.Setenv("UM_COMMA", "a,b")
+	t.Setenv("UM_DASH", "- x")
+
+	cases := []struct {
+		in, out string
+		err     string
+	}{
+		{"host: ${UM_HOST}", "host: 10.0.0.1", ""},
+		{"port: ${UM_PORT:-514}", "port: 514", ""},
+		{"a: ${UM_EMPTY:-x} b: ${UM_EMPTY-x}", "a: x b: ", ""},
+		{"price: $$5 ${UM_HOST}$$", "price: $5 10.0.0.1$", ""},
+		{"a: 1 # ${UM_MISSING}", "a: 1 # ${UM_MISSING}", ""},
+		{"url: http://x/#${UM_HOST}", "url: http://x/#10.0.0.1", ""},
+		{"a: 1\nb: ${UM_MISSING}", "a: 1\nb: ", "t.yml:2: переменная окружения UM_MISSING не задана"},
+		{"a: ${1X}", "a: ", "некорректная подстановка"},
+		{"a: ${UM_HOST\nb: 1", "a: ${UM_HOST\nb: 1", "не закрыта"},
+
+		// значения вставляются с учетом места подстановки
+		{`key: "a #b ${UM_HOST}"`, `key: "a #b 10.0.0.1"`, ""},
+		{`a: ${UM_COLON}`, `a: "x: y"`, ""},
+		{`a: pre${UM_HASH}`, `a: "pre #x"`, ""},
+		{`a: ${UM_ALIAS} # ${UM_MISSING}`, `a: "*x" # ${UM_MISSING}`, ""},
+		{`a: ${UM_NL}`, `a: "1\n2"`, ""},
+		{`a: "${UM_QUOTE}"`, `a: "say \"hi\" \\"`, ""},
+		{`a: '${UM_QUOTE} ${UM_APOS}'`, `a: 'say "hi" \ it''s'`, ""},
+		{`a: '${UM_NL}'`, `a: ''`, "переводом строки"},
+		{"t: |\n  # ${UM_NL}\n  x\nb: ${UM_HOST}", "t: |\n  # 1\n  2\n  x\nb: 10.0.0.1", ""},
+		{`in: {host: ${UM_HOST}, port: ${UM_PORT:-514}, tags: [${UM_COMMA}]}`, `in: {host: 10.0.0.1, port: 514, tags: ["a,b"]}`, ""},
+		{`{"a":"${UM_QUOTE}", "b": ${UM_PORT:-1}}`, `{"a":"say \"hi\" \\", "b": 1}`, ""},
+		{"- ${UM_DASH}\n- &x ${UM_HOST}", "- \"- x\"\n- &x 10.0.0.1", ""},
+	}
+	for _, c := range cases {
+		out, errs := interpolate("t.yml", []byte(c.in))
+		if string(out) != c.out {
+			t.Errorf("%q: получили %q, ожидали %q", c.in, out, c.out)
+		}
+		if c.err == "" && len(errs) > 0 || c.err != "" && (len(errs) != 1 || !strings.Contains(errs[0].Error(), c.err)) {
+			t.Errorf("%q: ошибки %v, ожидали %q", c.in, errs, c.err)
+		}
+	}
+
+	// TOML: в строках значения экранируются, вне строк вставляются как есть
+	for in, want := range map[string]string{
+		`host = "${UM_QUOTE}" # ${UM_MISSING}`: `host = "say \"hi\" \\" # ${UM_MISSING}`,
+		`port = ${UM_PORT:-514}`:               `port = 514`,
+		`t = """${UM_NL}"""`:                   `t = """1\n2"""`,
+		`t = '''${UM_NL}'''`:                   "t = '''1\n2'''",
+	} {
+		out, errs := interpolate("t.toml", []byte(in))
+		if string(out) != want || len(errs) > 0 {
+			t.Errorf("%q: получили %q %v, ожидали %q", in, out, errs, want)
+		}
+	}
+	if _, errs := interpolate("t.toml", []byte(`a = '${UM_APOS}'`)); len(errs) != 1 {
+		t.Errorf("кавычка в строке TOML в одинарных кавычках: %v", errs)
+	}
+}
+
+// подставленное значение разбирается как есть в любом месте документа
+func TestInterpolateRoundTrip(t *testing.T) {
+	docs := []string{
+		"a: ${UM_V}\n",
+		"a: \"${UM_V}\"\n",
+		"a: '${UM_V}'\n",
+		"m: {a: ${UM_V}}\n",
+		"l:\n  - ${UM_V}\n",
+		"a: ${UM_V} # комментарий\n",
+	}
+	for _, v := range []string{"x: y", "a #b", "*ref", "&a", "!tag", "- x", "a,b]", "{x}", `q"\'`, "  pad  ", "# x"} {
+		t.Setenv("UM_V", v)
+		for _, doc := range docs {
+			out, errs := interpolate("t.yml", []byte(doc))
+			if len(errs) > 0 {
+				t.Fatalf("%q в %q: %v", v, doc, errs)
+			}
+			var got struct {
+				A string
+				M struct{ A string }
+				L []string
+			}
+			if err := yaml.Unmarshal(out, &got); err != nil {
+				t.Errorf("%q в %q: %v", v, doc, err)
+				continue
+			}
+			if got.A != v && got.M.A != v && (len(got.L) != 1 || got.L[0] != v) {
+				t.Errorf("%q в %q: получили %q", v, doc, out)
+			}
+		}
+	}
+}
+
+func TestInclude(t *testing.T) {
+	t.Setenv("UM_TARGET", "10.0.0.3")
+	dir := writeFiles(t, map[string]string{
+		"main.yml": `include: [conf.d, extra/*.yml]
+pipeline:
+  - name: main
+    input: {host: 0.0.0.0, port: 2055}
+    targets: [{host: 10.0.0.1, port: 2055}]
+`,
+		"conf.d/a.json": `{"pipeline": [{"name": "a", "input": {"host": "0.0.0.0", "port": 3000},
+  "targets": [{"host": "10.0.0.2", "port": 514}]}]}`,
+		"conf.d/b.toml": `[[pipeline]]
+name = "b"
+input = {host = "0.0.0.0", port = 4000}
+targets = [{host = "${UM_TARGET}", port = 514}]
+
+[health]
+error_threshold = "10s"
+`,
+		"conf.d/notes.txt":   "не конфиг",
+		"extra/c.yml":        "pipeline:\n  - {name: c, input: {host: 0.0.0.0, port: 5000}, targets: [{host: 10.0.0.4, port: 514}]}\n",
+		"extra/ignored.toml": "",
+	})
+
+	cfg, files, err := LoadConfig(filepath.Join(dir, "main.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, pl := range cfg.Pipeline {
+		names = append(names, pl.Name)
+	}
+	if strings.Join(names, ",") != "main,a,b,c" {
+		t.Errorf("pipeline %v", names)
+	}
+	if got := cfg.Pipeline[2].Targets[0].Host; got != "10.0.0.3" {
+		t.Errorf("адрес из TOML %s", got)
+	}
+	if cfg.Health == nil || cfg.Health.ErrorThreshold.String() != "10s" {
+		t.Errorf("health %+v", cfg.Health)
+	}
+	if cfg.Include != nil {
+		t.Errorf("include в объединенном конфиге: %v", cfg.Include)
+	}
+
+	want := []string{"main.yml", "conf.d", "conf.d/a.json", "conf.d/b.toml", "extra", "extra/c.yml"}
+	if len(files) != len(want) {
+		t.Fatalf("файлы %v", files)
+	}
+	for i, w := range want {
+		if files[i] != filepath.Join(dir, w) {
+			t.Errorf("файл %d: %s, ожидали %s", i, files[i], w)
+		}
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.yml": `include:
+  - conf.d
+  - missing.yml
+  - main.yml
+health:
+  error_threshold: 5s
+`,
+		"conf.d/a.yml": `pipeline:
+  - name: a
+    input: {host: 0.0.0.0, port: 3000}
+    targets:
+      - {host: 10.0.0.2, port: 0}
+health:
+  error_threshold: 10s
+`,
+	})
+
+	_, err := GetConfig(filepath.Join(dir, "main.yml"))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("ошибка %v", err)
+	}
+
+	want := []struct {
+		file string
+		line int
+		msg  string
+	}{
+		{"conf.d/a.yml", 6, "секция уже задана"},
+		{"main.yml", 3, "не найден"},
+		{"main.yml", 4, "уже включен"},
+		{"conf.d/a.yml", 5, "порт"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("ошибок %d, ожидали %d:\n%v", len(errs), len(want), err)
+	}
+	for i, w := range want {
+		e := errs[i]
+		if e.File != filepath.Join(dir, w.file) || e.Line != w.line || !strings.Contains(e.Msg, w.msg) {
+			t.Errorf("ошибка %d: %+v, ожидали %+v", i, e, w)
+		}
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	_, err := ParseConfig("bad.yml", []byte("pipeline:\n  - name: a\n   bad"))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Line == 0 {
+		t.Fatalf("ошибка %v", err)
+	}
+}
+
+func TestWorkersInherit(t *testing.T) {
+	cfg, err := ParseConfig("w.yml", []byte(`workers: {count: 4, cpus: [0, 1]}
+pipeline:
+  - name: a
+    input: {host: 0.0.0.0, port: 3000}
+    workers: {lock_os_thread: true}
+    targets:
+      - {host: 10.0.0.1, port: 514}
+      - {host: 10.0.0.2, port: 514, workers: {count: 1, cpus: []}}
+  - name: b
+    input: {host: 0.0.0.0, port: 3001}
+    targets:
+      - {host: 10.0.0.3, port: 514, workers: {count: -1, order: fifo}}
+`))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 2 ||
+		errs[0].Line != 12 || errs[0].Path != "pipeline[1].targets[0].workers.count" ||
+		errs[1].Line != 12 || errs[1].Path != "pipeline[1].targets[0].workers.order" {
+		t.Fatalf("ошибка %v", err)
+	}
+
+	cfg, err = ParseConfig("w.yml", []byte(`workers: {count: 4, cpus: [0, 1]}
+pipeline:
+  - name: a
+    input: {host: 0.0.0.0, port: 3000}
+    workers: {lock_os_thread: true, order: source}
+    targets:
+      - {host: 10.0.0.1, port: 514}
+      - {host: 10.0.0.2, port: 514, workers: {count: 1, cpus: []}}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := cfg.Pipeline[0].Targets[0].Workers, cfg.Pipeline[0].Targets[1].Workers
+	if first.Count != 4 || len(first.CPUs) != 2 || first.LockOSThread == nil || !*first.LockOSThread || first.Order != OrderSource {
+		t.Errorf("цель 0: %+v", first)
+	}
+	if second.Count != 1 || len(second.CPUs) != 0 || !*second.LockOSThread {
+		t.Errorf("цель 1: %+v", second)
+	}
+}
@@ -1,31 +1,75 @@
 package config
 
 import (
-	"log"
+	"crypto/sha256"
+	"encoding/hex"
 	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"udp_mirror/pkg/logging"
 )
 
 // ConfigReloader управляет конфигурацией и её обновлением
 type ConfigReloader struct {
 	mu     sync.Mutex
 	config *Config
+	files  []string // файлы и каталоги include последнего загруженного конфига
+	hash   string
+
+	// refresh сообщает наблюдателю Watch, что набор файлов мог измениться
+	refresh chan struct{}
 }
 
-// LoadConfig загружает конфиг из файла
+// LoadConfig загружает конфиг из файла вместе с включаемыми файлами
 func (cr *ConfigReloader) LoadConfig(fileName string) error {
 	cr.mu.Lock()
 	defer cr.mu.Unlock()
 
-	cfg, err := GetConfig(fileName) // Читаем новый конфиг
+	cfg, files, err := LoadConfig(fileName) // Читаем новый конфиг
 	if err != nil {
 		return err
 	}
 	cr.config = &cfg
+	cr.files = files
+	cr.hash = Hash(cfg)
+
+	if cr.refresh != nil {
+		select {
+		case cr.refresh <- struct{}{}:
+		default:
+		}
+	}
 
-	log.Println("[Config] Конфигурация обновлена!")
+	logging.For("config").Info("Конфигурация обновлена", "file", fileName, "files", files, "hash", cr.hash)
 	return nil
 }
 
+// Hash возвращает хеш текущего конфига
+func (cr *ConfigReloader) Hash() string {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.hash
+}
+
+// Hash возвращает хеш объединенного конфига после подстановок: правка комментариев
+// и перенос pipeline между файлами его не меняют
+func Hash(cfg Config) string {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Files возвращает файлы и каталоги include, из которых собран текущий конфиг
+func (cr *ConfigReloader) Files() []string {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return append([]string(nil), cr.files...)
+}
+
 // GetConfigCopy возвращает копию текущего конфига (чтобы избежать гонки данных)
 func (cr *ConfigReloader) GetConfigCopy() Config {
 	cr.mu.Lock()
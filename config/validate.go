@@ -0,0 +1,568 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"udp_mirror/pkg/logging"
+)
+
+// ValidationError - ошибка конфига с положением в файле
+type ValidationError struct {
+	File string
+	Line int    // 0, если строку определить не удалось
+	Path string // путь к полю, например pipeline[0].targets[1].port
+	Msg  string
+}
+
+func (e ValidationError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		b.WriteString(":" + strconv.Itoa(e.Line))
+	}
+	b.WriteString(": ")
+	if e.Path != "" {
+		b.WriteString(e.Path + ": ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+// ValidationErrors - все ошибки конфига, по одной на строку
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, e := range errs {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Errors возвращает ошибки конфига по одной, если err содержит ValidationErrors
+func Errors(err error) []error {
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		return []error{err}
+	}
+	out := make([]error, len(errs))
+	for i, e := range errs {
+		out[i] = e
+	}
+	return out
+}
+
+// yamlLineRe выделяет номер строки из ошибок yaml.v3 вида "line 12: field foo not found in type ..."
+var yamlLineRe = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// typeErrors превращает ошибки декодирования yaml в ValidationErrors
+func typeErrors(file string, err *yaml.TypeError) ValidationErrors {
+	var errs ValidationErrors
+	for _, msg := range err.Errors {
+		e := ValidationError{File: file, Msg: msg}
+		if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.Msg = m[2]
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// origin - где в исходных файлах задан элемент конфига
+type origin struct {
+	file string
+	root *yaml.Node // дерево файла, nil для TOML
+	path path       // путь элемента внутри своего файла
+}
+
+// origins связывает элементы объединенного конфига с файлами, из которых они взяты
+type origins struct {
+	main      origin            // главный файл
+	sections  map[string]origin // секции верхнего уровня из включаемых файлов
+	pipelines []origin          // pipeline в порядке объединенного списка
+}
+
+// locate возвращает файл и строку поля объединенного конфига
+func (o *origins) locate(p path) (string, int) {
+	src, rest := o.main, p
+	if len(p) > 0 {
+		if key, ok := p[0].(string); ok {
+			if sec, ok := o.sections[key]; ok {
+				src = sec
+			}
+			if i, ok := p.index(1); ok && key == "pipeline" && i < len(o.pipelines) {
+				src, rest = o.pipelines[i], p[2:]
+			}
+		}
+	}
+	return src.file, nodeLine(src.root, src.path.with(rest...))
+}
+
+// index возвращает индекс списка на позиции i пути
+func (p path) index(i int) (int, bool) {
+	if i >= len(p) {
+		return 0, false
+	}
+	n, ok := p[i].(int)
+	return n, ok
+}
+
+// nodeLine возвращает строку самого глубокого найденного узла пути
+func nodeLine(root *yaml.Node, p path) int {
+	n := root
+	if n == nil {
+		return 0
+	}
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+
+	line := n.Line
+	for _, el := range p {
+		var next *yaml.Node
+		switch key := el.(type) {
+		case string:
+			if n.Kind != yaml.MappingNode {
+				return line
+			}
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == key {
+					next = n.Content[i+1]
+					line = n.Content[i].Line
+					break
+				}
+			}
+		case int:
+			if n.Kind != yaml.SequenceNode || key >= len(n.Content) {
+				return line
+			}
+			next = n.Content[key]
+			line = next.Line
+		}
+		if next == nil {
+			return line
+		}
+		n = next
+	}
+	return line
+}
+
+// validator собирает ошибки семантической проверки с номерами строк
+type validator struct {
+	src  *origins
+	errs ValidationErrors
+}
+
+// path - путь к полю: строки - ключи, int - индексы списков
+type path []any
+
+func (p path) String() string {
+	var b strings.Builder
+	for _, el := range p {
+		switch v := el.(type) {
+		case int:
+			fmt.Fprintf(&b, "[%d]", v)
+		case string:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(v)
+		}
+	}
+	return b.String()
+}
+
+func (p path) with(el ...any) path {
+	out := make(path, 0, len(p)+len(el))
+	return append(append(out, p...), el...)
+}
+
+func (v *validator) errorf(p path, format string, args ...any) {
+	file, line := v.src.locate(p)
+	v.errs = append(v.errs, ValidationError{
+		File: file,
+		Line: line,
+		Path: p.String(),
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+// validate проверяет объединенный конфиг и возвращает все найденные ошибки
+func validate(cfg *Config, src *origins) ValidationErrors {
+	v := &validator{src: src}
+
+	if len(cfg.Pipeline) == 0 {
+		v.errorf(path{"pipeline"}, "не задан ни один pipeline")
+	}
+
+	names := map[string]int{}
+	inputs := map[string]int{}
+	files := map[string]path{}
+	for i, pl := range cfg.Pipeline {
+		p := path{"pipeline", i}
+
+		switch prev, dup := names[pl.Name]; {
+		case pl.Name == "":
+			v.errorf(p, "не задано имя pipeline")
+		case dup:
+			v.errorf(p.with("name"), "имя %q уже используется в pipeline[%d]", pl.Name, prev)
+		default:
+			names[pl.Name] = i
+		}
+
+		v.addr(p.with("input"), pl.Input)
+		in := inputKey(pl.Input)
+		if prev, dup := inputs[in]; dup && pl.Input.Port != 0 {
+			v.errorf(p.with("input"), "адрес %s уже слушает pipeline[%d]: с SO_REUSEPORT трафик разделится между ними", in, prev)
+		} else {
+			inputs[in] = i
+		}
+
+		if len(pl.Targets) == 0 {
+			v.errorf(p.with("targets"), "не задана ни одна цель")
+		}
+		v.workers(p.with("workers"), pl.Workers)
+		v.listener(p.with("listener"), pl.Listener, pl.Input)
+		for j, t := range pl.Targets {
+			v.target(p.with("targets", j), pl.Input, t)
+			v.workers(p.with("targets", j, "workers"), t.Workers)
+
+			// два писателя одного файла портят его и ротируют сегменты друг друга
+			if t.Kind() == TargetFile && t.File != nil && t.File.Path != "" {
+				file, err := filepath.Abs(t.File.Path)
+				if err != nil {
+					file = filepath.Clean(t.File.Path)
+				}
+				if prev, dup := files[file]; dup {
+					v.errorf(p.with("targets", j, "file", "path"), "в файл %s уже пишет %s", t.File.Path, prev)
+				} else {
+					files[file] = p.with("targets", j)
+				}
+			}
+		}
+	}
+
+	v.listen(path{"prometheus"}, cfg.Prom != nil && cfg.Prom.Enabled, func() string { return cfg.Prom.Listen })
+	v.listen(path{"pprof"}, cfg.Pprof != nil && cfg.Pprof.Enabled, func() string { return cfg.Pprof.Listen })
+	v.listen(path{"admin"}, cfg.Admin != nil && cfg.Admin.Enabled, func() string { return cfg.Admin.Listen })
+
+	if cfg.Prom != nil && cfg.Prom.TopSources < 0 {
+		v.errorf(path{"prometheus", "top_sources"}, "размер таблицы не может быть отрицательным")
+	}
+	if cfg.OTLP != nil && cfg.OTLP.Enabled {
+		v.url(path{"otlp", "endpoint"}, cfg.OTLP.Endpoint)
+		if r := cfg.OTLP.TraceSampleRatio; r < 0 || r > 1 {
+			v.errorf(path{"otlp", "trace_sample_ratio"}, "доля должна быть от 0 до 1")
+		}
+	}
+	if cfg.Health != nil && cfg.Health.ErrorThreshold < 0 {
+		v.errorf(path{"health", "error_threshold"}, "порог не может быть отрицательным")
+	}
+	v.dns(cfg.DNS)
+	v.workers(path{"workers"}, cfg.Workers)
+	if cfg.Reload != nil && cfg.Reload.Debounce < 0 {
+		v.errorf(path{"reload", "debounce"}, "пауза не может быть отрицательной")
+	}
+	if cfg.Capture != nil && cfg.Capture.Enabled && cfg.Capture.Dir == "" {
+		v.errorf(path{"capture", "dir"}, "не задан каталог записи")
+	}
+	v.logging(cfg.Logging)
+
+	return v.errs
+}
+
+// Границы MTU цели: минимальный MTU IPv4 (RFC 791) и наибольший размер IP пакета
+const (
+	minMTU = 68
+	maxMTU = 65535
+)
+
+// maxDatagram - наибольший размер UDP датаграммы
+const maxDatagram = 65535
+
+func (v *validator) listener(p path, cfg *ListenerConfig, input AddrConfig) {
+	if cfg == nil {
+		return
+	}
+	if cfg.Count < 0 {
+		v.errorf(p.with("count"), "число слушателей не может быть отрицательным")
+	}
+	if cfg.ReadBuffer < 0 {
+		v.errorf(p.with("read_buffer"), "размер буфера не может быть отрицательным")
+	}
+	if cfg.ReadTimeout < 0 {
+		v.errorf(p.with("read_timeout"), "таймаут не может быть отрицательным")
+	}
+	if cfg.MaxDatagram < 0 || cfg.MaxDatagram > maxDatagram {
+		v.errorf(p.with("max_datagram"), "размер датаграммы должен быть от 1 до %d", maxDatagram)
+	}
+	switch cfg.Truncated {
+	case "", TruncatedDrop, TruncatedForward:
+	default:
+		v.errorf(p.with("truncated"), "неизвестное действие %q", cfg.Truncated)
+	}
+	switch cfg.Mode {
+	case "", ListenerSocket:
+	case ListenerRaw:
+		if input.Host != nil && input.Host.To4() == nil {
+			v.errorf(p.with("mode"), "режим raw поддерживает только IPv4 вход")
+		}
+	default:
+		v.errorf(p.with("mode"), "неизвестный режим %q", cfg.Mode)
+	}
+}
+
+// maxCPU - предел номера CPU для привязки (CPU_SETSIZE)
+const maxCPU = 1024
+
+func (v *validator) workers(p path, cfg *WorkersConfig) {
+	if cfg == nil {
+		return
+	}
+	if cfg.Count < 0 {
+		v.errorf(p.with("count"), "число воркеров не может быть отрицательным")
+	}
+	for i, cpu := range cfg.CPUs {
+		if cpu < 0 || cpu >= maxCPU {
+			v.errorf(p.with("cpus", i), "некорректный номер CPU %d", cpu)
+		}
+	}
+	switch cfg.Order {
+	case "", OrderNone, OrderSource, OrderSourceIP:
+	default:
+		v.errorf(p.with("order"), "неизвестный порядок %q", cfg.Order)
+	}
+}
+
+func (v *validator) dns(cfg *DNSConfig) {
+	if cfg == nil {
+		return
+	}
+	for i, server := range cfg.Servers {
+		if net.ParseIP(server) != nil {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(server); err != nil || net.ParseIP(host) == nil {
+			v.errorf(path{"dns", "servers", i}, "некорректный адрес DNS сервера %q", server)
+		}
+	}
+	for _, f := range []struct {
+		key string
+		d   time.Duration
+	}{{"min_ttl", cfg.MinTTL}, {"max_ttl", cfg.MaxTTL}, {"timeout", cfg.Timeout}} {
+		if f.d < 0 {
+			v.errorf(path{"dns", f.key}, "значение не может быть отрицательным")
+		}
+	}
+	if cfg.MinTTL > 0 && cfg.MaxTTL > 0 && cfg.MinTTL > cfg.MaxTTL {
+		v.errorf(path{"dns", "min_ttl"}, "min_ttl больше max_ttl")
+	}
+}
+
+// inputKey - адрес входа для поиска pipeline на одном порту
+func inputKey(a AddrConfig) string {
+	return net.JoinHostPort(a.Host.String(), strconv.Itoa(int(a.Port)))
+}
+
+func (v *validator) addr(p path, a AddrConfig) {
+	if a.Host == nil {
+		v.errorf(p.with("host"), "не задан адрес")
+	}
+	if a.Port == 0 {
+		v.errorf(p.with("port"), "порт не может быть 0")
+	}
+}
+
+func (v *validator) target(p path, input AddrConfig, t TargetConfig) {
+	switch t.Kind() {
+	case TargetUDP:
+		ip := t.IP()
+		switch {
+		case t.Host == "":
+			v.errorf(p.with("host"), "не задан адрес")
+		case ip == nil && !validHostname(t.Host):
+			v.errorf(p.with("host"), "некорректный адрес или имя узла %q", t.Host)
+		}
+		if t.Port == 0 {
+			v.errorf(p.with("port"), "порт не может быть 0")
+		}
+		if ip != nil && t.Port == input.Port && sameHost(ip, input.Host) {
+			v.errorf(p, "цель совпадает со входом pipeline: датаграммы пойдут по кругу")
+		}
+		if t.SrcHost != nil && ip != nil && (t.SrcHost.To4() == nil) != (ip.To4() == nil) {
+			v.errorf(p.with("src_host"), "адрес источника %s и цели %s из разных семейств", t.SrcHost, ip)
+		}
+		if t.MTU != 0 && (t.MTU < minMTU || t.MTU > maxMTU) {
+			v.errorf(p.with("mtu"), "MTU должен быть от %d до %d", minMTU, maxMTU)
+		}
+		switch t.DF {
+		case "", DFFragment, DFDrop, DFICMP:
+		default:
+			v.errorf(p.with("df"), "неизвестный режим %q", t.DF)
+		}
+
+	case TargetFile:
+		if t.File == nil || t.File.Path == "" {
+			v.errorf(p.with("file", "path"), "не задан путь файловой цели")
+			return
+		}
+		switch t.File.Format {
+		case "", FileFormatRaw, FileFormatBinary, FileFormatJSON, FileFormatPcap:
+		default:
+			v.errorf(p.with("file", "format"), "неизвестный формат %q", t.File.Format)
+		}
+		switch t.File.Compress {
+		case "", "gzip", "zstd":
+		default:
+			v.errorf(p.with("file", "compress"), "неизвестное сжатие %q", t.File.Compress)
+		}
+
+	case TargetKafka:
+		if t.Kafka == nil || len(t.Kafka.Brokers) == 0 {
+			v.errorf(p.with("kafka", "brokers"), "не заданы брокеры kafka")
+		}
+		if t.Kafka == nil || t.Kafka.Topic == "" {
+			v.errorf(p.with("kafka", "topic"), "не задан топик kafka")
+		}
+		if t.Kafka == nil {
+			return
+		}
+		switch t.Kafka.Compression {
+		case "", "none", "gzip", "snappy", "lz4", "zstd":
+		default:
+			v.errorf(p.with("kafka", "compression"), "неизвестное сжатие %q", t.Kafka.Compression)
+		}
+		switch t.Kafka.Acks {
+		case "", "all", "leader", "none":
+		default:
+			v.errorf(p.with("kafka", "acks"), "неизвестный режим acks %q", t.Kafka.Acks)
+		}
+
+	case TargetHTTP:
+		if t.HTTP == nil {
+			v.errorf(p.with("http", "url"), "не задан url")
+			return
+		}
+		v.url(p.with("http", "url"), t.HTTP.URL)
+		switch t.HTTP.Format {
+		case "", HTTPFormatNDJSON:
+		case HTTPFormatTemplate:
+			if t.HTTP.Template == "" {
+				v.errorf(p.with("http", "template"), "не задан шаблон")
+			} else if _, err := template.New("body").Funcs(httpTemplateFuncs).Parse(t.HTTP.Template); err != nil {
+				v.errorf(p.with("http", "template"), "ошибка в шаблоне: %v", err)
+			}
+		default:
+			v.errorf(p.with("http", "format"), "неизвестный формат %q", t.HTTP.Format)
+		}
+
+	default:
+		v.errorf(p.with("type"), "неизвестный тип цели %q", t.Type)
+	}
+}
+
+// httpTemplateFuncs - функции шаблона http цели для проверки разбора.
+// Имена совпадают с функциями в internal/sender, реализация не нужна.
+var httpTemplateFuncs = template.FuncMap{
+	"json":   func(any) (string, error) { return "", nil },
+	"base64": func([]byte) string { return "" },
+	"text":   func([]byte) string { return "" },
+}
+
+// validHostname проверяет синтаксис имени узла: метки из букв, цифр, '-' и '_'
+func validHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sameHost сообщает, попадет ли датаграмма на адрес target во вход, слушающий input
+func sameHost(target, input net.IP) bool {
+	if target.Equal(input) {
+		return true
+	}
+	// вход на всех адресах принимает и loopback
+	return input.IsUnspecified() && (target.IsLoopback() || target.IsUnspecified())
+}
+
+func (v *validator) url(p path, s string) {
+	if s == "" {
+		v.errorf(p, "не задан url")
+		return
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.errorf(p, "некорректный url %q, ожидается http(s)://host", s)
+	}
+}
+
+func (v *validator) listen(p path, enabled bool, addr func() string) {
+	if !enabled {
+		return
+	}
+	if _, _, err := net.SplitHostPort(addr()); err != nil {
+		v.errorf(p.with("listen"), "некорректный адрес %q", addr())
+	}
+}
+
+func (v *validator) logging(cfg *logging.Config) {
+	if cfg == nil {
+		return
+	}
+	p := path{"logging"}
+
+	switch strings.ToLower(cfg.Format) {
+	case "", logging.FormatText, logging.FormatJSON:
+	default:
+		v.errorf(p.with("format"), "неизвестный формат %q", cfg.Format)
+	}
+	switch strings.ToLower(cfg.Output) {
+	case "", logging.OutputStdout, logging.OutputStderr, logging.OutputSyslog:
+	case logging.OutputFile:
+		if cfg.File == "" {
+			v.errorf(p.with("file"), "не задан файл журнала")
+		}
+	default:
+		v.errorf(p.with("output"), "неизвестный вывод %q", cfg.Output)
+	}
+	if cfg.Level != "" {
+		if _, err := logging.ParseLevel(cfg.Level); err != nil {
+			v.errorf(p.with("level"), "%v", err)
+		}
+	}
+	names := make([]string, 0, len(cfg.Components))
+	for name := range cfg.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := logging.ParseLevel(cfg.Components[name]); err != nil {
+			v.errorf(p.with("components", name), "%v", err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestValidateExample(t *testing.T) {
+	if _, err := GetConfig("../config.yml.example"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetConfigMissingFile(t *testing.T) {
+	_, err := GetConfig(t.TempDir() + "/missing.yml")
+	if err == nil || !strings.Contains(err.Error(), "ошибка открытия файла") {
+		t.Fatalf("ошибка %v", err)
+	}
+}
+
+func TestValidateErrors(t *testing.T) {
+	const data = `pipeline:
+  - name: dp
+    input: {host: 0.0.0.0, port: 2088}
+    targets:
+      - host: 127.0.0.1
+        port: 2088
+      - host: "::1"
+        port: 9000
+        src_host: 10.0.0.1
+      - type: kafka
+        kafka: {topic: t}
+    unknown_key: 1
+  - name: dp
+    input: {host: 0.0.0.0, port: 0}
+    targets: []
+  - name: other
+    input: {host: 0.0.0.0, port: 2088}
+    targets:
+      - {host: 10.0.0.2, port: 514}
+health:
+  error_threshold: -1s
+`
+	_, err := ParseConfig("test.yml", []byte(data))
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("ошибка %v", err)
+	}
+
+	want := []struct {
+		line int
+		path string
+		msg  string
+	}{
+		{12, "", "field unknown_key not found"},
+		{5, "pipeline[0].targets[0]", "по кругу"},
+		{9, "pipeline[0].targets[1].src_host", "разных семейств"},
+		{11, "pipeline[0].targets[2].kafka.brokers", "брокеры"},
+		{13, "pipeline[1].name", "уже используется"},
+		{14, "pipeline[1].input.port", "порт не может быть 0"},
+		{15, "pipeline[1].targets", "ни одна цель"},
+		{17, "pipeline[2].input", "уже слушает pipeline[0]"},
+		{21, "health.error_threshold", "отрицательным"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("ошибок %d, ожидали %d:\n%v", len(errs), len(want), err)
+	}
+	for i, w := range want {
+		e := errs[i]
+		if e.File != "test.yml" || e.Line != w.line || e.Path != w.path || !strings.Contains(e.Msg, w.msg) {
+			t.Errorf("ошибка %d: %+v, ожидали %+v", i, e, w)
+		}
+	}
+}
+
+func TestValidateEmpty(t *testing.T) {
+	_, err := ParseConfig("empty.yml", nil)
+	if err == nil || !strings.Contains(err.Error(), "ни один pipeline") {
+		t.Fatalf("ошибка %v", err)
+	}
+}
+
+func TestValidateTargetLoop(t *testing.T) {
+	in := AddrConfig{Host: net.IPv4zero, Port: 2088}
+	cases := []struct {
+		host string
+		port uint16
+		loop bool
+	}{
+		{"127.0.0.1", 2088, true},
+		{"0.0.0.0", 2088, true},
+		{"127.0.0.1", 2089, false},
+		{"10.0.0.1", 2088, false},
+	}
+	for _, c := range cases {
+		cfg := Config{Pipeline: []Pipeline{{
+			Name:    "pl",
+			Input:   in,
+			Targets: []TargetConfig{{Host: c.host, Port: c.port}},
+		}}}
+		errs := validate(&cfg, &origins{main: origin{file: "t.yml"}})
+		if (len(errs) > 0) != c.loop {
+			t.Errorf("%s:%d: %v", c.host, c.port, errs)
+		}
+	}
+}
+
+func TestValidateHostname(t *testing.T) {
+	cases := []struct {
+		host string
+		ok   bool
+	}{
+		{"collector.example.com", true},
+		{"collector-1.dc_2.local.", true},
+		{"10.0.0.1", true},
+		{"fd00::1", true},
+		{"bad host", false},
+		{"-bad.example.com", false},
+		{"bad..example.com", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		cfg := Config{Pipeline: []Pipeline{{
+			Name:    "pl",
+			Input:   AddrConfig{Host: net.IPv4zero, Port: 2088},
+			Targets: []TargetConfig{{Host: c.host, Port: 514}},
+		}}}
+		errs := validate(&cfg, &origins{main: origin{file: "t.yml"}})
+		if (len(errs) == 0) != c.ok {
+			t.Errorf("%q: %v", c.host, errs)
+		}
+	}
+}
+
+func TestValidateListener(t *testing.T) {
+	const data = `pipeline:
+  - name: dp
+    input: {host: 0.0.0.0, port: 2088}
+    listener:
+      count: -1
+      max_datagram: 70000
+      truncated: cut
+      mode: sniff
+    targets:
+      - {host: 10.0.0.2, port: 514}
+  - name: v6
+    input: {host: "::", port: 2089}
+    listener: {mode: raw, truncated: forward}
+    targets:
+      - {host: 10.0.0.2, port: 514}
+`
+	_, err := ParseConfig("test.yml", []byte(data))
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 5 {
+		t.Fatalf("ошибка %v", err)
+	}
+	if errs[0].Path != "pipeline[0].listener.count" || errs[0].Line != 5 ||
+		errs[1].Path != "pipeline[0].listener.max_datagram" || errs[1].Line != 6 ||
+		errs[2].Path != "pipeline[0].listener.truncated" || errs[2].Line != 7 ||
+		errs[3].Path != "pipeline[0].listener.mode" || errs[3].Line != 8 ||
+		errs[4].Path != "pipeline[1].listener.mode" || errs[4].Line != 13 {
+		t.Errorf("ошибки %v", err)
+	}
+}
+
+func TestValidateTargetMTU(t *testing.T) {
+	const data = `pipeline:
+  - name: dp
+    input: {host: 0.0.0.0, port: 2088}
+    targets:
+      - {host: 10.0.0.2, port: 514, mtu: 9000, df: icmp}
+      - {host: 10.0.0.3, port: 514, mtu: 40, df: reject}
+`
+	_, err := ParseConfig("test.yml", []byte(data))
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("ошибка %v", err)
+	}
+	if errs[0].Path != "pipeline[0].targets[1].mtu" || errs[1].Path != "pipeline[0].targets[1].df" {
+		t.Errorf("ошибки %v", err)
+	}
+}
+
+func TestValidateFilePath(t *testing.T) {
+	const data = `pipeline:
+  - name: a
+    input: {host: 0.0.0.0, port: 2088}
+    targets:
+      - {type: file, file: {path: /var/lib/um/out}}
+      - {type: file, file: {path: /var/lib/um/out.pcap, format: pcap}}
+  - name: b
+    input: {host: 0.0.0.0, port: 2089}
+    targets:
+      - {type: file, file: {path: /var/lib/um/../um/out, compress: gzip}}
+`
+	_, err := ParseConfig("test.yml", []byte(data))
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 1 {
+		t.Fatalf("ошибка %v", err)
+	}
+	if errs[0].Path != "pipeline[1].targets[0].file.path" || errs[0].Line != 10 ||
+		!strings.Contains(errs[0].Msg, "pipeline[0].targets[0]") {
+		t.Errorf("ошибки %v", err)
+	}
+}
+
+func TestValidateKafka(t *testing.T) {
+	const data = `pipeline:
+  - name: a
+    input: {host: 0.0.0.0, port: 2088}
+    targets:
+      - type: kafka
+        kafka:
+          brokers: [10.0.0.1:9092]
+          topic: dp
+          compression: zstd
+          acks: leader
+      - type: kafka
+        kafka:
+          brokers: [10.0.0.1:9092]
+          topic: dp
+          compression: brotli
+          acks: one
+`
+	_, err := ParseConfig("test.yml", []byte(data))
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("ошибка %v", err)
+	}
+	if errs[0].Path != "pipeline[0].targets[1].kafka.compression" || errs[0].Line != 15 ||
+		errs[1].Path != "pipeline[0].targets[1].kafka.acks" || errs[1].Line != 16 {
+		t.Errorf("ошибки %v", err)
+	}
+}
+
+func TestValidateHTTPTemplate(t *testing.T) {
+	const data = `pipeline:
+  - name: a
+    input: {host: 0.0.0.0, port: 2088}
+    targets:
+      - type: http
+        http:
+          url: http://10.0.0.1/ingest
+          format: template
+          template: '{{range .Records}}{"src":"{{.SrcIP}}","data":{{json (text .Payload)}},"b64":"{{base64 .Payload}}"}{{end}}'
+      - type: http
+        http:
+          url: http://10.0.0.1/ingest
+          format: template
+          template: '{{range .Records}}{{hex .Payload}}{{end}}'
+      - type: http
+        http:
+          url: http://10.0.0.1/ingest
+          format: template
+          template: '{{range .Records}}'
+`
+	_, err := ParseConfig("test.yml", []byte(data))
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("ошибка %v", err)
+	}
+	if errs[0].Path != "pipeline[0].targets[1].http.template" || errs[0].Line != 14 || !strings.Contains(errs[0].Msg, "hex") ||
+		errs[1].Path != "pipeline[0].targets[2].http.template" || errs[1].Line != 19 {
+		t.Errorf("ошибки %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"udp_mirror/pkg/logging"
+)
+
+// DefaultReloadDebounce - пауза после последнего изменения файла перед перезагрузкой
+const DefaultReloadDebounce = 500 * time.Millisecond
+
+// watchMask - события каталогов, после которых конфиг перечитывается.
+// Следим за каталогами, а не за файлами: редакторы сохраняют файл через переименование.
+const watchMask = unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE |
+	unix.IN_MOVED_TO | unix.IN_MOVED_FROM
+
+// watchDir - отслеживаемый каталог
+type watchDir struct {
+	names map[string]bool // файлы конфига в каталоге
+	all   bool            // каталог include: интересны все файлы конфига
+}
+
+func (d *watchDir) match(name string) bool {
+	if d.names[name] {
+		return true
+	}
+	if !d.all || strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, ext := range includeExts {
+		if filepath.Ext(name) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// watcher следит за каталогами файлов конфига через inotify
+type watcher struct {
+	fd   int
+	file *os.File
+
+	mu   sync.Mutex
+	dirs map[int]*watchDir // по дескриптору наблюдения
+	wds  map[string]int    // дескриптор наблюдения по пути каталога
+}
+
+// update приводит набор наблюдений к списку файлов и каталогов текущего конфига
+func (w *watcher) update(files []string) {
+	want := map[string]*watchDir{}
+	dir := func(path string) *watchDir {
+		if want[path] == nil {
+			want[path] = &watchDir{names: map[string]bool{}}
+		}
+		return want[path]
+	}
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil && info.IsDir() {
+			dir(f).all = true
+			continue
+		}
+		dir(filepath.Dir(f)).names[filepath.Base(f)] = true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	log := logging.For("config")
+	for path, wd := range w.wds {
+		if want[path] == nil {
+			_, _ = unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.wds, path)
+			delete(w.dirs, wd)
+		}
+	}
+	for path, d := range want {
+		wd, err := unix.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			log.Warn("Ошибка наблюдения за каталогом конфига", "dir", path, logging.Err(err))
+			continue
+		}
+		w.wds[path] = wd
+		w.dirs[wd] = d
+	}
+}
+
+// read разбирает события inotify и сообщает об изменении файлов конфига
+func (w *watcher) read(events chan<- struct{}) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return // дескриптор закрыт
+		}
+
+		changed := false
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			wd := int(int32(binary.NativeEndian.Uint32(buf[off:])))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			size := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			name := strings.TrimRight(string(buf[off+unix.SizeofInotifyEvent:off+unix.SizeofInotifyEvent+size]), "\x00")
+			off += unix.SizeofInotifyEvent + size
+
+			if mask&unix.IN_Q_OVERFLOW != 0 {
+				changed = true
+				continue
+			}
+			w.mu.Lock()
+			if d := w.dirs[wd]; d != nil && d.match(name) {
+				changed = true
+			}
+			w.mu.Unlock()
+		}
+
+		if changed {
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Watch следит за файлом конфига и включаемыми файлами. Об изменении сообщается
+// в возвращаемый канал, когда изменения затихли на debounce. Набор файлов
+// обновляется после каждой загрузки конфига. Наблюдение останавливается по ctx.
+func (cr *ConfigReloader) Watch(ctx context.Context, debounce time.Duration) (<-chan struct{}, error) {
+	if debounce <= 0 {
+		debounce = DefaultReloadDebounce
+	}
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{
+		fd:   fd,
+		file: os.NewFile(uintptr(fd), "inotify"),
+		dirs: map[int]*watchDir{},
+		wds:  map[string]int{},
+	}
+
+	refresh := make(chan struct{}, 1)
+	cr.mu.Lock()
+	cr.refresh = refresh
+	files := append([]string(nil), cr.files...)
+	cr.mu.Unlock()
+	w.update(files)
+
+	events := make(chan struct{}, 1)
+	changes := make(chan struct{}, 1)
+	go w.read(events)
+	go func() {
+		defer w.file.Close()
+
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-refresh:
+				w.update(cr.Files())
+			case <-events:
+				timer.Reset(debounce)
+			case <-timer.C:
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitChange(t *testing.T, changes <-chan struct{}, want bool) {
+	t.Helper()
+	select {
+	case <-changes:
+		if !want {
+			t.Fatal("лишнее уведомление об изменении")
+		}
+	case <-time.After(500 * time.Millisecond):
+		if want {
+			t.Fatal("нет уведомления об изменении")
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.yml":     "include: [conf.d]\n",
+		"conf.d/a.yml": "pipeline:\n  - {name: a, input: {host: 0.0.0.0, port: 3000}, targets: [{host: 10.0.0.1, port: 514}]}\n",
+		"other.yml":    "не конфиг\n",
+	})
+	main := filepath.Join(dir, "main.yml")
+
+	cr := &ConfigReloader{}
+	if err := cr.LoadConfig(main); err != nil {
+		t.Fatal(err)
+	}
+	hash := cr.Hash()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := cr.Watch(ctx, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name, data string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// серия правок дает одно уведомление
+	for i := 0; i < 5; i++ {
+		write("conf.d/a.yml", "pipeline:\n  - {name: a, input: {host: 0.0.0.0, port: 3001}, targets: [{host: 10.0.0.1, port: 514}]}\n")
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitChange(t, changes, true)
+	waitChange(t, changes, false)
+
+	// файлы вне конфига не отслеживаются
+	write("other.yml", "x\n")
+	write("conf.d/notes.txt", "x\n")
+	waitChange(t, changes, false)
+
+	// новый файл в каталоге include
+	write("conf.d/b.yml", "pipeline:\n  - {name: b, input: {host: 0.0.0.0, port: 4000}, targets: [{host: 10.0.0.1, port: 514}]}\n")
+	waitChange(t, changes, true)
+
+	// сломанная правка не применяется
+	write("conf.d/b.yml", "pipeline:\n  - {name: b, input: {host: 0.0.0.0, port: 0}}\n")
+	waitChange(t, changes, true)
+	if err := cr.LoadConfig(main); err == nil {
+		t.Fatal("конфиг с ошибкой загружен")
+	}
+	if cr.Hash() != hash || len(cr.GetConfigCopy().Pipeline) != 1 {
+		t.Fatal("текущий конфиг изменен сломанной правкой")
+	}
+
+	// замена через переименование, как делают редакторы; после загрузки
+	// отслеживается и новый включаемый файл
+	write(".main.yml.swp", "include: [conf.d, extra.yml]\n")
+	write("conf.d/b.yml", "pipeline:\n  - {name: b, input: {host: 0.0.0.0, port: 4000}, targets: [{host: 10.0.0.1, port: 514}]}\n")
+	write("extra.yml", "")
+	if err := os.Rename(filepath.Join(dir, ".main.yml.swp"), main); err != nil {
+		t.Fatal(err)
+	}
+	waitChange(t, changes, true)
+	if err := cr.LoadConfig(main); err != nil {
+		t.Fatal(err)
+	}
+	if cr.Hash() == hash {
+		t.Fatal("хеш конфига не изменился")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	write("extra.yml", "reload: {watch: true}\n")
+	waitChange(t, changes, true)
+}
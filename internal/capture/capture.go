@@ -0,0 +1,446 @@
+package capture
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/pcap"
+	"udp_mirror/pkg/logging"
+)
+
+const (
+	DirectionIn   = "in"
+	DirectionOut  = "out"
+	DirectionBoth = "both"
+
+	filePrefix = "udp_mirror_"
+	fileSuffix = ".pcapng"
+
+	flushInterval = time.Second
+)
+
+var ErrNotActive = errors.New("запись трафика не запущена")
+
+var logger = logging.For("capture")
+
+// Capturer пишет принятые и отправленные кадры в pcapng файлы с ротацией.
+// Пока запись не запущена, Input/Output стоят одну атомарную загрузку.
+type Capturer struct {
+	active atomic.Bool
+
+	mu   sync.Mutex
+	base config.CaptureConfig // настройки из конфига
+	cfg  config.CaptureConfig // настройки текущей записи
+
+	file   *os.File
+	bw     *bufio.Writer
+	cw     *countingWriter
+	ngw    *pcap.NGWriter
+	ifIn   int
+	ifOut  int
+	opened time.Time
+
+	total   int64
+	scratch []byte
+
+	stopTimer  *time.Timer
+	done       chan struct{}
+	fromConfig bool   // запись запущена из конфига, а не по запросу
+	gen        uint64 // номер записи: таймер остановки прежней записи не трогает новую
+}
+
+// Status описывает состояние записи
+type Status struct {
+	Active    bool     `json:"active"`
+	File      string   `json:"file,omitempty"`
+	Bytes     int64    `json:"bytes"`
+	Pipelines []string `json:"pipelines,omitempty"`
+	Targets   []string `json:"targets,omitempty"`
+	Direction string   `json:"direction,omitempty"`
+}
+
+var std = &Capturer{}
+
+// Default возвращает общий Capturer процесса
+func Default() *Capturer {
+	return std
+}
+
+// Enabled сообщает, идет ли запись (быстрая проверка для горячего пути)
+func Enabled() bool {
+	return std.active.Load()
+}
+
+// Configure применяет настройки из конфига и запускает запись, если она включена
+func Configure(cfg *config.CaptureConfig) error {
+	return std.Configure(cfg)
+}
+
+// Input записывает принятую датаграмму
+func Input(plName string, src, dst *net.UDPAddr, payload []byte) {
+	if std.active.Load() {
+		std.Input(plName, src, dst, payload)
+	}
+}
+
+// InputIP записывает принятый IP пакет как есть, в том числе фрагмент
+func InputIP(plName string, ip []byte) {
+	if std.active.Load() {
+		std.InputIP(plName, ip)
+	}
+}
+
+// Output записывает отправленный IP кадр (заголовок и данные отдельно)
+func Output(plName, target string, ipHeader, payload []byte) {
+	if std.active.Load() {
+		std.Output(plName, target, ipHeader, payload)
+	}
+}
+
+// Configure сохраняет базовые настройки. Запись запускается, если Enabled,
+// и останавливается, если была запущена из конфига, а теперь выключена.
+// При перезагрузке с теми же настройками запись из конфига продолжается в том же
+// файле, а запись, запущенная по запросу, не прерывается.
+func (c *Capturer) Configure(cfg *config.CaptureConfig) error {
+	c.mu.Lock()
+	prev := c.base
+	if cfg == nil {
+		c.base = config.CaptureConfig{}
+	} else {
+		c.base = *cfg
+	}
+	base := c.base
+
+	if !base.Enabled {
+		defer c.mu.Unlock()
+		if c.active.Load() && c.fromConfig {
+			return c.stopLocked()
+		}
+		return nil
+	}
+	if c.active.Load() && (!c.fromConfig || reflect.DeepEqual(prev, base)) {
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+
+	return c.start(base, true)
+}
+
+// Base возвращает настройки из конфига (используются как основа для запуска по запросу)
+func (c *Capturer) Base() config.CaptureConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.base
+}
+
+// Start запускает запись. Если запись уже идет, она перезапускается с новыми настройками.
+func (c *Capturer) Start(cfg config.CaptureConfig) error {
+	return c.start(cfg, false)
+}
+
+func (c *Capturer) start(cfg config.CaptureConfig, fromConfig bool) error {
+	if cfg.Dir == "" {
+		cfg.Dir = "."
+	}
+	if cfg.Direction == "" {
+		cfg.Direction = DirectionBoth
+	}
+	switch cfg.Direction {
+	case DirectionIn, DirectionOut, DirectionBoth:
+	default:
+		return fmt.Errorf("неизвестное направление записи: %q", cfg.Direction)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active.Load() {
+		c.stopLocked()
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return err
+	}
+
+	c.cfg = cfg
+	c.total = 0
+	c.fromConfig = fromConfig
+	c.gen++
+	if err := c.openLocked(); err != nil {
+		return err
+	}
+
+	c.done = make(chan struct{})
+	go c.flusher(c.done)
+
+	if cfg.Duration > 0 {
+		gen := c.gen
+		c.stopTimer = time.AfterFunc(cfg.Duration, func() { c.expire(gen) })
+	}
+
+	c.active.Store(true)
+	logger.Info("Запись трафика запущена", "file", c.file.Name())
+	return nil
+}
+
+// Stop останавливает запись и закрывает текущий файл
+func (c *Capturer) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.active.Load() {
+		return ErrNotActive
+	}
+	return c.stopLocked()
+}
+
+// expire останавливает запись gen по истечении Duration. Таймер мог сработать, пока
+// запись перезапускалась: Timer.Stop его уже не отменит, и новую запись он не трогает.
+func (c *Capturer) expire(gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gen != gen || !c.active.Load() {
+		return
+	}
+	logger.Info("Истекло время записи, останавливаем", "duration", c.cfg.Duration)
+	_ = c.stopLocked()
+}
+
+// Status возвращает текущее состояние записи
+func (c *Capturer) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := Status{Active: c.active.Load()}
+	if !st.Active {
+		return st
+	}
+
+	st.File = c.file.Name()
+	st.Bytes = c.total
+	st.Pipelines = c.cfg.Pipelines
+	st.Targets = c.cfg.Targets
+	st.Direction = c.cfg.Direction
+	return st
+}
+
+// Input записывает принятую датаграмму, дописывая к ней IPv4/UDP заголовки
+func (c *Capturer) Input(plName string, src, dst *net.UDPAddr, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.active.Load() || c.cfg.Direction == DirectionOut || !match(c.cfg.Pipelines, plName) {
+		return
+	}
+
+	frame := pcap.BuildIPv4UDP(src.IP, uint16(src.Port), dst.IP, uint16(dst.Port), payload)
+	c.writeLocked(c.ifIn, frame, "pipeline="+plName)
+}
+
+// InputIP записывает принятый IP пакет как есть (режим приема raw)
+func (c *Capturer) InputIP(plName string, ip []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.active.Load() || c.cfg.Direction == DirectionOut || !match(c.cfg.Pipelines, plName) {
+		return
+	}
+	c.writeLocked(c.ifIn, ip, "pipeline="+plName)
+}
+
+// Output записывает отправленный кадр или фрагмент
+func (c *Capturer) Output(plName, target string, ipHeader, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.active.Load() || c.cfg.Direction == DirectionIn ||
+		!match(c.cfg.Pipelines, plName) || !match(c.cfg.Targets, target) {
+		return
+	}
+
+	c.scratch = append(append(c.scratch[:0], ipHeader...), payload...)
+	c.writeLocked(c.ifOut, c.scratch, "pipeline="+plName+" target="+target)
+}
+
+func (c *Capturer) writeLocked(ifID int, frame []byte, comment string) {
+	if c.needRotateLocked() {
+		if err := c.rotateLocked(); err != nil {
+			logger.Error("Ошибка ротации файла", logging.Err(err))
+			c.stopLocked()
+			return
+		}
+	}
+
+	origLen := len(frame)
+	if c.cfg.Snaplen > 0 && len(frame) > c.cfg.Snaplen {
+		frame = frame[:c.cfg.Snaplen]
+	}
+
+	before := c.cw.n
+	err := c.ngw.WritePacket(ifID, time.Now(), frame, origLen, comment)
+	if err != nil {
+		logger.Error("Ошибка записи", "file", c.file.Name(), logging.Err(err))
+		c.stopLocked()
+		return
+	}
+	c.total += c.cw.n - before
+
+	if c.cfg.MaxBytes > 0 && c.total >= c.cfg.MaxBytes {
+		logger.Info("Достигнут лимит записи, останавливаем", "max_bytes", c.cfg.MaxBytes)
+		c.stopLocked()
+	}
+}
+
+func (c *Capturer) needRotateLocked() bool {
+	if c.cfg.FileSize > 0 && c.cw.n >= c.cfg.FileSize {
+		return true
+	}
+	return c.cfg.FileAge > 0 && time.Since(c.opened) >= c.cfg.FileAge
+}
+
+func (c *Capturer) rotateLocked() error {
+	if err := c.closeFileLocked(); err != nil {
+		return err
+	}
+	return c.openLocked()
+}
+
+func (c *Capturer) openLocked() error {
+	name := filepath.Join(c.cfg.Dir, filePrefix+time.Now().Format("20060102T150405.000000")+fileSuffix)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriterSize(f, 256*1024)
+	cw := &countingWriter{w: bw}
+	ngw, err := pcap.NewNGWriter(cw)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	snaplen := uint32(max(c.cfg.Snaplen, 0))
+	ifIn, err := ngw.AddInterface("udp_mirror-in", pcap.LinkTypeRaw, snaplen)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	ifOut, err := ngw.AddInterface("udp_mirror-out", pcap.LinkTypeRaw, snaplen)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	c.file, c.bw, c.cw, c.ngw = f, bw, cw, ngw
+	c.ifIn, c.ifOut = ifIn, ifOut
+	c.opened = time.Now()
+
+	c.cleanupLocked()
+	return nil
+}
+
+func (c *Capturer) closeFileLocked() error {
+	if c.file == nil {
+		return nil
+	}
+
+	err := c.bw.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	c.file, c.bw, c.cw, c.ngw = nil, nil, nil, nil
+	return err
+}
+
+func (c *Capturer) stopLocked() error {
+	c.active.Store(false)
+
+	if c.stopTimer != nil {
+		c.stopTimer.Stop()
+		c.stopTimer = nil
+	}
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+
+	name := ""
+	if c.file != nil {
+		name = c.file.Name()
+	}
+	err := c.closeFileLocked()
+	logger.Info("Запись трафика остановлена", "file", name, "bytes", c.total)
+	return err
+}
+
+// cleanupLocked удаляет старые файлы записи сверх MaxFiles
+func (c *Capturer) cleanupLocked() {
+	if c.cfg.MaxFiles <= 0 {
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(c.cfg.Dir, filePrefix+"*"+fileSuffix))
+	if err != nil || len(files) <= c.cfg.MaxFiles {
+		return
+	}
+
+	// имя содержит время создания, поэтому лексикографический порядок совпадает с хронологическим
+	sort.Strings(files)
+	for _, f := range files[:len(files)-c.cfg.MaxFiles] {
+		if err := os.Remove(f); err != nil {
+			logger.Error("Ошибка удаления", "file", f, logging.Err(err))
+		}
+	}
+}
+
+// flusher периодически сбрасывает буфер на диск, чтобы файл можно было читать во время записи
+func (c *Capturer) flusher(done <-chan struct{}) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			if c.bw != nil {
+				if err := c.bw.Flush(); err != nil {
+					logger.Error("Ошибка сброса буфера", logging.Err(err))
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+func match(filter []string, value string) bool {
+	return len(filter) == 0 || slices.Contains(filter, value)
+}
+
+// countingWriter считает записанные в текущий файл байты
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
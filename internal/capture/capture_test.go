@@ -0,0 +1,208 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"udp_mirror/config"
+)
+
+const blockEPBType = 0x00000006
+
+// epbCount возвращает количество Enhanced Packet Block в файле по интерфейсам
+func epbCount(t *testing.T, name string) map[uint32]int {
+	t.Helper()
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[uint32]int{}
+	for len(b) >= 12 {
+		blockType := binary.LittleEndian.Uint32(b[0:])
+		length := binary.LittleEndian.Uint32(b[4:])
+		if length < 12 || int(length) > len(b) {
+			t.Fatalf("битый блок: тип %x, длина %d", blockType, length)
+		}
+		if blockType == blockEPBType {
+			counts[binary.LittleEndian.Uint32(b[8:])]++
+		}
+		b = b[length:]
+	}
+	if len(b) != 0 {
+		t.Fatalf("лишние %d байт в конце файла", len(b))
+	}
+	return counts
+}
+
+func TestCaptureFilters(t *testing.T) {
+	dir := t.TempDir()
+	c := &Capturer{}
+
+	err := c.Start(config.CaptureConfig{
+		Dir:       dir,
+		Pipelines: []string{"pl1"},
+		Targets:   []string{"10.0.0.1:2000"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 5000}
+	dst := &net.UDPAddr{IP: net.IPv4zero, Port: 2000}
+	hdr := make([]byte, 20)
+
+	c.Input("pl1", src, dst, []byte("in-1"))
+	c.Input("pl2", src, dst, []byte("skip"))
+	c.Output("pl1", "10.0.0.1:2000", hdr, []byte("out-1"))
+	c.Output("pl1", "10.0.0.2:2000", hdr, []byte("skip"))
+
+	name := c.Status().File
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := epbCount(t, name)
+	if counts[0] != 1 || counts[1] != 1 {
+		t.Fatalf("ожидали по одному пакету на интерфейс, получили %v", counts)
+	}
+}
+
+func TestCaptureRotationAndLimits(t *testing.T) {
+	dir := t.TempDir()
+	c := &Capturer{}
+
+	err := c.Start(config.CaptureConfig{
+		Dir:      dir,
+		FileSize: 600,
+		MaxFiles: 2,
+		MaxBytes: 4000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 5000}
+	dst := &net.UDPAddr{IP: net.IPv4zero, Port: 2000}
+	payload := make([]byte, 200)
+
+	for i := 0; i < 100 && c.active.Load(); i++ {
+		c.Input("pl", src, dst, payload)
+		// имена файлов содержат время с микросекундами
+		time.Sleep(time.Millisecond)
+	}
+
+	if c.active.Load() {
+		t.Fatal("запись должна была остановиться по max_bytes")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"+fileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("ожидали 2 файла после очистки, получили %d", len(files))
+	}
+	for _, f := range files {
+		epbCount(t, f)
+	}
+}
+
+func TestCaptureDisabledFromConfig(t *testing.T) {
+	dir := t.TempDir()
+	c := &Capturer{}
+
+	if err := c.Configure(&config.CaptureConfig{Enabled: true, Dir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	if !c.active.Load() {
+		t.Fatal("запись не запущена из конфига")
+	}
+
+	if err := c.Configure(&config.CaptureConfig{Enabled: false, Dir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	if c.active.Load() {
+		t.Fatal("запись не остановлена при выключении в конфиге")
+	}
+}
+
+func TestCaptureReconfigure(t *testing.T) {
+	dir := t.TempDir()
+	c := &Capturer{}
+	defer c.Stop()
+
+	cfg := config.CaptureConfig{Enabled: true, Dir: dir, Pipelines: []string{"pl1"}}
+	if err := c.Configure(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	file := c.Status().File
+
+	// перезагрузка с теми же настройками продолжает запись в тот же файл
+	same := cfg
+	same.Pipelines = []string{"pl1"}
+	if err := c.Configure(&same); err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Status(); !st.Active || st.File != file {
+		t.Fatalf("запись перезапущена без изменений: %+v", st)
+	}
+
+	// измененные настройки применяются
+	time.Sleep(time.Millisecond)
+	changed := cfg
+	changed.Pipelines = []string{"pl2"}
+	if err := c.Configure(&changed); err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Status(); !st.Active || st.File == file || st.Pipelines[0] != "pl2" {
+		t.Fatalf("изменения не применены: %+v", st)
+	}
+
+	// запись по запросу перезагрузка не прерывает
+	if err := c.Start(config.CaptureConfig{Dir: dir, Pipelines: []string{"admin"}}); err != nil {
+		t.Fatal(err)
+	}
+	file = c.Status().File
+	if err := c.Configure(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Status(); !st.Active || st.File != file || st.Pipelines[0] != "admin" {
+		t.Fatalf("запись по запросу заменена настройками конфига: %+v", st)
+	}
+	if err := c.Configure(&config.CaptureConfig{Dir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	if !c.active.Load() {
+		t.Fatal("запись по запросу остановлена выключением в конфиге")
+	}
+}
+
+func TestCaptureStaleTimer(t *testing.T) {
+	dir := t.TempDir()
+	c := &Capturer{}
+	defer c.Stop()
+
+	if err := c.Start(config.CaptureConfig{Dir: dir, Duration: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	gen := c.gen
+	if err := c.Start(config.CaptureConfig{Dir: dir, Duration: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	// таймер прежней записи, сработавший во время перезапуска, новую не останавливает
+	c.expire(gen)
+	if !c.active.Load() {
+		t.Fatal("таймер прежней записи остановил новую")
+	}
+	c.expire(c.gen)
+	if c.active.Load() {
+		t.Fatal("запись не остановлена по истечении времени")
+	}
+}
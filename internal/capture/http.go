@@ -0,0 +1,110 @@
+package capture
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"udp_mirror/config"
+)
+
+// Handler возвращает HTTP-обработчик управления записью:
+//
+//	GET  /capture        - состояние записи
+//	POST /capture/start  - запуск (параметры: pipeline, target, direction, duration, max_bytes)
+//	POST /capture/stop   - остановка
+//
+// Параметры запроса переопределяют фильтры из конфига, остальные настройки берутся из него.
+func Handler() http.Handler {
+	return handler{c: std}
+}
+
+type handler struct {
+	c *Capturer
+}
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.URL.Path, "/capture")
+	action = strings.Trim(action, "/")
+
+	switch action {
+	case "":
+		writeJSON(w, http.StatusOK, h.c.Status())
+
+	case "start":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		cfg, err := h.startConfig(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.c.Start(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, h.c.Status())
+
+	case "stop":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		err := h.c.Stop()
+		if errors.Is(err, ErrNotActive) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, h.c.Status())
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h handler) startConfig(r *http.Request) (config.CaptureConfig, error) {
+	var err error
+	cfg := h.c.Base()
+	q := r.URL.Query()
+
+	if v, ok := q["pipeline"]; ok {
+		cfg.Pipelines = v
+	}
+	if v, ok := q["target"]; ok {
+		cfg.Targets = v
+	}
+	if v := q.Get("direction"); v != "" {
+		cfg.Direction = v
+	}
+	if v := q.Get("duration"); v != "" {
+		cfg.Duration, err = time.ParseDuration(v)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	if v := q.Get("max_bytes"); v != "" {
+		cfg.MaxBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
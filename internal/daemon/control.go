@@ -0,0 +1,161 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"udp_mirror/pkg/logging"
+)
+
+// controlTimeout ограничивает обмен по управляющему сокету
+const controlTimeout = 5 * time.Second
+
+// Handler выполняет команду управляющего сокета и возвращает результат для ответа в JSON
+type Handler func(ctx context.Context) (any, error)
+
+// ConnHandler выполняет команду, сам отвечая в соединение, например с передачей дескрипторов
+type ConnHandler func(ctx context.Context, conn *net.UnixConn) error
+
+// reply - ответ управляющего сокета
+type reply struct {
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// Server - управляющий сокет запущенного экземпляра. Протокол: клиент
+// отправляет строку с именем команды, сервер отвечает одним JSON объектом.
+type Server struct {
+	ln   *net.UnixListener
+	path string
+
+	mu           sync.RWMutex
+	handlers     map[string]Handler
+	connHandlers map[string]ConnHandler
+}
+
+// Listen открывает управляющий сокет. Оставшийся от аварийно завершенного
+// экземпляра файл сокета удаляется, поэтому вызывать после WritePIDFile.
+func Listen(path string) (*Server, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("ошибка удаления устаревшего сокета: %w", err)
+	}
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия управляющего сокета: %w", err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("ошибка установки прав управляющего сокета: %w", err)
+	}
+
+	return &Server{
+		ln:           ln,
+		path:         path,
+		handlers:     map[string]Handler{},
+		connHandlers: map[string]ConnHandler{},
+	}, nil
+}
+
+// Handle регистрирует обработчик команды
+func (s *Server) Handle(cmd string, h Handler) {
+	s.mu.Lock()
+	s.handlers[cmd] = h
+	s.mu.Unlock()
+}
+
+// HandleConn регистрирует обработчик команды, который отвечает сам
+func (s *Server) HandleConn(cmd string, h ConnHandler) {
+	s.mu.Lock()
+	s.connHandlers[cmd] = h
+	s.mu.Unlock()
+}
+
+// Serve принимает команды до отмены контекста, затем закрывает и удаляет сокет
+func (s *Server) Serve(ctx context.Context) {
+	log := logging.For("control")
+
+	go func() {
+		<-ctx.Done()
+		s.ln.Close() // файл сокета удаляется автоматически
+	}()
+
+	for {
+		conn, err := s.ln.AcceptUnix()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error("Ошибка приема подключения", logging.Err(err))
+			}
+			return
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, conn *net.UnixConn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	cmd := strings.TrimSpace(line)
+
+	s.mu.RLock()
+	h, ok := s.handlers[cmd]
+	ch, connOK := s.connHandlers[cmd]
+	s.mu.RUnlock()
+
+	if connOK {
+		if err := ch(ctx, conn); err != nil {
+			logging.For("control").Error("Ошибка выполнения команды", "cmd", cmd, logging.Err(err))
+		}
+		return
+	}
+
+	var resp reply
+	if !ok {
+		resp.Error = fmt.Sprintf("неизвестная команда %q", cmd)
+	} else if result, err := h(ctx); err != nil {
+		resp.Error = err.Error()
+	} else if resp.Result, err = json.Marshal(result); err != nil {
+		resp.Error = err.Error()
+	}
+
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+// Call отправляет команду в управляющий сокет и декодирует результат в result
+func Call(path, cmd string, result any) error {
+	conn, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return fmt.Errorf("ошибка подключения к управляющему сокету: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if _, err := fmt.Fprintln(conn, cmd); err != nil {
+		return fmt.Errorf("ошибка отправки команды: %w", err)
+	}
+
+	var resp reply
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result == nil || resp.Result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
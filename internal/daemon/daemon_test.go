@@ -0,0 +1,151 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"udp_mirror/internal/health"
+)
+
+func TestPIDFile(t *testing.T) {
+	paths, err := NewPaths(t.TempDir()+"/run", "config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Running(paths.PIDFile); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("без PID файла: %v", err)
+	}
+
+	if err := WritePIDFile(paths.PIDFile); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := Running(paths.PIDFile); err != nil || pid != os.Getpid() {
+		t.Fatalf("Running = %d, %v", pid, err)
+	}
+
+	if err := RemovePIDFile(paths.PIDFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(paths.PIDFile); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("PID файл не удален: %v", err)
+	}
+}
+
+func TestStalePIDFile(t *testing.T) {
+	// процесс с тем же PID, но другим исполняемым файлом
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	pidFile := t.TempDir() + "/udp_mirror.pid"
+	for _, content := range []string{strconv.Itoa(cmd.Process.Pid), "garbage"} {
+		if err := os.WriteFile(pidFile, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Running(pidFile); !errors.Is(err, ErrNotRunning) {
+			t.Fatalf("%s: %v", content, err)
+		}
+		if _, err := os.Stat(pidFile); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s: устаревший PID файл не удален", content)
+		}
+	}
+
+	// устаревший файл не мешает запуску
+	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritePIDFile(pidFile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAlive(t *testing.T) {
+	if !Alive(os.Getpid()) {
+		t.Fatal("текущий процесс не найден")
+	}
+
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	if Alive(cmd.Process.Pid) {
+		t.Fatal("чужой процесс принят за udp_mirror")
+	}
+}
+
+func TestControl(t *testing.T) {
+	socket := t.TempDir() + "/udp_mirror.sock"
+	srv, err := Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.Serve(ctx)
+		close(done)
+	}()
+
+	p := health.Register("control_test", 1, []string{"127.0.0.1:9000"})
+	defer health.Unregister("control_test")
+	p.ListenerBound("0")
+
+	srv.Handle("status", func(context.Context) (any, error) {
+		return CurrentStatus("config.yml", time.Now()), nil
+	})
+	srv.Handle("fail", func(context.Context) (any, error) {
+		return nil, errors.New("boom")
+	})
+
+	var st Status
+	if err := Call(socket, "status", &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.PID != os.Getpid() || st.Config != "config.yml" {
+		t.Fatalf("status %+v", st)
+	}
+	found := false
+	for _, ps := range st.Pipelines {
+		if ps.Name == "control_test" && ps.Listeners.Bound == 1 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("pipeline не найден: %+v", st.Pipelines)
+	}
+
+	var out strings.Builder
+	st.Print(&out)
+	if !strings.Contains(out.String(), "control_test") {
+		t.Fatalf("вывод %q", out.String())
+	}
+
+	if err := Call(socket, "fail", nil); err == nil || err.Error() != "boom" {
+		t.Fatalf("fail: %v", err)
+	}
+	if err := Call(socket, "unknown", nil); err == nil {
+		t.Fatal("неизвестная команда принята")
+	}
+
+	cancel()
+	<-done
+	if _, err := os.Stat(socket); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("сокет не удален: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+// Package daemon управляет запущенным экземпляром: PID файл, каталог запуска
+// и управляющий сокет для команд status, upgrade и т.п.
+package daemon
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrRunning - экземпляр с тем же конфигом уже запущен
+var ErrRunning = errors.New("процесс udp_mirror уже запущен")
+
+// ErrNotRunning - экземпляр с этим конфигом не запущен
+var ErrNotRunning = errors.New("процесс udp_mirror не запущен")
+
+// DefaultRunDir возвращает каталог для PID файла и управляющего сокета:
+// RUNTIME_DIRECTORY от systemd, /run/udp_mirror для root,
+// $XDG_RUNTIME_DIR/udp_mirror или временный каталог для остальных
+func DefaultRunDir() string {
+	if dir := os.Getenv("RUNTIME_DIRECTORY"); dir != "" {
+		// systemd может передать несколько каталогов через двоеточие
+		return strings.Split(dir, ":")[0]
+	}
+	if os.Geteuid() == 0 {
+		return "/run/udp_mirror"
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "udp_mirror")
+	}
+	return filepath.Join(os.TempDir(), "udp_mirror")
+}
+
+// Paths - файлы экземпляра в каталоге запуска. Имена зависят от пути к конфигу,
+// поэтому на одной машине могут работать экземпляры с разными конфигами.
+type Paths struct {
+	PIDFile string
+	Socket  string
+}
+
+// NewPaths возвращает пути файлов экземпляра с конфигом configPath
+func NewPaths(runDir, configPath string) (Paths, error) {
+	absPath, err := filepath.Abs(configPath)
+	if err != nil {
+		return Paths{}, fmt.Errorf("ошибка получения абсолютного пути: %w", err)
+	}
+
+	hash := md5.Sum([]byte(absPath))
+	base := filepath.Join(runDir, "udp_mirror_"+hex.EncodeToString(hash[:8]))
+	return Paths{PIDFile: base + ".pid", Socket: base + ".sock"}, nil
+}
+
+// ReadPID читает PID из файла
+func ReadPID(pidFile string) (int, error) {
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("некорректный PID в файле %s: %q", pidFile, data)
+	}
+	return pid, nil
+}
+
+// Alive проверяет, что процесс pid существует и это udp_mirror.
+// Существование проверяется сигналом 0, а /proc/<pid>/exe защищает от
+// PID, доставшегося другому процессу после перезагрузки или аварии.
+func Alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	if err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		// чужой процесс или нет /proc: полагаемся на сигнал 0
+		return errors.Is(err, os.ErrPermission) || (errors.Is(err, os.ErrNotExist) && !procMounted())
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return true
+	}
+
+	// после обновления бинарника ссылка получает суффикс " (deleted)"
+	exe = strings.TrimSuffix(exe, " (deleted)")
+	return filepath.Base(exe) == filepath.Base(self)
+}
+
+func procMounted() bool {
+	_, err := os.Stat("/proc/self/exe")
+	return err == nil
+}
+
+// Running возвращает PID запущенного экземпляра. Устаревший PID файл удаляется.
+func Running(pidFile string) (int, error) {
+	pid, err := ReadPID(pidFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, ErrNotRunning
+	}
+	if err == nil && Alive(pid) {
+		return pid, nil
+	}
+
+	// файл поврежден или процесс завершился аварийно
+	if err := os.Remove(pidFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("ошибка удаления устаревшего PID файла: %w", err)
+	}
+	return 0, ErrNotRunning
+}
+
+// WritePIDFile создает каталог запуска и записывает PID текущего процесса.
+// Если экземпляр уже запущен, возвращает ErrRunning.
+func WritePIDFile(pidFile string) error {
+	if err := os.MkdirAll(filepath.Dir(pidFile), 0o755); err != nil {
+		return fmt.Errorf("ошибка создания каталога запуска: %w", err)
+	}
+
+	pid, err := Running(pidFile)
+	switch {
+	case err == nil && pid != os.Getpid():
+		return fmt.Errorf("%w: PID %d", ErrRunning, pid)
+	case err == nil:
+		// PID совпал с нашим, например после перезапуска контейнера
+		_ = os.Remove(pidFile)
+	case !errors.Is(err, ErrNotRunning):
+		return err
+	}
+
+	// O_EXCL не дает двум одновременно запущенным экземплярам записать файл
+	f, err := os.OpenFile(pidFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, os.ErrExist) {
+		return ErrRunning
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка записи PID файла: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(strconv.Itoa(os.Getpid())); err != nil {
+		return fmt.Errorf("ошибка записи PID файла: %w", err)
+	}
+	return nil
+}
+
+// RemovePIDFile удаляет PID файл, если в нем PID текущего процесса
+func RemovePIDFile(pidFile string) error {
+	pid, err := ReadPID(pidFile)
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	return os.Remove(pidFile)
+}
@@ -0,0 +1,90 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"udp_mirror/internal/health"
+	"udp_mirror/pkg/metrics"
+)
+
+// Status - ответ команды status
+type Status struct {
+	PID       int              `json:"pid"`
+	Config    string           `json:"config"`
+	Started   time.Time        `json:"started"`
+	Pipelines []PipelineStatus `json:"pipelines"`
+}
+
+// PipelineStatus - состояние pipeline и счетчики его целей
+type PipelineStatus struct {
+	health.PipelineStatus
+
+	Received uint64                  `json:"received"`
+	Counters map[string]TargetCounts `json:"counters"`
+}
+
+// TargetCounts - счетчики цели pipeline
+type TargetCounts struct {
+	Sent    uint64 `json:"sent"`
+	Dropped uint64 `json:"dropped"`
+	Errors  uint64 `json:"errors"`
+}
+
+// CurrentStatus собирает состояние текущего процесса
+func CurrentStatus(configFile string, started time.Time) Status {
+	st := Status{PID: os.Getpid(), Config: configFile, Started: started}
+
+	for _, hs := range health.All(time.Now()) {
+		ms := metrics.Stats(hs.Name)
+		ps := PipelineStatus{
+			PipelineStatus: hs,
+			Received:       ms.Received,
+			Counters:       map[string]TargetCounts{},
+		}
+		for label, ts := range ms.Targets {
+			ps.Counters[label] = TargetCounts{Sent: ts.Sent, Dropped: ts.Dropped, Errors: ts.Errors}
+		}
+		st.Pipelines = append(st.Pipelines, ps)
+	}
+	return st
+}
+
+// Print выводит состояние в виде таблицы
+func (st Status) Print(w io.Writer) {
+	fmt.Fprintf(w, "udp_mirror запущен, PID %d, конфиг %s, работает %v\n\n",
+		st.PID, st.Config, time.Since(st.Started).Truncate(time.Second))
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PIPELINE\tREADY\tHEALTHY\tLISTENERS\tRECEIVED\tTARGET\tWORKERS\tSENT\tDROPPED\tERRORS")
+	for _, ps := range st.Pipelines {
+		listeners := fmt.Sprintf("%d/%d", ps.Listeners.Bound, ps.Listeners.Expected)
+		for i, ts := range ps.Targets {
+			c := ps.Counters[ts.Target]
+			if i == 0 {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t", ps.Name, yesNo(ps.Ready), yesNo(ps.Healthy), listeners, ps.Received)
+			} else {
+				fmt.Fprint(tw, "\t\t\t\t\t")
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", ts.Target, ts.Workers, c.Sent, c.Dropped, c.Errors)
+		}
+	}
+	tw.Flush()
+
+	for _, ps := range st.Pipelines {
+		if len(ps.Reasons) > 0 {
+			fmt.Fprintf(w, "%s: %s\n", ps.Name, strings.Join(ps.Reasons, "; "))
+		}
+	}
+}
+
+func yesNo(ok bool) string {
+	if ok {
+		return "да"
+	}
+	return "нет"
+}
@@ -0,0 +1,220 @@
+// Package handoff передает открытые UDP сокеты pipeline новому процессу
+// при обновлении без простоя. Слушатели регистрируют свои сокеты, а старый
+// процесс отправляет их дубликаты через управляющий сокет (SCM_RIGHTS).
+// Оба процесса читают одну и ту же очередь сокета, поэтому датаграммы не теряются.
+package handoff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Command - команда управляющего сокета для передачи сокетов
+const Command = "handoff"
+
+// maxFDs - ограничение ядра на число дескрипторов в одном сообщении SCM_RIGHTS
+const maxFDs = 253
+
+const timeout = 5 * time.Second
+
+var (
+	mu      sync.Mutex
+	sockets = map[string][]*net.UDPConn{}
+)
+
+// Register добавляет сокет слушателя pipeline в список для передачи
+func Register(plName string, conn *net.UDPConn) {
+	mu.Lock()
+	sockets[plName] = append(sockets[plName], conn)
+	mu.Unlock()
+}
+
+// Unregister убирает закрываемый сокет из списка
+func Unregister(plName string, conn *net.UDPConn) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	list := sockets[plName]
+	for i, c := range list {
+		if c == conn {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(sockets, plName)
+		return
+	}
+	sockets[plName] = list
+}
+
+// header - описание переданных дескрипторов, по имени pipeline на каждый
+type header struct {
+	Error string   `json:"error,omitempty"`
+	Names []string `json:"names,omitempty"`
+}
+
+// Send отправляет дубликаты зарегистрированных сокетов в conn одним сообщением
+func Send(conn *net.UnixConn) error {
+	var h header
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	mu.Lock()
+	for name, list := range sockets {
+		for _, c := range list {
+			f, err := c.File()
+			if err != nil {
+				mu.Unlock()
+				return sendError(conn, fmt.Errorf("ошибка получения дескриптора pipeline %s: %w", name, err))
+			}
+			files = append(files, f)
+			h.Names = append(h.Names, name)
+		}
+	}
+	mu.Unlock()
+
+	if len(files) > maxFDs {
+		return sendError(conn, fmt.Errorf("слишком много сокетов для передачи: %d", len(files)))
+	}
+
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	var oob []byte
+	if len(fds) > 0 {
+		oob = unix.UnixRights(fds...)
+	}
+
+	_, _, err = conn.WriteMsgUnix(append(data, '\n'), oob, nil)
+	return err
+}
+
+func sendError(conn *net.UnixConn, err error) error {
+	data, _ := json.Marshal(header{Error: err.Error()})
+	_, _ = conn.Write(append(data, '\n'))
+	return err
+}
+
+// Receive запрашивает сокеты у запущенного процесса через его управляющий сокет
+// и возвращает их по именам pipeline
+func Receive(socket string) (map[string][]*net.UDPConn, error) {
+	c, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка подключения к управляющему сокету: %w", err)
+	}
+	conn := c.(*net.UnixConn)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := fmt.Fprintln(conn, Command); err != nil {
+		return nil, fmt.Errorf("ошибка отправки команды: %w", err)
+	}
+
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, unix.CmsgSpace(maxFDs*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	fds, err := parseRights(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+
+	var h header
+	if err := json.Unmarshal(buf[:n], &h); err != nil {
+		closeFDs(fds)
+		return nil, fmt.Errorf("ошибка разбора ответа: %w", err)
+	}
+	if h.Error != "" {
+		closeFDs(fds)
+		return nil, errors.New(h.Error)
+	}
+	if len(h.Names) != len(fds) {
+		closeFDs(fds)
+		return nil, fmt.Errorf("получено %d дескрипторов для %d сокетов", len(fds), len(h.Names))
+	}
+
+	out := map[string][]*net.UDPConn{}
+	for i, fd := range fds {
+		udp, err := udpConn(fd, h.Names[i])
+		if err != nil {
+			closeFDs(fds[i+1:])
+			Close(out)
+			return nil, err
+		}
+		out[h.Names[i]] = append(out[h.Names[i]], udp)
+	}
+	return out, nil
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка разбора дескрипторов: %w", err)
+	}
+
+	var fds []int
+	for _, m := range msgs {
+		rights, err := unix.ParseUnixRights(&m)
+		if err != nil {
+			continue
+		}
+		for _, fd := range rights {
+			unix.CloseOnExec(fd)
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+// udpConn оборачивает полученный дескриптор в *net.UDPConn
+func udpConn(fd int, name string) (*net.UDPConn, error) {
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close() // FilePacketConn дублирует дескриптор
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("сокет pipeline %s: %w", name, err)
+	}
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("сокет pipeline %s не UDP", name)
+	}
+	return conn, nil
+}
+
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
+
+// Close закрывает полученные сокеты, например не нужные новому конфигу
+func Close(conns map[string][]*net.UDPConn) {
+	for _, list := range conns {
+		for _, c := range list {
+			c.Close()
+		}
+	}
+}
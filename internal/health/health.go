@@ -0,0 +1,269 @@
+// Package health отслеживает состояние pipeline для проверок /healthz и /readyz.
+package health
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"udp_mirror/pkg/metrics"
+)
+
+// DefaultErrorThreshold - сколько все цели pipeline должны непрерывно
+// отдавать ошибки, чтобы pipeline считался неисправным
+const DefaultErrorThreshold = 30 * time.Second
+
+// Pipeline - состояние одного pipeline: слушатели и цели
+type Pipeline struct {
+	name      string
+	listeners int // ожидаемое число слушателей
+
+	mu      sync.Mutex
+	bound   map[string]bool // слушатель -> сокет открыт
+	dead    map[string]bool // слушатели, завершившиеся до остановки pipeline
+	targets []*target
+}
+
+type target struct {
+	label string
+
+	sent, errors uint64    // значения счетчиков при прошлом замере
+	failingSince time.Time // начало непрерывных ошибок, нулевое - цель исправна
+}
+
+var (
+	mu        sync.RWMutex
+	pipelines = map[string]*Pipeline{}
+	threshold = DefaultErrorThreshold
+)
+
+// SetErrorThreshold задает порог непрерывных ошибок целей, 0 - значение по умолчанию
+func SetErrorThreshold(d time.Duration) {
+	if d <= 0 {
+		d = DefaultErrorThreshold
+	}
+
+	mu.Lock()
+	threshold = d
+	mu.Unlock()
+}
+
+// Register начинает отслеживать pipeline с заданным числом слушателей и целями
+func Register(name string, listeners int, targets []string) *Pipeline {
+	p := &Pipeline{
+		name:      name,
+		listeners: listeners,
+		bound:     map[string]bool{},
+		dead:      map[string]bool{},
+	}
+	for _, t := range targets {
+		p.targets = append(p.targets, &target{label: t})
+	}
+
+	mu.Lock()
+	pipelines[name] = p
+	mu.Unlock()
+	return p
+}
+
+// Unregister прекращает отслеживать остановленный pipeline
+func Unregister(name string) {
+	mu.Lock()
+	delete(pipelines, name)
+	mu.Unlock()
+}
+
+// Get возвращает зарегистрированный pipeline или nil
+func Get(name string) *Pipeline {
+	mu.RLock()
+	defer mu.RUnlock()
+	return pipelines[name]
+}
+
+// ListenerBound отмечает, что слушатель открыл сокет
+func (p *Pipeline) ListenerBound(lName string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.bound[lName] = true
+	delete(p.dead, lName)
+	p.mu.Unlock()
+}
+
+// ListenerDied отмечает, что слушатель завершился, хотя pipeline работает
+func (p *Pipeline) ListenerDied(lName string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.bound[lName] = false
+	p.dead[lName] = true
+	p.mu.Unlock()
+}
+
+// Sample сравнивает счетчики целей с прошлым замером. Цель считается
+// ошибающейся, если за период были ошибки и их не меньше отправленного:
+// UDP цель учитывает пакет отправленным до записи в сокет, HTTP и Kafka - после подтверждения.
+func (p *Pipeline) Sample(now time.Time) {
+	if p == nil {
+		return
+	}
+
+	st := metrics.Stats(p.name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, t := range p.targets {
+		ts := st.Targets[t.label]
+		dSent, dErr := ts.Sent-t.sent, ts.Errors-t.errors
+		t.sent, t.errors = ts.Sent, ts.Errors
+
+		switch {
+		case dErr > 0 && dErr >= dSent:
+			if t.failingSince.IsZero() {
+				t.failingSince = now
+			}
+		case dSent > 0:
+			t.failingSince = time.Time{}
+		}
+	}
+}
+
+// PipelineStatus - состояние pipeline в ответе /healthz и /readyz
+type PipelineStatus struct {
+	Name    string `json:"name"`
+	Ready   bool   `json:"ready"`
+	Healthy bool   `json:"healthy"`
+	// Reasons - почему pipeline не готов или неисправен
+	Reasons []string `json:"reasons,omitempty"`
+
+	Listeners ListenersStatus `json:"listeners"`
+	Targets   []TargetStatus  `json:"targets"`
+}
+
+// ListenersStatus - состояние слушателей pipeline
+type ListenersStatus struct {
+	Expected int      `json:"expected"`
+	Bound    int      `json:"bound"`
+	Dead     []string `json:"dead,omitempty"`
+}
+
+// TargetStatus - состояние цели pipeline
+type TargetStatus struct {
+	Target  string `json:"target"`
+	Workers int    `json:"workers"`
+	// FailingFor - сколько цель непрерывно отдает ошибки
+	FailingFor string `json:"failing_for,omitempty"`
+}
+
+// Status возвращает состояние pipeline на момент now
+func (p *Pipeline) Status(now time.Time) PipelineStatus {
+	mu.RLock()
+	limit := threshold
+	mu.RUnlock()
+
+	st := metrics.Stats(p.name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ps := PipelineStatus{
+		Name:      p.name,
+		Ready:     true,
+		Healthy:   true,
+		Listeners: ListenersStatus{Expected: p.listeners},
+	}
+
+	for lName, ok := range p.bound {
+		if ok {
+			ps.Listeners.Bound++
+		}
+		if p.dead[lName] {
+			ps.Listeners.Dead = append(ps.Listeners.Dead, lName)
+		}
+	}
+	sort.Strings(ps.Listeners.Dead)
+
+	if ps.Listeners.Bound < p.listeners {
+		ps.Ready = false
+		ps.Reasons = append(ps.Reasons, "не все слушатели открыли сокеты")
+	}
+	if len(ps.Listeners.Dead) > 0 {
+		ps.Ready, ps.Healthy = false, false
+		ps.Reasons = append(ps.Reasons, "слушатель завершился")
+	}
+
+	failing := 0
+	for _, t := range p.targets {
+		ts := TargetStatus{Target: t.label, Workers: st.Targets[t.label].Workers}
+		if ts.Workers == 0 {
+			ps.Ready = false
+			ps.Reasons = append(ps.Reasons, "нет работающих воркеров: "+t.label)
+		}
+		if !t.failingSince.IsZero() {
+			d := now.Sub(t.failingSince)
+			ts.FailingFor = d.Truncate(time.Second).String()
+			if d >= limit {
+				failing++
+			}
+		}
+		ps.Targets = append(ps.Targets, ts)
+	}
+
+	if len(p.targets) > 0 && failing == len(p.targets) {
+		ps.Healthy = false
+		ps.Reasons = append(ps.Reasons, "все цели отдают ошибки дольше "+limit.String())
+	}
+	return ps
+}
+
+// All возвращает состояние всех pipeline, отсортированное по имени
+func All(now time.Time) []PipelineStatus {
+	mu.RLock()
+	list := make([]*Pipeline, 0, len(pipelines))
+	for _, p := range pipelines {
+		list = append(list, p)
+	}
+	mu.RUnlock()
+
+	out := make([]PipelineStatus, 0, len(list))
+	for _, p := range list {
+		out = append(out, p.Status(now))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Ready сообщает, готовы ли все pipeline. expected - сколько pipeline должно быть запущено.
+func Ready(expected int) bool {
+	all := All(time.Now())
+	return len(all) >= expected && allOK(all, isReady)
+}
+
+// Healthy сообщает, исправны ли все запущенные pipeline. Как и /healthz, без запущенных
+// pipeline возвращает false.
+func Healthy() bool {
+	return allOK(All(time.Now()), isHealthy)
+}
+
+// allOK - общее правило для Ready, Healthy, /healthz и /readyz: pipeline запущены
+// и каждый проходит проверку ok
+func allOK(all []PipelineStatus, ok func(PipelineStatus) bool) bool {
+	if len(all) == 0 {
+		return false
+	}
+	for _, ps := range all {
+		if !ok(ps) {
+			return false
+		}
+	}
+	return true
+}
+
+func isHealthy(ps PipelineStatus) bool { return ps.Healthy }
+
+func isReady(ps PipelineStatus) bool { return ps.Ready }
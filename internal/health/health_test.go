@@ -0,0 +1,137 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"udp_mirror/pkg/metrics"
+)
+
+// register регистрирует pipeline с одним воркером на цель и снимает его по завершении теста
+func register(t *testing.T, name string, listeners int, targets ...string) *Pipeline {
+	t.Helper()
+
+	p := Register(name, listeners, targets)
+	for _, tg := range targets {
+		metrics.Default().Workers(name, tg, 1)
+	}
+	t.Cleanup(func() {
+		Unregister(name)
+		for _, tg := range targets {
+			metrics.Default().Workers(name, tg, -1)
+		}
+	})
+	return p
+}
+
+func get(t *testing.T, h http.Handler) (int, Response) {
+	t.Helper()
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var resp Response
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s: %v", rr.Body.String(), err)
+	}
+	return rr.Code, resp
+}
+
+func TestReadiness(t *testing.T) {
+	p := register(t, "health_ready", 2, "127.0.0.1:9000")
+
+	code, resp := get(t, ReadyzHandler())
+	if code != http.StatusServiceUnavailable || resp.Status != "fail" {
+		t.Fatalf("до открытия сокетов: %d %+v", code, resp)
+	}
+
+	p.ListenerBound("0")
+	p.ListenerBound("1")
+
+	code, resp = get(t, ReadyzHandler())
+	if code != http.StatusOK || resp.Status != "ok" {
+		t.Fatalf("после открытия сокетов: %d %+v", code, resp)
+	}
+	ps := resp.Pipelines[0]
+	if ps.Listeners.Bound != 2 || ps.Listeners.Expected != 2 || ps.Targets[0].Workers != 1 {
+		t.Fatalf("состояние %+v", ps)
+	}
+}
+
+func TestListenerDied(t *testing.T) {
+	p := register(t, "health_listener", 2, "127.0.0.1:9001")
+	p.ListenerBound("0")
+	p.ListenerBound("1")
+	p.ListenerDied("1")
+
+	code, resp := get(t, HealthzHandler())
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("код %d", code)
+	}
+	ps := resp.Pipelines[0]
+	if ps.Healthy || ps.Ready || len(ps.Listeners.Dead) != 1 || ps.Listeners.Dead[0] != "1" {
+		t.Fatalf("состояние %+v", ps)
+	}
+}
+
+func TestAllTargetsFailing(t *testing.T) {
+	SetErrorThreshold(10 * time.Second)
+	t.Cleanup(func() { SetErrorThreshold(0) })
+
+	const pl = "health_targets"
+	a, b := "127.0.0.1:9002", "127.0.0.1:9003"
+	p := register(t, pl, 1, a, b)
+	p.ListenerBound("0")
+
+	rec := metrics.Default()
+	start := time.Now()
+	p.Sample(start)
+
+	// обе цели только ошибаются, но порог еще не пройден
+	rec.DeliveryErrors(pl, a, "write", 5)
+	rec.DeliveryErrors(pl, b, "write", 5)
+	p.Sample(start.Add(time.Second))
+	if ps := p.Status(start.Add(5 * time.Second)); !ps.Healthy {
+		t.Fatalf("неисправен до порога: %+v", ps)
+	}
+
+	// одна цель восстановилась - pipeline исправен и после порога
+	rec.Sent(pl, a, 100)
+	rec.DeliveryErrors(pl, b, "write", 5)
+	p.Sample(start.Add(2 * time.Second))
+	if ps := p.Status(start.Add(20 * time.Second)); !ps.Healthy || ps.Targets[0].FailingFor != "" {
+		t.Fatalf("цель %s восстановилась: %+v", a, ps)
+	}
+
+	// обе цели снова ошибаются дольше порога
+	rec.DeliveryErrors(pl, a, "write", 5)
+	rec.DeliveryErrors(pl, b, "write", 5)
+	p.Sample(start.Add(3 * time.Second))
+	ps := p.Status(start.Add(15 * time.Second))
+	if ps.Healthy || ps.Targets[0].FailingFor != "12s" || ps.Targets[1].FailingFor != "14s" {
+		t.Fatalf("все цели ошибаются: %+v", ps)
+	}
+	if !ps.Ready {
+		t.Fatalf("ошибки целей не влияют на готовность: %+v", ps)
+	}
+}
+
+func TestNoPipelines(t *testing.T) {
+	code, resp := get(t, HealthzHandler())
+	if code != http.StatusServiceUnavailable || len(resp.Pipelines) != 0 {
+		t.Fatalf("%d %+v", code, resp)
+	}
+	// watchdog судит так же, как /healthz
+	if Healthy() || Ready(0) {
+		t.Fatal("без pipeline сервис исправен или готов")
+	}
+
+	rr := httptest.NewRecorder()
+	HealthzHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST: код %d", rr.Code)
+	}
+}
@@ -0,0 +1,48 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Response - тело ответа /healthz и /readyz
+type Response struct {
+	Status    string           `json:"status"` // ok или fail
+	Pipelines []PipelineStatus `json:"pipelines"`
+}
+
+// HealthzHandler отвечает 200, если все pipeline исправны, иначе 503.
+// Пока не запущен ни один pipeline, сервис не исправен.
+func HealthzHandler() http.Handler {
+	return handler(isHealthy)
+}
+
+// ReadyzHandler отвечает 200, когда сокеты всех pipeline открыты и воркеры работают, иначе 503.
+// Пока не запущен ни один pipeline, сервис не готов.
+func ReadyzHandler() http.Handler {
+	return handler(isReady)
+}
+
+func handler(ok func(PipelineStatus) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		resp := Response{Status: "ok", Pipelines: All(time.Now())}
+		if !allOK(resp.Pipelines, ok) {
+			resp.Status = "fail"
+		}
+
+		code := http.StatusOK
+		if resp.Status != "ok" {
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+}
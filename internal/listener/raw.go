@@ -0,0 +1,412 @@
+package listener
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/capture"
+	"udp_mirror/internal/health"
+	"udp_mirror/internal/packet"
+	"udp_mirror/pkg/logging"
+	"udp_mirror/pkg/metrics"
+)
+
+// maxIPPacket - наибольший размер IPv4 пакета
+const maxIPPacket = 65535
+
+const (
+	udpHeaderLen  = 8
+	moreFragments = 0x2000
+	fragOffset    = 0x1fff
+)
+
+// fragTTL - сколько помнить порт источника по первому фрагменту датаграммы
+const fragTTL = 30 * time.Second
+
+// fragKey - датаграмма, фрагменты которой принимаются (RFC 791)
+type fragKey struct {
+	src, dst [4]byte
+	id       uint16
+}
+
+// fragSource - порт источника из заголовка UDP первого фрагмента
+type fragSource struct {
+	port  uint16
+	other bool // датаграмма на другой порт, ее фрагменты не нужны
+	at    time.Time
+}
+
+// rawReader разбирает IP пакеты одного сокета режима raw. Fanout по хешу
+// направляет фрагменты одной датаграммы в один сокет, поэтому таблица
+// фрагментов у каждого слушателя своя.
+type rawReader struct {
+	l        *UDPListener
+	plName   string
+	lName    string
+	log      *slog.Logger
+	received metrics.PacketCounter
+	frags    map[fragKey]fragSource
+	cleaned  time.Time
+}
+
+// StartRaw принимает IP пакеты входа с AF_PACKET сокета, до сборки фрагментов ядром.
+// Целые датаграммы обрабатываются как в Serve, а фрагменты передаются целям как есть.
+// Фрагменты, пришедшие раньше первого, не пересылаются: порт источника известен только из него.
+// Они считаются отброшенными с причиной fragment_orphan.
+func (l *UDPListener) StartRaw(lName string) {
+	plName, _ := l.ctx.Value(config.PlNameKey).(string)
+	log := l.log.With("listener", lName)
+
+	var group *fanoutGroup
+	if l.cfg.Count > 1 {
+		group = &l.fanout
+	}
+	fd, err := openPacketSocket(l.addr, l.cfg, group, log)
+	if err != nil {
+		log.Error("Ошибка запуска слушателя raw", "addr", l.addr.String(), logging.Err(err))
+		return
+	}
+	f := os.NewFile(uintptr(fd), "packet")
+	defer f.Close()
+
+	// сокет на порту входа, чтобы ядро не отвечало источникам ICMP port unreachable;
+	// сам он ничего не принимает
+	sink, err := listenSink(l.addr, log)
+	if err != nil {
+		log.Error("Ошибка открытия UDP сокета входа", "addr", l.addr.String(), logging.Err(err))
+	} else {
+		defer sink.Close()
+	}
+
+	rc, err := f.SyscallConn()
+	if err != nil {
+		log.Error("Ошибка запуска слушателя raw", logging.Err(err))
+		return
+	}
+
+	health.Get(plName).ListenerBound(lName)
+
+	log.Info("Сервер запущен в режиме raw", "addr", l.addr.String(), "interface", l.cfg.Interface)
+
+	r := &rawReader{
+		l:        l,
+		plName:   plName,
+		lName:    lName,
+		log:      log,
+		received: l.rec.Receiver(plName, lName),
+		frags:    make(map[fragKey]fragSource),
+	}
+
+	for {
+		select {
+		case <-l.ctx.Done():
+			log.Info("UDP Listener завершает работу...")
+			return
+		default:
+			err := f.SetReadDeadline(l.nextReadDeadline())
+			if err != nil {
+				logging.DefaultLimiter().Error(log,
+					logging.LimitKey{Pipeline: plName, Type: "read_deadline"}, "Ошибка SetReadDeadline", err)
+			}
+
+			buf := l.pool.Get()
+
+			// с MSG_TRUNC возвращается полная длина пакета, даже если он не поместился
+			var n int
+			var readErr error
+			err = rc.Read(func(fd uintptr) bool {
+				n, _, readErr = unix.Recvfrom(int(fd), buf.Bytes(), unix.MSG_TRUNC)
+				return readErr != unix.EAGAIN
+			})
+			if err == nil {
+				err = readErr
+			}
+			if err != nil {
+				buf.Release()
+				if isTimeoutError(err) {
+					continue
+				}
+				logging.DefaultLimiter().Error(log,
+					logging.LimitKey{Pipeline: plName, Type: "read"}, "Ошибка чтения из AF_PACKET", err)
+				continue
+			}
+
+			r.handle(buf, n, time.Now())
+			buf.Release()
+		}
+	}
+}
+
+// handle разбирает IPv4 пакет длины n из buf и передает целям датаграмму или фрагмент
+func (r *rawReader) handle(buf *packet.Buffer, n int, now time.Time) {
+	b := buf.Bytes()
+	if n > len(b) {
+		// пакет больше 64 КБ (например, GSO), передать его нельзя
+		r.l.rec.Truncated(r.plName, config.TruncatedDrop)
+		logging.DefaultLimiter().Error(r.log,
+			logging.LimitKey{Pipeline: r.plName, Type: "truncated"}, "Пакет обрезан",
+			fmt.Errorf("IP пакет %d байт больше %d", n, len(b)))
+		return
+	}
+	if n < ipv4.HeaderLen {
+		return
+	}
+
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:]))
+	if ihl < ipv4.HeaderLen || total < ihl || total > n {
+		return
+	}
+
+	field := binary.BigEndian.Uint16(b[6:])
+	frag := packet.Fragment{
+		ID:     binary.BigEndian.Uint16(b[4:]),
+		Offset: int(field&fragOffset) * 8,
+		More:   field&moreFragments != 0,
+	}
+	key := fragKey{id: frag.ID}
+	copy(key.src[:], b[12:16])
+	copy(key.dst[:], b[16:20])
+	src := &net.UDPAddr{IP: net.IPv4(b[12], b[13], b[14], b[15])}
+	dst := net.IPv4(b[16], b[17], b[18], b[19])
+
+	if frag.Offset > 0 {
+		s, ok := r.frags[key]
+		if !ok {
+			// первый фрагмент потерян, пришел позже или забыт по fragTTL
+			for _, target := range r.l.targets {
+				r.l.rec.Dropped(r.plName, target, "fragment_orphan")
+			}
+			return
+		}
+		if !frag.More {
+			delete(r.frags, key)
+		}
+		if s.other {
+			return
+		}
+		src.Port = int(s.port)
+		capture.InputIP(r.plName, b[:total])
+		buf.Slice(ihl, total)
+		r.deliver(buf, frag, src, dst, now)
+		return
+	}
+
+	udp := b[ihl:total]
+	if len(udp) < udpHeaderLen {
+		return
+	}
+	if binary.BigEndian.Uint16(udp[2:]) != uint16(r.l.addr.Port) {
+		// первые фрагменты на другие порты фильтр пропускает, чтобы остальные
+		// фрагменты этих датаграмм не считались потерявшими первый
+		if frag.More {
+			r.cleanup(now)
+			r.frags[key] = fragSource{other: true, at: now}
+		}
+		return
+	}
+	src.Port = int(binary.BigEndian.Uint16(udp))
+
+	if frag.More {
+		r.cleanup(now)
+		r.frags[key] = fragSource{port: uint16(src.Port), at: now}
+		capture.InputIP(r.plName, b[:total])
+		buf.Slice(ihl, total)
+		r.deliver(buf, frag, src, dst, now)
+		return
+	}
+
+	length := int(binary.BigEndian.Uint16(udp[4:]))
+	if length < udpHeaderLen || length > len(udp) {
+		return
+	}
+	capture.InputIP(r.plName, b[:total])
+	buf.Slice(ihl+udpHeaderLen, ihl+length)
+	r.deliver(buf, packet.Fragment{}, src, dst, now)
+}
+
+func (r *rawReader) deliver(buf *packet.Buffer, frag packet.Fragment, src *net.UDPAddr, dst net.IP, now time.Time) {
+	n := len(buf.Bytes())
+	r.received.Add(src.IP, n)
+	r.l.processData(r.plName, buf, frag, src, dst, now, metrics.TraceReceive(r.plName, r.lName, src, n, now))
+}
+
+// cleanup забывает датаграммы, последний фрагмент которых не пришел за fragTTL
+func (r *rawReader) cleanup(now time.Time) {
+	if now.Sub(r.cleaned) < fragTTL {
+		return
+	}
+	r.cleaned = now
+	for k, s := range r.frags {
+		if now.Sub(s.at) > fragTTL {
+			delete(r.frags, k)
+		}
+	}
+}
+
+// fanoutGroup - группа PACKET_FANOUT_HASH сокетов слушателей входа. Номер группы
+// выбирает ядро, когда первый сокет создает ее с PACKET_FANOUT_FLAG_UNIQUEID,
+// поэтому он не совпадает с группами других процессов.
+type fanoutGroup struct {
+	mu      sync.Mutex
+	id      uint16
+	created bool
+}
+
+// join добавляет сокет в группу; первый сокет создает ее
+func (g *fanoutGroup) join(fd int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.created {
+		return unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT, int(g.id)|unix.PACKET_FANOUT_HASH<<16)
+	}
+	mode := unix.PACKET_FANOUT_HASH | unix.PACKET_FANOUT_FLAG_UNIQUEID
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT, mode<<16); err != nil {
+		return err
+	}
+	// младшие 16 бит - номер группы, старшие - режим и флаги
+	v, err := unix.GetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT)
+	if err != nil {
+		return err
+	}
+	g.id, g.created = uint16(v), true
+	return nil
+}
+
+// openPacketSocket открывает неблокирующий AF_PACKET сокет, принимающий UDP пакеты
+// на адрес входа и все фрагменты UDP на этот адрес. Сокеты слушателей одного
+// pipeline объединяются в группу group, если она задана.
+func openPacketSocket(addr *net.UDPAddr, cfg config.ListenerConfig, group *fanoutGroup, log *slog.Logger) (int, error) {
+	proto := htons(unix.ETH_P_IP)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return -1, err
+	}
+
+	if err := setupPacketSocket(fd, proto, addr, cfg, group, log); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func setupPacketSocket(fd int, proto uint16, addr *net.UDPAddr, cfg config.ListenerConfig, group *fanoutGroup, log *slog.Logger) error {
+	raw, err := rawProgram(addr)
+	if err != nil {
+		return err
+	}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, sockFprog(raw)); err != nil {
+		return fmt.Errorf("фильтр: %w", err)
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, cfg.ReadBuffer); err != nil {
+		log.Error("Ошибка установки буфера приема", logging.Err(err))
+	}
+
+	ifindex := 0
+	if cfg.Interface != "" {
+		ifi, err := net.InterfaceByName(cfg.Interface)
+		if err != nil {
+			return err
+		}
+		ifindex = ifi.Index
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: proto, Ifindex: ifindex}); err != nil {
+		return err
+	}
+
+	if group != nil {
+		if err := group.join(fd); err != nil {
+			return fmt.Errorf("fanout: %w", err)
+		}
+	}
+	return nil
+}
+
+// rawProgram возвращает фильтр входящих IPv4 пакетов UDP на адрес и порт входа.
+// Порт есть только в первом фрагменте, поэтому все фрагменты на адрес входа
+// проходят фильтр, а отбираются по таблице первых фрагментов.
+func rawProgram(addr *net.UDPAddr) ([]bpf.RawInstruction, error) {
+	var prog []bpf.Instruction
+	var drops []int
+	jumpDrop := func(cond bpf.JumpTest, val uint32) {
+		drops = append(drops, len(prog))
+		prog = append(prog, bpf.JumpIf{Cond: cond, Val: val})
+	}
+
+	// исходящие и чужие (PACKET_OTHERHOST) пакеты не нужны
+	prog = append(prog, bpf.LoadExtension{Num: bpf.ExtType})
+	jumpDrop(bpf.JumpGreaterThan, unix.PACKET_MULTICAST)
+	prog = append(prog, bpf.LoadAbsolute{Off: 9, Size: 1})
+	jumpDrop(bpf.JumpNotEqual, unix.IPPROTO_UDP)
+	if ip := addr.IP.To4(); ip != nil && !ip.IsUnspecified() {
+		prog = append(prog, bpf.LoadAbsolute{Off: 16, Size: 4})
+		jumpDrop(bpf.JumpNotEqual, binary.BigEndian.Uint32(ip))
+	}
+	// фрагмент
+	prog = append(prog,
+		bpf.LoadAbsolute{Off: 6, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: moreFragments | fragOffset, SkipTrue: 3},
+		bpf.LoadMemShift{Off: 0},
+		bpf.LoadIndirect{Off: 2, Size: 2},
+	)
+	jumpDrop(bpf.JumpNotEqual, uint32(addr.Port))
+	prog = append(prog, bpf.RetConstant{Val: maxIPPacket}, bpf.RetConstant{Val: 0})
+
+	drop := len(prog) - 1
+	for _, i := range drops {
+		j := prog[i].(bpf.JumpIf)
+		j.SkipTrue = uint8(drop - i - 1)
+		prog[i] = j
+	}
+	return bpf.Assemble(prog)
+}
+
+// listenSink открывает UDP сокет на адресе входа с фильтром, отбрасывающим все датаграммы
+func listenSink(addr *net.UDPAddr, log *slog.Logger) (*net.UDPConn, error) {
+	conn, err := listenReusePort(addr, 0, log)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 0}})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var opErr error
+	err = rc.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, sockFprog(raw))
+	})
+	if err == nil {
+		err = opErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// htons переводит число в сетевой порядок байт
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
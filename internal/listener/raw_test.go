@@ -0,0 +1,286 @@
+package listener
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/capture"
+	"udp_mirror/internal/packet"
+	"udp_mirror/internal/pcap"
+	"udp_mirror/internal/worker"
+	"udp_mirror/pkg/logging"
+	"udp_mirror/pkg/metrics"
+)
+
+// ipPacket собирает IPv4 пакет UDP протокола с данными payload
+func ipPacket(src, dst net.IP, id uint16, field uint16, payload []byte) []byte {
+	p := make([]byte, 20+len(payload))
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	binary.BigEndian.PutUint16(p[4:], id)
+	binary.BigEndian.PutUint16(p[6:], field)
+	p[8] = 64
+	p[9] = unix.IPPROTO_UDP
+	copy(p[12:], src.To4())
+	copy(p[16:], dst.To4())
+	copy(p[20:], payload)
+	return p
+}
+
+// fragments делит датаграмму UDP с портами srcPort -> dstPort на IP фрагменты по size байт
+func fragments(src, dst net.IP, id, srcPort, dstPort uint16, data []byte, size int) [][]byte {
+	udp := make([]byte, udpHeaderLen+len(data))
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[udpHeaderLen:], data)
+
+	var frags [][]byte
+	for off := 0; off < len(udp); off += size {
+		end := min(off+size, len(udp))
+		field := uint16(off / 8)
+		if end < len(udp) {
+			field |= moreFragments
+		}
+		frags = append(frags, ipPacket(src, dst, id, field, udp[off:end]))
+	}
+	return frags
+}
+
+func rawListener(t *testing.T, pl string, port uint16, count int) (*UDPListener, chan worker.IRPData, context.CancelFunc) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), config.PlNameKey, pl))
+	ch := make(chan worker.IRPData, 100)
+	settings := Settings(&config.ListenerConfig{Mode: config.ListenerRaw, Count: count})
+	l, err := NewUDPListener(ctx, config.AddrConfig{Host: net.IPv4(127, 0, 0, 1), Port: port}, []chan worker.IRPData{ch}, []string{"t"}, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, ch, cancel
+}
+
+func TestRawHandle(t *testing.T) {
+	const pl = "raw_handle"
+	l, ch, cancel := rawListener(t, pl, 2055, 1)
+	defer cancel()
+	r := &rawReader{l: l, plName: pl, lName: "0", log: l.log, received: l.rec.Receiver(pl, "0"), frags: map[fragKey]fragSource{}}
+
+	src, dst := net.IPv4(192, 0, 2, 1), net.IPv4(127, 0, 0, 1)
+	handle := func(p []byte) {
+		buf := l.pool.Get()
+		r.handle(buf, copy(buf.Bytes(), p), time.Now())
+		buf.Release()
+	}
+
+	dir := t.TempDir()
+	if err := capture.Default().Start(config.CaptureConfig{Dir: dir, Direction: capture.DirectionIn}); err != nil {
+		t.Fatal(err)
+	}
+	defer capture.Default().Stop()
+	dropped := metrics.Stats(pl).Targets["t"].Dropped
+
+	data := make([]byte, 100)
+	frags := fragments(src, dst, 7, 514, 2055, data, 48)
+	orphan := fragments(src, dst, 8, 514, 2055, data, 48)[1]
+	whole := fragments(src, dst, 9, 514, 2055, []byte("hello"), 100)[0]
+	other := fragments(src, dst, 10, 514, 2056, []byte("hello"), 100)[0]
+	otherFrags := fragments(src, dst, 11, 514, 2056, data, 48)
+
+	// фрагмент без первого и датаграммы на другой порт не передаются
+	handle(orphan)
+	handle(other)
+	for _, p := range otherFrags {
+		handle(p)
+	}
+	for _, p := range frags {
+		handle(p)
+	}
+	handle(whole)
+
+	want := []struct {
+		frag packet.Fragment
+		size int
+	}{
+		{packet.Fragment{ID: 7, Offset: 0, More: true}, 48},
+		{packet.Fragment{ID: 7, Offset: 48, More: true}, 48},
+		{packet.Fragment{ID: 7, Offset: 96, More: false}, 12},
+		{packet.Fragment{}, 5},
+	}
+	if len(ch) != len(want) {
+		t.Fatalf("в очереди %d пакетов, ожидали %d", len(ch), len(want))
+	}
+	for i, w := range want {
+		d := <-ch
+		if d.Frag != w.frag || len(d.Data) != w.size || !d.Src.Host.Equal(src) || d.Src.Port != 514 ||
+			!d.Origin.Dst.Host.Equal(dst) || d.Origin.Dst.Port != 2055 {
+			t.Errorf("пакет %d: %+v, %d байт от %s:%d", i, d.Frag, len(d.Data), d.Src.Host, d.Src.Port)
+		}
+		d.Buf.Release()
+	}
+	if len(r.frags) != 0 {
+		t.Errorf("датаграмма не удалена из таблицы: %v", r.frags)
+	}
+
+	// потерявшим первый считается только фрагмент orphan, а не фрагменты на другой порт
+	if got := metrics.Stats(pl).Targets["t"].Dropped - dropped; got != 1 {
+		t.Errorf("отброшено фрагментов без первого: %d", got)
+	}
+
+	// в запись попадают принятые IP пакеты как есть, включая фрагменты
+	file := capture.Default().Status().File
+	if err := capture.Default().Stop(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rd, err := pcap.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var captured [][]byte
+	for {
+		p, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		captured = append(captured, append([]byte(nil), p.Data...))
+	}
+	if len(captured) != 4 {
+		t.Fatalf("записано %d пакетов, ожидали 4", len(captured))
+	}
+	for i, p := range append(frags, whole) {
+		if !bytes.Equal(captured[i], p) {
+			t.Errorf("пакет %d записан не как принят", i)
+		}
+	}
+}
+
+func TestRawListener(t *testing.T) {
+	const pl = "raw_listener"
+
+	out, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("нужен CAP_NET_RAW")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(out)
+
+	port := freePort(t)
+	l, ch, cancel := rawListener(t, pl, port, 2)
+	done := make(chan struct{}, 2)
+	for _, name := range []string{"0", "1"} {
+		go func() {
+			l.StartRaw(name)
+			done <- struct{}{}
+		}()
+	}
+	defer func() {
+		cancel()
+		<-done
+		<-done
+	}()
+
+	lo := net.IPv4(127, 0, 0, 1)
+	data := make([]byte, 3000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	send := func(p []byte) {
+		if err := unix.Sendto(out, p, 0, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// сокет открывается асинхронно, шлем целые датаграммы до первой принятой
+	received := metrics.Stats(pl).Received
+	deadline := time.Now().Add(2 * time.Second)
+	for metrics.Stats(pl).Received == received {
+		if time.Now().After(deadline) {
+			t.Fatal("слушатель не принял пакет")
+		}
+		send(fragments(lo, lo, 1, 40000, port, []byte("probe"), 100)[0])
+		time.Sleep(10 * time.Millisecond)
+	}
+	for len(ch) > 0 {
+		(<-ch).Buf.Release()
+	}
+
+	for _, p := range fragments(lo, lo, 2, 40000, port, data, 1480) {
+		send(p)
+	}
+
+	var got []byte
+	for i := 0; i < 3; i++ {
+		select {
+		case d := <-ch:
+			if d.Frag.ID != 2 || d.Frag.Offset != len(got) || d.Src.Port != 40000 {
+				t.Fatalf("фрагмент %d: %+v от %d", i, d.Frag, d.Src.Port)
+			}
+			got = append(got, d.Data...)
+			d.Buf.Release()
+		case <-time.After(2 * time.Second):
+			t.Fatalf("принято %d фрагментов", i)
+		}
+	}
+	if len(got) != udpHeaderLen+len(data) || string(got[udpHeaderLen:]) != string(data) {
+		t.Fatalf("собрано %d байт", len(got))
+	}
+
+	// исходящие копии пакетов на lo фильтр отбрасывает
+	time.Sleep(50 * time.Millisecond)
+	if len(ch) != 0 {
+		t.Errorf("лишние пакеты в очереди: %d", len(ch))
+	}
+}
+
+func TestFanoutGroup(t *testing.T) {
+	var g fanoutGroup
+	var fds []int
+	defer func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(freePort(t))}
+	for range 2 {
+		fd, err := openPacketSocket(addr, config.ListenerConfig{ReadBuffer: 1 << 16}, &g, logging.For("listener"))
+		if errors.Is(err, unix.EPERM) {
+			t.Skip("нужен CAP_NET_RAW")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fds = append(fds, fd)
+	}
+
+	// второй сокет вошел в группу, созданную первым с номером от ядра
+	for _, fd := range fds {
+		v, err := unix.GetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint16(v) != g.id {
+			t.Errorf("сокет в группе %d, ожидали %d", uint16(v), g.id)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package listener
+
+import (
+	"net"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// skfNetOff - смещение SKF_NET_OFF: программа SO_ATTACH_REUSEPORT_CBPF видит пакет
+// с начала данных UDP, а IP заголовок доступен по отрицательным смещениям
+const skfNetOff = 0xfff00000 // -0x100000
+
+// steerProgram возвращает программу, выбирающую сокет группы SO_REUSEPORT по IP источника:
+// номер сокета - свертка адреса (для IPv6 - последние 4 байта) по модулю числа сокетов.
+// Датаграммы одного источника всегда читает один сокет, и их порядок сохраняется.
+func steerProgram(sockets int) ([]bpf.RawInstruction, error) {
+	return bpf.Assemble([]bpf.Instruction{
+		// версия IP
+		bpf.LoadAbsolute{Off: skfNetOff, Size: 1},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x40, SkipFalse: 2},
+		// IPv4: адрес источника по смещению 12
+		bpf.LoadAbsolute{Off: skfNetOff + 12, Size: 4},
+		bpf.Jump{Skip: 1},
+		// IPv6: последние 4 байта адреса источника
+		bpf.LoadAbsolute{Off: skfNetOff + 20, Size: 4},
+		// A = (A ^ A>>16) % sockets
+		bpf.TAX{},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 16},
+		bpf.ALUOpX{Op: bpf.ALUOpXor},
+		bpf.ALUOpConstant{Op: bpf.ALUOpMod, Val: uint32(sockets)},
+		bpf.RetA{},
+	})
+}
+
+// steerIndex - номер сокета, который steerProgram выберет для адреса ip
+func steerIndex(ip net.IP, sockets int) int {
+	var key []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		key = ip4
+	} else {
+		key = ip.To16()[12:]
+	}
+	a := uint32(key[0])<<24 | uint32(key[1])<<16 | uint32(key[2])<<8 | uint32(key[3])
+	return int((a ^ a>>16) % uint32(sockets))
+}
+
+// attachSteering подключает программу выбора сокета к группе SO_REUSEPORT сокета conn.
+// Программа общая для группы, поэтому ее установка каждым слушателем ничего не меняет.
+func attachSteering(conn *net.UDPConn, sockets int) error {
+	raw, err := steerProgram(sockets)
+	if err != nil {
+		return err
+	}
+	prog := sockFprog(raw)
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var opErr error
+	err = rc.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_CBPF, prog)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+// sockFprog переводит собранную программу в формат setsockopt
+func sockFprog(raw []bpf.RawInstruction) *unix.SockFprog {
+	filter := make([]unix.SockFilter, len(raw))
+	for i, ins := range raw {
+		filter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return &unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+}
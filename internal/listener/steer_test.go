@@ -0,0 +1,92 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"udp_mirror/pkg/logging"
+)
+
+func TestSteerBySource(t *testing.T) {
+	const sockets = 4
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(freePort(t))}
+	log := logging.For("listener")
+
+	// номер сокета в группе - порядок привязки
+	conns := make([]*net.UDPConn, sockets)
+	for i := range conns {
+		conn, err := listenReusePort(addr, DefaultReadBuffer, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	if err := attachSteering(conns[0], sockets); err != nil {
+		if errors.Is(err, unix.ENOPROTOOPT) || errors.Is(err, unix.EPERM) {
+			t.Skip("SO_ATTACH_REUSEPORT_CBPF не поддерживается:", err)
+		}
+		t.Fatal(err)
+	}
+
+	// с каждого источника несколько датаграмм с разных портов
+	const sources = 16
+	for s := range sources {
+		src := net.IPv4(127, 0, 0, byte(2+s*7))
+		for range 3 {
+			c, err := net.DialUDP("udp", &net.UDPAddr{IP: src}, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = c.Write([]byte(src.String()))
+			c.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	got := map[string][]int{}
+	buf := make([]byte, 64)
+	for i, conn := range conns {
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			if string(buf[:n]) != src.IP.String() {
+				t.Fatalf("данные %q от %s", buf[:n], src.IP)
+			}
+			got[src.IP.String()] = append(got[src.IP.String()], i)
+		}
+	}
+
+	if len(got) != sources {
+		t.Fatalf("датаграммы от %d источников из %d", len(got), sources)
+	}
+	used := map[int]bool{}
+	for ip, idx := range got {
+		want := steerIndex(net.ParseIP(ip), sockets)
+		if fmt.Sprint(idx) != fmt.Sprint([]int{want, want, want}) {
+			t.Errorf("%s: сокеты %v, ожидали %d", ip, idx, want)
+		}
+		used[want] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("все источники попали в сокеты %v", used)
+	}
+}
+
+func TestSettingsDefaults(t *testing.T) {
+	s := Settings(nil)
+	if s.Count != DefaultCount || s.ReadBuffer != DefaultReadBuffer ||
+		s.ReadTimeout != DefaultReadTimeout || s.MaxDatagram != DefaultMaxDatagram {
+		t.Errorf("настройки по умолчанию %+v", s)
+	}
+}
@@ -3,49 +3,106 @@ package listener
 import (
 	"context"
 	"fmt"
-	"log"
 	"log/slog"
 	"net"
-	"sync"
 	"syscall"
 	"time"
 
 	"udp_mirror/config"
+	"udp_mirror/internal/capture"
+	"udp_mirror/internal/handoff"
+	"udp_mirror/internal/health"
+	"udp_mirror/internal/packet"
 	"udp_mirror/internal/worker"
+	"udp_mirror/pkg/logging"
 	"udp_mirror/pkg/metrics"
 
 	"golang.org/x/sys/unix"
 )
 
+// Настройки слушателя по умолчанию
+const (
+	DefaultCount       = 2
+	DefaultReadBuffer  = 32 * 1024 * 1024
+	DefaultReadTimeout = 300 * time.Millisecond
+	DefaultMaxDatagram = 65536 - 28
+)
+
+// Settings возвращает настройки слушателей pipeline с подставленными значениями по умолчанию
+func Settings(cfg *config.ListenerConfig) config.ListenerConfig {
+	var s config.ListenerConfig
+	if cfg != nil {
+		s = *cfg
+	}
+	if s.Count <= 0 {
+		s.Count = DefaultCount
+	}
+	if s.ReadBuffer <= 0 {
+		s.ReadBuffer = DefaultReadBuffer
+	}
+	if s.ReadTimeout <= 0 {
+		s.ReadTimeout = DefaultReadTimeout
+	}
+	if s.MaxDatagram <= 0 {
+		s.MaxDatagram = DefaultMaxDatagram
+	}
+	if s.Truncated == "" {
+		s.Truncated = config.TruncatedDrop
+	}
+	if s.Mode == "" {
+		s.Mode = config.ListenerSocket
+	}
+	return s
+}
+
 type UDPListener struct {
 	addr *net.UDPAddr
+	cfg  config.ListenerConfig
 	// conn     *net.UDPConn
 	// channels []chan worker.IRPData
 	channels []chan worker.IRPData
+	targets  []string // имена целей для метрик, по индексу канала
+	pool     *packet.Pool
+	rec      metrics.Recorder
+	log      *slog.Logger
+	fanout   fanoutGroup // группа AF_PACKET сокетов режима raw
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-// NewUDPListener создает новый экземпляр UDPListener
-func NewUDPListener(ctx context.Context, serverAddr config.AddrConfig, chs []chan worker.IRPData) (*UDPListener, error) {
+// NewUDPListener создает новый экземпляр UDPListener.
+// cfg - настройки после Settings; Count - число сокетов группы SO_REUSEPORT.
+func NewUDPListener(ctx context.Context, serverAddr config.AddrConfig, chs []chan worker.IRPData, targets []string, cfg config.ListenerConfig) (*UDPListener, error) {
 	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", serverAddr.Host.String(), serverAddr.Port))
 	if err != nil {
 		return nil, err
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
+	plName, _ := ctx.Value(config.PlNameKey).(string)
+
+	// в режиме raw буфер вмещает IP пакет наибольшего размера
+	size := cfg.MaxDatagram
+	if cfg.Mode == config.ListenerRaw {
+		size = maxIPPacket
+	}
 
 	return &UDPListener{
 		addr: addr,
+		cfg:  cfg,
 
 		channels: chs,
+		targets:  targets,
+		pool:     packet.NewPool(size),
+		rec:      metrics.Default(),
+		log:      logging.For("listener").With("pipeline", plName),
 		ctx:      ctx,
 		cancel:   cancel,
 	}, nil
 }
 
-func listenReusePort(addr *net.UDPAddr) *net.UDPConn {
+func listenReusePort(addr *net.UDPAddr, readBuffer int, log *slog.Logger) (*net.UDPConn, error) {
 	// Настройка SO_REUSEPORT
 	lc := net.ListenConfig{
 		Control: func(_, address string, c syscall.RawConn) error {
@@ -62,23 +119,22 @@ func listenReusePort(addr *net.UDPAddr) *net.UDPConn {
 
 	lp, err := lc.ListenPacket(context.Background(), "udp", addr.String())
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	conn := lp.(*net.UDPConn)
 
-	// Увеличиваем буфер приема до 8MB
-	err = conn.SetReadBuffer(32 * 1024 * 1024)
+	// Увеличиваем буфер приема
+	err = conn.SetReadBuffer(readBuffer)
 	if err != nil {
-		slog.Error(err.Error())
+		log.Error("Ошибка установки буфера приема", logging.Err(err))
 	}
 
-	return conn
+	return conn, nil
 }
 
 // Устанавливаем таймаут для `ReadFromUDP`
 func (l *UDPListener) nextReadDeadline() time.Time {
-	return time.Now().Add(300 * time.Millisecond)
-	// return time.Now().Add(10 * time.Second)
+	return time.Now().Add(l.cfg.ReadTimeout)
 }
 
 // Проверяем, является ли ошибка таймаутом
@@ -87,60 +143,107 @@ func isTimeoutError(err error) bool {
 	return ok && netErr.Timeout()
 }
 
-// Start Listen начинает прием данных с UDP-соединения
+// Start Listen начинает прием данных с UDP-соединения.
+// Если сокет открыть не удалось, слушатель завершается, а pipeline помечается неисправным.
 func (l *UDPListener) Start(lName string) {
-	conn := listenReusePort(l.addr)
-	defer conn.Close()
+	log := l.log.With("listener", lName)
 
+	conn, err := listenReusePort(l.addr, l.cfg.ReadBuffer, log)
+	if err != nil {
+		log.Error("Ошибка запуска UDP слушателя", "addr", l.addr.String(), logging.Err(err))
+		return
+	}
+
+	l.serve(lName, conn)
+}
+
+// Serve принимает данные с уже открытого сокета, например переданного systemd
+// или старым процессом при обновлении, и закрывает его по завершении.
+// Буфер приема сокета устанавливается по read_buffer текущего конфига.
+func (l *UDPListener) Serve(lName string, conn *net.UDPConn) {
+	if err := conn.SetReadBuffer(l.cfg.ReadBuffer); err != nil {
+		l.log.Error("Ошибка установки буфера приема", "listener", lName, logging.Err(err))
+	}
+	l.serve(lName, conn)
+}
+
+// serve читает сокет до отмены контекста и закрывает его по завершении.
+// Пока слушатель работает, сокет доступен для передачи новому процессу.
+func (l *UDPListener) serve(lName string, conn *net.UDPConn) {
 	plName, _ := l.ctx.Value(config.PlNameKey).(string)
-	log.Printf("[Pipeline %s] Сервер запущен и слушает на %s\n", plName, conn.LocalAddr())
+	log := l.log.With("listener", lName)
+	defer conn.Close()
 
-	bufPool := sync.Pool{
-		New: func() any {
-			return make([]byte, 65536-28) // Выделяем буфер заранее
-		},
+	handoff.Register(plName, conn)
+	defer handoff.Unregister(plName, conn)
+
+	if l.cfg.SteerBySource {
+		if err := attachSteering(conn, l.cfg.Count); err != nil {
+			log.Error("Ошибка установки выбора сокета по источнику", logging.Err(err))
+		}
 	}
-	// buffer := make([]byte, 1024*10)
+
+	health.Get(plName).ListenerBound(lName)
+
+	log.Info("Сервер запущен", "addr", conn.LocalAddr().String())
+
+	received := l.rec.Receiver(plName, lName)
 
 	for {
 		select {
 		case <-l.ctx.Done():
-			log.Printf("[Pipeline %s] UDP Listener завершает работу...\n", plName)
+			log.Info("UDP Listener завершает работу...")
 			return
 		default:
 			// log.Println("запуск новой итериции ")
 			err := conn.SetReadDeadline(l.nextReadDeadline())
 			if err != nil {
-				slog.Error("SetReadDeadline: " + err.Error())
+				logging.DefaultLimiter().Error(log,
+					logging.LimitKey{Pipeline: plName, Type: "read_deadline"}, "Ошибка SetReadDeadline", err)
 			}
 
 			// Получаем буфер из пула
-			buffer := bufPool.Get().([]byte)
+			buf := l.pool.Get()
 
-			n, src, err := conn.ReadFromUDP(buffer)
+			n, _, flags, src, err := conn.ReadMsgUDP(buf.Bytes(), nil)
 			if err != nil {
-				bufPool.Put(buffer)
+				buf.Release()
 				if isTimeoutError(err) {
 					continue // Просто повторяем чтение, если таймаут
 				}
-				slog.Error(fmt.Sprintf("[Pipeline %s] Ошибка чтения из UDP: %v", plName, err))
+				logging.DefaultLimiter().Error(log,
+					logging.LimitKey{Pipeline: plName, Type: "read"}, "Ошибка чтения из UDP", err)
 				continue
 			}
 			// slog.Debug(fmt.Sprintf("[Pipeline %s] Полученные данные от %v, в размере %v", plName, src, n))
-			go metrics.IncrementReceived(lName, plName, src.IP.String(), n)
+			now := time.Now()
+			received.Add(src.IP, n)
 
-			safeData := make([]byte, n)
-			copy(safeData, buffer[:n])
-			// fmt.Printf("Адрес buffer: %p\n", unsafe.Pointer(&buffer[0]))
-			// fmt.Printf("Адрес safeData: %p\n", unsafe.Pointer(&safeData[0]))
+			if flags&unix.MSG_TRUNC != 0 && !l.truncated(plName, log, src) {
+				buf.Release()
+				continue
+			}
 
-			l.processData(&safeData, src)
+			buf.SetLen(n)
+			capture.Input(plName, src, l.addr, buf.Bytes())
 
-			bufPool.Put(buffer)
+			// цели получают ссылки на буфер без копирования, ссылку слушателя освобождаем
+			l.processData(plName, buf, packet.Fragment{}, src, l.addr.IP, now, metrics.TraceReceive(plName, lName, src, n, now))
+			buf.Release()
 		}
 	}
 }
 
+// truncated учитывает датаграмму, не поместившуюся в буфер, и сообщает,
+// нужно ли переслать ее начало
+func (l *UDPListener) truncated(plName string, log *slog.Logger, src *net.UDPAddr) bool {
+	l.rec.Truncated(plName, l.cfg.Truncated)
+	logging.DefaultLimiter().Error(log,
+		logging.LimitKey{Pipeline: plName, Type: "truncated"}, "Датаграмма обрезана",
+		fmt.Errorf("датаграмма от %s больше %d байт", src, l.cfg.MaxDatagram))
+	return l.cfg.Truncated == config.TruncatedForward
+}
+
 // // processData обрабатывает полученные данные
 // func (l *UDPListener) processData(data *[]byte, src *net.UDPAddr) {
 // 	// fmt.Printf("data: %v, Len: %d\n", data, len(data))
@@ -157,20 +260,41 @@ func (l *UDPListener) Start(lName string) {
 // }
 
 // Обрабатываем полученные данные и уведомнением переполнености канала.
-func (l *UDPListener) processData(data *[]byte, src *net.UDPAddr) {
+// При переполнении канала датаграмма для этой цели отбрасывается и учитывается в метриках.
+// Пакеты, попавшие в выборку трассировки, получают span постановки в очередь каждой цели.
+// Каждая очередь получает свою ссылку на буфер. dst - адрес, на который пришла датаграмма.
+func (l *UDPListener) processData(plName string, buf *packet.Buffer, frag packet.Fragment, src *net.UDPAddr, dst net.IP, received time.Time, tr metrics.PacketTrace) {
+	from := config.AddrConfig{
+		Host: src.IP,
+		Port: uint16(src.Port),
+	}
 	d := worker.IRPData{
-		Data: *data,
-		Src: config.AddrConfig{
-			Host: src.IP,
-			Port: uint16(src.Port),
+		Data: buf.Bytes(),
+		Buf:  buf,
+		Frag: frag,
+		Src:  from,
+		Origin: packet.Origin{
+			Src: from,
+			Dst: config.AddrConfig{Host: dst, Port: uint16(l.addr.Port)},
 		},
+		Received: received,
+		Trace:    tr,
 	}
 
-	for _, ch := range l.channels {
+	for i, ch := range l.channels {
+		var start time.Time
+		if tr.Sampled() {
+			start = time.Now()
+		}
+
+		buf.Retain()
 		select {
 		case ch <- d:
-		case <-time.After(100 * time.Millisecond):
+			tr.Enqueue(plName, l.targets[i], start, false)
 		default:
+			buf.Release()
+			l.rec.Dropped(plName, l.targets[i], "queue_full")
+			tr.Enqueue(plName, l.targets[i], start, true)
 		}
 	}
 }
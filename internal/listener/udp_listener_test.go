@@ -0,0 +1,165 @@
+package listener
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/worker"
+	"udp_mirror/pkg/metrics"
+)
+
+// freePort возвращает свободный UDP порт на loopback
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return uint16(c.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestListenerDropsOnFullQueue(t *testing.T) {
+	const pl = "listener_drops"
+
+	port := freePort(t)
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), config.PlNameKey, pl))
+	defer cancel()
+
+	// у первой цели очередь на один пакет, у второй с запасом
+	chs := []chan worker.IRPData{make(chan worker.IRPData, 1), make(chan worker.IRPData, 10)}
+	l, err := NewUDPListener(ctx, config.AddrConfig{Host: net.IPv4(127, 0, 0, 1), Port: port}, chs, []string{"small", "big"}, Settings(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.Start("0")
+		close(done)
+	}()
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// сокет слушателя открывается асинхронно, шлем до первого принятого пакета
+	deadline := time.Now().Add(2 * time.Second)
+	for metrics.Stats(pl).Received == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("слушатель не принял пакет")
+		}
+		_, _ = conn.Write([]byte("probe"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	for range 3 {
+		if _, err := conn.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline = time.Now().Add(2 * time.Second)
+	for metrics.Stats(pl).Received < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("приняли %d пакетов", metrics.Stats(pl).Received)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+
+	st := metrics.Stats(pl)
+	if st.Targets["small"].Dropped != st.Received-1 {
+		t.Fatalf("small: отброшено %d из %d", st.Targets["small"].Dropped, st.Received)
+	}
+	if st.Targets["big"].Dropped != 0 {
+		t.Fatalf("big: отброшено %d", st.Targets["big"].Dropped)
+	}
+
+	d := <-chs[1]
+	if d.Received.IsZero() || !d.Src.Host.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("неверные данные в канале: %+v", d)
+	}
+}
+
+func TestListenerTruncated(t *testing.T) {
+	for _, action := range []string{config.TruncatedDrop, config.TruncatedForward} {
+		t.Run(action, func(t *testing.T) {
+			pl := "listener_truncated_" + action
+
+			port := freePort(t)
+			ctx, cancel := context.WithCancel(context.WithValue(context.Background(), config.PlNameKey, pl))
+			defer cancel()
+
+			ch := make(chan worker.IRPData, 100)
+			settings := Settings(&config.ListenerConfig{MaxDatagram: 16, Truncated: action})
+			l, err := NewUDPListener(ctx, config.AddrConfig{Host: net.IPv4(127, 0, 0, 1), Port: port}, []chan worker.IRPData{ch}, []string{"t"}, settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan struct{})
+			go func() {
+				l.Start("0")
+				close(done)
+			}()
+
+			conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			// статистика общая для повторных запусков теста
+			before := metrics.Stats(pl)
+			deadline := time.Now().Add(2 * time.Second)
+			for metrics.Stats(pl).Received == before.Received {
+				if time.Now().After(deadline) {
+					t.Fatal("слушатель не принял пакет")
+				}
+				_, _ = conn.Write([]byte("probe"))
+				time.Sleep(10 * time.Millisecond)
+			}
+			if _, err := conn.Write([]byte("0123456789abcdef-tail")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write([]byte("end")); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for {
+				select {
+				case d := <-ch:
+					got = append(got, string(d.Data))
+					d.Buf.Release()
+				case <-time.After(2 * time.Second):
+					t.Fatalf("нет последней датаграммы, приняли %q", got)
+				}
+				if got[len(got)-1] == "end" {
+					break
+				}
+			}
+			cancel()
+			<-done
+
+			want := "probe"
+			if action == config.TruncatedForward {
+				want = "0123456789abcdef"
+			}
+			if len(got) < 2 || got[len(got)-2] != want {
+				t.Errorf("приняли %q, ожидали %q перед end", got, want)
+			}
+			if st := metrics.Stats(pl); st.Truncated-before.Truncated != 1 {
+				t.Errorf("обрезано %d", st.Truncated-before.Truncated)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package listener
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/daemon"
+	"udp_mirror/internal/handoff"
+	"udp_mirror/internal/worker"
+)
+
+// instance - упрощенный экземпляр udp_mirror: слушатель и потребитель очереди
+type instance struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu   sync.Mutex
+	seqs map[uint32]bool
+}
+
+func startInstance(t *testing.T, port uint16, serve func(*UDPListener)) *instance {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), config.PlNameKey, "upgrade"))
+	ch := make(chan worker.IRPData, 1500)
+	l, err := NewUDPListener(ctx, config.AddrConfig{Host: net.IPv4(127, 0, 0, 1), Port: port}, []chan worker.IRPData{ch}, []string{"t"}, Settings(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := &instance{cancel: cancel, done: make(chan struct{}), seqs: map[uint32]bool{}}
+	// слушатель должен снять сокет с регистрации до следующего теста
+	t.Cleanup(func() {
+		cancel()
+		<-in.done
+	})
+
+	// как Pipeline.Start: слушатель останавливается по контексту, затем очередь закрывается и дочитывается
+	go func() {
+		serve(l)
+		l.Shutdown()
+	}()
+	go func() {
+		defer close(in.done)
+		for d := range ch {
+			in.mu.Lock()
+			in.seqs[binary.BigEndian.Uint32(d.Data)] = true
+			in.mu.Unlock()
+		}
+	}()
+	return in
+}
+
+func (in *instance) count() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return len(in.seqs)
+}
+
+// TestUpgradeHandoff запускает два экземпляра в одном процессе: новый получает сокет
+// старого через управляющий сокет, старый останавливается и дочитывает очередь.
+// Ни одна датаграмма не должна потеряться.
+func TestUpgradeHandoff(t *testing.T) {
+	const total = 3000
+
+	port := freePort(t)
+	old := startInstance(t, port, func(l *UDPListener) { l.Start("0") })
+
+	ctlCtx, ctlCancel := context.WithCancel(context.Background())
+	defer ctlCancel()
+	socket := t.TempDir() + "/udp_mirror.sock"
+	srv, err := daemon.Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.HandleConn(handoff.Command, func(_ context.Context, conn *net.UnixConn) error {
+		return handoff.Send(conn)
+	})
+	go srv.Serve(ctlCtx)
+
+	// неподключенный сокет: ICMP port unreachable от проб до запуска слушателя не вернется ошибкой записи
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)}
+
+	// ждем, пока старый слушатель откроет сокет
+	send := func(seq uint32) {
+		buf := make([]byte, 64)
+		binary.BigEndian.PutUint32(buf, seq)
+		if _, err := conn.WriteToUDP(buf, dst); err != nil {
+			t.Error(err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for old.count() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("старый слушатель не запустился")
+		}
+		send(0)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sent, stop := make(chan struct{}), make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		<-sent
+	})
+	go func() {
+		defer close(sent)
+		for seq := uint32(1); seq <= total; seq++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			send(seq)
+			if seq%50 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	// новый экземпляр получает сокет, пока идет трафик
+	time.Sleep(10 * time.Millisecond)
+	conns, err := handoff.Receive(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns["upgrade"]) != 1 {
+		t.Fatalf("получены сокеты %v", conns)
+	}
+	upgraded := startInstance(t, port, func(l *UDPListener) { l.Serve("0", conns["upgrade"][0]) })
+
+	// старый экземпляр завершается и дочитывает очередь
+	old.cancel()
+	<-old.done
+	ctlCancel()
+
+	<-sent
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		seen := map[uint32]bool{}
+		for _, in := range []*instance{old, upgraded} {
+			in.mu.Lock()
+			for seq := range in.seqs {
+				seen[seq] = true
+			}
+			in.mu.Unlock()
+		}
+		missing := 0
+		for seq := uint32(1); seq <= total; seq++ {
+			if !seen[seq] {
+				missing++
+			}
+		}
+		if missing == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("потеряно %d из %d датаграмм", missing, total)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if upgraded.count() == 0 {
+		t.Fatal("новый экземпляр не принял ни одной датаграммы")
+	}
+	t.Logf("старый принял %d, новый %d", old.count(), upgraded.count())
+}
@@ -6,14 +6,35 @@ import (
 	"runtime"
 	"sync"
 
+	"golang.org/x/sys/unix"
+
 	"udp_mirror/config"
 	"udp_mirror/internal/sender"
 	"udp_mirror/internal/worker"
+	"udp_mirror/pkg/logging"
 )
 
+// numCPU - число CPU для числа воркеров по умолчанию, подменяется в тестах
+var numCPU = runtime.NumCPU
+
+// DefaultWorkers возвращает число воркеров на цель по умолчанию: четверть CPU,
+// но не меньше одного, иначе на машинах с 1-3 CPU цель не получит ни одного воркера
+func DefaultWorkers(cpus int) int {
+	return max(1, cpus/4)
+}
+
+// workerSlot - воркер и его место: очередь цели и привязка к CPU
+type workerSlot struct {
+	worker *worker.Worker
+	target int  // индекс цели и ее канала
+	lock   bool // закрепить за потоком ОС
+	cpu    int  // CPU для привязки, -1 - без привязки
+}
+
 type WorkerManager struct {
 	Workers []*worker.Worker
-	count   int
+	slots   []workerSlot
+	orders  []string // порядок отправки по индексу цели
 	wg      sync.WaitGroup
 	ctx     context.Context
 	cancel  context.CancelFunc
@@ -21,24 +42,29 @@ type WorkerManager struct {
 
 type SenderFactoryFunc func(context.Context, config.TargetConfig) (sender.PacketSender, error)
 
-// NewWorkerManager создает и инициализирует WorkerManager
+// NewWorkerManager создает и инициализирует WorkerManager.
+// Число воркеров и привязка к CPU берутся из target.Workers.
 func NewWorkerManager(ctx context.Context, targets []config.TargetConfig, senderFactory SenderFactoryFunc) (*WorkerManager, error) {
 	ctx, cancel := context.WithCancel(ctx)
-	count := runtime.NumCPU() / 4
-	// count := runtime.NumCPU() / 2
-	// count := 8
+	plName, _ := ctx.Value(config.PlNameKey).(string)
+	log := logging.For("manager").With("pipeline", plName)
 
 	manager := &WorkerManager{
-		count:  count,
 		ctx:    ctx,
 		cancel: cancel,
 	}
 
-	for _, target := range targets {
-		for range count {
+	for i, target := range targets {
+		count, cpus, lock, order := workerSettings(target.Workers)
+		log.Debug("Воркеры цели", "target", target.Label(), "count", count, "cpus", cpus, "lock_os_thread", lock, "order", order)
+		manager.orders = append(manager.orders, order)
+
+		for n := range count {
 			// Создаем менеджер воркеров
 			sender, err := senderFactory(ctx, target)
 			if err != nil {
+				cancel()
+				manager.closeSenders()
 				return nil, fmt.Errorf("ошибка при создании PacketSender: %w", err)
 			}
 
@@ -46,24 +72,134 @@ func NewWorkerManager(ctx context.Context, targets []config.TargetConfig, sender
 				Target: target,
 				Sender: sender,
 			}
+			slot := workerSlot{worker: w, target: i, lock: lock, cpu: -1}
+			if len(cpus) > 0 {
+				slot.cpu = cpus[n%len(cpus)]
+			}
 			manager.Workers = append(manager.Workers, w)
+			manager.slots = append(manager.slots, slot)
 		}
 	}
 
 	return manager, nil
 }
 
+// workerSettings возвращает число воркеров, CPU для привязки, закрепление за потоком
+// и порядок отправки. Один воркер сохраняет порядок и так, ему очередь не делится.
+func workerSettings(cfg *config.WorkersConfig) (count int, cpus []int, lock bool, order string) {
+	count = DefaultWorkers(numCPU())
+	if cfg == nil {
+		return count, nil, false, config.OrderNone
+	}
+	if cfg.Count > 0 {
+		count = cfg.Count
+	}
+	lock = len(cfg.CPUs) > 0 || (cfg.LockOSThread != nil && *cfg.LockOSThread)
+	order = cfg.Order
+	if order == "" || count == 1 {
+		order = config.OrderNone
+	}
+	return count, cfg.CPUs, lock, order
+}
+
 func (wm *WorkerManager) Start(chs []chan worker.IRPData) {
-	for i, wk := range wm.Workers {
+	inputs := wm.inputs(chs)
+	for i, slot := range wm.slots {
+		wm.wg.Add(1)
+		go func(slot workerSlot, ch <-chan worker.IRPData) {
+			defer wm.wg.Done()
+			if slot.lock {
+				// поток не освобождается: при выходе горутины он завершится
+				// вместе со своей привязкой к CPU
+				runtime.LockOSThread()
+			}
+			if slot.cpu >= 0 {
+				if err := pinCPU(slot.cpu); err != nil {
+					plName, _ := wm.ctx.Value(config.PlNameKey).(string)
+					logging.For("manager").Error("Ошибка привязки воркера к CPU",
+						"pipeline", plName, "target", slot.worker.Target.Label(), "cpu", slot.cpu, logging.Err(err))
+				}
+			}
+			slot.worker.StartProcessPackets(wm.ctx, ch)
+		}(slot, inputs[i])
+	}
+}
+
+// inputs возвращает очередь каждого воркера. Без сохранения порядка воркеры цели читают
+// ее общую очередь. С сохранением у каждого воркера своя очередь того же размера,
+// и датаграммы из очереди цели раскладывает по ним dispatch.
+func (wm *WorkerManager) inputs(chs []chan worker.IRPData) []<-chan worker.IRPData {
+	inputs := make([]<-chan worker.IRPData, len(wm.slots))
+	shards := map[int][]chan worker.IRPData{}
+	for i, slot := range wm.slots {
+		if wm.orders[slot.target] == config.OrderNone {
+			inputs[i] = chs[slot.target]
+			continue
+		}
+		ch := make(chan worker.IRPData, cap(chs[slot.target]))
+		shards[slot.target] = append(shards[slot.target], ch)
+		inputs[i] = ch
+	}
+
+	for target, out := range shards {
 		wm.wg.Add(1)
-		go func(w *worker.Worker, ch <-chan worker.IRPData) {
+		go func() {
 			defer wm.wg.Done()
-			w.StartProcessPackets(wm.ctx, ch)
-		}(wk, chs[i/wm.count])
+			dispatch(chs[target], out, wm.orders[target] == config.OrderSource)
+		}()
+	}
+	return inputs
+}
+
+// dispatch раскладывает датаграммы по очередям воркеров по хешу источника, так что
+// датаграммы одного источника отправляет один воркер в порядке приема.
+// Очереди воркеров закрываются, когда закрыта очередь цели.
+func dispatch(in <-chan worker.IRPData, out []chan worker.IRPData, withPort bool) {
+	defer func() {
+		for _, ch := range out {
+			close(ch)
+		}
+	}()
+
+	n := uint32(len(out))
+	for d := range in {
+		// ожидание занятого воркера задерживает очередь цели, при ее переполнении
+		// слушатель отбрасывает датаграммы, как и без сохранения порядка
+		out[sourceHash(d.Src, withPort)%n] <- d
 	}
 }
 
+// sourceHash - FNV-1a адреса и, если withPort, порта источника
+func sourceHash(src config.AddrConfig, withPort bool) uint32 {
+	const prime = 16777619
+	h := uint32(2166136261)
+	for _, b := range src.Host.To16() {
+		h = (h ^ uint32(b)) * prime
+	}
+	if withPort {
+		h = (h ^ uint32(src.Port>>8)) * prime
+		h = (h ^ uint32(src.Port&0xff)) * prime
+	}
+	return h
+}
+
+// pinCPU привязывает текущий поток к одному CPU
+func pinCPU(cpu int) error {
+	var set unix.CPUSet
+	set.Set(cpu)
+	return unix.SchedSetaffinity(0, &set)
+}
+
 func (wm *WorkerManager) Shutdown() {
 	wm.cancel()
 	wm.wg.Wait()
+
+	// воркеры завершены, закрываем отправителей (буферизующие цели дописывают накопленное)
+	wm.closeSenders()
+}
+
+func (wm *WorkerManager) closeSenders() {
+	for _, w := range wm.Workers {
+		w.Sender.Close()
+	}
 }
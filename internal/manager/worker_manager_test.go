@@ -0,0 +1,267 @@
+package manager
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/sender"
+	"udp_mirror/internal/worker"
+)
+
+// fakeSender считает пакеты и запоминает привязку потока к CPU при отправке
+type fakeSender struct {
+	mu      sync.Mutex
+	packets int
+	cpus    []int
+	closed  bool
+}
+
+func (s *fakeSender) SendPacket([]byte, config.AddrConfig) {
+	var set unix.CPUSet
+	_ = unix.SchedGetaffinity(0, &set)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packets++
+	s.cpus = s.cpus[:0]
+	for cpu := 0; cpu < 1024 && len(s.cpus) < set.Count(); cpu++ {
+		if set.IsSet(cpu) {
+			s.cpus = append(s.cpus, cpu)
+		}
+	}
+}
+
+func (s *fakeSender) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+func withNumCPU(t *testing.T, n int) {
+	t.Helper()
+	prev := numCPU
+	numCPU = func() int { return n }
+	t.Cleanup(func() { numCPU = prev })
+}
+
+func TestDefaultWorkers(t *testing.T) {
+	for _, c := range []struct{ cpus, want int }{
+		{1, 1}, {2, 1}, {3, 1}, {4, 1}, {8, 2}, {64, 16},
+	} {
+		if got := DefaultWorkers(c.cpus); got != c.want {
+			t.Errorf("NumCPU=%d: %d воркеров, ожидали %d", c.cpus, got, c.want)
+		}
+	}
+}
+
+// startManager запускает воркеры целей с подставными отправителями
+func startManager(t *testing.T, targets []config.TargetConfig) (*WorkerManager, []chan worker.IRPData, *[]*fakeSender) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var senders []*fakeSender
+	factory := func(context.Context, config.TargetConfig) (sender.PacketSender, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		s := &fakeSender{}
+		senders = append(senders, s)
+		return s, nil
+	}
+
+	wm, err := NewWorkerManager(context.Background(), targets, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chs := make([]chan worker.IRPData, len(targets))
+	for i := range chs {
+		chs[i] = make(chan worker.IRPData, 100)
+	}
+	wm.Start(chs)
+	return wm, chs, &senders
+}
+
+func TestWorkersSmallNumCPU(t *testing.T) {
+	for _, cpus := range []int{1, 2, 3} {
+		withNumCPU(t, cpus)
+
+		cfg := config.Config{
+			Workers: &config.WorkersConfig{Count: 2},
+			Pipeline: []config.Pipeline{{Targets: []config.TargetConfig{
+				{Host: "10.0.0.1", Port: 1},
+				{Host: "10.0.0.2", Port: 2, Workers: &config.WorkersConfig{Count: 3}},
+			}}},
+		}
+		targets := []config.TargetConfig{
+			{Host: "10.0.0.3", Port: 3}, // без настроек: значение по умолчанию
+		}
+		for _, tc := range cfg.Pipeline[0].Targets {
+			tc.Workers = config.MergeWorkers(cfg.Workers, cfg.Pipeline[0].Workers, tc.Workers)
+			targets = append(targets, tc)
+		}
+
+		wm, chs, senders := startManager(t, targets)
+		if len(wm.Workers) != 1+2+3 {
+			t.Fatalf("NumCPU=%d: %d воркеров, ожидали 6", cpus, len(wm.Workers))
+		}
+
+		const perTarget = 50
+		for _, ch := range chs {
+			for range perTarget {
+				ch <- worker.IRPData{Data: []byte{1}}
+			}
+			close(ch)
+		}
+		wm.Shutdown()
+
+		// воркеры каждой цели вместе отправили все ее пакеты
+		sent := map[int]int{}
+		for i, s := range *senders {
+			if !s.closed {
+				t.Errorf("отправитель %d не закрыт", i)
+			}
+			sent[wm.slots[i].target] += s.packets
+		}
+		for i := range chs {
+			if sent[i] != perTarget {
+				t.Errorf("NumCPU=%d: цель %d отправила %d из %d", cpus, i, sent[i], perTarget)
+			}
+		}
+	}
+}
+
+func TestPinCPU(t *testing.T) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil || !set.IsSet(0) {
+		t.Skip("CPU 0 недоступен процессу")
+	}
+
+	lock := true
+	targets := []config.TargetConfig{{
+		Host:    "10.0.0.1",
+		Port:    1,
+		Workers: &config.WorkersConfig{Count: 2, CPUs: []int{0}, LockOSThread: &lock},
+	}}
+	wm, chs, senders := startManager(t, targets)
+	for range 10 {
+		chs[0] <- worker.IRPData{Data: []byte{1}}
+	}
+	close(chs[0])
+	wm.Shutdown()
+
+	for _, s := range *senders {
+		if s.packets > 0 && (len(s.cpus) != 1 || s.cpus[0] != 0) {
+			t.Errorf("воркер работал на CPU %v, ожидали [0]", s.cpus)
+		}
+	}
+}
+
+// sendLog - общий журнал отправок всех воркеров в порядке отправки
+type sendLog struct {
+	mu      sync.Mutex
+	entries []sent
+}
+
+type sent struct {
+	sender int
+	src    string
+	seq    uint32
+}
+
+// orderSender пишет отправки в общий журнал со случайной задержкой, чтобы воркеры обгоняли друг друга
+type orderSender struct {
+	id  int
+	log *sendLog
+}
+
+func (s *orderSender) SendPacket(data []byte, src config.AddrConfig) {
+	time.Sleep(time.Duration(rand.IntN(20)) * time.Microsecond)
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+	s.log.entries = append(s.log.entries, sent{s.id, fmt.Sprintf("%s:%d", src.Host, src.Port), binary.BigEndian.Uint32(data)})
+}
+
+func (s *orderSender) Close() {}
+
+func runOrdered(t *testing.T, order string, sources func(i int) config.AddrConfig) *sendLog {
+	t.Helper()
+
+	log := &sendLog{}
+	var ids atomic.Int32
+	factory := func(context.Context, config.TargetConfig) (sender.PacketSender, error) {
+		return &orderSender{id: int(ids.Add(1)), log: log}, nil
+	}
+	targets := []config.TargetConfig{{Host: "10.0.0.1", Port: 1, Workers: &config.WorkersConfig{Count: 4, Order: order}}}
+	wm, err := NewWorkerManager(context.Background(), targets, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan worker.IRPData, 16)
+	wm.Start([]chan worker.IRPData{ch})
+
+	const perSource = 300
+	for seq := range perSource {
+		for i := range 16 {
+			data := make([]byte, 4)
+			binary.BigEndian.PutUint32(data, uint32(seq))
+			ch <- worker.IRPData{Data: data, Src: sources(i)}
+		}
+	}
+	close(ch)
+	wm.Shutdown()
+
+	if len(log.entries) != 16*perSource {
+		t.Fatalf("отправлено %d из %d", len(log.entries), 16*perSource)
+	}
+	return log
+}
+
+func TestOrderBySource(t *testing.T) {
+	log := runOrdered(t, config.OrderSource, func(i int) config.AddrConfig {
+		// один IP с разных портов - разные источники
+		return config.AddrConfig{Host: net.IPv4(10, 1, 0, byte(i/2)), Port: uint16(2000 + i%2)}
+	})
+
+	next := map[string]uint32{}
+	senders := map[string]int{}
+	used := map[int]bool{}
+	for _, e := range log.entries {
+		if e.seq != next[e.src] {
+			t.Fatalf("%s: отправлен %d, ожидали %d", e.src, e.seq, next[e.src])
+		}
+		next[e.src]++
+		if id, ok := senders[e.src]; ok && id != e.sender {
+			t.Fatalf("%s: отправляли воркеры %d и %d", e.src, id, e.sender)
+		}
+		senders[e.src] = e.sender
+		used[e.sender] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("работал только воркер %v", used)
+	}
+}
+
+func TestOrderBySourceIP(t *testing.T) {
+	log := runOrdered(t, config.OrderSourceIP, func(i int) config.AddrConfig {
+		return config.AddrConfig{Host: net.IPv4(10, 1, 0, byte(i/4)), Port: uint16(2000 + i%4)}
+	})
+
+	// все порты одного IP отправляет один воркер
+	senders := map[string]int{}
+	for _, e := range log.entries {
+		ip, _, _ := net.SplitHostPort(e.src)
+		if id, ok := senders[ip]; ok && id != e.sender {
+			t.Fatalf("%s: отправляли воркеры %d и %d", ip, id, e.sender)
+		}
+		senders[ip] = e.sender
+	}
+}
@@ -0,0 +1,139 @@
+// Package otlp экспортирует метрики и трассы udp_mirror по OTLP/HTTP.
+package otlp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"udp_mirror/config"
+	"udp_mirror/pkg/logging"
+	"udp_mirror/pkg/metrics"
+)
+
+const (
+	defaultServiceName = "udp_mirror"
+	defaultInterval    = 10 * time.Second
+)
+
+// Exporter отправляет метрики и трассы в OTLP коллектор
+type Exporter struct {
+	meters *sdkmetric.MeterProvider
+	traces *sdktrace.TracerProvider // nil, если трассировка выключена
+
+	tracing bool // трассировка подключена к metrics
+}
+
+// Start создает экспортер, подключает его к metrics.Default() и включает
+// выборочную трассировку пакетов, если задан trace_sample_ratio
+func Start(ctx context.Context, cfg config.OTLPConfig) (*Exporter, error) {
+	e, err := New(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	rec, err := NewRecorder(e.meters)
+	if err != nil {
+		_ = e.Shutdown(ctx)
+		return nil, err
+	}
+	metrics.AddRecorder(rec)
+
+	if e.traces != nil {
+		metrics.SetTracing(e.traces, cfg.TraceSampleRatio)
+		e.tracing = true
+	}
+
+	logging.For("otlp").Info("OTLP экспорт запущен", "endpoint", cfg.Endpoint)
+	return e, nil
+}
+
+// New создает провайдеры метрик и трасс без подключения к metrics
+func New(ctx context.Context, cfg config.OTLPConfig) (*Exporter, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("неверный otlp.endpoint %q", cfg.Endpoint)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("otlp.endpoint: неподдерживаемая схема %q", u.Scheme)
+	}
+	base := strings.TrimSuffix(u.Path, "/")
+
+	name := cfg.ServiceName
+	if name == "" {
+		name = defaultServiceName
+	}
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	res := resource.NewSchemaless(attribute.String("service.name", name))
+
+	metricOpts := []otlpmetrichttp.Option{
+		otlpmetrichttp.WithEndpoint(u.Host),
+		otlpmetrichttp.WithURLPath(base + "/v1/metrics"),
+		otlpmetrichttp.WithHeaders(cfg.Headers),
+	}
+	if u.Scheme == "http" {
+		metricOpts = append(metricOpts, otlpmetrichttp.WithInsecure())
+	}
+	metricExp, err := otlpmetrichttp.New(ctx, metricOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Exporter{
+		meters: sdkmetric.NewMeterProvider(
+			sdkmetric.WithResource(res),
+			sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExp, sdkmetric.WithInterval(interval))),
+		),
+	}
+
+	if cfg.TraceSampleRatio > 0 {
+		traceOpts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(u.Host),
+			otlptracehttp.WithURLPath(base + "/v1/traces"),
+			otlptracehttp.WithHeaders(cfg.Headers),
+		}
+		if u.Scheme == "http" {
+			traceOpts = append(traceOpts, otlptracehttp.WithInsecure())
+		}
+		traceExp, err := otlptracehttp.New(ctx, traceOpts...)
+		if err != nil {
+			_ = e.meters.Shutdown(ctx)
+			return nil, err
+		}
+
+		// решение о выборке принимает metrics.TraceReceive, здесь пишем все
+		e.traces = sdktrace.NewTracerProvider(
+			sdktrace.WithResource(res),
+			sdktrace.WithSampler(sdktrace.AlwaysSample()),
+			sdktrace.WithBatcher(traceExp),
+		)
+	}
+
+	return e, nil
+}
+
+// Shutdown отправляет накопленное и останавливает экспорт
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	var errs []error
+	if e.tracing {
+		metrics.SetTracing(nil, 0)
+	}
+	if e.traces != nil {
+		errs = append(errs, e.traces.Shutdown(ctx))
+	}
+	errs = append(errs, e.meters.Shutdown(ctx))
+	return errors.Join(errs...)
+}
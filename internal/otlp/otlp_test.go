@@ -0,0 +1,211 @@
+package otlp_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	collmetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	colltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/otlp"
+	"udp_mirror/pkg/metrics"
+)
+
+// receiver - OTLP/HTTP коллектор в процессе теста
+type receiver struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	metrics []*metricspb.ResourceMetrics
+	spans   []*tracepb.Span
+}
+
+func newReceiver(t *testing.T) *receiver {
+	t.Helper()
+
+	rcv := &receiver{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/otlp/v1/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var req collmetrics.ExportMetricsServiceRequest
+		if !rcv.decode(t, w, r, &req) {
+			return
+		}
+		rcv.mu.Lock()
+		rcv.metrics = append(rcv.metrics, req.GetResourceMetrics()...)
+		rcv.mu.Unlock()
+		rcv.reply(w, &collmetrics.ExportMetricsServiceResponse{})
+	})
+	mux.HandleFunc("/otlp/v1/traces", func(w http.ResponseWriter, r *http.Request) {
+		var req colltrace.ExportTraceServiceRequest
+		if !rcv.decode(t, w, r, &req) {
+			return
+		}
+		rcv.mu.Lock()
+		for _, rs := range req.GetResourceSpans() {
+			for _, ss := range rs.GetScopeSpans() {
+				rcv.spans = append(rcv.spans, ss.GetSpans()...)
+			}
+		}
+		rcv.mu.Unlock()
+		rcv.reply(w, &colltrace.ExportTraceServiceResponse{})
+	})
+
+	rcv.Server = httptest.NewServer(mux)
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *receiver) decode(t *testing.T, w http.ResponseWriter, r *http.Request, m proto.Message) bool {
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = proto.Unmarshal(body, m)
+	}
+	if err != nil {
+		t.Error(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (rcv *receiver) reply(w http.ResponseWriter, m proto.Message) {
+	b, _ := proto.Marshal(m)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(b)
+}
+
+// sum возвращает последнее значение счетчика с заданными атрибутами
+func (rcv *receiver) sum(name string, attrs map[string]string) (int64, bool) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	var (
+		val   int64
+		found bool
+	)
+	for _, rm := range rcv.metrics {
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				if m.GetName() != name {
+					continue
+				}
+				for _, dp := range m.GetSum().GetDataPoints() {
+					if hasAttrs(dp.GetAttributes(), attrs) {
+						val, found = dp.GetAsInt(), true
+					}
+				}
+			}
+		}
+	}
+	return val, found
+}
+
+func hasAttrs(kvs []*commonpb.KeyValue, want map[string]string) bool {
+	got := map[string]string{}
+	for _, kv := range kvs {
+		got[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	for k, v := range want {
+		if got[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestExportMetricsAndTraces(t *testing.T) {
+	rcv := newReceiver(t)
+
+	ctx := context.Background()
+	exp, err := otlp.Start(ctx, config.OTLPConfig{
+		Enabled:          true,
+		Endpoint:         rcv.URL + "/otlp",
+		Interval:         time.Hour, // отправка только при Shutdown
+		TraceSampleRatio: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// путь пакета: прием, постановка в очередь цели, передача цели
+	const pl, target = "otlp_test", "127.0.0.1:9999"
+	rec := metrics.Default()
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 514}
+
+	received := time.Now()
+	rec.Receiver(pl, "0").Add(src.IP, 100)
+	tr := metrics.TraceReceive(pl, "0", src, 100, received)
+	if !tr.Sampled() {
+		t.Fatal("при trace_sample_ratio: 1 пакет должен попасть в выборку")
+	}
+	tr.Enqueue(pl, target, time.Now(), false)
+	tr.Send(pl, target, time.Now())
+	rec.Sent(pl, target, 100)
+	rec.Sent(pl, target, 50)
+	rec.Dropped(pl, target, "queue_full")
+	rec.Latency(pl, target, time.Millisecond)
+
+	if err := exp.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.TraceReceive(pl, "0", src, 1, time.Now()).Sampled() {
+		t.Fatal("трассировка не выключена после Shutdown")
+	}
+
+	checks := []struct {
+		name  string
+		attrs map[string]string
+		want  int64
+	}{
+		{"received_packets_total", map[string]string{"pipeline_name": pl, "lisneter_number": "0"}, 1},
+		{"sent_packets_total", map[string]string{"pipeline_name": pl, "recipient": target}, 2},
+		{"sent_bytes_total", map[string]string{"pipeline_name": pl, "recipient": target}, 150},
+		{"dropped_packets_total", map[string]string{"pipeline_name": pl, "recipient": target, "reason": "queue_full"}, 1},
+	}
+	for _, c := range checks {
+		got, ok := rcv.sum(c.name, c.attrs)
+		if !ok || got != c.want {
+			t.Errorf("%s%v = %d (найдено %v), ожидали %d", c.name, c.attrs, got, ok, c.want)
+		}
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	byName := map[string]*tracepb.Span{}
+	for _, s := range rcv.spans {
+		byName[s.GetName()] = s
+	}
+	root := byName["receive"]
+	if root == nil || byName["enqueue"] == nil || byName["send"] == nil {
+		t.Fatalf("получены spans %v", byName)
+	}
+	for _, name := range []string{"enqueue", "send"} {
+		s := byName[name]
+		if string(s.GetParentSpanId()) != string(root.GetSpanId()) || string(s.GetTraceId()) != string(root.GetTraceId()) {
+			t.Errorf("span %s не дочерний для receive", name)
+		}
+		if !hasAttrs(s.GetAttributes(), map[string]string{"pipeline": pl, "target": target}) {
+			t.Errorf("span %s: атрибуты %v", name, s.GetAttributes())
+		}
+	}
+}
+
+func TestInvalidEndpoint(t *testing.T) {
+	for _, ep := range []string{"", "localhost:4318", "grpc://localhost:4317"} {
+		if _, err := otlp.New(context.Background(), config.OTLPConfig{Endpoint: ep}); err == nil {
+			t.Errorf("endpoint %q принят", ep)
+		}
+	}
+}
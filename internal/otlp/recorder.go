@@ -0,0 +1,194 @@
+package otlp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"udp_mirror/pkg/metrics"
+)
+
+// Recorder передает события pipeline в инструменты OpenTelemetry.
+// Имена метрик совпадают с метриками Prometheus.
+type Recorder struct {
+	receivedPackets metric.Int64Counter
+	receivedBytes   metric.Int64Counter
+	sentPackets     metric.Int64Counter
+	sentBytes       metric.Int64Counter
+	deliveryErrors  metric.Int64Counter
+	dropped         metric.Int64Counter
+	truncated       metric.Int64Counter
+	fragments       metric.Int64Counter
+	queueLength     metric.Int64Gauge
+	queueCapacity   metric.Int64Gauge
+	workers         metric.Int64UpDownCounter
+	latency         metric.Float64Histogram
+	httpBatch       metric.Int64Histogram
+	httpDuration    metric.Float64Histogram
+	httpResponses   metric.Int64Counter
+
+	// наборы атрибутов создаются один раз на сочетание меток
+	mu    sync.RWMutex
+	attrs map[attrKey]metric.MeasurementOption
+}
+
+type attrKey struct {
+	pipeline, recipient, extraKey, extra string
+}
+
+var _ metrics.Recorder = (*Recorder)(nil)
+
+// NewRecorder создает инструменты в провайдере метрик
+func NewRecorder(mp metric.MeterProvider) (*Recorder, error) {
+	m := mp.Meter("udp_mirror")
+	r := &Recorder{attrs: map[attrKey]metric.MeasurementOption{}}
+
+	var errs [15]error
+	r.receivedPackets, errs[0] = m.Int64Counter("received_packets_total",
+		metric.WithDescription("Total number of received packets"))
+	r.receivedBytes, errs[1] = m.Int64Counter("received_bytes_total",
+		metric.WithDescription("Total number of received bytes"), metric.WithUnit("By"))
+	r.sentPackets, errs[2] = m.Int64Counter("sent_packets_total",
+		metric.WithDescription("Total number of sent packets"))
+	r.sentBytes, errs[3] = m.Int64Counter("sent_bytes_total",
+		metric.WithDescription("Total number of sent bytes"), metric.WithUnit("By"))
+	r.deliveryErrors, errs[4] = m.Int64Counter("delivery_errors_total",
+		metric.WithDescription("Total number of datagrams that failed to be delivered to a target"))
+	r.dropped, errs[5] = m.Int64Counter("dropped_packets_total",
+		metric.WithDescription("Total number of datagrams dropped before reaching a target worker"))
+	r.fragments, errs[6] = m.Int64Counter("sent_fragments_total",
+		metric.WithDescription("Total number of IP fragments sent"))
+	r.queueLength, errs[7] = m.Int64Gauge("queue_length",
+		metric.WithDescription("Number of datagrams waiting in a target queue"))
+	r.queueCapacity, errs[8] = m.Int64Gauge("queue_capacity",
+		metric.WithDescription("Capacity of a target queue"))
+	r.workers, errs[9] = m.Int64UpDownCounter("workers",
+		metric.WithDescription("Number of running workers per target"))
+	r.latency, errs[10] = m.Float64Histogram("mirror_latency_seconds",
+		metric.WithDescription("Time from receiving a datagram to handing it to the target"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(exponentialBuckets(0.00001, 4, 10)...))
+	r.httpBatch, errs[11] = m.Int64Histogram("http_batch_records",
+		metric.WithDescription("Number of datagrams per HTTP batch"),
+		metric.WithExplicitBucketBoundaries(exponentialBuckets(1, 4, 8)...))
+	r.httpDuration, errs[12] = m.Float64Histogram("http_request_duration_seconds",
+		metric.WithDescription("Latency of HTTP batch requests"), metric.WithUnit("s"))
+	r.httpResponses, errs[13] = m.Int64Counter("http_responses_total",
+		metric.WithDescription("Total number of HTTP batch responses by status code"))
+	r.truncated, errs[14] = m.Int64Counter("truncated_packets_total",
+		metric.WithDescription("Total number of datagrams larger than the listener buffer"))
+
+	if err := errors.Join(errs[:]...); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// exponentialBuckets - границы как у prometheus.ExponentialBuckets
+func exponentialBuckets(start, factor float64, count int) []float64 {
+	b := make([]float64, count)
+	for i := range b {
+		b[i] = start
+		start *= factor
+	}
+	return b
+}
+
+// attributes возвращает набор атрибутов для сочетания меток
+func (r *Recorder) attributes(key attrKey) metric.MeasurementOption {
+	r.mu.RLock()
+	opt, ok := r.attrs[key]
+	r.mu.RUnlock()
+	if ok {
+		return opt
+	}
+
+	kv := []attribute.KeyValue{attribute.String("pipeline_name", key.pipeline)}
+	if key.recipient != "" {
+		kv = append(kv, attribute.String("recipient", key.recipient))
+	}
+	if key.extraKey != "" {
+		kv = append(kv, attribute.String(key.extraKey, key.extra))
+	}
+	opt = metric.WithAttributeSet(attribute.NewSet(kv...))
+
+	r.mu.Lock()
+	r.attrs[key] = opt
+	r.mu.Unlock()
+	return opt
+}
+
+func (r *Recorder) target(plName, recipient string) metric.MeasurementOption {
+	return r.attributes(attrKey{pipeline: plName, recipient: recipient})
+}
+
+type receiver struct {
+	r   *Recorder
+	opt metric.MeasurementOption
+}
+
+func (r *Recorder) Receiver(plName, listener string) metrics.PacketCounter {
+	return receiver{r: r, opt: r.attributes(attrKey{pipeline: plName, extraKey: "lisneter_number", extra: listener})}
+}
+
+func (rc receiver) Add(_ net.IP, bytes int) {
+	ctx := context.Background()
+	rc.r.receivedPackets.Add(ctx, 1, rc.opt)
+	rc.r.receivedBytes.Add(ctx, int64(bytes), rc.opt)
+}
+
+func (r *Recorder) Sent(plName, recipient string, bytes int) {
+	ctx := context.Background()
+	opt := r.target(plName, recipient)
+	r.sentPackets.Add(ctx, 1, opt)
+	r.sentBytes.Add(ctx, int64(bytes), opt)
+}
+
+func (r *Recorder) DeliveryErrors(plName, recipient, reason string, n int) {
+	opt := r.attributes(attrKey{plName, recipient, "reason", reason})
+	r.deliveryErrors.Add(context.Background(), int64(n), opt)
+}
+
+func (r *Recorder) Dropped(plName, recipient, reason string) {
+	opt := r.attributes(attrKey{plName, recipient, "reason", reason})
+	r.dropped.Add(context.Background(), 1, opt)
+}
+
+func (r *Recorder) Truncated(plName, action string) {
+	opt := r.attributes(attrKey{pipeline: plName, extraKey: "action", extra: action})
+	r.truncated.Add(context.Background(), 1, opt)
+}
+
+func (r *Recorder) Fragments(plName, recipient string, n int) {
+	r.fragments.Add(context.Background(), int64(n), r.target(plName, recipient))
+}
+
+func (r *Recorder) QueueDepth(plName, recipient string, length, capacity int) {
+	ctx := context.Background()
+	opt := r.target(plName, recipient)
+	r.queueLength.Record(ctx, int64(length), opt)
+	r.queueCapacity.Record(ctx, int64(capacity), opt)
+}
+
+func (r *Recorder) Workers(plName, recipient string, delta int) {
+	r.workers.Add(context.Background(), int64(delta), r.target(plName, recipient))
+}
+
+func (r *Recorder) Latency(plName, recipient string, d time.Duration) {
+	r.latency.Record(context.Background(), d.Seconds(), r.target(plName, recipient))
+}
+
+func (r *Recorder) HTTPBatch(plName, recipient string, records int) {
+	r.httpBatch.Record(context.Background(), int64(records), r.target(plName, recipient))
+}
+
+func (r *Recorder) HTTPResponse(plName, recipient, code string, d time.Duration) {
+	ctx := context.Background()
+	r.httpDuration.Record(ctx, d.Seconds(), r.target(plName, recipient))
+	r.httpResponses.Add(ctx, 1, r.attributes(attrKey{plName, recipient, "code", code}))
+}
@@ -0,0 +1,113 @@
+// Package packet - буферы датаграмм из пула, общие для всех целей pipeline.
+//
+// Слушатель читает датаграмму в буфер пула и ставит в очереди целей ссылки на него,
+// без копирования. Буфер возвращается в пул, когда его освободила последняя цель.
+package packet
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"udp_mirror/config"
+)
+
+// Headroom - место перед данными под заголовки IPv4 (без опций) и UDP.
+// Отправитель, единственный владелец буфера, пишет заголовки прямо перед данными.
+const Headroom = 20 + 8
+
+// Pool выдает буферы под датаграммы до size байт
+type Pool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewPool создает пул буферов под датаграммы до size байт
+func NewPool(size int) *Pool {
+	p := &Pool{size: size}
+	p.pool.New = func() any {
+		return &Buffer{buf: make([]byte, Headroom+size), pool: p}
+	}
+	return p
+}
+
+// Get возвращает буфер с одной ссылкой и данными наибольшей длины
+func (p *Pool) Get() *Buffer {
+	b := p.pool.Get().(*Buffer)
+	b.start, b.n = Headroom, p.size
+	b.refs.Store(1)
+	return b
+}
+
+// Buffer - датаграмма с местом под заголовки и счетчиком ссылок.
+// Данные не изменяются, пока на буфер есть больше одной ссылки.
+type Buffer struct {
+	buf   []byte
+	start int // начало данных, перед ним место под заголовки
+	n     int
+	refs  atomic.Int32
+	pool  *Pool
+}
+
+// Bytes возвращает данные датаграммы
+func (b *Buffer) Bytes() []byte {
+	return b.buf[b.start : b.start+b.n]
+}
+
+// Slice сужает данные до Bytes()[from:to], например до данных UDP принятого IP пакета.
+// Отрезанное начало становится местом под заголовки.
+func (b *Buffer) Slice(from, to int) {
+	b.start += from
+	b.n = to - from
+}
+
+// SetLen задает длину данных, например после чтения в Bytes
+func (b *Buffer) SetLen(n int) {
+	b.n = n
+}
+
+// Frame возвращает данные вместе с hdr байтами места под заголовки перед ними.
+// Писать в место под заголовки можно, только если буфер Exclusive.
+func (b *Buffer) Frame(hdr int) []byte {
+	return b.buf[b.start-hdr : b.start+b.n]
+}
+
+// Fragment описывает IP фрагмент, принятый без сборки датаграммы. Нулевое значение -
+// целая датаграмма. Данные фрагмента с нулевым смещением начинаются с заголовка UDP.
+type Fragment struct {
+	ID     uint16 // IP ID исходной датаграммы
+	Offset int    // смещение данных фрагмента в датаграмме UDP, байт
+	More   bool   // за фрагментом следуют другие
+}
+
+// Origin - адреса датаграммы, как она принята: источник до подмены src_host и src_port
+// цели и адрес входа. Нулевое значение - адреса неизвестны, например при воспроизведении.
+type Origin struct {
+	Src config.AddrConfig
+	Dst config.AddrConfig // адрес входа; host 0.0.0.0, если вход слушает все адреса
+}
+
+// IsFragment сообщает, что данные - часть датаграммы
+func (f Fragment) IsFragment() bool {
+	return f.More || f.Offset > 0
+}
+
+// Exclusive сообщает, что других ссылок на буфер нет
+func (b *Buffer) Exclusive() bool {
+	return b.refs.Load() == 1
+}
+
+// Retain добавляет ссылку, например перед постановкой буфера в очередь цели
+func (b *Buffer) Retain() {
+	b.refs.Add(1)
+}
+
+// Release освобождает ссылку; с последней буфер возвращается в пул.
+// После Release буфер использовать нельзя.
+func (b *Buffer) Release() {
+	switch refs := b.refs.Add(-1); {
+	case refs == 0:
+		b.pool.pool.Put(b)
+	case refs < 0:
+		panic("packet: Release освобожденного буфера")
+	}
+}
@@ -0,0 +1,54 @@
+package packet
+
+import "testing"
+
+func TestBufferRefs(t *testing.T) {
+	p := NewPool(100)
+	b := p.Get()
+	if len(b.Bytes()) != 100 || !b.Exclusive() {
+		t.Fatalf("новый буфер: %d байт, exclusive %v", len(b.Bytes()), b.Exclusive())
+	}
+	b.SetLen(copy(b.Bytes(), "data"))
+	if f := b.Frame(Headroom); len(f) != Headroom+4 || string(f[Headroom:]) != "data" {
+		t.Fatalf("кадр %q", f)
+	}
+
+	b.Retain()
+	b.Retain()
+	b.Release()
+	if b.Exclusive() {
+		t.Fatal("буфер с двумя ссылками exclusive")
+	}
+	b.Release()
+	if !b.Exclusive() {
+		t.Fatal("последняя ссылка не exclusive")
+	}
+	b.Release()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("лишний Release не обнаружен")
+		}
+	}()
+	b.Release()
+}
+
+func TestBufferSlice(t *testing.T) {
+	p := NewPool(64)
+	b := p.Get()
+	b.SetLen(copy(b.Bytes(), "head-data-tail"))
+	b.Slice(5, 9)
+	if string(b.Bytes()) != "data" {
+		t.Fatalf("данные %q", b.Bytes())
+	}
+	// отрезанное начало - место под заголовки
+	if f := b.Frame(Headroom + 5); string(f[Headroom:]) != "head-data" {
+		t.Fatalf("кадр %q", f)
+	}
+	b.Release()
+
+	if b = p.Get(); len(b.Bytes()) != 64 || len(b.Frame(Headroom)) != Headroom+64 {
+		t.Fatalf("буфер из пула не сброшен: %d байт", len(b.Bytes()))
+	}
+	b.Release()
+}
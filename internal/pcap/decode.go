@@ -0,0 +1,124 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Типы канального уровня, которые умеет разбирать DecodeUDP
+const (
+	LinkTypeNull     uint16 = 0
+	LinkTypeEthernet uint16 = 1
+	LinkTypeRawAlt   uint16 = 12 // DLT_RAW на некоторых BSD
+	LinkTypeLinuxSLL uint16 = 113
+	LinkTypeLoop     uint16 = 108
+	LinkTypeIPv4     uint16 = 228
+
+	LinkTypeLinuxSLL2 uint16 = 276
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88A8
+)
+
+// Datagram - UDP датаграмма, извлеченная из кадра
+type Datagram struct {
+	Src     net.IP
+	SrcPort uint16
+	Dst     net.IP
+	DstPort uint16
+	Payload []byte
+}
+
+// DecodeUDP извлекает IPv4/UDP датаграмму из кадра.
+// Возвращает false для остальных протоколов, фрагментов и обрезанных кадров.
+func DecodeUDP(linkType uint16, frame []byte) (Datagram, bool) {
+	ip, ok := networkLayer(linkType, frame)
+	if !ok {
+		return Datagram{}, false
+	}
+
+	if len(ip) < IPv4HeaderLen || ip[0]>>4 != 4 {
+		return Datagram{}, false
+	}
+	ihl := int(ip[0]&0x0F) * 4
+	totalLen := int(binary.BigEndian.Uint16(ip[2:]))
+	if ihl < IPv4HeaderLen || totalLen < ihl || totalLen > len(ip) {
+		return Datagram{}, false
+	}
+	if ip[9] != 17 {
+		return Datagram{}, false
+	}
+
+	// фрагменты не собираем: MF или ненулевое смещение
+	flagsOff := binary.BigEndian.Uint16(ip[6:])
+	if flagsOff&0x2000 != 0 || flagsOff&0x1FFF != 0 {
+		return Datagram{}, false
+	}
+
+	udp := ip[ihl:totalLen]
+	if len(udp) < UDPHeaderLen {
+		return Datagram{}, false
+	}
+	udpLen := int(binary.BigEndian.Uint16(udp[4:]))
+	if udpLen < UDPHeaderLen || udpLen > len(udp) {
+		return Datagram{}, false
+	}
+
+	return Datagram{
+		Src:     net.IP(ip[12:16]),
+		SrcPort: binary.BigEndian.Uint16(udp[0:]),
+		Dst:     net.IP(ip[16:20]),
+		DstPort: binary.BigEndian.Uint16(udp[2:]),
+		Payload: udp[UDPHeaderLen:udpLen],
+	}, true
+}
+
+// networkLayer снимает канальный заголовок и возвращает IPv4 пакет
+func networkLayer(linkType uint16, frame []byte) ([]byte, bool) {
+	switch linkType {
+	case LinkTypeRaw, LinkTypeRawAlt, LinkTypeIPv4:
+		return frame, true
+
+	case LinkTypeNull, LinkTypeLoop:
+		// 4 байта семейства адресов в порядке байт записавшей машины
+		if len(frame) < 4 {
+			return nil, false
+		}
+		if binary.LittleEndian.Uint32(frame) != 2 && binary.BigEndian.Uint32(frame) != 2 {
+			return nil, false
+		}
+		return frame[4:], true
+
+	case LinkTypeEthernet:
+		if len(frame) < 14 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(frame[12:])
+		frame = frame[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+			if len(frame) < 4 {
+				return nil, false
+			}
+			etherType = binary.BigEndian.Uint16(frame[2:])
+			frame = frame[4:]
+		}
+		return frame, etherType == etherTypeIPv4
+
+	case LinkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil, false
+		}
+		return frame[16:], binary.BigEndian.Uint16(frame[14:]) == etherTypeIPv4
+
+	case LinkTypeLinuxSLL2:
+		if len(frame) < 20 {
+			return nil, false
+		}
+		return frame[20:], binary.BigEndian.Uint16(frame[0:]) == etherTypeIPv4
+	}
+
+	return nil, false
+}
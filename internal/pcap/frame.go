@@ -0,0 +1,57 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	IPv4HeaderLen = 20
+	UDPHeaderLen  = 8
+)
+
+// BuildIPv4UDP собирает IPv4/UDP кадр вокруг payload.
+// Используется для записи входящих датаграмм, у которых заголовки уже сняты ядром.
+// Контрольная сумма UDP не считается (0 допустим для IPv4).
+func BuildIPv4UDP(src net.IP, srcPort uint16, dst net.IP, dstPort uint16, payload []byte) []byte {
+	frame := make([]byte, IPv4HeaderLen+UDPHeaderLen+len(payload))
+
+	ip := frame[:IPv4HeaderLen]
+	ip[0] = 0x45 // версия 4, длина заголовка 5*4
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(frame)))
+	ip[8] = 64 // TTL
+	ip[9] = 17 // UDP
+	copy(ip[12:16], to4(src))
+	copy(ip[16:20], to4(dst))
+	binary.BigEndian.PutUint16(ip[10:], Checksum(ip))
+
+	udp := frame[IPv4HeaderLen : IPv4HeaderLen+UDPHeaderLen]
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(UDPHeaderLen+len(payload)))
+
+	copy(frame[IPv4HeaderLen+UDPHeaderLen:], payload)
+	return frame
+}
+
+// Checksum считает контрольную сумму интернет-заголовка (RFC 1071)
+func Checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func to4(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return net.IPv4zero.To4()
+}
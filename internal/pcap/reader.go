@@ -0,0 +1,284 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// Магические числа классического pcap
+const (
+	magicMicro uint32 = 0xA1B2C3D4
+	magicNano  uint32 = 0xA1B23C4D
+
+	blockSPB uint32 = 0x00000003
+
+	optIfTsresol uint16 = 9
+
+	maxBlockLen = 16 * 1024 * 1024
+)
+
+var ErrBadFormat = errors.New("pcap: неизвестный формат файла")
+
+// Packet - прочитанный из файла кадр
+type Packet struct {
+	Timestamp time.Time
+	LinkType  uint16
+	Data      []byte
+}
+
+// Reader читает файлы pcap и pcapng.
+// Data возвращенного пакета действителен до следующего вызова Next.
+type Reader struct {
+	r   *bufio.Reader
+	ng  bool
+	buf []byte
+
+	// pcap
+	order    binary.ByteOrder
+	nano     bool
+	linkType uint16
+
+	// pcapng
+	ifaces []ngInterface
+}
+
+type ngInterface struct {
+	linkType uint16
+	tsUnit   time.Duration // длительность одного тика временной метки
+	tsDiv    uint64        // тиков в секунде, если не кратно наносекундам
+}
+
+// NewReader определяет формат по заголовку файла
+func NewReader(r io.Reader) (*Reader, error) {
+	rd := &Reader{r: bufio.NewReaderSize(r, 256*1024)}
+
+	head, err := rd.r.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(head) == blockSHB {
+		rd.ng = true
+		return rd, nil
+	}
+	return rd, rd.readPcapHeader()
+}
+
+func (rd *Reader) readPcapHeader() error {
+	var hdr [24]byte
+	if _, err := io.ReadFull(rd.r, hdr[:]); err != nil {
+		return err
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(hdr[:]) == magicMicro:
+		rd.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[:]) == magicMicro:
+		rd.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr[:]) == magicNano:
+		rd.order, rd.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr[:]) == magicNano:
+		rd.order, rd.nano = binary.BigEndian, true
+	default:
+		return ErrBadFormat
+	}
+
+	rd.linkType = uint16(rd.order.Uint32(hdr[20:]))
+	return nil
+}
+
+// Next возвращает следующий пакет или io.EOF
+func (rd *Reader) Next() (Packet, error) {
+	if rd.ng {
+		return rd.nextNG()
+	}
+	return rd.nextPcap()
+}
+
+func (rd *Reader) nextPcap() (Packet, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(rd.r, hdr[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Packet{}, io.EOF
+		}
+		return Packet{}, err
+	}
+
+	sec := int64(rd.order.Uint32(hdr[0:]))
+	frac := int64(rd.order.Uint32(hdr[4:]))
+	capLen := rd.order.Uint32(hdr[8:])
+	if capLen > maxBlockLen {
+		return Packet{}, fmt.Errorf("pcap: слишком большой пакет %d", capLen)
+	}
+
+	data, err := rd.read(int(capLen))
+	if err != nil {
+		return Packet{}, err
+	}
+
+	if !rd.nano {
+		frac *= 1000
+	}
+
+	return Packet{
+		Timestamp: time.Unix(sec, frac),
+		LinkType:  rd.linkType,
+		Data:      data,
+	}, nil
+}
+
+func (rd *Reader) nextNG() (Packet, error) {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(rd.r, hdr[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return Packet{}, io.EOF
+			}
+			return Packet{}, err
+		}
+
+		blockType := binary.LittleEndian.Uint32(hdr[0:])
+		length := binary.LittleEndian.Uint32(hdr[4:])
+		if length < 12 || length > maxBlockLen || length%4 != 0 {
+			return Packet{}, fmt.Errorf("pcapng: неверная длина блока %d", length)
+		}
+
+		body, err := rd.read(int(length) - 8)
+		if err != nil {
+			return Packet{}, err
+		}
+		body = body[:len(body)-4] // повтор длины блока
+
+		switch blockType {
+		case blockSHB:
+			if len(body) < 4 || binary.LittleEndian.Uint32(body) != byteOrderMagic {
+				return Packet{}, fmt.Errorf("pcapng: поддерживается только little-endian секция")
+			}
+			rd.ifaces = rd.ifaces[:0]
+
+		case blockIDB:
+			if len(body) < 8 {
+				return Packet{}, ErrBadFormat
+			}
+			rd.ifaces = append(rd.ifaces, parseIDB(body))
+
+		case blockEPB:
+			if len(body) < 20 {
+				return Packet{}, ErrBadFormat
+			}
+			ifID := binary.LittleEndian.Uint32(body[0:])
+			if int(ifID) >= len(rd.ifaces) {
+				return Packet{}, ErrUnknownInterface
+			}
+			iface := rd.ifaces[ifID]
+
+			ts := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+			capLen := binary.LittleEndian.Uint32(body[12:])
+			if int(capLen) > len(body)-20 {
+				return Packet{}, ErrBadFormat
+			}
+
+			return Packet{
+				Timestamp: iface.time(ts),
+				LinkType:  iface.linkType,
+				Data:      body[20 : 20+capLen],
+			}, nil
+
+		case blockSPB:
+			if len(body) < 4 || len(rd.ifaces) == 0 {
+				return Packet{}, ErrBadFormat
+			}
+			origLen := binary.LittleEndian.Uint32(body[0:])
+			data := body[4:]
+			if int(origLen) < len(data) {
+				data = data[:origLen]
+			}
+
+			// в Simple Packet Block нет временной метки
+			return Packet{LinkType: rd.ifaces[0].linkType, Data: data}, nil
+		}
+	}
+}
+
+// read читает n байт во внутренний буфер
+func (rd *Reader) read(n int) ([]byte, error) {
+	if cap(rd.buf) < n {
+		rd.buf = make([]byte, n)
+	}
+	buf := rd.buf[:n]
+	if _, err := io.ReadFull(rd.r, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+func parseIDB(body []byte) ngInterface {
+	iface := ngInterface{
+		linkType: binary.LittleEndian.Uint16(body[0:]),
+		tsUnit:   time.Microsecond,
+	}
+
+	opts := body[8:]
+	for len(opts) >= 4 {
+		code := binary.LittleEndian.Uint16(opts[0:])
+		length := int(binary.LittleEndian.Uint16(opts[2:]))
+		if code == optEndOfOpt || 4+length > len(opts) {
+			break
+		}
+		value := opts[4 : 4+length]
+
+		if code == optIfTsresol && length >= 1 {
+			iface.setResolution(value[0])
+		}
+		opts = opts[4+pad4(length):]
+	}
+
+	return iface
+}
+
+// setResolution разбирает if_tsresol: старший бит - основание 2, иначе 10
+func (iface *ngInterface) setResolution(v byte) {
+	exp := uint(v & 0x7F)
+	iface.tsUnit = 0
+
+	if v&0x80 != 0 {
+		iface.tsDiv = 1 << exp
+		return
+	}
+
+	if exp <= 9 {
+		unit := time.Second
+		for range exp {
+			unit /= 10
+		}
+		iface.tsUnit = unit
+		return
+	}
+
+	iface.tsDiv = 1
+	for range exp {
+		iface.tsDiv *= 10
+	}
+}
+
+func (iface ngInterface) time(ts uint64) time.Time {
+	if iface.tsUnit != 0 {
+		unit := uint64(iface.tsUnit)
+		sec := ts / (uint64(time.Second) / unit)
+		rem := ts % (uint64(time.Second) / unit)
+		return time.Unix(int64(sec), int64(rem*unit))
+	}
+
+	sec := ts / iface.tsDiv
+	hi, lo := bits.Mul64(ts%iface.tsDiv, uint64(time.Second))
+	nsec, _ := bits.Div64(hi, lo, iface.tsDiv)
+	return time.Unix(int64(sec), int64(nsec))
+}
@@ -0,0 +1,121 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNGRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := NewNGWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifID, err := w.AddInterface("test", LinkTypeRaw, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	ts := time.Unix(1700000000, 123456000)
+	payloads := [][]byte{[]byte("a"), []byte("hello"), bytes.Repeat([]byte{7}, 1500)}
+
+	for i, p := range payloads {
+		frame := BuildIPv4UDP(src, 1000, dst, 2000, p)
+		if err := w.WritePacket(ifID, ts.Add(time.Duration(i)*time.Millisecond), frame, 0, "c"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rd, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, p := range payloads {
+		pkt, err := rd.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := ts.Add(time.Duration(i) * time.Millisecond); !pkt.Timestamp.Equal(want) {
+			t.Fatalf("пакет %d: время %v, ожидали %v", i, pkt.Timestamp, want)
+		}
+
+		dg, ok := DecodeUDP(pkt.LinkType, pkt.Data)
+		if !ok {
+			t.Fatalf("пакет %d не разобран", i)
+		}
+		if !dg.Src.Equal(src) || !dg.Dst.Equal(dst) || dg.SrcPort != 1000 || dg.DstPort != 2000 {
+			t.Fatalf("пакет %d: неверные адреса %+v", i, dg)
+		}
+		if !bytes.Equal(dg.Payload, p) {
+			t.Fatalf("пакет %d: неверные данные", i)
+		}
+		if Checksum(pkt.Data[:IPv4HeaderLen]) != 0 {
+			t.Fatalf("пакет %d: неверная контрольная сумма IP", i)
+		}
+	}
+
+	if _, err := rd.Next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("ожидали EOF, получили %v", err)
+	}
+}
+
+func TestClassicPcapEthernet(t *testing.T) {
+	var buf bytes.Buffer
+
+	// заголовок файла: big-endian, наносекунды, Ethernet
+	hdr := make([]byte, 24)
+	binary.BigEndian.PutUint32(hdr[0:], magicNano)
+	binary.BigEndian.PutUint16(hdr[4:], 2)
+	binary.BigEndian.PutUint16(hdr[6:], 4)
+	binary.BigEndian.PutUint32(hdr[16:], 65535)
+	binary.BigEndian.PutUint32(hdr[20:], uint32(LinkTypeEthernet))
+	buf.Write(hdr)
+
+	ip := BuildIPv4UDP(net.IPv4(1, 2, 3, 4), 53, net.IPv4(5, 6, 7, 8), 9000, []byte("payload"))
+	eth := make([]byte, 18)
+	binary.BigEndian.PutUint16(eth[12:], etherTypeVLAN)
+	binary.BigEndian.PutUint16(eth[16:], etherTypeIPv4)
+	frame := append(eth, ip...)
+
+	rec := make([]byte, 16)
+	binary.BigEndian.PutUint32(rec[0:], 10)
+	binary.BigEndian.PutUint32(rec[4:], 500)
+	binary.BigEndian.PutUint32(rec[8:], uint32(len(frame)))
+	binary.BigEndian.PutUint32(rec[12:], uint32(len(frame)))
+	buf.Write(rec)
+	buf.Write(frame)
+
+	rd, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := rd.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pkt.Timestamp.Equal(time.Unix(10, 500)) {
+		t.Fatalf("неверное время %v", pkt.Timestamp)
+	}
+
+	dg, ok := DecodeUDP(pkt.LinkType, pkt.Data)
+	if !ok || dg.DstPort != 9000 || string(dg.Payload) != "payload" {
+		t.Fatalf("кадр разобран неверно: %+v, %v", dg, ok)
+	}
+}
+
+func TestDecodeSkipsFragments(t *testing.T) {
+	frame := BuildIPv4UDP(net.IPv4(1, 2, 3, 4), 1, net.IPv4(5, 6, 7, 8), 2, []byte("x"))
+	binary.BigEndian.PutUint16(frame[6:], 0x2000) // MF
+
+	if _, ok := DecodeUDP(LinkTypeRaw, frame); ok {
+		t.Fatal("фрагмент не должен разбираться как датаграмма")
+	}
+}
@@ -0,0 +1,47 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Writer пишет пакеты в классическом формате pcap (микросекунды, little-endian).
+// Writer не потокобезопасен.
+type Writer struct {
+	w   io.Writer
+	hdr [16]byte
+}
+
+// NewWriter пишет заголовок файла
+func NewWriter(w io.Writer, linkType uint16, snaplen uint32) (*Writer, error) {
+	if snaplen == 0 {
+		snaplen = 262144
+	}
+
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], magicMicro)
+	binary.LittleEndian.PutUint16(hdr[4:], 2) // major
+	binary.LittleEndian.PutUint16(hdr[6:], 4) // minor
+	binary.LittleEndian.PutUint32(hdr[16:], snaplen)
+	binary.LittleEndian.PutUint32(hdr[20:], uint32(linkType))
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// WritePacket пишет запись пакета
+func (pw *Writer) WritePacket(ts time.Time, data []byte) error {
+	binary.LittleEndian.PutUint32(pw.hdr[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(pw.hdr[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(pw.hdr[8:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(pw.hdr[12:], uint32(len(data)))
+
+	if _, err := pw.w.Write(pw.hdr[:]); err != nil {
+		return err
+	}
+	_, err := pw.w.Write(data)
+	return err
+}
@@ -3,22 +3,38 @@ package pipeline
 import (
 	"context"
 	"fmt"
-	"log"
 	"log/slog"
+	"net"
 	"sync"
+	"time"
 	"udp_mirror/config"
+	"udp_mirror/internal/health"
 	"udp_mirror/internal/listener"
 	"udp_mirror/internal/manager"
+	"udp_mirror/internal/replay"
 	"udp_mirror/internal/sender"
 	"udp_mirror/internal/worker"
+	"udp_mirror/pkg/logging"
+	"udp_mirror/pkg/metrics"
 )
 
+const queueSampleInterval = time.Second
+
 type Pipeline struct {
 	Channels []chan worker.IRPData
 
 	Name    string
 	Input   config.AddrConfig
 	Targets []config.TargetConfig
+
+	// Conns - сокеты, переданные systemd при активации или старым процессом при обновлении.
+	// Слушатели читают по одному из тех, что слушают Input; недостающие сокеты открываются,
+	// лишние и чужие закрываются.
+	Conns []*net.UDPConn
+
+	Listener *config.ListenerConfig
+
+	log *slog.Logger
 }
 
 // NewPipeline создает и инициализирует Pipeline
@@ -37,6 +53,10 @@ func NewPipeline(plCfg config.Pipeline) *Pipeline {
 		Name:    plCfg.Name,
 		Input:   plCfg.Input,
 		Targets: plCfg.Targets,
+
+		Listener: plCfg.Listener,
+
+		log: logging.For("pipeline").With("pipeline", plCfg.Name),
 	}
 
 	return pipeline
@@ -47,19 +67,25 @@ func (pl *Pipeline) Start(ctx context.Context) {
 	defer cancel()
 
 	ctx = context.WithValue(ctx, config.PlNameKey, pl.Name)
+	ctx = context.WithValue(ctx, config.InputKey, pl.Input)
 
-	log.Printf("[Pipeline %s] Запуск...\n", pl.Name)
+	pl.log.Info("Запуск...")
+
+	settings := listener.Settings(pl.Listener)
+	raw := settings.Mode == config.ListenerRaw
+	conns := pl.adoptConns(raw, settings.Count)
+	listenerWorker := settings.Count
 
 	// Создаем слушателя
-	listener, err := listener.NewUDPListener(ctx, pl.Input, pl.Channels)
+	listener, err := listener.NewUDPListener(ctx, pl.Input, pl.Channels, pl.targetLabels(), settings)
 	if err != nil {
-		msg := fmt.Sprintf("[Pipeline %s] Ошибка запуска UDP слушателя: %v\n", pl.Name, err)
-		slog.Error(msg)
+		pl.log.Error("Ошибка запуска UDP слушателя", logging.Err(err))
 		return
 	}
 	// defer listener.Close()
-	// listenerWorker := runtime.NumCPU()/2 - 3
-	listenerWorker := 2
+
+	hp := health.Register(pl.Name, listenerWorker, pl.targetLabels())
+	defer health.Unregister(pl.Name)
 
 	var wg sync.WaitGroup
 
@@ -67,24 +93,165 @@ func (pl *Pipeline) Start(ctx context.Context) {
 		lName := fmt.Sprintf("%d", i)
 		wg.Add(1)
 		go func(lName string) {
-			listener.Start(lName)
 			defer wg.Done()
+			defer pl.listenerExited(ctx, hp, lName)
+			switch {
+			case raw:
+				listener.StartRaw(lName)
+			case i < len(conns):
+				listener.Serve(lName, conns[i])
+			default:
+				listener.Start(lName)
+			}
 		}(lName)
 	}
-	workerManager, err := manager.NewWorkerManager(ctx, pl.Targets, sender.NewUDPSender)
+	workerManager, err := manager.NewWorkerManager(ctx, pl.Targets, sender.NewSender)
 	if err != nil {
-		log.Panicf("[Pipeline %s] %v", pl.Name, err)
+		pl.log.Error("Ошибка создания воркеров", logging.Err(err))
+		panic(err)
 	}
 
 	workerManager.Start(pl.Channels)
+	go pl.sampleQueues(ctx, hp)
 
 	<-ctx.Done()
-	log.Printf("[Pipeline %s] Остановка...\n", pl.Name)
+	pl.log.Info("Остановка...")
 
 	wg.Wait()
 	listener.Shutdown()
 
 	workerManager.Shutdown()
 
-	log.Printf("[Pipeline %s] Завершен\n", pl.Name)
+	pl.log.Info("Завершен")
+}
+
+// adoptConns отбирает переданные сокеты, которые слушают вход pipeline, не больше count.
+// Остальные закрываются: слушатели без сокета открывают свои с SO_REUSEPORT.
+// В режиме raw переданные сокеты не используются и закрываются все.
+func (pl *Pipeline) adoptConns(raw bool, count int) []*net.UDPConn {
+	if len(pl.Conns) == 0 {
+		return nil
+	}
+	if raw {
+		pl.log.Warn("Переданные сокеты не используются в режиме raw, закрываем", "count", len(pl.Conns))
+		closeConns(pl.Conns)
+		return nil
+	}
+
+	var conns []*net.UDPConn
+	for _, c := range pl.Conns {
+		if !boundTo(c, pl.Input) {
+			pl.log.Warn("Переданный сокет слушает другой адрес, закрываем", "addr", c.LocalAddr().String())
+			c.Close()
+			continue
+		}
+		conns = append(conns, c)
+	}
+
+	if len(conns) > count {
+		pl.log.Info("Переданных сокетов больше listener.count, лишние закрываем", "count", count, "closed", len(conns)-count)
+		closeConns(conns[count:])
+		conns = conns[:count]
+	}
+	if len(conns) > 0 {
+		pl.log.Info("Используются переданные сокеты", "count", len(conns), "open", count-len(conns))
+	}
+	return conns
+}
+
+// boundTo сообщает, что сокет слушает адрес in. Сокет на 0.0.0.0 в Go двухстековый
+// и сообщает адрес [::], поэтому любые неуказанные адреса считаются одинаковыми.
+func boundTo(c *net.UDPConn, in config.AddrConfig) bool {
+	addr, ok := c.LocalAddr().(*net.UDPAddr)
+	if !ok || addr.Port != int(in.Port) {
+		return false
+	}
+	if in.Host == nil || in.Host.IsUnspecified() {
+		return addr.IP == nil || addr.IP.IsUnspecified()
+	}
+	return addr.IP.Equal(in.Host)
+}
+
+func closeConns(conns []*net.UDPConn) {
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// targetLabels возвращает имена целей для метрик в порядке каналов
+func (pl *Pipeline) targetLabels() []string {
+	labels := make([]string, len(pl.Targets))
+	for i, t := range pl.Targets {
+		labels[i] = t.Label()
+	}
+	return labels
+}
+
+// listenerExited отмечает слушатель завершившимся, если pipeline еще работает.
+// Паника слушателя не роняет процесс, а делает pipeline неисправным.
+func (pl *Pipeline) listenerExited(ctx context.Context, hp *health.Pipeline, lName string) {
+	if r := recover(); r != nil {
+		pl.log.Error("Паника в UDP слушателе", "listener", lName, "panic", r)
+	}
+	if ctx.Err() == nil {
+		pl.log.Error("UDP слушатель завершился", "listener", lName)
+		hp.ListenerDied(lName)
+	}
+}
+
+// sampleQueues периодически публикует заполненность каналов целей
+// и обновляет состояние целей для проверки /healthz
+func (pl *Pipeline) sampleQueues(ctx context.Context, hp *health.Pipeline) {
+	labels := pl.targetLabels()
+	rec := metrics.Default()
+
+	ticker := time.NewTicker(queueSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		for i, ch := range pl.Channels {
+			rec.QueueDepth(pl.Name, labels[i], len(ch), cap(ch))
+		}
+		hp.Sample(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// StartReplay воспроизводит pcap файл в каналы pipeline вместо приема из сети.
+// Завершается, когда файл воспроизведен и воркеры обработали очередь, или при отмене контекста.
+func (pl *Pipeline) StartReplay(ctx context.Context, opts replay.Options) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ctx = context.WithValue(ctx, config.PlNameKey, pl.Name)
+	ctx = context.WithValue(ctx, config.InputKey, pl.Input)
+
+	pl.log.Info("Запуск воспроизведения...")
+
+	source, err := replay.NewSource(ctx, opts, pl.Input, pl.Channels)
+	if err != nil {
+		pl.log.Error("Ошибка открытия файла воспроизведения", "file", opts.File, logging.Err(err))
+		return
+	}
+
+	workerManager, err := manager.NewWorkerManager(ctx, pl.Targets, sender.NewSender)
+	if err != nil {
+		pl.log.Error("Ошибка создания воркеров", logging.Err(err))
+		panic(err)
+	}
+
+	workerManager.Start(pl.Channels)
+	go pl.sampleQueues(ctx, nil)
+
+	source.Start("replay")
+	source.Shutdown()
+
+	workerManager.Shutdown()
+
+	pl.log.Info("Воспроизведение завершено")
 }
@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"udp_mirror/config"
+)
+
+func listen(t *testing.T, addr string) *net.UDPConn {
+	t.Helper()
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+	}}
+	c, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c.(*net.UDPConn)
+}
+
+func closed(c *net.UDPConn) bool {
+	_, err := c.File()
+	return err != nil
+}
+
+func TestAdoptConns(t *testing.T) {
+	own := listen(t, "127.0.0.1:0")
+	port := uint16(own.LocalAddr().(*net.UDPAddr).Port)
+	other := listen(t, "127.0.0.2:0")
+	wildcard := listen(t, "0.0.0.0:0")
+
+	pl := NewPipeline(config.Pipeline{Name: "adopt", Input: config.AddrConfig{Host: net.IPv4(127, 0, 0, 1), Port: port}})
+	pl.Conns = []*net.UDPConn{other, own, wildcard}
+
+	conns := pl.adoptConns(false, 4)
+	if len(conns) != 1 || conns[0] != own || closed(own) {
+		t.Errorf("сокеты %v", conns)
+	}
+	if !closed(other) || !closed(wildcard) {
+		t.Error("сокеты на чужих адресах не закрыты")
+	}
+
+	// 0.0.0.0 в конфиге совпадает с двухстековым [::]
+	a := listen(t, "0.0.0.0:0")
+	port = uint16(a.LocalAddr().(*net.UDPAddr).Port)
+	b := listen(t, a.LocalAddr().String())
+	pl = NewPipeline(config.Pipeline{Name: "adopt", Input: config.AddrConfig{Host: net.IPv4zero, Port: port}})
+	pl.Conns = []*net.UDPConn{a, b}
+	if conns := pl.adoptConns(false, 1); len(conns) != 1 || conns[0] != a || !closed(b) {
+		t.Errorf("лишний сокет не закрыт: %v", conns)
+	}
+
+	c := listen(t, "127.0.0.1:0")
+	pl.Conns = []*net.UDPConn{c}
+	if conns := pl.adoptConns(true, 1); conns != nil || !closed(c) {
+		t.Error("в режиме raw переданный сокет не закрыт")
+	}
+}
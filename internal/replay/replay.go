@@ -0,0 +1,205 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/capture"
+	"udp_mirror/internal/pcap"
+	"udp_mirror/internal/worker"
+	"udp_mirror/pkg/logging"
+	"udp_mirror/pkg/metrics"
+)
+
+// Options настройки воспроизведения pcap файла
+type Options struct {
+	File string
+
+	// Speed - множитель скорости: 1 - исходные интервалы, 2 - вдвое быстрее, 0 - без пауз
+	Speed float64
+	// MaxRate - ограничение пакетов в секунду, 0 - без ограничения
+	MaxRate float64
+	// Loop - количество проходов по файлу, 0 - бесконечно
+	Loop int
+	// RewritePort - подставлять порт входа pipeline вместо порта назначения из файла.
+	// Без него в pipeline попадают только датаграммы на его порт.
+	RewritePort bool
+}
+
+// Source читает UDP датаграммы из pcap/pcapng файла и отправляет их в каналы pipeline
+// вместо UDPListener. Сеть для приема не используется.
+type Source struct {
+	opts     Options
+	input    config.AddrConfig
+	channels []chan worker.IRPData
+
+	ctx context.Context
+}
+
+// NewSource создает источник и проверяет, что файл читается
+func NewSource(ctx context.Context, opts Options, input config.AddrConfig, chs []chan worker.IRPData) (*Source, error) {
+	if opts.Speed < 0 || opts.MaxRate < 0 || opts.Loop < 0 {
+		return nil, errors.New("speed, max rate и loop не могут быть отрицательными")
+	}
+
+	f, err := os.Open(opts.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := pcap.NewReader(f); err != nil {
+		return nil, fmt.Errorf("%s: %w", opts.File, err)
+	}
+
+	return &Source{
+		opts:     opts,
+		input:    input,
+		channels: chs,
+		ctx:      ctx,
+	}, nil
+}
+
+// Start воспроизводит файл нужное количество раз. Возвращается по окончании или отмене контекста.
+func (s *Source) Start(lName string) {
+	plName, _ := s.ctx.Value(config.PlNameKey).(string)
+	log := logging.For("replay").With("pipeline", plName, "listener", lName, "file", s.opts.File)
+	log.Info("Воспроизведение")
+
+	var total uint64
+	for i := 0; s.opts.Loop == 0 || i < s.opts.Loop; i++ {
+		n, err := s.play(lName, plName)
+		total += n
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				log.Error("Ошибка воспроизведения", logging.Err(err))
+			}
+			break
+		}
+		if n == 0 {
+			log.Warn("В файле нет подходящих датаграмм")
+			break
+		}
+	}
+
+	log.Info("Воспроизведение завершено", "datagrams", total)
+}
+
+// play делает один проход по файлу
+func (s *Source) play(lName, plName string) (uint64, error) {
+	f, err := os.Open(s.opts.File)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rd, err := pcap.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		sent      uint64
+		first     time.Time
+		start     time.Time
+		nextSlot  time.Time
+		rateDelay time.Duration
+	)
+	if s.opts.MaxRate > 0 {
+		rateDelay = time.Duration(float64(time.Second) / s.opts.MaxRate)
+	}
+	dst := &net.UDPAddr{IP: s.input.Host, Port: int(s.input.Port)}
+	received := metrics.Default().Receiver(plName, lName)
+
+	for {
+		pkt, err := rd.Next()
+		if errors.Is(err, io.EOF) {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+
+		dg, ok := pcap.DecodeUDP(pkt.LinkType, pkt.Data)
+		if !ok || (!s.opts.RewritePort && dg.DstPort != s.input.Port) {
+			continue
+		}
+
+		// сохраняем исходные интервалы между пакетами
+		if s.opts.Speed > 0 && !pkt.Timestamp.IsZero() {
+			if first.IsZero() {
+				first, start = pkt.Timestamp, time.Now()
+			}
+			offset := time.Duration(float64(pkt.Timestamp.Sub(first)) / s.opts.Speed)
+			if err := s.sleepUntil(start.Add(offset)); err != nil {
+				return sent, err
+			}
+		}
+
+		if rateDelay > 0 {
+			if err := s.sleepUntil(nextSlot); err != nil {
+				return sent, err
+			}
+			nextSlot = time.Now().Add(rateDelay)
+		}
+
+		data := make([]byte, len(dg.Payload))
+		copy(data, dg.Payload)
+		src := &net.UDPAddr{IP: append(net.IP(nil), dg.Src...), Port: int(dg.SrcPort)}
+
+		received.Add(src.IP, len(data))
+		capture.Input(plName, src, dst, data)
+
+		if err := s.push(worker.IRPData{
+			Data:     data,
+			Src:      config.AddrConfig{Host: src.IP, Port: dg.SrcPort},
+			Received: time.Now(),
+		}); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+}
+
+// push отправляет датаграмму во все каналы. В отличие от UDPListener не отбрасывает
+// пакеты при переполнении, а ждет, чтобы результат воспроизведения был повторяемым.
+func (s *Source) push(d worker.IRPData) error {
+	for _, ch := range s.channels {
+		select {
+		case ch <- d:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *Source) sleepUntil(t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return s.ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// Shutdown закрывает каналы, чтобы воркеры дообработали очередь и завершились
+func (s *Source) Shutdown() {
+	for _, ch := range s.channels {
+		close(ch)
+	}
+}
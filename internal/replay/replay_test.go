@@ -0,0 +1,148 @@
+package replay
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/pcap"
+	"udp_mirror/internal/worker"
+)
+
+type testPacket struct {
+	offset  time.Duration
+	dstPort uint16
+	payload string
+}
+
+func writeCapture(t *testing.T, packets []testPacket) string {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "test.pcapng")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := pcap.NewNGWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifID, err := w.AddInterface("", pcap.LinkTypeRaw, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1700000000, 0)
+	for _, p := range packets {
+		frame := pcap.BuildIPv4UDP(net.IPv4(10, 0, 0, 1), 4000, net.IPv4(10, 0, 0, 2), p.dstPort, []byte(p.payload))
+		if err := w.WritePacket(ifID, start.Add(p.offset), frame, 0, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return name
+}
+
+func run(t *testing.T, opts Options, input config.AddrConfig) ([]string, time.Duration) {
+	t.Helper()
+
+	ch := make(chan worker.IRPData, 100)
+	ctx := context.WithValue(context.Background(), config.PlNameKey, "test")
+
+	src, err := NewSource(ctx, opts, input, []chan worker.IRPData{ch})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	src.Start("replay")
+	elapsed := time.Since(start)
+	src.Shutdown()
+
+	var got []string
+	for d := range ch {
+		if d.Src.Port != 4000 || !d.Src.Host.Equal(net.IPv4(10, 0, 0, 1)) {
+			t.Fatalf("неверный источник %+v", d.Src)
+		}
+		got = append(got, string(d.Data))
+	}
+	return got, elapsed
+}
+
+func TestReplayFilterAndLoop(t *testing.T) {
+	file := writeCapture(t, []testPacket{
+		{0, 2000, "a"},
+		{0, 3000, "skip"},
+		{0, 2000, "b"},
+	})
+	input := config.AddrConfig{Host: net.IPv4zero, Port: 2000}
+
+	got, _ := run(t, Options{File: file, Loop: 2}, input)
+	want := []string{"a", "b", "a", "b"}
+	if len(got) != len(want) {
+		t.Fatalf("получили %v, ожидали %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("получили %v, ожидали %v", got, want)
+		}
+	}
+
+	got, _ = run(t, Options{File: file, Loop: 1, RewritePort: true}, input)
+	if len(got) != 3 {
+		t.Fatalf("с rewrite ожидали 3 датаграммы, получили %v", got)
+	}
+}
+
+func TestReplayTiming(t *testing.T) {
+	file := writeCapture(t, []testPacket{
+		{0, 2000, "a"},
+		{100 * time.Millisecond, 2000, "b"},
+		{200 * time.Millisecond, 2000, "c"},
+	})
+	input := config.AddrConfig{Host: net.IPv4zero, Port: 2000}
+
+	_, elapsed := run(t, Options{File: file, Loop: 1, Speed: 2}, input)
+	if elapsed < 90*time.Millisecond || elapsed > 190*time.Millisecond {
+		t.Fatalf("при скорости x2 ожидали около 100ms, получили %v", elapsed)
+	}
+
+	_, elapsed = run(t, Options{File: file, Loop: 1, Speed: 0, MaxRate: 20}, input)
+	if elapsed < 90*time.Millisecond {
+		t.Fatalf("при 20 pps три пакета не могут уйти быстрее 100ms, получили %v", elapsed)
+	}
+}
+
+func TestReplayCancel(t *testing.T) {
+	file := writeCapture(t, []testPacket{
+		{0, 2000, "a"},
+		{time.Hour, 2000, "b"},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan worker.IRPData, 10)
+	src, err := NewSource(ctx, Options{File: file, Speed: 1}, config.AddrConfig{Port: 2000}, []chan worker.IRPData{ch})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		src.Start("replay")
+		close(done)
+	}()
+
+	<-ch
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("воспроизведение не остановилось после отмены контекста")
+	}
+}
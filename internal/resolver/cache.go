@@ -0,0 +1,180 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"udp_mirror/config"
+	"udp_mirror/pkg/logging"
+)
+
+// Границы TTL по умолчанию: не чаще раза в 5 секунд и не реже раза в 5 минут
+const (
+	DefaultMinTTL = 5 * time.Second
+	DefaultMaxTTL = 5 * time.Minute
+)
+
+// Адреса имени используются всеми воркерами целей с этим именем: имя разрешается
+// один раз и обновляется в фоне, пока есть хотя бы один пользователь.
+
+var (
+	mu       sync.Mutex
+	resolver Resolver
+	minTTL   = DefaultMinTTL
+	maxTTL   = DefaultMaxTTL
+	entries  = map[string]*Addrs{}
+)
+
+// Configure задает DNS серверы и границы TTL из секции dns конфига.
+// Вызывается при запуске, до создания целей.
+func Configure(cfg *config.DNSConfig) {
+	if cfg == nil {
+		cfg = &config.DNSConfig{}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	resolver = NewDNS(cfg.Servers, cfg.Timeout)
+	minTTL, maxTTL = DefaultMinTTL, DefaultMaxTTL
+	if cfg.MinTTL > 0 {
+		minTTL = cfg.MinTTL
+	}
+	if cfg.MaxTTL > 0 {
+		maxTTL = cfg.MaxTTL
+	}
+	maxTTL = max(maxTTL, minTTL)
+}
+
+// SetResolver заменяет резолвер, например заглушкой в тестах
+func SetResolver(r Resolver, lo, hi time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	resolver, minTTL, maxTTL = r, lo, hi
+}
+
+// Addrs - текущие адреса имени узла. Адреса заменяются атомарно,
+// Load можно вызывать на каждый пакет.
+type Addrs struct {
+	host string
+	ips  atomic.Pointer[[]net.IP]
+
+	refs   int
+	cancel context.CancelFunc
+	ready  chan struct{} // закрывается после первого запроса
+	done   chan struct{}
+	log    *slog.Logger
+}
+
+// Static возвращает неизменяемый набор адресов для цели, заданной IP адресом
+func Static(ips ...net.IP) *Addrs {
+	a := &Addrs{}
+	a.ips.Store(&ips)
+	return a
+}
+
+// Acquire возвращает адреса имени host. При первом обращении имя разрешается сразу,
+// затем обновляется в фоне по TTL ответа. Если имя не разрешилось, Load возвращает
+// пустой список, пока очередной запрос не будет успешным.
+// Первый запрос выполняется без блокировки: Acquire других имен и Release не ждут его,
+// Acquire того же имени ждет его результата.
+// Каждому Acquire должен соответствовать Release.
+func Acquire(host string) *Addrs {
+	mu.Lock()
+	if a, ok := entries[host]; ok {
+		a.refs++
+		mu.Unlock()
+		<-a.ready
+		return a
+	}
+
+	if resolver == nil {
+		resolver = NewDNS(nil, 0)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &Addrs{
+		host:   host,
+		refs:   1,
+		cancel: cancel,
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+		log:    logging.For("resolver").With("target", host),
+	}
+	a.ips.Store(&[]net.IP{})
+	entries[host] = a
+	r, lo, hi := resolver, minTTL, maxTTL
+	mu.Unlock()
+
+	delay := a.resolve(ctx, r, lo, hi)
+	close(a.ready)
+	go a.refresh(ctx, r, lo, hi, delay)
+	return a
+}
+
+// Load возвращает текущие адреса, отсортированные для стабильного порядка
+func (a *Addrs) Load() []net.IP {
+	return *a.ips.Load()
+}
+
+// Release освобождает адреса; с последним пользователем останавливается обновление
+func (a *Addrs) Release() {
+	if a.host == "" {
+		return
+	}
+
+	mu.Lock()
+	a.refs--
+	last := a.refs == 0
+	if last {
+		delete(entries, a.host)
+	}
+	mu.Unlock()
+
+	if last {
+		a.cancel()
+		<-a.done
+	}
+}
+
+// refresh повторяет запрос, когда истекает TTL предыдущего ответа
+func (a *Addrs) refresh(ctx context.Context, r Resolver, lo, hi, delay time.Duration) {
+	defer close(a.done)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			timer.Reset(a.resolve(ctx, r, lo, hi))
+		}
+	}
+}
+
+// resolve запрашивает адреса и возвращает паузу до следующего запроса.
+// TTL ограничивается [lo, hi]. При ошибке остаются прежние адреса, запрос повторяется через lo.
+func (a *Addrs) resolve(ctx context.Context, r Resolver, lo, hi time.Duration) time.Duration {
+	ips, ttl, err := r.Lookup(ctx, a.host)
+	if err != nil {
+		if ctx.Err() == nil {
+			logging.DefaultLimiter().Error(a.log,
+				logging.LimitKey{Target: a.host, Type: "resolve"}, "Ошибка разрешения имени цели", err)
+		}
+		return lo
+	}
+
+	slices.SortFunc(ips, func(x, y net.IP) int { return bytes.Compare(x.To16(), y.To16()) })
+	old := a.Load()
+	if !slices.EqualFunc(old, ips, net.IP.Equal) {
+		a.log.Info("Адреса цели обновлены", "old", old, "new", ips, "ttl", ttl.String())
+		a.ips.Store(&ips)
+	}
+	return min(max(ttl, lo), hi)
+}
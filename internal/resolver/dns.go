@@ -0,0 +1,223 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultTimeout - время ожидания ответа DNS сервера
+const DefaultTimeout = 2 * time.Second
+
+// ErrNotFound - имя не существует или у него нет адресов
+var ErrNotFound = errors.New("адреса не найдены")
+
+// Resolver разрешает имя узла в адреса. TTL - сколько адреса можно считать актуальными,
+// 0 - неизвестно.
+type Resolver interface {
+	Lookup(ctx context.Context, host string) (ips []net.IP, ttl time.Duration, err error)
+}
+
+// DNS запрашивает A и AAAA записи напрямую у DNS серверов, чтобы знать TTL ответа.
+// Если серверы не ответили или не знают имя, оно разрешается системным резолвером (/etc/hosts, search)
+// с неизвестным TTL.
+type DNS struct {
+	Servers []string // host:port
+	Timeout time.Duration
+}
+
+// NewDNS создает резолвер с серверами servers или, если они не заданы, из /etc/resolv.conf
+func NewDNS(servers []string, timeout time.Duration) *DNS {
+	if len(servers) == 0 {
+		servers = systemServers("/etc/resolv.conf")
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	r := &DNS{Timeout: timeout}
+	for _, s := range servers {
+		if net.ParseIP(s) != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		r.Servers = append(r.Servers, s)
+	}
+	return r
+}
+
+// systemServers читает адреса серверов из resolv.conf
+func systemServers(file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// Lookup возвращает адреса имени и наименьший TTL из ответов
+func (r *DNS) Lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, fmt.Errorf("некорректное имя %q: %w", host, err)
+	}
+
+	var errs []error
+	for _, server := range r.Servers {
+		ips, ttl, err := r.lookup(ctx, server, name)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
+		if errors.Is(err, ErrNotFound) {
+			break // имя может быть в /etc/hosts или разрешаться через search
+		}
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		errs = append(errs, err)
+		return nil, 0, errors.Join(errs...)
+	}
+	return ips, 0, nil
+}
+
+// lookup запрашивает у одного сервера A и AAAA записи
+func (r *DNS) lookup(ctx context.Context, server string, name dnsmessage.Name) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	var ttl uint32
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		got, gotTTL, err := r.query(ctx, server, name, qtype)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(ips) == 0 || gotTTL < ttl {
+			ttl = gotTTL
+		}
+		ips = append(ips, got...)
+	}
+	if len(ips) == 0 {
+		return nil, 0, ErrNotFound
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// query отправляет один запрос по UDP и разбирает ответ
+func (r *DNS) query(ctx context.Context, server string, name dnsmessage.Name, qtype dnsmessage.Type) ([]net.IP, uint32, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	req, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil || h.ID != id || !h.Response {
+			continue // чужой или поврежденный ответ, ждем свой
+		}
+		return parseAnswers(&p, h, qtype)
+	}
+}
+
+// parseAnswers выбирает из ответа адреса запрошенного типа и наименьший TTL
+func parseAnswers(p *dnsmessage.Parser, h dnsmessage.Header, qtype dnsmessage.Type) ([]net.IP, uint32, error) {
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, ErrNotFound
+	default:
+		return nil, 0, fmt.Errorf("ответ сервера: %s", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for {
+		ah, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// CNAME пропускаются: рекурсивный сервер добавляет в ответ и адреса цели CNAME
+		switch {
+		case ah.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			res, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(res.A[:]).To16())
+		case ah.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			res, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(res.AAAA[:]))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if len(ips) == 1 || ah.TTL < ttl {
+			ttl = ah.TTL
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, ErrNotFound
+	}
+	return ips, ttl, nil
+}
@@ -0,0 +1,290 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"udp_mirror/pkg/logging"
+)
+
+// stubDNS отвечает на запросы по таблице записей; имен нет в таблице - NXDOMAIN
+func stubDNS(t *testing.T, records map[string][]dnsmessage.Resource) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var req dnsmessage.Message
+			if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+				continue
+			}
+			q := req.Questions[0]
+
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: req.ID, Response: true, RecursionAvailable: true},
+				Questions: req.Questions,
+			}
+			list, ok := records[q.Name.String()]
+			if !ok {
+				resp.RCode = dnsmessage.RCodeNameError
+			}
+			for _, r := range list {
+				if r.Header.Type == q.Type || r.Header.Type == dnsmessage.TypeCNAME {
+					resp.Answers = append(resp.Answers, r)
+				}
+			}
+			out, err := resp.Pack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, _ = conn.WriteTo(out, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func a(name string, ttl uint32, ip string) dnsmessage.Resource {
+	var res dnsmessage.AResource
+	copy(res.A[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &res,
+	}
+}
+
+func aaaa(name string, ttl uint32, ip string) dnsmessage.Resource {
+	var res dnsmessage.AAAAResource
+	copy(res.AAAA[:], net.ParseIP(ip))
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &res,
+	}
+}
+
+func cname(name string, ttl uint32, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)},
+	}
+}
+
+func TestDNSLookup(t *testing.T) {
+	server := stubDNS(t, map[string][]dnsmessage.Resource{
+		"collector.test.": {
+			a("collector.test.", 60, "10.0.0.1"),
+			a("collector.test.", 30, "10.0.0.2"),
+			aaaa("collector.test.", 120, "fd00::1"),
+		},
+		"alias.test.": {
+			cname("alias.test.", 300, "collector.test."),
+			a("collector.test.", 20, "10.0.0.1"),
+		},
+	})
+	r := NewDNS([]string{server}, time.Second)
+
+	ips, ttl, err := r.Lookup(context.Background(), "collector.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 3 || !ips[0].Equal(net.ParseIP("10.0.0.1")) || !ips[2].Equal(net.ParseIP("fd00::1")) {
+		t.Errorf("адреса %v", ips)
+	}
+	if ttl != 30*time.Second {
+		t.Errorf("TTL %v, ожидали наименьший 30s", ttl)
+	}
+
+	ips, ttl, err = r.Lookup(context.Background(), "alias.test.")
+	if err != nil || len(ips) != 1 || ttl != 20*time.Second {
+		t.Errorf("CNAME: %v %v %v", ips, ttl, err)
+	}
+
+	// имени нет ни в DNS, ни в системном резолвере
+	if _, _, err := r.Lookup(context.Background(), "missing.invalid"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ошибка %v", err)
+	}
+}
+
+// fakeResolver отдает заданные адреса и считает запросы
+type fakeResolver struct {
+	mu    sync.Mutex
+	ips   []net.IP
+	ttl   time.Duration
+	err   error
+	calls int
+}
+
+func (r *fakeResolver) Lookup(context.Context, string) ([]net.IP, time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	return append([]net.IP(nil), r.ips...), r.ttl, r.err
+}
+
+func (r *fakeResolver) set(err error, ips ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err, r.ips = err, nil
+	for _, ip := range ips {
+		r.ips = append(r.ips, net.ParseIP(ip))
+	}
+}
+
+func waitAddrs(t *testing.T, addrs *Addrs, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := addrs.Load()
+		ok := len(got) == len(want)
+		for i := 0; ok && i < len(want); i++ {
+			ok = got[i].Equal(net.ParseIP(want[i]))
+		}
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("адреса %v, ожидали %v", got, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAcquireRefresh(t *testing.T) {
+	r := &fakeResolver{ttl: 20 * time.Millisecond}
+	r.set(nil, "10.0.0.2", "10.0.0.1")
+	SetResolver(r, 10*time.Millisecond, time.Second)
+	t.Cleanup(func() { SetResolver(nil, DefaultMinTTL, DefaultMaxTTL) })
+
+	first := Acquire("collector.test")
+	second := Acquire("collector.test")
+	if first != second {
+		t.Fatal("адреса одного имени не общие")
+	}
+	// первый запрос выполняется сразу, адреса отсортированы
+	waitAddrs(t, first, "10.0.0.1", "10.0.0.2")
+
+	// переключение после истечения TTL
+	r.set(nil, "10.0.0.3")
+	waitAddrs(t, first, "10.0.0.3")
+
+	// при ошибке остаются последние адреса
+	r.set(errors.New("сервер недоступен"))
+	time.Sleep(50 * time.Millisecond)
+	waitAddrs(t, first, "10.0.0.3")
+
+	first.Release()
+	second.Release()
+	mu.Lock()
+	left := len(entries)
+	mu.Unlock()
+	if left != 0 {
+		t.Fatal("адреса не освобождены")
+	}
+
+	// после освобождения имя больше не запрашивается
+	r.mu.Lock()
+	calls := r.calls
+	r.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.calls != calls {
+		t.Errorf("запросы после Release: %d", r.calls-calls)
+	}
+}
+
+// slowResolver не отвечает на запрос имени slow.test до закрытия release
+type slowResolver struct {
+	release chan struct{}
+}
+
+func (r *slowResolver) Lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if host == "slow.test" {
+		select {
+		case <-r.release:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+	return []net.IP{net.ParseIP("10.0.0.1")}, time.Minute, nil
+}
+
+func TestAcquireSlowLookup(t *testing.T) {
+	r := &slowResolver{release: make(chan struct{})}
+	SetResolver(r, time.Minute, time.Minute)
+	t.Cleanup(func() { SetResolver(nil, DefaultMinTTL, DefaultMaxTTL) })
+
+	slow := make(chan *Addrs, 2)
+	go func() { slow <- Acquire("slow.test") }()
+	for {
+		mu.Lock()
+		_, ok := entries["slow.test"]
+		mu.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go func() { slow <- Acquire("slow.test") }()
+
+	// долгий запрос одного имени не задерживает другие имена
+	fast := make(chan *Addrs)
+	go func() { fast <- Acquire("fast.test") }()
+	select {
+	case a := <-fast:
+		waitAddrs(t, a, "10.0.0.1")
+		a.Release()
+	case <-time.After(2 * time.Second):
+		t.Fatal("Acquire ждет запроса другого имени")
+	}
+
+	// пользователи одного имени получают адреса после первого запроса
+	select {
+	case <-slow:
+		t.Fatal("Acquire вернулся до первого запроса")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(r.release)
+	for range 2 {
+		a := <-slow
+		if len(a.Load()) != 1 {
+			t.Errorf("адреса %v до первого запроса", a.Load())
+		}
+		a.Release()
+	}
+}
+
+func TestTTLBounds(t *testing.T) {
+	r := &fakeResolver{}
+	r.set(nil, "10.0.0.1")
+	a := &Addrs{host: "collector.test", log: logging.For("resolver")}
+	a.ips.Store(&[]net.IP{})
+
+	for _, c := range []struct{ ttl, want time.Duration }{
+		{0, 5 * time.Second},
+		{time.Second, 5 * time.Second},
+		{time.Minute, time.Minute},
+		{time.Hour, 5 * time.Minute},
+	} {
+		r.ttl = c.ttl
+		if got := a.resolve(context.Background(), r, DefaultMinTTL, DefaultMaxTTL); got != c.want {
+			t.Errorf("TTL %v: пауза %v, ожидали %v", c.ttl, got, c.want)
+		}
+	}
+}
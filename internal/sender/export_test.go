@@ -0,0 +1,4 @@
+package sender
+
+// HTTPTemplateFuncs открывает функции шаблона http цели для тестов
+var HTTPTemplateFuncs = httpTemplateFuncs
@@ -0,0 +1,425 @@
+package sender
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/pcap"
+	"udp_mirror/pkg/logging"
+	"udp_mirror/pkg/metrics"
+)
+
+const (
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+
+	fileFlushInterval = time.Second
+	rotatedTimeFormat = "20060102T150405.000000"
+)
+
+// FileSender пишет датаграммы в файл с ротацией по размеру и времени.
+// Закрытые сегменты переименовываются в <path>.<время>, сжимаются и удаляются по сроку хранения.
+// Один FileSender обслуживает все воркеры цели.
+type FileSender struct {
+	cfg       config.FileTargetConfig
+	dst       config.AddrConfig // адрес получателя в pcap: вход pipeline
+	plName    string
+	recipient string // имя цели в метриках, путь как в конфиге
+	metrics   metrics.Recorder
+	log       *slog.Logger
+
+	mu      sync.Mutex
+	file    *os.File // nil, если файл не удалось открыть: flusher повторяет открытие
+	openErr error    // последняя ошибка открытия
+	bw      *bufio.Writer
+	cw      *countingWriter
+	pw      *pcap.Writer
+	opened  time.Time
+	lenBuf  [4]byte
+
+	done chan struct{}
+	wg   sync.WaitGroup // фоновое сжатие и очистка
+}
+
+// jsonRecord - строка формата jsonl
+type jsonRecord struct {
+	Time     time.Time `json:"ts"`
+	Pipeline string    `json:"pipeline,omitempty"`
+	SrcIP    string    `json:"src_ip"`
+	SrcPort  uint16    `json:"src_port"`
+	Payload  []byte    `json:"payload"` // base64
+}
+
+// NewFileSender возвращает общий на все воркеры FileSender для цели
+func NewFileSender(ctx context.Context, target config.TargetConfig) (PacketSender, error) {
+	plName, _ := ctx.Value(config.PlNameKey).(string)
+	input, _ := ctx.Value(config.InputKey).(config.AddrConfig)
+
+	if target.File == nil || target.File.Path == "" {
+		return nil, errors.New("для файловой цели не указан file.path")
+	}
+	cfg := *target.File
+
+	switch cfg.Format {
+	case "":
+		cfg.Format = config.FileFormatRaw
+	case config.FileFormatRaw, config.FileFormatBinary, config.FileFormatJSON, config.FileFormatPcap:
+	default:
+		return nil, fmt.Errorf("неизвестный формат файловой цели: %q", cfg.Format)
+	}
+
+	switch cfg.Compress {
+	case "", compressGzip, compressZstd:
+	default:
+		return nil, fmt.Errorf("неизвестное сжатие файловой цели: %q", cfg.Compress)
+	}
+
+	path, err := filepath.Abs(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Path = path
+
+	return acquireShared("file:"+path, func() (PacketSender, error) {
+		s := &FileSender{
+			cfg:       cfg,
+			dst:       input,
+			plName:    plName,
+			recipient: target.Label(),
+			metrics:   metrics.Default(),
+			log:       logging.For("sender").With("pipeline", plName, "target", target.Label()),
+			done:      make(chan struct{}),
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			return nil, err
+		}
+
+		// оставшийся от прошлого запуска файл считаем закрытым сегментом
+		if st, err := os.Stat(path); err == nil && st.Size() > 0 {
+			s.archive()
+		}
+
+		if err := s.open(); err != nil {
+			return nil, err
+		}
+
+		go s.flusher()
+		return s, nil
+	})
+}
+
+func (s *FileSender) SendPacket(data []byte, src config.AddrConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		s.openFailed()
+		return
+	}
+
+	if s.cfg.MaxSize > 0 && s.cw.n >= s.cfg.MaxSize {
+		s.rotate()
+		if s.file == nil {
+			s.openFailed()
+			return
+		}
+	}
+
+	if err := s.write(data, src); err != nil {
+		s.metrics.DeliveryErrors(s.plName, s.recipient, "write", 1)
+		logging.DefaultLimiter().Error(s.log,
+			logging.LimitKey{Pipeline: s.plName, Target: s.recipient, Type: "write"}, "Ошибка записи", err)
+		return
+	}
+
+	s.metrics.Sent(s.plName, s.recipient, len(data))
+}
+
+func (s *FileSender) write(data []byte, src config.AddrConfig) error {
+	switch s.cfg.Format {
+	case config.FileFormatBinary:
+		binary.BigEndian.PutUint32(s.lenBuf[:], uint32(len(data)))
+		if _, err := s.cw.Write(s.lenBuf[:]); err != nil {
+			return err
+		}
+		_, err := s.cw.Write(data)
+		return err
+
+	case config.FileFormatJSON:
+		rec := jsonRecord{
+			Time:     time.Now(),
+			Pipeline: s.plName,
+			SrcIP:    src.Host.String(),
+			SrcPort:  src.Port,
+			Payload:  data,
+		}
+		// Encode дописывает перевод строки
+		return json.NewEncoder(s.cw).Encode(rec)
+
+	case config.FileFormatPcap:
+		frame := pcap.BuildIPv4UDP(src.Host, src.Port, s.dst.Host, s.dst.Port, data)
+		return s.pw.WritePacket(time.Now(), frame)
+
+	default:
+		if _, err := s.cw.Write(data); err != nil {
+			return err
+		}
+		_, err := s.cw.Write([]byte{'\n'})
+		return err
+	}
+}
+
+func (s *FileSender) open() error {
+	f, err := os.OpenFile(s.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+
+	s.file = f
+	s.bw = bufio.NewWriterSize(f, 256*1024)
+	s.cw = &countingWriter{w: s.bw}
+	s.opened = time.Now()
+
+	if s.cfg.Format == config.FileFormatPcap {
+		s.pw, err = pcap.NewWriter(s.cw, pcap.LinkTypeRaw, 0)
+		if err != nil {
+			s.closeFile()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileSender) closeFile() {
+	if s.file == nil {
+		return
+	}
+
+	if err := s.bw.Flush(); err != nil {
+		s.log.Error("Ошибка записи", logging.Err(err))
+	}
+	if err := s.file.Close(); err != nil {
+		s.log.Error("Ошибка закрытия", logging.Err(err))
+	}
+	s.file, s.bw, s.cw, s.pw = nil, nil, nil, nil
+}
+
+// rotate закрывает текущий сегмент и открывает новый
+func (s *FileSender) rotate() {
+	s.closeFile()
+	s.archive()
+	s.reopen()
+}
+
+// reopen открывает файл; при ошибке датаграммы считаются ошибками доставки,
+// пока flusher не откроет файл снова
+func (s *FileSender) reopen() {
+	err := s.open()
+	switch {
+	case err != nil:
+		s.openErr = err
+		logging.DefaultLimiter().Error(s.log,
+			logging.LimitKey{Pipeline: s.plName, Target: s.recipient, Type: "open"}, "Ошибка открытия", err)
+	case s.openErr != nil:
+		s.openErr = nil
+		s.log.Info("Файл снова открыт")
+	}
+}
+
+// openFailed учитывает датаграмму, которую некуда записать
+func (s *FileSender) openFailed() {
+	s.metrics.DeliveryErrors(s.plName, s.recipient, "open", 1)
+	logging.DefaultLimiter().Error(s.log,
+		logging.LimitKey{Pipeline: s.plName, Target: s.recipient, Type: "open"}, "Файл не открыт", s.openErr)
+}
+
+// archive переименовывает текущий файл в закрытый сегмент и в фоне сжимает его и чистит старые
+func (s *FileSender) archive() {
+	rotated := s.cfg.Path + "." + time.Now().Format(rotatedTimeFormat)
+	if err := os.Rename(s.cfg.Path, rotated); err != nil {
+		s.log.Error("Ошибка ротации", logging.Err(err))
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		if s.cfg.Compress != "" {
+			if err := compressFile(rotated, s.cfg.Compress); err != nil {
+				s.log.Error("Ошибка сжатия", "file", rotated, logging.Err(err))
+			}
+		}
+		s.cleanup()
+	}()
+}
+
+// cleanup удаляет закрытые сегменты сверх MaxFiles и старше MaxAge
+func (s *FileSender) cleanup() {
+	if s.cfg.MaxFiles <= 0 && s.cfg.MaxAge <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(s.cfg.Path + ".*")
+	if err != nil {
+		return
+	}
+
+	var segments []string
+	for _, m := range matches {
+		if isSegment(s.cfg.Path, m) {
+			segments = append(segments, m)
+		}
+	}
+	// время в имени задает хронологический порядок
+	sort.Strings(segments)
+
+	for i, name := range segments {
+		remove := s.cfg.MaxFiles > 0 && i < len(segments)-s.cfg.MaxFiles
+
+		if !remove && s.cfg.MaxAge > 0 {
+			st, err := os.Stat(name)
+			remove = err == nil && time.Since(st.ModTime()) > s.cfg.MaxAge
+		}
+
+		if remove {
+			if err := os.Remove(name); err != nil {
+				s.log.Error("Ошибка удаления", "file", name, logging.Err(err))
+			}
+		}
+	}
+}
+
+// isSegment проверяет, что name - закрытый сегмент файла path: <path>.<время>[.gz|.zst].
+// Файлы других целей рядом (out и out.pcap) и недописанные .tmp не подходят
+func isSegment(path, name string) bool {
+	rest, ok := strings.CutPrefix(name, path+".")
+	if !ok {
+		return false
+	}
+	if r, ok := strings.CutSuffix(rest, ".gz"); ok {
+		rest = r
+	} else if r, ok := strings.CutSuffix(rest, ".zst"); ok {
+		rest = r
+	}
+	_, err := time.Parse(rotatedTimeFormat, rest)
+	return err == nil
+}
+
+// flusher сбрасывает буфер на диск, ротирует файл по времени и повторяет
+// открытие файла после ошибки
+func (s *FileSender) flusher() {
+	ticker := time.NewTicker(fileFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			switch {
+			case s.file == nil:
+				s.reopen()
+			case s.cfg.Interval > 0 && time.Since(s.opened) >= s.cfg.Interval && s.cw.n > 0:
+				s.rotate()
+			default:
+				if err := s.bw.Flush(); err != nil {
+					s.metrics.DeliveryErrors(s.plName, s.recipient, "write", 1)
+					logging.DefaultLimiter().Error(s.log,
+						logging.LimitKey{Pipeline: s.plName, Target: s.recipient, Type: "write"}, "Ошибка записи", err)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *FileSender) Close() {
+	close(s.done)
+
+	s.mu.Lock()
+	s.closeFile()
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	s.log.Info("Файл закрыт")
+}
+
+// compressFile сжимает файл в <name>.gz или <name>.zst и удаляет исходный
+func compressFile(name, method string) error {
+	ext := ".gz"
+	if method == compressZstd {
+		ext = ".zst"
+	}
+	tmp := name + ext + ".tmp"
+
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+
+	var zw io.WriteCloser
+	if method == compressZstd {
+		zw, err = zstd.NewWriter(out)
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return err
+		}
+	} else {
+		zw = gzip.NewWriter(out)
+	}
+
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, name+ext); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// countingWriter считает записанные байты
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
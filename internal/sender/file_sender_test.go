@@ -0,0 +1,336 @@
+package sender_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/pcap"
+	"udp_mirror/internal/sender"
+	"udp_mirror/pkg/metrics"
+)
+
+var fileSrc = config.AddrConfig{Host: net.IPv4(10, 1, 2, 3), Port: 5555}
+
+func newFileSender(t *testing.T, cfg config.FileTargetConfig) sender.PacketSender {
+	t.Helper()
+
+	ctx := context.WithValue(context.Background(), config.PlNameKey, "test")
+	ctx = context.WithValue(ctx, config.InputKey, config.AddrConfig{Host: net.IPv4(127, 0, 0, 1), Port: 9999})
+	s, err := sender.NewSender(ctx, config.TargetConfig{
+		Type: config.TargetFile,
+		File: &cfg,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFileSenderFormats(t *testing.T) {
+	dir := t.TempDir()
+	payloads := [][]byte{[]byte("first"), []byte("second\x00bin")}
+
+	for _, format := range []string{config.FileFormatRaw, config.FileFormatBinary, config.FileFormatJSON, config.FileFormatPcap} {
+		path := filepath.Join(dir, "out."+format)
+		s := newFileSender(t, config.FileTargetConfig{Path: path, Format: format})
+		for _, p := range payloads {
+			s.SendPacket(p, fileSrc)
+		}
+		s.Close()
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got [][]byte
+		switch format {
+		case config.FileFormatRaw:
+			for _, line := range strings.SplitAfter(string(b), "\n") {
+				if line != "" {
+					got = append(got, []byte(strings.TrimSuffix(line, "\n")))
+				}
+			}
+
+		case config.FileFormatBinary:
+			for len(b) >= 4 {
+				n := binary.BigEndian.Uint32(b)
+				got = append(got, b[4:4+n])
+				b = b[4+n:]
+			}
+
+		case config.FileFormatJSON:
+			dec := json.NewDecoder(bytes.NewReader(b))
+			for dec.More() {
+				var rec struct {
+					SrcIP   string `json:"src_ip"`
+					SrcPort uint16 `json:"src_port"`
+					Payload []byte `json:"payload"`
+				}
+				if err := dec.Decode(&rec); err != nil {
+					t.Fatal(err)
+				}
+				if rec.SrcIP != "10.1.2.3" || rec.SrcPort != 5555 {
+					t.Fatalf("jsonl: неверный источник %+v", rec)
+				}
+				got = append(got, rec.Payload)
+			}
+
+		case config.FileFormatPcap:
+			rd, err := pcap.NewReader(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				pkt, err := rd.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				dg, ok := pcap.DecodeUDP(pkt.LinkType, pkt.Data)
+				// получатель в pcap - вход pipeline
+				if !ok || !dg.Dst.Equal(net.IPv4(127, 0, 0, 1)) || dg.DstPort != 9999 || dg.SrcPort != 5555 {
+					t.Fatalf("pcap: неверная датаграмма %+v", dg)
+				}
+				got = append(got, append([]byte(nil), dg.Payload...))
+			}
+		}
+
+		if len(got) != len(payloads) {
+			t.Fatalf("%s: прочитали %d записей, ожидали %d", format, len(got), len(payloads))
+		}
+		for i := range payloads {
+			if !bytes.Equal(got[i], payloads[i]) {
+				t.Fatalf("%s: запись %d = %q, ожидали %q", format, i, got[i], payloads[i])
+			}
+		}
+	}
+}
+
+func TestFileSenderRotation(t *testing.T) {
+	for _, method := range []string{"gzip", "zstd"} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "mirror.log")
+
+		s := newFileSender(t, config.FileTargetConfig{
+			Path:     path,
+			Format:   config.FileFormatRaw,
+			MaxSize:  100,
+			Compress: method,
+			MaxFiles: 3,
+		})
+		payload := bytes.Repeat([]byte("x"), 49)
+		for range 20 {
+			s.SendPacket(payload, fileSrc)
+			// имена сегментов содержат время с микросекундами
+			time.Sleep(time.Millisecond)
+		}
+		s.Close()
+
+		segments, err := filepath.Glob(path + ".*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != 3 {
+			t.Fatalf("%s: ожидали 3 сегмента, получили %v", method, segments)
+		}
+
+		for _, seg := range segments {
+			f, err := os.Open(seg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var r io.Reader
+			if method == "gzip" {
+				if !strings.HasSuffix(seg, ".gz") {
+					t.Fatalf("сегмент не сжат: %s", seg)
+				}
+				r, err = gzip.NewReader(f)
+			} else {
+				if !strings.HasSuffix(seg, ".zst") {
+					t.Fatalf("сегмент не сжат: %s", seg)
+				}
+				var zr *zstd.Decoder
+				zr, err = zstd.NewReader(f)
+				r = zr
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			if len(b) != 100 {
+				t.Fatalf("%s: в сегменте %d байт, ожидали 100", seg, len(b))
+			}
+		}
+	}
+}
+
+// очистка не трогает файлы других целей с тем же префиксом
+func TestFileSenderCleanupOwnSegments(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out")
+
+	others := []string{
+		path + ".pcap",
+		path + ".pcap." + time.Now().Add(-time.Hour).Format("20060102T150405.000000") + ".gz",
+		path + ".old",
+	}
+	for _, name := range others {
+		if err := os.WriteFile(name, []byte("x"), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newFileSender(t, config.FileTargetConfig{
+		Path:     path,
+		Format:   config.FileFormatRaw,
+		MaxSize:  1,
+		MaxFiles: 1,
+	})
+	for range 3 {
+		s.SendPacket([]byte("a"), fileSrc)
+		time.Sleep(time.Millisecond)
+	}
+	s.Close()
+
+	for _, name := range others {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("удален чужой файл: %v", err)
+		}
+	}
+	segments, err := filepath.Glob(path + ".2*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("ожидали 1 сегмент, получили %v", segments)
+	}
+}
+
+func TestFileSenderShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.log")
+	cfg := config.FileTargetConfig{Path: path}
+
+	s1 := newFileSender(t, cfg)
+	s2 := newFileSender(t, cfg)
+
+	s1.SendPacket([]byte("a"), fileSrc)
+	s1.Close()
+	// общий файл остается открытым, пока жив второй воркер
+	s2.SendPacket([]byte("b"), fileSrc)
+	s2.Close()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "a\nb\n" {
+		t.Fatalf("содержимое файла %q", b)
+	}
+}
+
+func TestFileSenderMetrics(t *testing.T) {
+	const pl = "file_metrics"
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	ctx := context.WithValue(context.Background(), config.PlNameKey, pl)
+	newSender := func(path string) sender.PacketSender {
+		s, err := sender.NewSender(ctx, config.TargetConfig{Type: config.TargetFile, File: &config.FileTargetConfig{Path: path}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// метрики под путем, как он задан в конфиге, как у воркеров и health
+	s := newSender("rel.log")
+	s.SendPacket([]byte("a"), fileSrc)
+	s.Close()
+	if st := metrics.Stats(pl).Targets["rel.log"]; st.Sent != 1 {
+		t.Errorf("rel.log: %+v", st)
+	}
+
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("нет /dev/full")
+	}
+	// запись больше буфера идет сразу в файл и получает ENOSPC
+	s = newSender("/dev/full")
+	s.SendPacket(make([]byte, 512*1024), fileSrc)
+	s.Close()
+	if st := metrics.Stats(pl).Targets["/dev/full"]; st.Errors == 0 || st.Sent != 0 {
+		t.Errorf("/dev/full: %+v", st)
+	}
+}
+
+func TestFileSenderReopen(t *testing.T) {
+	const pl = "file_reopen"
+	dir := filepath.Join(t.TempDir(), "out")
+	path := filepath.Join(dir, "out.log")
+
+	ctx := context.WithValue(context.Background(), config.PlNameKey, pl)
+	s, err := sender.NewSender(ctx, config.TargetConfig{Type: config.TargetFile, File: &config.FileTargetConfig{Path: path, MaxSize: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SendPacket([]byte("a"), fileSrc)
+
+	// каталог удален: новый сегмент не открыть, датаграммы считаются ошибками
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	s.SendPacket([]byte("b"), fileSrc)
+	s.SendPacket([]byte("c"), fileSrc)
+	if st := metrics.Stats(pl).Targets[path]; st.Errors != 2 || st.Sent != 1 {
+		t.Fatalf("без файла: %+v", st)
+	}
+
+	// flusher открывает файл, когда это снова возможно
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("файл не открыт повторно")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	s.SendPacket([]byte("d"), fileSrc)
+	if st := metrics.Stats(pl).Targets[path]; st.Errors != 2 || st.Sent != 2 {
+		t.Fatalf("после открытия: %+v", st)
+	}
+}
@@ -0,0 +1,380 @@
+package sender
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"udp_mirror/config"
+	"udp_mirror/pkg/logging"
+	"udp_mirror/pkg/metrics"
+)
+
+// Значения по умолчанию для HTTP цели
+const (
+	httpDefaultBatchSize     = 500
+	httpDefaultBatchBytes    = 1024 * 1024
+	httpDefaultFlushInterval = time.Second
+	httpDefaultTimeout       = 10 * time.Second
+	httpDefaultMaxRetries    = 3
+	httpDefaultRetryBackoff  = 200 * time.Millisecond
+	httpDefaultMaxBackoff    = 5 * time.Second
+	httpDefaultQueueSize     = 16
+)
+
+// HTTPSender собирает датаграммы в пачки и отправляет их POST запросами.
+// Пачка уходит по числу записей, объему данных или по таймеру.
+// Один HTTPSender обслуживает все воркеры цели.
+type HTTPSender struct {
+	cfg       config.HTTPTargetConfig
+	client    *http.Client
+	tmpl      *template.Template
+	plName    string
+	recipient string
+	metrics   metrics.Recorder
+	log       *slog.Logger
+
+	mu         sync.Mutex
+	batch      []jsonRecord
+	batchBytes int
+
+	queue   chan []jsonRecord
+	done    chan struct{}
+	flushed chan struct{} // закрывается при выходе из flushLoop
+	wg      sync.WaitGroup
+}
+
+var errHTTPQueueFull = errors.New("очередь отправки переполнена")
+
+// httpTemplateData - данные, доступные в шаблоне тела запроса
+type httpTemplateData struct {
+	Pipeline string
+	Records  []jsonRecord
+}
+
+var httpTemplateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"base64": func(b []byte) string {
+		return base64.StdEncoding.EncodeToString(b)
+	},
+	"text": func(b []byte) string {
+		return string(b)
+	},
+}
+
+// NewHTTPSender возвращает общий на все воркеры HTTPSender для цели
+func NewHTTPSender(ctx context.Context, target config.TargetConfig) (PacketSender, error) {
+	plName, _ := ctx.Value(config.PlNameKey).(string)
+
+	if target.HTTP == nil || target.HTTP.URL == "" {
+		return nil, errors.New("для http цели не указан http.url")
+	}
+	cfg := httpDefaults(*target.HTTP)
+
+	var tmpl *template.Template
+	switch cfg.Format {
+	case config.HTTPFormatNDJSON:
+	case config.HTTPFormatTemplate:
+		var err error
+		tmpl, err = template.New("body").Funcs(httpTemplateFuncs).Parse(cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("шаблон http цели: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("неизвестный формат http цели: %q", cfg.Format)
+	}
+
+	return acquireShared("http:"+plName+":"+cfg.URL+":"+settingsKey(cfg), func() (PacketSender, error) {
+		s := &HTTPSender{
+			cfg:       cfg,
+			client:    &http.Client{Timeout: cfg.Timeout},
+			tmpl:      tmpl,
+			plName:    plName,
+			recipient: target.Label(),
+			metrics:   metrics.Default(),
+			log:       logging.For("sender").With("pipeline", plName, "target", target.Label()),
+			queue:     make(chan []jsonRecord, cfg.QueueSize),
+			done:      make(chan struct{}),
+			flushed:   make(chan struct{}),
+		}
+
+		s.wg.Add(1)
+		go s.postLoop()
+		go s.flushLoop()
+
+		return s, nil
+	})
+}
+
+func httpDefaults(cfg config.HTTPTargetConfig) config.HTTPTargetConfig {
+	if cfg.Format == "" {
+		cfg.Format = config.HTTPFormatNDJSON
+	}
+	if cfg.ContentType == "" {
+		cfg.ContentType = "application/x-ndjson"
+		if cfg.Format == config.HTTPFormatTemplate {
+			cfg.ContentType = "application/json"
+		}
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = httpDefaultBatchSize
+	}
+	if cfg.BatchBytes <= 0 {
+		cfg.BatchBytes = httpDefaultBatchBytes
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = httpDefaultFlushInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = httpDefaultTimeout
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	} else if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = httpDefaultMaxRetries
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = httpDefaultRetryBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = httpDefaultMaxBackoff
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = httpDefaultQueueSize
+	}
+	return cfg
+}
+
+func (s *HTTPSender) SendPacket(data []byte, src config.AddrConfig) {
+	payload := make([]byte, len(data))
+	copy(payload, data)
+
+	rec := jsonRecord{
+		Time:     time.Now(),
+		Pipeline: s.plName,
+		SrcIP:    src.Host.String(),
+		SrcPort:  src.Port,
+		Payload:  payload,
+	}
+
+	s.mu.Lock()
+	s.batch = append(s.batch, rec)
+	s.batchBytes += len(payload)
+
+	var full []jsonRecord
+	if len(s.batch) >= s.cfg.BatchSize || s.batchBytes >= s.cfg.BatchBytes {
+		full = s.takeBatch()
+	}
+	s.mu.Unlock()
+
+	if full != nil {
+		s.enqueue(full)
+	}
+}
+
+// takeBatch забирает накопленную пачку. Вызывается под s.mu.
+func (s *HTTPSender) takeBatch() []jsonRecord {
+	batch := s.batch
+	s.batch = make([]jsonRecord, 0, s.cfg.BatchSize)
+	s.batchBytes = 0
+	return batch
+}
+
+// enqueue ставит пачку в очередь отправки, не блокируя воркер
+func (s *HTTPSender) enqueue(batch []jsonRecord) {
+	select {
+	case s.queue <- batch:
+	default:
+		s.metrics.DeliveryErrors(s.plName, s.recipient, "queue_full", len(batch))
+		logging.DefaultLimiter().Error(s.log,
+			logging.LimitKey{Pipeline: s.plName, Target: s.recipient, Type: "queue_full"},
+			"Очередь HTTP переполнена, пачка отброшена", errHTTPQueueFull)
+	}
+}
+
+// flushLoop отправляет неполную пачку по таймеру
+func (s *HTTPSender) flushLoop() {
+	defer close(s.flushed)
+
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			var batch []jsonRecord
+			if len(s.batch) > 0 {
+				batch = s.takeBatch()
+			}
+			s.mu.Unlock()
+
+			if batch != nil {
+				s.enqueue(batch)
+			}
+		}
+	}
+}
+
+func (s *HTTPSender) postLoop() {
+	defer s.wg.Done()
+
+	for batch := range s.queue {
+		s.post(batch)
+	}
+}
+
+// post отправляет пачку с повторами и экспоненциальной задержкой
+func (s *HTTPSender) post(batch []jsonRecord) {
+	s.metrics.HTTPBatch(s.plName, s.recipient, len(batch))
+
+	body, err := s.encode(batch)
+	if err != nil {
+		s.metrics.DeliveryErrors(s.plName, s.recipient, "encode", len(batch))
+		s.log.Error("Ошибка формирования тела запроса", logging.Err(err))
+		return
+	}
+
+	backoff := s.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		code, retryAfter, err := s.do(body)
+		if err == nil && code < 300 {
+			for _, rec := range batch {
+				s.metrics.Sent(s.plName, s.recipient, len(rec.Payload))
+			}
+			return
+		}
+
+		if !retryable(code, err) || attempt >= s.cfg.MaxRetries {
+			reason := "http_" + strconv.Itoa(code)
+			if err != nil {
+				reason = "request"
+			}
+			s.metrics.DeliveryErrors(s.plName, s.recipient, reason, len(batch))
+			if err == nil {
+				err = fmt.Errorf("код ответа %d", code)
+			}
+			logging.DefaultLimiter().Error(s.log,
+				logging.LimitKey{Pipeline: s.plName, Target: s.recipient, Type: reason}, "Пачка не доставлена", err)
+			return
+		}
+
+		delay := backoff + rand.N(backoff/2+1) // #nosec G404 -- разброс задержки, не криптография
+		if retryAfter > delay {
+			delay = min(retryAfter, s.cfg.MaxBackoff)
+		}
+		time.Sleep(delay)
+		backoff = min(backoff*2, s.cfg.MaxBackoff)
+	}
+}
+
+// do выполняет один запрос и возвращает код ответа и Retry-After
+func (s *HTTPSender) do(body []byte) (int, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	req.Header.Set("Content-Type", s.cfg.ContentType)
+	if s.cfg.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	}
+	for k, v := range s.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.metrics.HTTPResponse(s.plName, s.recipient, "error", time.Since(start))
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	s.metrics.HTTPResponse(s.plName, s.recipient, strconv.Itoa(resp.StatusCode), time.Since(start))
+
+	var retryAfter time.Duration
+	if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && sec > 0 {
+		retryAfter = time.Duration(sec) * time.Second
+	}
+	return resp.StatusCode, retryAfter, nil
+}
+
+// encode формирует тело запроса: NDJSON или шаблон, при необходимости сжатое gzip
+func (s *HTTPSender) encode(batch []jsonRecord) ([]byte, error) {
+	var buf bytes.Buffer
+
+	var w io.Writer = &buf
+	var zw *gzip.Writer
+	if s.cfg.Gzip {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+
+	if s.tmpl != nil {
+		if err := s.tmpl.Execute(w, httpTemplateData{Pipeline: s.plName, Records: batch}); err != nil {
+			return nil, err
+		}
+	} else {
+		enc := json.NewEncoder(w)
+		for _, rec := range batch {
+			if err := enc.Encode(rec); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// retryable - повторяем сетевые ошибки, 429 и 5xx
+func retryable(code int, err error) bool {
+	if err != nil {
+		return true
+	}
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// Close отправляет накопленное и дожидается завершения запросов
+func (s *HTTPSender) Close() {
+	close(s.done)
+	<-s.flushed
+
+	s.mu.Lock()
+	batch := s.takeBatch()
+	s.mu.Unlock()
+
+	if len(batch) > 0 {
+		s.queue <- batch
+	}
+	close(s.queue)
+
+	s.wg.Wait()
+	s.log.Info("HTTP закрыт")
+}
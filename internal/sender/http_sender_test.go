@@ -0,0 +1,226 @@
+package sender_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/sender"
+)
+
+type httpBatch struct {
+	header  http.Header
+	records []map[string]any
+}
+
+// batchServer принимает NDJSON пачки; первые failFirst запросов получают 503
+type batchServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	batches   []httpBatch
+	requests  atomic.Int32
+	failFirst int32
+}
+
+func newBatchServer(t *testing.T, failFirst int32) *batchServer {
+	t.Helper()
+
+	bs := &batchServer{failFirst: failFirst}
+	bs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bs.requests.Add(1) <= bs.failFirst {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+
+		var batch httpBatch
+		batch.header = r.Header.Clone()
+		sc := bufio.NewScanner(body)
+		for sc.Scan() {
+			var rec map[string]any
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				t.Error(err)
+			}
+			batch.records = append(batch.records, rec)
+		}
+
+		bs.mu.Lock()
+		bs.batches = append(bs.batches, batch)
+		bs.mu.Unlock()
+	}))
+	t.Cleanup(bs.Close)
+	return bs
+}
+
+func (bs *batchServer) snapshot() []httpBatch {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return append([]httpBatch(nil), bs.batches...)
+}
+
+func newHTTPSender(t *testing.T, cfg config.HTTPTargetConfig) sender.PacketSender {
+	t.Helper()
+
+	ctx := context.WithValue(context.Background(), config.PlNameKey, "test")
+	s, err := sender.NewSender(ctx, config.TargetConfig{Type: config.TargetHTTP, HTTP: &cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+var httpSrc = config.AddrConfig{Host: net.IPv4(192, 0, 2, 1), Port: 514}
+
+func TestHTTPSenderBatchBySize(t *testing.T) {
+	srv := newBatchServer(t, 0)
+	s := newHTTPSender(t, config.HTTPTargetConfig{
+		URL:           srv.URL,
+		Gzip:          true,
+		Token:         "secret",
+		Headers:       map[string]string{"X-Source": "udp_mirror"},
+		BatchSize:     3,
+		FlushInterval: time.Hour,
+	})
+
+	for range 7 {
+		s.SendPacket([]byte("hello"), httpSrc)
+	}
+	s.Close()
+
+	batches := srv.snapshot()
+	if len(batches) != 3 {
+		t.Fatalf("ожидали 3 пачки (3+3+1 при закрытии), получили %d", len(batches))
+	}
+	sizes := []int{len(batches[0].records), len(batches[1].records), len(batches[2].records)}
+	if sizes[0] != 3 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Fatalf("размеры пачек %v", sizes)
+	}
+
+	h := batches[0].header
+	if h.Get("Authorization") != "Bearer secret" || h.Get("X-Source") != "udp_mirror" {
+		t.Fatalf("нет заголовков авторизации: %v", h)
+	}
+	if h.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Content-Type %q", h.Get("Content-Type"))
+	}
+
+	rec := batches[0].records[0]
+	// "hello" в base64
+	if rec["payload"] != "aGVsbG8=" || rec["src_ip"] != "192.0.2.1" || rec["src_port"] != float64(514) {
+		t.Fatalf("неверная запись %v", rec)
+	}
+}
+
+func TestHTTPSenderFlushInterval(t *testing.T) {
+	srv := newBatchServer(t, 0)
+	s := newHTTPSender(t, config.HTTPTargetConfig{
+		URL:           srv.URL,
+		BatchSize:     1000,
+		FlushInterval: 20 * time.Millisecond,
+	})
+	defer s.Close()
+
+	s.SendPacket([]byte("x"), httpSrc)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(srv.snapshot()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("неполная пачка не отправлена по таймеру")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHTTPSenderRetry(t *testing.T) {
+	srv := newBatchServer(t, 2)
+	s := newHTTPSender(t, config.HTTPTargetConfig{
+		URL:          srv.URL,
+		BatchSize:    1,
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+	})
+
+	s.SendPacket([]byte("x"), httpSrc)
+	s.Close()
+
+	if n := srv.requests.Load(); n != 3 {
+		t.Fatalf("ожидали 3 попытки, получили %d", n)
+	}
+	if len(srv.snapshot()) != 1 {
+		t.Fatal("пачка не доставлена после повторов")
+	}
+}
+
+func TestHTTPSenderGivesUp(t *testing.T) {
+	srv := newBatchServer(t, 100)
+	s := newHTTPSender(t, config.HTTPTargetConfig{
+		URL:          srv.URL,
+		BatchSize:    1,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+	})
+
+	s.SendPacket([]byte("x"), httpSrc)
+	s.Close()
+
+	if n := srv.requests.Load(); n != 3 {
+		t.Fatalf("ожидали 1 попытку и 2 повтора, получили %d", n)
+	}
+}
+
+func TestHTTPSenderTemplate(t *testing.T) {
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	s := newHTTPSender(t, config.HTTPTargetConfig{
+		URL:       srv.URL,
+		Format:    config.HTTPFormatTemplate,
+		Template:  `{"pl":"{{.Pipeline}}","msgs":[{{range $i, $r := .Records}}{{if $i}},{{end}}{{json (text $r.Payload)}}{{end}}]}`,
+		BatchSize: 2,
+	})
+	s.SendPacket([]byte("a"), httpSrc)
+	s.SendPacket([]byte("b"), httpSrc)
+	s.Close()
+
+	if string(body) != `{"pl":"test","msgs":["a","b"]}` {
+		t.Fatalf("тело запроса %s", body)
+	}
+}
+
+// проверка конфига знает все функции шаблона http цели
+func TestHTTPTemplateFuncsValidated(t *testing.T) {
+	for name := range sender.HTTPTemplateFuncs {
+		data := `pipeline:
+  - name: a
+    input: {host: 0.0.0.0, port: 2088}
+    targets:
+      - {type: http, http: {url: "http://10.0.0.1/", format: template, template: "{{` + name + ` .Payload}}"}}
+`
+		if _, err := config.ParseConfig("test.yml", []byte(data)); err != nil {
+			t.Errorf("функция %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"udp_mirror/config"
+	"udp_mirror/pkg/logging"
+	"udp_mirror/pkg/metrics"
+)
+
+const (
+	kafkaDefaultBuffer = 10000
+	kafkaCloseTimeout  = 10 * time.Second
+
+	// Заголовки сообщений
+	kafkaHeaderSrcIP    = "src_ip"
+	kafkaHeaderSrcPort  = "src_port"
+	kafkaHeaderPipeline = "pipeline"
+)
+
+// KafkaSender публикует датаграммы в топик Kafka.
+// Ключ сообщения - IP источника, поэтому датаграммы одного источника попадают в одну партицию.
+// Один KafkaSender (и одно подключение к кластеру) обслуживает все воркеры цели.
+type KafkaSender struct {
+	client    *kgo.Client
+	topic     string
+	recipient string
+	plName    string
+	metrics   metrics.Recorder
+	log       *slog.Logger
+}
+
+// NewKafkaSender возвращает общий на все воркеры KafkaSender для цели
+func NewKafkaSender(ctx context.Context, target config.TargetConfig) (PacketSender, error) {
+	plName, _ := ctx.Value(config.PlNameKey).(string)
+
+	cfg := target.Kafka
+	if cfg == nil || len(cfg.Brokers) == 0 || cfg.Topic == "" {
+		return nil, errors.New("для kafka цели нужно указать kafka.brokers и kafka.topic")
+	}
+
+	opts, err := kafkaOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return acquireShared("kafka:"+plName+":"+settingsKey(*cfg), func() (PacketSender, error) {
+		client, err := kgo.NewClient(opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		return &KafkaSender{
+			client:    client,
+			topic:     cfg.Topic,
+			recipient: target.Label(),
+			plName:    plName,
+			metrics:   metrics.Default(),
+			log:       logging.For("sender").With("pipeline", plName, "target", target.Label()),
+		}, nil
+	})
+}
+
+func kafkaOptions(cfg *config.KafkaTargetConfig) ([]kgo.Opt, error) {
+	buffer := cfg.BufferSize
+	if buffer <= 0 {
+		buffer = kafkaDefaultBuffer
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.DefaultProduceTopic(cfg.Topic),
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil)),
+		kgo.MaxBufferedRecords(buffer),
+	}
+
+	if cfg.ClientID != "" {
+		opts = append(opts, kgo.ClientID(cfg.ClientID))
+	}
+	if cfg.BatchBytes > 0 {
+		opts = append(opts, kgo.ProducerBatchMaxBytes(cfg.BatchBytes))
+	}
+	if cfg.Linger > 0 {
+		opts = append(opts, kgo.ProducerLinger(cfg.Linger))
+	}
+
+	switch cfg.Compression {
+	case "", "none":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.NoCompression()))
+	case "gzip":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.GzipCompression()))
+	case "snappy":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.SnappyCompression()))
+	case "lz4":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.Lz4Compression()))
+	case "zstd":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.ZstdCompression()))
+	default:
+		return nil, fmt.Errorf("неизвестное сжатие kafka: %q", cfg.Compression)
+	}
+
+	// идемпотентная запись возможна только с подтверждением от всех реплик
+	switch cfg.Acks {
+	case "", "all":
+		opts = append(opts, kgo.RequiredAcks(kgo.AllISRAcks()))
+	case "leader":
+		opts = append(opts, kgo.RequiredAcks(kgo.LeaderAck()), kgo.DisableIdempotentWrite())
+	case "none":
+		opts = append(opts, kgo.RequiredAcks(kgo.NoAck()), kgo.DisableIdempotentWrite())
+	default:
+		return nil, fmt.Errorf("неизвестный режим acks kafka: %q", cfg.Acks)
+	}
+
+	return opts, nil
+}
+
+func (s *KafkaSender) SendPacket(data []byte, src config.AddrConfig) {
+	// запись уходит асинхронно, поэтому данные копируем
+	value := make([]byte, len(data))
+	copy(value, data)
+
+	srcIP := src.Host.String()
+	rec := &kgo.Record{
+		Topic: s.topic,
+		Key:   []byte(srcIP),
+		Value: value,
+		Headers: []kgo.RecordHeader{
+			{Key: kafkaHeaderSrcIP, Value: []byte(srcIP)},
+			{Key: kafkaHeaderSrcPort, Value: []byte(strconv.Itoa(int(src.Port)))},
+			{Key: kafkaHeaderPipeline, Value: []byte(s.plName)},
+		},
+	}
+
+	// TryProduce не блокирует воркер: при заполненном буфере запись сразу отклоняется
+	s.client.TryProduce(context.Background(), rec, s.delivered)
+}
+
+// delivered вызывается клиентом после подтверждения или ошибки доставки
+func (s *KafkaSender) delivered(rec *kgo.Record, err error) {
+	if err == nil {
+		s.metrics.Sent(s.plName, s.recipient, len(rec.Value))
+		return
+	}
+
+	reason := "produce"
+	switch {
+	case errors.Is(err, kgo.ErrMaxBuffered):
+		reason = "buffer_full"
+	case errors.Is(err, kgo.ErrClientClosed):
+		reason = "closed"
+	case errors.Is(err, kgo.ErrRecordTimeout):
+		reason = "timeout"
+	}
+	s.metrics.DeliveryErrors(s.plName, s.recipient, reason, 1)
+
+	logging.DefaultLimiter().Error(s.log,
+		logging.LimitKey{Pipeline: s.plName, Target: s.recipient, Type: reason}, "Ошибка доставки в Kafka", err)
+}
+
+func (s *KafkaSender) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaCloseTimeout)
+	defer cancel()
+
+	if err := s.client.Flush(ctx); err != nil {
+		s.log.Error("Не все записи доставлены в Kafka", logging.Err(err))
+	}
+	s.client.Close()
+
+	s.log.Info("Kafka закрыт")
+}
@@ -0,0 +1,131 @@
+package sender_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/sender"
+)
+
+func TestKafkaSender(t *testing.T) {
+	const topic = "udp-mirror"
+
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(3, topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+
+	ctx := context.WithValue(context.Background(), config.PlNameKey, "test")
+	target := config.TargetConfig{
+		Type: config.TargetKafka,
+		Kafka: &config.KafkaTargetConfig{
+			Brokers:     cluster.ListenAddrs(),
+			Topic:       topic,
+			Compression: "zstd",
+			Linger:      5 * time.Millisecond,
+		},
+	}
+
+	// два воркера одной цели делят одного клиента
+	s1, err := sender.NewSender(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := sender.NewSender(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sources := []config.AddrConfig{
+		{Host: net.IPv4(10, 0, 0, 1), Port: 1001},
+		{Host: net.IPv4(10, 0, 0, 2), Port: 1002},
+		{Host: net.IPv4(10, 0, 0, 3), Port: 1003},
+	}
+	const perSource = 20
+	for i := range perSource {
+		for j, src := range sources {
+			s := s1
+			if j%2 == 1 {
+				s = s2
+			}
+			s.SendPacket([]byte{byte(j), byte(i)}, src)
+		}
+	}
+	s1.Close()
+	s2.Close() // последний Close дожидается доставки
+
+	consumer, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumeTopics(topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+
+	partitions := map[string]int32{}
+	next := map[string]int{}
+	total := 0
+
+	fetchCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for total < perSource*len(sources) {
+		fetches := consumer.PollFetches(fetchCtx)
+		if fetchCtx.Err() != nil {
+			t.Fatalf("прочитали %d из %d сообщений", total, perSource*len(sources))
+		}
+		fetches.EachRecord(func(r *kgo.Record) {
+			total++
+			key := string(r.Key)
+
+			headers := map[string]string{}
+			for _, h := range r.Headers {
+				headers[h.Key] = string(h.Value)
+			}
+			if headers["src_ip"] != key || headers["pipeline"] != "test" || headers["src_port"] == "" {
+				t.Errorf("неверные заголовки %v для ключа %s", headers, key)
+			}
+
+			if p, ok := partitions[key]; ok && p != r.Partition {
+				t.Errorf("источник %s попал в партиции %d и %d", key, p, r.Partition)
+			}
+			partitions[key] = r.Partition
+
+			// внутри партиции порядок одного источника сохраняется
+			if int(r.Value[1]) < next[key] {
+				t.Errorf("источник %s: сообщение %d после %d", key, r.Value[1], next[key])
+			}
+			next[key] = int(r.Value[1])
+		})
+	}
+
+	if len(partitions) != len(sources) {
+		t.Fatalf("ожидали сообщения от %d источников, получили %v", len(sources), partitions)
+	}
+}
+
+func TestKafkaSenderBadConfig(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := sender.NewSender(ctx, config.TargetConfig{
+		Type:  config.TargetKafka,
+		Kafka: &config.KafkaTargetConfig{Brokers: []string{"127.0.0.1:1"}, Topic: "t", Compression: "brotli"},
+	})
+	if err == nil {
+		t.Fatal("ожидали ошибку для неизвестного сжатия")
+	}
+
+	_, err = sender.NewSender(ctx, config.TargetConfig{Type: config.TargetKafka})
+	if err == nil {
+		t.Fatal("ожидали ошибку без brokers/topic")
+	}
+}
@@ -0,0 +1,77 @@
+package sender
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ipWriter отправляет IPv4 пакет, собранный из частей; первая часть начинается с заголовка IP
+type ipWriter interface {
+	WriteIP(dst net.IP, parts [][]byte) error
+	Close() error
+}
+
+// rawWriter отправляет пакеты через raw сокет с IP_HDRINCL одним sendmsg
+// без склейки частей. Используется одним воркером.
+type rawWriter struct {
+	conn net.PacketConn
+	rc   syscall.RawConn
+
+	sa    unix.SockaddrInet4
+	parts [][]byte
+	err   error
+	send  func(fd uintptr) bool // создается один раз, чтобы не выделять замыкание на пакет
+}
+
+func newRawWriter(listen string) (*rawWriter, error) {
+	conn, err := net.ListenPacket("ip4:udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := conn.(*net.IPConn).SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// заголовок IP пишет отправитель
+	var opErr error
+	err = rc.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_HDRINCL, 1)
+	})
+	if err == nil {
+		err = opErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	w := &rawWriter{conn: conn, rc: rc}
+	w.send = func(fd uintptr) bool {
+		_, w.err = unix.SendmsgBuffers(int(fd), w.parts, nil, &w.sa, 0)
+		return w.err != unix.EAGAIN
+	}
+	return w, nil
+}
+
+func (w *rawWriter) WriteIP(dst net.IP, parts [][]byte) error {
+	copy(w.sa.Addr[:], dst.To4())
+	w.parts = parts
+	defer func() { w.parts = nil }()
+
+	if err := w.rc.Write(w.send); err != nil {
+		return err
+	}
+	if w.err != nil {
+		return os.NewSyscallError("sendmsg", w.err)
+	}
+	return nil
+}
+
+func (w *rawWriter) Close() error {
+	return w.conn.Close()
+}
@@ -1,11 +1,45 @@
 package sender
 
 import (
+	"context"
+	"fmt"
+
 	"udp_mirror/config"
+	"udp_mirror/internal/packet"
 )
 
-// PacketSender определяет интерфейс для отправки UDP-пакетов
+// PacketSender определяет интерфейс для отправки UDP-пакетов.
+// data действительны только до возврата из SendPacket: буфер общий для всех целей
+// и после отправки возвращается в пул, отложенная отправка должна копировать данные.
 type PacketSender interface {
 	SendPacket(data []byte, src config.AddrConfig)
 	Close()
 }
+
+// BufferSender - отправитель, которому нужен буфер пула целиком, например чтобы
+// дописать заголовки в место перед данными. Ссылку на буфер освобождает вызывающий.
+// origin - адреса датаграммы до подмены источника, для ответа ICMP источнику.
+type BufferSender interface {
+	SendBuffer(b *packet.Buffer, src config.AddrConfig, origin packet.Origin)
+}
+
+// FragmentSender - отправитель, который пересылает IP фрагменты без сборки датаграммы.
+// Цели без него получают от слушателя raw только целые датаграммы.
+type FragmentSender interface {
+	SendFragment(data []byte, frag packet.Fragment, src config.AddrConfig)
+}
+
+// NewSender создает PacketSender по типу цели
+func NewSender(ctx context.Context, target config.TargetConfig) (PacketSender, error) {
+	switch target.Kind() {
+	case config.TargetUDP:
+		return NewUDPSender(ctx, target)
+	case config.TargetFile:
+		return NewFileSender(ctx, target)
+	case config.TargetKafka:
+		return NewKafkaSender(ctx, target)
+	case config.TargetHTTP:
+		return NewHTTPSender(ctx, target)
+	}
+	return nil, fmt.Errorf("неизвестный тип цели: %q", target.Type)
+}
@@ -0,0 +1,69 @@
+package sender
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Некоторые цели (файл, внешний клиент) должны существовать в одном экземпляре
+// на все воркеры цели. Фабрика отдает каждому воркеру обертку над общим экземпляром,
+// а сам экземпляр закрывается вместе с последней оберткой.
+
+var (
+	sharedMu sync.Mutex
+	shared   = map[string]*sharedEntry{}
+)
+
+type sharedEntry struct {
+	sender PacketSender
+	refs   int
+}
+
+type sharedSender struct {
+	PacketSender
+	key  string
+	once sync.Once
+}
+
+// settingsKey возвращает настройки цели как часть ключа общего экземпляра: цели
+// с одним адресом, но разными настройками получают разные экземпляры
+func settingsKey(cfg any) string {
+	return fmt.Sprintf("%+v", cfg)
+}
+
+// acquireShared возвращает общий экземпляр по ключу, создавая его при первом обращении
+func acquireShared(key string, create func() (PacketSender, error)) (PacketSender, error) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+
+	e, ok := shared[key]
+	if !ok {
+		s, err := create()
+		if err != nil {
+			return nil, err
+		}
+		e = &sharedEntry{sender: s}
+		shared[key] = e
+	}
+	e.refs++
+
+	return &sharedSender{PacketSender: e.sender, key: key}, nil
+}
+
+// Close уменьшает счетчик ссылок и закрывает общий экземпляр на последней
+func (s *sharedSender) Close() {
+	s.once.Do(func() {
+		sharedMu.Lock()
+		e := shared[s.key]
+		e.refs--
+		last := e.refs == 0
+		if last {
+			delete(shared, s.key)
+		}
+		sharedMu.Unlock()
+
+		if last {
+			e.sender.Close()
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package sender
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"udp_mirror/config"
+)
+
+// sharedOf возвращает общий экземпляр за оберткой и функцию ее закрытия
+func sharedOf(t *testing.T, target config.TargetConfig) (PacketSender, func()) {
+	t.Helper()
+
+	ctx := context.WithValue(context.Background(), config.PlNameKey, "shared")
+	s, err := NewSender(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*sharedSender).PacketSender, s.Close
+}
+
+func TestSharedBySettings(t *testing.T) {
+	kafka := func(acks string) config.TargetConfig {
+		return config.TargetConfig{Type: config.TargetKafka, Kafka: &config.KafkaTargetConfig{
+			Brokers: []string{"127.0.0.1:1"}, Topic: "t", Acks: acks, Linger: time.Millisecond,
+		}}
+	}
+	web := func(token string) config.TargetConfig {
+		return config.TargetConfig{Type: config.TargetHTTP, HTTP: &config.HTTPTargetConfig{
+			URL: "http://127.0.0.1:1/ingest", Token: token, Headers: map[string]string{"X-Team": "a"},
+		}}
+	}
+
+	for _, c := range []struct {
+		name       string
+		a, same, b config.TargetConfig
+	}{
+		{"kafka", kafka("all"), kafka("all"), kafka("leader")},
+		{"http", web("t1"), web("t1"), web("t2")},
+	} {
+		a, closeA := sharedOf(t, c.a)
+		same, closeSame := sharedOf(t, c.same)
+		b, closeB := sharedOf(t, c.b)
+		if a != same {
+			t.Errorf("%s: воркеры одной цели не делят экземпляр", c.name)
+		}
+		if a == b {
+			t.Errorf("%s: цель с другими настройками получила чужой экземпляр", c.name)
+		}
+		closeA()
+		closeSame()
+		closeB()
+	}
+}
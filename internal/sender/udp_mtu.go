@@ -0,0 +1,144 @@
+package sender
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/packet"
+	"udp_mirror/internal/pcap"
+	"udp_mirror/pkg/logging"
+)
+
+// defaultMTU - MTU, если маршрут до цели определить не удалось
+const defaultMTU = 1500
+
+// icmpInterval - не чаще одного ICMP сообщения источнику за интервал на воркер (RFC 1812)
+const icmpInterval = 100 * time.Millisecond
+
+// routeMTU возвращает MTU маршрута до dst: ядро выбирает маршрут для подключенного
+// UDP сокета и сообщает его MTU (с учетом известного Path MTU) через IP_MTU
+func routeMTU(dst net.IP) (int, error) {
+	fd, err := routeSocket(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	return unix.GetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU)
+}
+
+// localAddr возвращает локальный адрес, с которого ядро отправило бы пакет на dst
+func localAddr(dst net.IP) (net.IP, error) {
+	fd, err := routeSocket(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	local, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, err
+	}
+	addr := local.(*unix.SockaddrInet4).Addr
+	return net.IP(addr[:]), nil
+}
+
+// routeSocket возвращает UDP сокет, подключенный к dst: при подключении ядро выбирает
+// маршрут, пакеты при этом не отправляются
+func routeSocket(dst net.IP) (int, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+
+	sa := &unix.SockaddrInet4{Port: 9}
+	copy(sa.Addr[:], dst.To4())
+	if err := unix.Connect(fd, sa); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// pathMTU возвращает MTU до адреса: заданный в цели или MTU маршрута,
+// определенный при первой отправке на адрес
+func (s *UDPSender) pathMTU(dst net.IP) int {
+	if s.mtu > 0 {
+		return s.mtu
+	}
+
+	var key [4]byte
+	copy(key[:], dst.To4())
+	if mtu, ok := s.mtus[key]; ok {
+		return mtu
+	}
+
+	mtu, err := routeMTU(dst)
+	if err != nil {
+		mtu = defaultMTU
+		s.log.Warn("Не удалось определить MTU маршрута", "dst", dst.String(), "mtu", mtu, logging.Err(err))
+	}
+	if s.mtus == nil {
+		s.mtus = map[[4]byte]int{}
+	}
+	s.mtus[key] = mtu
+	return mtu
+}
+
+// tooBig отбрасывает датаграмму больше MTU при запрете фрагментации. В режиме icmp
+// исходному источнику отправляется ICMP "fragmentation needed" с MTU, как это сделал бы
+// маршрутизатор на пути пакета с флагом DF. В сообщении цитируется датаграмма, как ее
+// отправил источник (на адрес входа), чтобы он обновил Path MTU своего пути.
+// Без адресов приема (воспроизведение) ICMP не отправляется.
+func (s *UDPSender) tooBig(data []byte, origin packet.Origin, mtu int) {
+	length := udpHeaderLen + len(data)
+	s.metrics.DeliveryErrors(s.plName, s.recipient, "too_big", 1)
+	logging.DefaultLimiter().Error(s.log,
+		logging.LimitKey{Pipeline: s.plName, Target: s.recipient, Type: "too_big"},
+		"Датаграмма больше MTU цели", fmt.Errorf("%d байт при MTU %d", ipv4.HeaderLen+length, mtu))
+
+	src := origin.Src
+	if s.df != config.DFICMP || src.Host.To4() == nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(s.icmpAt) < icmpInterval {
+		return
+	}
+	s.icmpAt = now
+
+	input := origin.Dst.Host.To4()
+	if input == nil || input.IsUnspecified() {
+		// вход слушает все адреса: источник писал на адрес, с которого ему ответило бы ядро
+		var err error
+		if input, err = localAddr(src.Host); err != nil {
+			s.log.Warn("Не удалось определить адрес входа для ICMP", "src", src.Host.String(), logging.Err(err))
+			return
+		}
+	}
+
+	// заголовок IP (адрес и ID заполняет ядро), ICMP: тип, код, сумма, MTU,
+	// затем заголовок исходного пакета и первые 8 байт его данных (заголовок UDP)
+	var msg [ipv4.HeaderLen + 8 + ipv4.HeaderLen + udpHeaderLen]byte
+	putIPv4(msg[:], len(msg)-ipv4.HeaderLen, 0, 0, nil, src.Host)
+	msg[9] = 1 // ICMP
+
+	icmp := msg[ipv4.HeaderLen:]
+	icmp[0], icmp[1] = 3, 4 // destination unreachable, fragmentation needed
+	binary.BigEndian.PutUint16(icmp[6:], uint16(mtu))
+	orig := icmp[8:]
+	putIPv4(orig, length, 0, dontFragment, src.Host, input)
+	binary.BigEndian.PutUint16(orig[10:], pcap.Checksum(orig[:ipv4.HeaderLen]))
+	putUDP(orig[ipv4.HeaderLen:], src.Port, origin.Dst.Port, length)
+	binary.BigEndian.PutUint16(icmp[2:], pcap.Checksum(icmp))
+
+	s.parts = append(s.parts[:0], msg[:])
+	if err := s.writer.WriteIP(src.Host, s.parts); err != nil {
+		s.writeError(err)
+	}
+}
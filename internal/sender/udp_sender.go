@@ -2,171 +2,301 @@ package sender
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
-	"log"
+	"hash/maphash"
 	"log/slog"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/ipv4"
 
 	"udp_mirror/config"
+	"udp_mirror/internal/capture"
+	"udp_mirror/internal/packet"
+	"udp_mirror/internal/pcap"
+	"udp_mirror/internal/resolver"
+	"udp_mirror/pkg/logging"
 	"udp_mirror/pkg/metrics"
 )
 
-var id uint16
+// ipIdents - счетчики IP ID, выбираемые по хешу пары адресов, как ip_idents в Linux.
+// Пакеты одной пары от всех воркеров и целей берут ID из общего атомарного счетчика
+// и не повторяются, пока пара не отправит 65536 пакетов. Начальное значение для пары
+// задает случайный ключ хеша, так что ID не предсказуемы снаружи (RFC 6864).
+var (
+	ipIdents    [2048]atomic.Uint32
+	ipIdentSeed = maphash.MakeSeed()
+)
+
+// nextID возвращает IP ID для пакета от src к dst
+func nextID(src, dst net.IP) uint16 {
+	var key [8]byte
+	copy(key[:4], src.To4())
+	copy(key[4:], dst.To4())
+	h := maphash.Bytes(ipIdentSeed, key[:])
+	return uint16(h>>48) + uint16(ipIdents[h%uint64(len(ipIdents))].Add(1))
+}
+
+// udpHeaderLen - длина заголовка UDP
+const udpHeaderLen = 8
+
+// Флаги в поле смещения фрагмента
+const (
+	dontFragment  = 0x4000
+	moreFragments = 0x2000
+)
 
 type UDPSender struct {
-	dst     config.AddrConfig
-	mtu     int
-	conn    net.PacketConn
-	rawConn *ipv4.RawConn
+	port   uint16
+	addrs  *resolver.Addrs // адреса цели: один IP или адреса имени, обновляемые по TTL
+	fanOut bool            // копия на каждый адрес имени
+	mtu    int             // MTU из конфига, 0 - MTU маршрута
+	mtus   map[[4]byte]int // MTU маршрутов до адресов цели
+	df     string          // обработка датаграмм больше MTU
+	icmpAt time.Time       // время последнего ICMP источнику
+	writer ipWriter
+	hdr    [ipv4.HeaderLen + udpHeaderLen]byte // заголовки, когда буфер данных нельзя изменять
+	parts  [][]byte                            // части пакета для writer
 	// mu      sync.Mutex
-	plName string
+	plName    string
+	recipient string
+	metrics   metrics.Recorder
+	log       *slog.Logger
 }
 
 func NewUDPSender(ctx context.Context, target config.TargetConfig) (PacketSender, error) {
 	plName, _ := ctx.Value(config.PlNameKey).(string)
 
 	listen := "127.0.0.1"
-	if target.Host.String() != listen {
+	if target.Host != listen {
 		listen = ""
 	}
 
-	conn, err := net.ListenPacket("ip4:udp", listen)
+	writer, err := newRawWriter(listen)
 	if err != nil {
 		return nil, err
 	}
 
-	rawConn, err := ipv4.NewRawConn(conn)
-	if err != nil {
-		return nil, err
-	}
-
-	dst := config.AddrConfig{
-		Host: target.Host,
-		Port: target.Port,
-	}
-
-	mtu := 1480 // 1500 - 20 (ip)  - 8 (udp)
-	if dst.Host.String() == "127.0.0.1" {
-		mtu = 65508
+	addrs := resolver.Static(target.IP())
+	if target.IP() == nil {
+		addrs = resolver.Acquire(target.Host)
 	}
 
 	return &UDPSender{
-		dst:     dst,
-		mtu:     mtu,
-		conn:    conn,
-		rawConn: rawConn,
-		plName:  plName,
+		port:      target.Port,
+		addrs:     addrs,
+		fanOut:    target.FanOut,
+		mtu:       target.MTU,
+		df:        target.DF,
+		writer:    writer,
+		parts:     make([][]byte, 0, 2),
+		plName:    plName,
+		recipient: target.Label(),
+		metrics:   metrics.Default(),
+		log:       logging.For("sender").With("pipeline", plName, "target", target.Label()),
 	}, nil
 }
 
 func (s *UDPSender) SendPacket(data []byte, src config.AddrConfig) {
-	id++
+	s.sendAll(data, nil, src, packet.Origin{})
+}
 
-	// src.IP = net.IPv4(192, 168, 1, 78)
+// SendBuffer отправляет датаграмму из буфера пула. Если других ссылок на буфер нет,
+// заголовки пишутся в место перед данными и пакет уходит одним куском.
+func (s *UDPSender) SendBuffer(b *packet.Buffer, src config.AddrConfig, origin packet.Origin) {
+	s.sendAll(b.Bytes(), b, src, origin)
+}
+
+func (s *UDPSender) sendAll(data []byte, buf *packet.Buffer, src config.AddrConfig, origin packet.Origin) {
+	s.each(func(dst net.IP) {
+		s.send(data, buf, src, origin, dst)
+	})
+}
 
-	udpHeader := []byte{
-		byte(src.Port >> 8), byte(src.Port), // Src порт
-		byte(s.dst.Port >> 8), byte(s.dst.Port), // Dst порт
-		byte((len(data) + 8) >> 8), byte(len(data) + 8), // Размер пакета (заголовок + данные)
-		byte(0), byte(0), // Подставляем 0, для иннорирования контрольной сумму
+// each вызывает send для первого IPv4 адреса цели или, с fanOut, для всех
+func (s *UDPSender) each(send func(dst net.IP)) {
+	sent := false
+	for _, ip := range s.addrs.Load() {
+		// отправка идет через IPv4 raw сокет, адреса IPv6 пропускаются
+		if ip.To4() == nil {
+			continue
+		}
+		send(ip)
+		sent = true
+		if !s.fanOut {
+			break
+		}
 	}
 
-	ipHeader := &ipv4.Header{
-		Version:  ipv4.Version,
-		Len:      ipv4.HeaderLen,
-		TOS:      0x00,
-		TotalLen: ipv4.HeaderLen + len(data) + 8,
-		ID:       int(id),
-		//Flags:    ipv4.DontFragment,
-		FragOff:  0,
-		TTL:      64,
-		Protocol: 17,
-		Src:      src.Host.To4(),
-		Dst:      s.dst.Host.To4(),
+	if !sent {
+		s.metrics.DeliveryErrors(s.plName, s.recipient, "resolve", 1)
+		logging.DefaultLimiter().Error(s.log,
+			logging.LimitKey{Pipeline: s.plName, Target: s.recipient, Type: "resolve"},
+			"Нет IPv4 адреса цели", fmt.Errorf("имя %s не разрешено в IPv4 адрес", s.recipient))
 	}
+}
 
-	buffer := make([]byte, len(udpHeader)+len(data))
-	copy(buffer, udpHeader)
-	copy(buffer[len(udpHeader):], data)
-	// buffer := append(append([]byte{}, udpHeader...), data...)
-	// log.Printf("Адрес buffer: %p\n", unsafe.Pointer(&buffer[0]))
+// send отправляет датаграмму на один адрес, фрагментируя ее по MTU или, если фрагментация
+// запрещена, отбрасывая слишком большую. Данные не копируются: заголовки и данные
+// передаются ядру отдельными частями.
+func (s *UDPSender) send(data []byte, buf *packet.Buffer, src config.AddrConfig, origin packet.Origin, dst net.IP) {
+	id := nextID(src.Host, dst)
+	mtu := s.pathMTU(dst)
+	length := udpHeaderLen + len(data)
+
+	flags := 0
+	if s.df == config.DFDrop || s.df == config.DFICMP {
+		if ipv4.HeaderLen+length > mtu {
+			s.tooBig(data, origin, mtu)
+			return
+		}
+		flags = dontFragment
+	}
+
+	s.metrics.Sent(s.plName, s.recipient, len(data))
 
-	recipient := fmt.Sprintf("%s:%d", s.dst.Host.String(), s.dst.Port)
-	metrics.IncrementSent(s.plName, recipient, len(data))
+	if ipv4.HeaderLen+length <= mtu {
+		hdr := s.hdr[:]
+		s.parts = append(s.parts[:0], hdr, data)
+		if buf != nil && buf.Exclusive() {
+			frame := buf.Frame(len(hdr))
+			hdr = frame[:len(hdr)]
+			s.parts = append(s.parts[:0], frame)
+		}
+		putIPv4(hdr, length, id, flags, src.Host, dst)
+		putUDP(hdr[ipv4.HeaderLen:], src.Port, s.port, length)
+		s.write(dst, hdr, data)
+		return
+	}
 
-	if len(buffer) <= s.mtu {
-		err := s.rawConn.WriteTo(ipHeader, buffer, nil)
-		if err != nil {
-			msg := fmt.Sprintf("[Pipeline %v] WriteTo %v: %v\n", s.plName, recipient, err)
-			slog.Error(msg)
+	putUDP(s.hdr[ipv4.HeaderLen:], src.Port, s.port, length)
+	s.fragment(data, 0, false, id, mtu, src.Host, dst)
+}
+
+// SendFragment пересылает IP фрагмент, принятый слушателем raw, с тем же ID и смещением.
+// В первом фрагменте заменяются порты заголовка UDP, а контрольная сумма обнуляется:
+// она считалась для исходного адреса назначения. Фрагмент больше MTU цели
+// делится дальше.
+func (s *UDPSender) SendFragment(data []byte, frag packet.Fragment, src config.AddrConfig) {
+	s.each(func(dst net.IP) {
+		s.sendFragment(data, frag, src, dst)
+	})
+}
+
+func (s *UDPSender) sendFragment(data []byte, frag packet.Fragment, src config.AddrConfig, dst net.IP) {
+	mtu := s.pathMTU(dst)
+	s.metrics.Sent(s.plName, s.recipient, len(data))
+
+	if frag.Offset == 0 {
+		if len(data) < udpHeaderLen {
 			return
 		}
+		putUDP(s.hdr[ipv4.HeaderLen:], src.Port, s.port, int(binary.BigEndian.Uint16(data[4:])))
+		data = data[udpHeaderLen:]
+	}
+	s.fragment(data, frag.Offset, frag.More, frag.ID, mtu, src.Host, dst)
+}
 
-		// fmt.Println(iph)
-		// fmt.Println("=====================")
-
-	} else {
-		// fmt.Println("MTU привешен", len(data), "len= ", len(buffer))
-		fragOff := 0
-
-		for {
-			// fmt.Println("fragOff: ", fragOff)
-
-			if len(buffer) > s.mtu {
-				fragment := buffer[:s.mtu]
-				// fmt.Println("len fragment ", len(fragment))
-				buffer = buffer[s.mtu:]
-				// fmt.Println("len new  buffer", len(buffer))
-				ipHeader.Flags = ipv4.MoreFragments
-				ipHeader.TotalLen = ipv4.HeaderLen + len(fragment)
-				ipHeader.FragOff = fragOff
-				fragOff += len(fragment) / 8
-
-				// fmt.Printf("buffer: %v\n", buffer)
-
-				err := s.rawConn.WriteTo(ipHeader, fragment, nil)
-				if err != nil {
-					msg := fmt.Sprintf("[Pipeline %v] WriteTo %v: %v\n", s.plName, recipient, err)
-					slog.Error(msg)
-					return
-				}
-
-			} else {
-				ipHeader.Flags = 0
-				ipHeader.FragOff = fragOff
-				ipHeader.TotalLen = ipv4.HeaderLen + len(buffer)
-				// fmt.Println("send finish buffer ", len(buffer))
-				// fmt.Println("FragOff finish", ipHeader.FragOff)
-
-				err := s.rawConn.WriteTo(ipHeader, buffer, nil)
-				if err != nil {
-					msg := fmt.Sprintf("[Pipeline %v] WriteTo %v: %v\n", s.plName, recipient, err)
-					slog.Error(msg)
-				}
-
-				// fmt.Println(ipHeader)
-				// fmt.Println("=====================")
-				return
-			}
-
-			// fmt.Println(ipHeader)
-			// fmt.Println("-------------------")
+// fragment отправляет часть датаграммы UDP со смещения base фрагментами не больше MTU.
+// Часть с нулевым смещением начинается с заголовка UDP, он уже записан в s.hdr.
+// more - за частью в датаграмме следуют другие фрагменты.
+// Смещение фрагмента считается в 8 байтах, поэтому данные всех фрагментов,
+// кроме последнего, кратны 8.
+func (s *UDPSender) fragment(data []byte, base int, more bool, id uint16, mtu int, src, dst net.IP) {
+	udp := 0
+	if base == 0 {
+		udp = udpHeaderLen
+	}
+	length := udp + len(data)
+
+	step := (mtu - ipv4.HeaderLen) &^ 7
+	for off := 0; off < length; {
+		end := min(off+step, length)
+		field := (base + off) / 8
+		if end < length || more {
+			field |= moreFragments
+		}
 
+		var hdr, payload []byte
+		if off == 0 && udp > 0 {
+			hdr = s.hdr[:]
+			payload = data[:end-udp]
+		} else {
+			hdr = s.hdr[:ipv4.HeaderLen]
+			payload = data[off-udp : end-udp]
 		}
+		putIPv4(hdr, len(hdr)-ipv4.HeaderLen+len(payload), id, field, src, dst)
 
+		s.parts = append(s.parts[:0], hdr, payload)
+		if !s.write(dst, hdr, payload) {
+			return
+		}
+		s.metrics.Fragments(s.plName, s.recipient, 1)
+		off = end
 	}
 }
 
-func (s *UDPSender) Close() {
-	err := s.rawConn.Close()
-	if err != nil {
-		log.Fatalf("[Pipeline %v] err: %v\n", s.plName, err)
+// write отправляет собранные в s.parts части пакета; hdr и payload - те же байты для записи трафика
+func (s *UDPSender) write(dst net.IP, hdr, payload []byte) bool {
+	s.capture(hdr, payload)
+	if err := s.writer.WriteIP(dst, s.parts); err != nil {
+		s.writeError(err)
+		return false
 	}
+	return true
+}
 
-	err = s.conn.Close()
+// putIPv4 пишет заголовок IPv4 без опций. Контрольную сумму заполняет ядро.
+func putIPv4(b []byte, payloadLen int, id uint16, fragment int, src, dst net.IP) {
+	b[0] = ipv4.Version<<4 | ipv4.HeaderLen>>2
+	b[1] = 0 // TOS
+	binary.BigEndian.PutUint16(b[2:], uint16(ipv4.HeaderLen+payloadLen))
+	binary.BigEndian.PutUint16(b[4:], id)
+	binary.BigEndian.PutUint16(b[6:], uint16(fragment))
+	b[8] = 64 // TTL
+	b[9] = 17 // UDP
+	b[10], b[11] = 0, 0
+	// без адреса источника его подставляет ядро
+	clear(b[12:16])
+	copy(b[12:16], src.To4())
+	copy(b[16:20], dst.To4())
+}
+
+// putUDP пишет заголовок UDP с нулевой контрольной суммой (не проверяется получателем)
+func putUDP(b []byte, srcPort, dstPort uint16, length int) {
+	binary.BigEndian.PutUint16(b[0:], srcPort)
+	binary.BigEndian.PutUint16(b[2:], dstPort)
+	binary.BigEndian.PutUint16(b[4:], uint16(length))
+	b[6], b[7] = 0, 0
+}
+
+// writeError учитывает ошибку отправки. Повторяющиеся ошибки цели сворачиваются
+// в периодические сводки, чтобы недоступная цель не засыпала журнал.
+func (s *UDPSender) writeError(err error) {
+	s.metrics.DeliveryErrors(s.plName, s.recipient, "write", 1)
+	logging.DefaultLimiter().Error(s.log,
+		logging.LimitKey{Pipeline: s.plName, Target: s.recipient, Type: "write"}, "Ошибка WriteTo", err)
+}
+
+// capture передает кадр в запись трафика, если она запущена
+func (s *UDPSender) capture(hdr, payload []byte) {
+	if !capture.Enabled() {
+		return
+	}
+
+	// контрольную сумму при отправке заполняет ядро, для файла считаем сами
+	binary.BigEndian.PutUint16(hdr[10:], pcap.Checksum(hdr[:ipv4.HeaderLen]))
+
+	capture.Output(s.plName, s.recipient, hdr, payload)
+}
+
+// Close закрывает сокет и освобождает адреса цели
+func (s *UDPSender) Close() {
+	s.addrs.Release()
+	err := s.writer.Close()
 	if err != nil {
-		log.Fatalf("[Pipeline %v] err: %v\n", s.plName, err)
+		s.log.Error("Ошибка закрытия сокета", logging.Err(err))
 	}
 }
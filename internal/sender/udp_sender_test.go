@@ -0,0 +1,425 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"udp_mirror/config"
+	"udp_mirror/internal/packet"
+	"udp_mirror/internal/pcap"
+	"udp_mirror/internal/resolver"
+	"udp_mirror/pkg/logging"
+	"udp_mirror/pkg/metrics"
+)
+
+// packetLog запоминает отправленные IP пакеты, склеивая части
+type packetLog struct {
+	packets [][]byte
+	parts   []int
+}
+
+func (w *packetLog) WriteIP(_ net.IP, parts [][]byte) error {
+	var p []byte
+	for _, part := range parts {
+		p = append(p, part...)
+	}
+	w.packets = append(w.packets, p)
+	w.parts = append(w.parts, len(parts))
+	return nil
+}
+
+func (w *packetLog) Close() error { return nil }
+
+func testSender(dst string, w ipWriter) *UDPSender {
+	return &UDPSender{
+		port:      9000,
+		addrs:     resolver.Static(net.ParseIP(dst)),
+		mtu:       1500,
+		writer:    w,
+		plName:    "udp_test",
+		recipient: dst + ":9000",
+		metrics:   metrics.Default(),
+		log:       logging.For("sender"),
+	}
+}
+
+// reassemble собирает датаграмму UDP из фрагментов одного ID в любом порядке
+func reassemble(t *testing.T, frags [][]byte) (srcPort, dstPort uint16, data []byte) {
+	t.Helper()
+
+	var whole []byte
+	last := false
+	for _, f := range frags {
+		if int(binary.BigEndian.Uint16(f[2:])) != len(f) {
+			t.Fatalf("total length %d, пакет %d байт", binary.BigEndian.Uint16(f[2:]), len(f))
+		}
+		field := binary.BigEndian.Uint16(f[6:])
+		off := int(field&0x1fff) * 8
+		if field&0x2000 == 0 {
+			last = true
+		} else if (len(f)-20)%8 != 0 {
+			t.Fatalf("фрагмент со смещением %d: %d байт данных не кратно 8", off, len(f)-20)
+		}
+		if need := off + len(f) - 20; need > len(whole) {
+			whole = append(whole, make([]byte, need-len(whole))...)
+		}
+		copy(whole[off:], f[20:])
+	}
+	if !last {
+		t.Fatal("нет последнего фрагмента")
+	}
+	if int(binary.BigEndian.Uint16(whole[4:])) != len(whole) {
+		t.Fatalf("длина UDP %d, собрано %d", binary.BigEndian.Uint16(whole[4:]), len(whole))
+	}
+	return binary.BigEndian.Uint16(whole[0:]), binary.BigEndian.Uint16(whole[2:]), whole[8:]
+}
+
+func TestUDPSenderBuffer(t *testing.T) {
+	w := &packetLog{}
+	s := testSender("10.0.0.1", w)
+	src := config.AddrConfig{Host: net.IPv4(192, 0, 2, 1), Port: 514}
+
+	pool := packet.NewPool(2000)
+	b := pool.Get()
+	b.SetLen(copy(b.Bytes(), "hello"))
+
+	// буфер нужен еще одной цели: заголовки отдельно, данные буфера не трогаются
+	b.Retain()
+	frame := append([]byte(nil), b.Frame(packet.Headroom)...)
+	s.SendBuffer(b, src, packet.Origin{})
+	b.Release()
+	if w.parts[0] != 2 || !bytes.Equal(b.Frame(packet.Headroom), frame) {
+		t.Errorf("общий буфер изменен или отправлен одним куском: %d частей", w.parts[0])
+	}
+
+	// последняя ссылка: заголовки пишутся перед данными
+	s.SendBuffer(b, src, packet.Origin{})
+	if w.parts[1] != 1 {
+		t.Errorf("%d частей, ожидали заголовки в буфере", w.parts[1])
+	}
+	b.Release()
+
+	for i, p := range w.packets {
+		p[4], p[5] = 0, 0 // ID у пакетов разный
+		if !bytes.Equal(p, w.packets[0]) {
+			t.Fatalf("пакет %d отличается: % x", i, p)
+		}
+		if len(p) != 20+8+5 || !net.IP(p[12:16]).Equal(src.Host) || !net.IP(p[16:20]).Equal(net.IPv4(10, 0, 0, 1)) {
+			t.Fatalf("заголовок IP: % x", p[:20])
+		}
+		srcPort, dstPort, data := reassemble(t, [][]byte{p})
+		if srcPort != 514 || dstPort != 9000 || string(data) != "hello" {
+			t.Fatalf("UDP %d -> %d %q", srcPort, dstPort, data)
+		}
+	}
+}
+
+func TestUDPSenderFragments(t *testing.T) {
+	w := &packetLog{}
+	s := testSender("10.0.0.1", w)
+
+	data := make([]byte, 4000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	s.SendPacket(data, config.AddrConfig{Host: net.IPv4(192, 0, 2, 1), Port: 514})
+
+	if len(w.packets) != 3 {
+		t.Fatalf("%d фрагментов, ожидали 3", len(w.packets))
+	}
+	_, _, got := reassemble(t, w.packets)
+	if !bytes.Equal(got, data) {
+		t.Fatal("собранные данные отличаются")
+	}
+}
+
+func TestUDPSenderConcurrentIDs(t *testing.T) {
+	const workers, perWorker = 8, 200
+	src := config.AddrConfig{Host: net.IPv4(192, 0, 2, 1), Port: 514}
+
+	// воркеры одной цели отправляют фрагментированные датаграммы одновременно
+	logs := make([]*packetLog, workers)
+	var wg sync.WaitGroup
+	for w := range workers {
+		logs[w] = &packetLog{}
+		s := testSender("10.0.0.1", logs[w])
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWorker {
+				data := bytes.Repeat([]byte{byte(w), byte(i)}, 1000+i*7)
+				s.SendPacket(data, src)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// фрагменты всех воркеров приходят вперемешку, получатель собирает их по ID
+	var all [][]byte
+	for _, l := range logs {
+		all = append(all, l.packets...)
+	}
+	rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+	byID := map[uint16][][]byte{}
+	for _, p := range all {
+		id := binary.BigEndian.Uint16(p[4:])
+		byID[id] = append(byID[id], p)
+	}
+	if len(byID) != workers*perWorker {
+		t.Fatalf("%d разных ID на %d датаграмм", len(byID), workers*perWorker)
+	}
+
+	seen := map[[2]byte]bool{}
+	for _, frags := range byID {
+		_, _, data := reassemble(t, frags)
+		key := [2]byte{data[0], data[1]}
+		if !bytes.Equal(data, bytes.Repeat(key[:], 1000+int(key[1])*7)) {
+			t.Fatalf("датаграмма воркера %d #%d собрана неверно", key[0], key[1])
+		}
+		seen[key] = true
+	}
+	if len(seen) != workers*perWorker {
+		t.Fatalf("собрано %d датаграмм из %d", len(seen), workers*perWorker)
+	}
+}
+
+func TestUDPSenderMTU(t *testing.T) {
+	src := config.AddrConfig{Host: net.IPv4(192, 0, 2, 1), Port: 514}
+	for _, mtu := range []int{68, 576, 1006, 1500, 9000} {
+		sizes := []int{0, 1, mtu - 28, mtu - 27, mtu - 20, 2*(mtu-20) - 8, 2*(mtu-20) - 7, 20000, 65507}
+		for _, size := range sizes {
+			w := &packetLog{}
+			s := testSender("10.0.0.1", w)
+			s.mtu = mtu
+
+			data := make([]byte, size)
+			for i := range data {
+				data[i] = byte(i * 7)
+			}
+			s.SendPacket(data, src)
+
+			step := (mtu - 20) &^ 7
+			want := 1
+			if 28+size > mtu {
+				want = (8 + size + step - 1) / step
+			}
+			if len(w.packets) != want {
+				t.Fatalf("MTU %d, %d байт: %d пакетов, ожидали %d", mtu, size, len(w.packets), want)
+			}
+			for _, p := range w.packets {
+				if len(p) > mtu {
+					t.Fatalf("MTU %d, %d байт: пакет %d байт", mtu, size, len(p))
+				}
+			}
+			_, _, got := reassemble(t, w.packets)
+			if !bytes.Equal(got, data) {
+				t.Fatalf("MTU %d, %d байт: собранные данные отличаются", mtu, size)
+			}
+		}
+	}
+}
+
+func TestUDPSenderDontFragment(t *testing.T) {
+	src := config.AddrConfig{Host: net.IPv4(192, 0, 2, 1), Port: 514}
+
+	w := &packetLog{}
+	s := testSender("10.0.0.1", w)
+	s.df = config.DFDrop
+	s.SendPacket(make([]byte, 1472), src)
+	s.SendPacket(make([]byte, 1473), src)
+	if len(w.packets) != 1 || binary.BigEndian.Uint16(w.packets[0][6:]) != 0x4000 {
+		t.Fatalf("drop: %d пакетов", len(w.packets))
+	}
+
+	// без адресов приема (воспроизведение) ICMP отправить некому
+	w = &packetLog{}
+	s = testSender("10.0.0.1", w)
+	s.df = config.DFICMP
+	s.SendPacket(make([]byte, 2000), src)
+	if len(w.packets) != 0 {
+		t.Fatalf("icmp без адресов приема: %d пакетов", len(w.packets))
+	}
+}
+
+// С src_host цель отправляет с подмененного адреса, а ICMP получает исходный источник
+// и цитирует датаграмму, как он ее отправил: на адрес и порт входа.
+func TestUDPSenderICMPOriginalSource(t *testing.T) {
+	origin := packet.Origin{
+		Src: config.AddrConfig{Host: net.IPv4(192, 0, 2, 1), Port: 514},
+		Dst: config.AddrConfig{Host: net.IPv4(198, 51, 100, 5), Port: 2055},
+	}
+	rewritten := config.AddrConfig{Host: net.IPv4(10, 9, 9, 9), Port: 7000}
+
+	w := &packetLog{}
+	s := testSender("10.0.0.1", w)
+	s.df = config.DFICMP
+	pool := packet.NewPool(2000)
+	for range 2 { // повтор сразу же не сообщается
+		b := pool.Get()
+		b.SetLen(2000)
+		s.SendBuffer(b, rewritten, origin)
+		b.Release()
+	}
+	if len(w.packets) != 1 {
+		t.Fatalf("icmp: %d пакетов", len(w.packets))
+	}
+	p := w.packets[0]
+	icmp := p[20:]
+	quoted := icmp[8:]
+	switch {
+	case p[9] != 1 || !net.IP(p[16:20]).Equal(origin.Src.Host) || len(p) != 20+8+28:
+		t.Fatalf("заголовок ICMP пакета: % x", p[:20])
+	case icmp[0] != 3 || icmp[1] != 4 || binary.BigEndian.Uint16(icmp[6:]) != 1500:
+		t.Fatalf("ICMP: % x", icmp[:8])
+	case pcap.Checksum(icmp) != 0 || pcap.Checksum(quoted[:20]) != 0:
+		t.Fatal("неверная контрольная сумма")
+	case !net.IP(quoted[12:16]).Equal(origin.Src.Host) || !net.IP(quoted[16:20]).Equal(origin.Dst.Host):
+		t.Fatalf("адреса исходного пакета: % x", quoted[:20])
+	case binary.BigEndian.Uint16(quoted[20:]) != 514 || binary.BigEndian.Uint16(quoted[22:]) != 2055 ||
+		binary.BigEndian.Uint16(quoted[24:]) != 2008:
+		t.Fatalf("UDP исходного пакета: % x", quoted[20:])
+	}
+
+	// вход на всех адресах: цитируется адрес, с которого ядро ответило бы источнику
+	w = &packetLog{}
+	s = testSender("10.0.0.1", w)
+	s.df = config.DFICMP
+	origin.Src.Host = net.IPv4(127, 0, 0, 1)
+	origin.Dst.Host = net.IPv4zero
+	b := pool.Get()
+	b.SetLen(2000)
+	s.SendBuffer(b, rewritten, origin)
+	b.Release()
+	if len(w.packets) != 1 || !net.IP(w.packets[0][20+8+16:20+8+20]).Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("icmp для входа 0.0.0.0: %d пакетов", len(w.packets))
+	}
+}
+
+func TestUDPSenderSendFragment(t *testing.T) {
+	src := config.AddrConfig{Host: net.IPv4(192, 0, 2, 1), Port: 514}
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	// датаграмма на вход, фрагментированная по MTU 1500 до приема
+	udp := make([]byte, udpHeaderLen+len(payload))
+	putUDP(udp, 514, 2055, len(udp))
+	binary.BigEndian.PutUint16(udp[6:], 0xbeef) // контрольная сумма для прежнего адреса
+	copy(udp[udpHeaderLen:], payload)
+
+	w := &packetLog{}
+	s := testSender("10.0.0.1", w)
+	s.mtu = 1006 // фрагменты больше MTU цели делятся дальше
+	for off := 0; off < len(udp); off += 1480 {
+		end := min(off+1480, len(udp))
+		s.SendFragment(udp[off:end], packet.Fragment{ID: 0x1234, Offset: off, More: end < len(udp)}, src)
+	}
+
+	if len(w.packets) != 5 {
+		t.Fatalf("%d фрагментов, ожидали 5", len(w.packets))
+	}
+	for _, p := range w.packets {
+		if binary.BigEndian.Uint16(p[4:]) != 0x1234 || len(p) > 1006 {
+			t.Fatalf("фрагмент ID %#x, %d байт", binary.BigEndian.Uint16(p[4:]), len(p))
+		}
+	}
+	srcPort, dstPort, data := reassemble(t, w.packets)
+	if srcPort != 514 || dstPort != 9000 || !bytes.Equal(data, payload) {
+		t.Fatalf("UDP %d -> %d, %d байт", srcPort, dstPort, len(data))
+	}
+	if binary.BigEndian.Uint16(w.packets[0][26:]) != 0 {
+		t.Error("контрольная сумма UDP не обнулена")
+	}
+}
+
+func TestRouteMTU(t *testing.T) {
+	mtu, err := routeMTU(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu < 1500 {
+		t.Errorf("MTU loopback %d", mtu)
+	}
+}
+
+// TestUDPSenderKernelReassembly отправляет фрагменты через raw сокет на loopback:
+// ядро получателя собирает датаграмму, только если смещения фрагментов верны
+func TestUDPSenderKernelReassembly(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	ps, err := NewUDPSender(context.Background(), config.TargetConfig{Host: "127.0.0.1", Port: port, MTU: 1006})
+	if err != nil {
+		t.Skip("raw сокет недоступен:", err)
+	}
+	defer ps.Close()
+
+	src := config.AddrConfig{Host: net.IPv4(127, 0, 0, 1), Port: 4242}
+	buf := make([]byte, 65536)
+	for _, size := range []int{100, 979, 980, 3000, 65507} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		ps.SendPacket(data, src)
+
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("%d байт: %v", size, err)
+		}
+		if from.Port != 4242 || !bytes.Equal(buf[:n], data) {
+			t.Fatalf("%d байт: получено %d от %s", size, n, from)
+		}
+	}
+}
+
+// discard отбрасывает пакеты
+type discard struct{}
+
+func (discard) WriteIP(net.IP, [][]byte) error { return nil }
+func (discard) Close() error                   { return nil }
+
+// BenchmarkUDPSenderFanOut отправляет одну датаграмму трем целям, как воркеры pipeline:
+// copy - копия в слушателе и в каждой цели (прежняя схема), buffer - общий буфер пула
+func BenchmarkUDPSenderFanOut(b *testing.B) {
+	src := config.AddrConfig{Host: net.IPv4(192, 0, 2, 1), Port: 514}
+	targets := []*UDPSender{testSender("10.0.0.1", discard{}), testSender("10.0.0.2", discard{}), testSender("10.0.0.3", discard{})}
+	datagram := bytes.Repeat([]byte{1}, 1400)
+
+	b.Run("copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			safe := make([]byte, len(datagram))
+			copy(safe, datagram)
+			for _, s := range targets {
+				buffer := make([]byte, udpHeaderLen+len(safe))
+				copy(buffer[udpHeaderLen:], safe)
+				s.SendPacket(buffer[udpHeaderLen:], src)
+			}
+		}
+	})
+
+	b.Run("buffer", func(b *testing.B) {
+		pool := packet.NewPool(65508)
+		b.ReportAllocs()
+		for range b.N {
+			buf := pool.Get()
+			buf.SetLen(copy(buf.Bytes(), datagram))
+			for _, s := range targets {
+				buf.Retain()
+				s.SendBuffer(buf, src, packet.Origin{})
+				buf.Release()
+			}
+			buf.Release()
+		}
+	})
+}
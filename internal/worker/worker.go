@@ -2,25 +2,47 @@ package worker
 
 import (
 	"context"
-	"log"
+	"time"
 	"udp_mirror/config"
+	"udp_mirror/internal/packet"
 	"udp_mirror/internal/sender"
+	"udp_mirror/pkg/logging"
+	"udp_mirror/pkg/metrics"
 )
 
 type IRPData struct {
-	Data []byte
-	Src  config.AddrConfig
+	Data     []byte
+	Buf      *packet.Buffer  // буфер пула с Data, ссылка освобождается после отправки; nil - Data не из пула
+	Frag     packet.Fragment // IP фрагмент, принятый слушателем raw; нулевое значение - целая датаграмма
+	Src      config.AddrConfig
+	Origin   packet.Origin       // адреса датаграммы до подмены источника целью
+	Received time.Time           // время приема, для метрики задержки
+	Trace    metrics.PacketTrace // трассировка, если пакет попал в выборку
 }
 
 type Worker struct {
 	Target config.TargetConfig
 	Sender sender.PacketSender
+	// Metrics - приемник метрик, по умолчанию metrics.Default()
+	Metrics metrics.Recorder
 }
 
 func (w *Worker) StartProcessPackets(ctx context.Context, ch <-chan IRPData) {
 	plName, _ := ctx.Value(config.PlNameKey).(string)
 
-	log.Printf("[Pipeline %s] Worker запущен: %+v", plName, w.Target)
+	recipient := w.Target.Label()
+	rec := w.Metrics
+	if rec == nil {
+		rec = metrics.Default()
+	}
+
+	log := logging.For("worker").With("pipeline", plName, "target", recipient)
+	log.Debug("Worker запущен", "type", w.Target.Kind())
+	rec.Workers(plName, recipient, 1)
+	defer rec.Workers(plName, recipient, -1)
+
+	fs, fragments := w.Sender.(sender.FragmentSender)
+	bs, buffers := w.Sender.(sender.BufferSender)
 
 	for data := range ch {
 		// log.Printf("Полученные данные: len: %d для %v\n", len(data.Data), w.Target)
@@ -33,11 +55,34 @@ func (w *Worker) StartProcessPackets(ctx context.Context, ch <-chan IRPData) {
 			data.Src.Host = w.Target.SrcHost
 		}
 
-		w.Sender.SendPacket(data.Data, data.Src)
+		var start time.Time
+		if data.Trace.Sampled() {
+			start = time.Now()
+		}
+
+		switch {
+		case data.Frag.IsFragment() && !fragments:
+			// цель принимает только целые датаграммы
+			rec.Dropped(plName, recipient, "fragment")
+		case data.Frag.IsFragment():
+			fs.SendFragment(data.Data, data.Frag, data.Src)
+		case buffers && data.Buf != nil:
+			bs.SendBuffer(data.Buf, data.Src, data.Origin)
+		default:
+			w.Sender.SendPacket(data.Data, data.Src)
+		}
+		if data.Buf != nil {
+			data.Buf.Release()
+		}
+
+		data.Trace.Send(plName, recipient, start)
+		if !data.Received.IsZero() {
+			rec.Latency(plName, recipient, time.Since(data.Received))
+		}
 
 		// time.Sleep(500 * time.Millisecond)
 	}
 
-	log.Printf("[Pipeline %s] Worker завершен: %+v\n", plName, w.Target)
+	log.Debug("Worker завершен")
 
 }
@@ -0,0 +1,25 @@
+package adminhttp
+
+import (
+	"net/http"
+	"os"
+
+	"udp_mirror/pkg/logging"
+)
+
+var mux = http.NewServeMux()
+
+// Handle регистрирует обработчик на административном сервере
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+// Start запускает административный сервер на указанном адресе
+func Start(addr string) {
+	log := logging.For("admin")
+	log.Info("Административный сервер запущен", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error("Ошибка запуска административного сервера", logging.Err(err))
+		os.Exit(1)
+	}
+}
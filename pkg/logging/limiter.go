@@ -0,0 +1,109 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultLimitInterval - период сводок по повторяющимся ошибкам
+const DefaultLimitInterval = 10 * time.Second
+
+// LimitKey определяет, какие ошибки считаются повторяющимися
+type LimitKey struct {
+	Pipeline string
+	Target   string
+	Type     string // вид ошибки: write, read, queue_full и т.п.
+}
+
+// Limiter сворачивает повторяющиеся ошибки горячего пути в периодические сводки.
+// Первая ошибка по ключу пишется сразу, остальные за интервал только считаются,
+// а по его окончании пишется одна запись "N ошибок за последние 10s".
+// Если за интервал ошибок больше не было, следующая снова пишется сразу.
+type Limiter struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	entries map[LimitKey]*limitEntry
+}
+
+type limitEntry struct {
+	log        *slog.Logger
+	msg        string
+	suppressed int
+	lastErr    error
+	timer      *time.Timer
+}
+
+// NewLimiter создает ограничитель с заданным периодом сводок
+func NewLimiter(interval time.Duration) *Limiter {
+	return &Limiter{
+		interval: interval,
+		entries:  map[LimitKey]*limitEntry{},
+	}
+}
+
+var defaultLimiter = NewLimiter(DefaultLimitInterval)
+
+// DefaultLimiter возвращает общий ограничитель слушателей и отправителей
+func DefaultLimiter() *Limiter {
+	return defaultLimiter
+}
+
+// Error пишет ошибку или учитывает ее в сводке, если по ключу уже была запись
+// в текущем интервале. log должен содержать поля pipeline и target.
+func (l *Limiter) Error(log *slog.Logger, key LimitKey, msg string, err error) {
+	l.mu.Lock()
+	if e, ok := l.entries[key]; ok {
+		e.suppressed++
+		e.lastErr = err
+		l.mu.Unlock()
+		return
+	}
+
+	e := &limitEntry{log: log, msg: msg}
+	e.timer = time.AfterFunc(l.interval, func() { l.flush(key) })
+	l.entries[key] = e
+	l.mu.Unlock()
+
+	log.Error(msg, "type", key.Type, Err(err))
+}
+
+// flush пишет сводку по ключу. Если ошибок не было, интервал закрывается.
+func (l *Limiter) flush(key LimitKey) {
+	l.mu.Lock()
+	e, ok := l.entries[key]
+	if !ok {
+		l.mu.Unlock()
+		return
+	}
+	if e.suppressed == 0 {
+		e.timer.Stop()
+		delete(l.entries, key)
+		l.mu.Unlock()
+		return
+	}
+
+	n, lastErr := e.suppressed, e.lastErr
+	e.suppressed, e.lastErr = 0, nil
+	e.timer.Reset(l.interval)
+	l.mu.Unlock()
+
+	e.log.Error(fmt.Sprintf("%s: %d ошибок за последние %v", e.msg, n, l.interval),
+		"type", key.Type, "count", n, "interval", l.interval.String(), Err(lastErr))
+}
+
+// Flush пишет сводки по всем ключам, например перед завершением работы
+func (l *Limiter) Flush() {
+	l.mu.Lock()
+	keys := make([]LimitKey, 0, len(l.entries))
+	for key := range l.entries {
+		keys = append(keys, key)
+	}
+	l.mu.Unlock()
+
+	for _, key := range keys {
+		l.flush(key)
+	}
+}
@@ -0,0 +1,112 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiterCollapsesRepeats(t *testing.T) {
+	buf := capture(t)
+	lim := NewLimiter(time.Hour) // сводки только по Flush
+
+	log := For("sender").With("pipeline", "pl", "target", "a")
+	key := LimitKey{Pipeline: "pl", Target: "a", Type: "write"}
+	for i := range 1000 {
+		lim.Error(log, key, "Ошибка WriteTo", fmt.Errorf("ошибка %d", i))
+	}
+
+	recs := records(t, buf)
+	if len(recs) != 1 || recs[0]["err"] != "ошибка 0" || recs[0]["type"] != "write" {
+		t.Fatalf("ожидали одну запись о первой ошибке, получили %v", recs)
+	}
+
+	lim.Flush()
+	recs = records(t, buf)
+	if len(recs) != 1 {
+		t.Fatalf("ожидали сводку, получили %v", recs)
+	}
+	sum := recs[0]
+	if sum["count"] != float64(999) || sum["err"] != "ошибка 999" || sum["target"] != "a" {
+		t.Fatalf("сводка %v", sum)
+	}
+	if sum["msg"] != "Ошибка WriteTo: 999 ошибок за последние 1h0m0s" {
+		t.Fatalf("сообщение %q", sum["msg"])
+	}
+
+	// интервал без ошибок закрывает окно, следующая ошибка пишется сразу
+	lim.Flush()
+	if recs = records(t, buf); len(recs) != 0 {
+		t.Fatalf("пустая сводка %v", recs)
+	}
+	lim.Error(log, key, "Ошибка WriteTo", errors.New("снова"))
+	if recs = records(t, buf); len(recs) != 1 || recs[0]["err"] != "снова" {
+		t.Fatalf("после паузы %v", recs)
+	}
+}
+
+func TestLimiterKeys(t *testing.T) {
+	buf := capture(t)
+	lim := NewLimiter(time.Hour)
+	log := For("sender")
+
+	keys := []LimitKey{
+		{Pipeline: "pl", Target: "a", Type: "write"},
+		{Pipeline: "pl", Target: "b", Type: "write"},
+		{Pipeline: "pl", Target: "a", Type: "queue_full"},
+		{Pipeline: "pl2", Target: "a", Type: "write"},
+	}
+	for range 3 {
+		for _, k := range keys {
+			lim.Error(log, k, "ошибка", errors.New("x"))
+		}
+	}
+
+	if recs := records(t, buf); len(recs) != len(keys) {
+		t.Fatalf("ожидали по записи на ключ, получили %d", len(recs))
+	}
+}
+
+func TestLimiterPeriodicSummary(t *testing.T) {
+	buf := capture(t)
+	lim := NewLimiter(20 * time.Millisecond)
+	log := For("listener")
+	key := LimitKey{Pipeline: "pl", Type: "read"}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				lim.Error(log, key, "Ошибка чтения из UDP", errors.New("x"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		lim.mu.Lock()
+		_, open := lim.entries[key]
+		lim.mu.Unlock()
+		if !open {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("окно не закрылось")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var total float64
+	recs := records(t, buf)
+	for _, r := range recs[1:] {
+		total += r["count"].(float64)
+	}
+	if recs[0]["count"] != nil || total != 399 {
+		t.Fatalf("первая запись и сводки должны покрыть 400 ошибок: %v", recs)
+	}
+}
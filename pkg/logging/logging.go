@@ -0,0 +1,280 @@
+// Package logging настраивает структурированные журналы slog: формат, вывод
+// и уровни по компонентам. Уровни можно менять на лету при перезагрузке конфига.
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Форматы журнала
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Варианты вывода журнала
+const (
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+	OutputFile   = "file"
+	OutputSyslog = "syslog"
+)
+
+// Config - секция logging конфига
+type Config struct {
+	Format    string `yaml:"format,omitempty"` // text (по умолчанию) или json
+	Output    string `yaml:"output,omitempty"` // stdout (по умолчанию), stderr, file, syslog
+	File      string `yaml:"file,omitempty"`   // путь для output: file
+	SyslogTag string `yaml:"syslog_tag,omitempty"`
+
+	// Level - уровень по умолчанию: debug, info, warn, error.
+	// Если не задан, берется из LOG_LEVEL.
+	Level string `yaml:"level,omitempty"`
+	// Components - уровни отдельных компонентов, например listener: debug
+	Components map[string]string `yaml:"components,omitempty"`
+}
+
+// component - уровень журнала компонента. Если уровень не задан явно,
+// используется уровень по умолчанию.
+type component struct {
+	level slog.LevelVar
+	set   atomic.Bool
+}
+
+var (
+	defaultLevel slog.LevelVar
+
+	componentsMu sync.Mutex
+	components   = map[string]*component{}
+
+	// базовый обработчик, в который пишут все компоненты
+	base atomic.Pointer[slog.Handler]
+
+	// открытый файл или syslog текущего вывода
+	output io.Closer
+)
+
+// For возвращает журнал компонента. Записи получают поле component,
+// уровень определяется настройкой компонента.
+func For(name string) *slog.Logger {
+	return slog.New(&handler{comp: lookup(name), name: name})
+}
+
+func lookup(name string) *component {
+	componentsMu.Lock()
+	defer componentsMu.Unlock()
+
+	c, ok := components[name]
+	if !ok {
+		c = &component{}
+		components[name] = c
+	}
+	return c
+}
+
+// Err возвращает поле err для ошибки
+func Err(err error) slog.Attr {
+	return slog.Any("err", err)
+}
+
+// Setup настраивает формат, вывод и уровни журнала и делает его журналом по умолчанию,
+// в том числе для стандартного пакета log. Формат и вывод применяются при запуске,
+// при перезагрузке конфига достаточно SetLevels.
+func Setup(cfg *Config) error {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	w, closer, err := openOutput(cfg)
+	if err != nil {
+		return err
+	}
+
+	// фильтрация по уровню выполняется в handler, базовый пропускает все
+	opts := &slog.HandlerOptions{Level: slog.Level(-16)}
+
+	var h slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "", FormatText:
+		h = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		if closer != nil {
+			_ = closer.Close()
+		}
+		return fmt.Errorf("неизвестный формат журнала: %q", cfg.Format)
+	}
+
+	if err := SetLevels(cfg); err != nil {
+		if closer != nil {
+			_ = closer.Close()
+		}
+		return err
+	}
+
+	base.Store(&h)
+	if output != nil {
+		_ = output.Close()
+	}
+	output = closer
+
+	slog.SetDefault(For(""))
+	return nil
+}
+
+func openOutput(cfg *Config) (io.Writer, io.Closer, error) {
+	switch strings.ToLower(cfg.Output) {
+	case "", OutputStdout:
+		return os.Stdout, nil, nil
+	case OutputStderr:
+		return os.Stderr, nil, nil
+	case OutputFile:
+		if cfg.File == "" {
+			return nil, nil, errors.New("для output: file не указан logging.file")
+		}
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, f, nil
+	case OutputSyslog:
+		tag := cfg.SyslogTag
+		if tag == "" {
+			tag = "udp_mirror"
+		}
+		sw, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sw, sw, nil
+	default:
+		return nil, nil, fmt.Errorf("неизвестный вывод журнала: %q", cfg.Output)
+	}
+}
+
+// SetLevels применяет уровень по умолчанию и уровни компонентов.
+// Компоненты, которых нет в конфиге, возвращаются к уровню по умолчанию.
+func SetLevels(cfg *Config) error {
+	level := os.Getenv("LOG_LEVEL")
+	var comps map[string]string
+	if cfg != nil {
+		if cfg.Level != "" {
+			level = cfg.Level
+		}
+		comps = cfg.Components
+	}
+
+	def, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	parsed := make(map[string]slog.Level, len(comps))
+	for name, lvl := range comps {
+		l, err := ParseLevel(lvl)
+		if err != nil {
+			return fmt.Errorf("компонент %s: %w", name, err)
+		}
+		parsed[name] = l
+	}
+
+	defaultLevel.Set(def)
+
+	componentsMu.Lock()
+	defer componentsMu.Unlock()
+
+	for name := range parsed {
+		if _, ok := components[name]; !ok {
+			components[name] = &component{}
+		}
+	}
+	for name, c := range components {
+		l, ok := parsed[name]
+		if ok {
+			c.level.Set(l)
+		}
+		c.set.Store(ok)
+	}
+	return nil
+}
+
+// ParseLevel разбирает уровень журнала, пустая строка - info
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("неизвестный уровень журнала: %q", s)
+	}
+}
+
+// defaultHandler используется до вызова Setup
+var defaultHandler slog.Handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.Level(-16)})
+
+func current() slog.Handler {
+	if h := base.Load(); h != nil {
+		return *h
+	}
+	return defaultHandler
+}
+
+// handler фильтрует записи по уровню компонента и передает их текущему
+// базовому обработчику. Атрибуты и группы применяются к базовому обработчику
+// при записи, поэтому журналы, созданные до Setup, тоже получают новый вывод.
+type handler struct {
+	comp *component
+	name string
+	ops  []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) level() slog.Level {
+	if h.comp.set.Load() {
+		return h.comp.level.Level()
+	}
+	return defaultLevel.Level()
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	bh := current()
+	if h.name != "" {
+		bh = bh.WithAttrs([]slog.Attr{slog.String("component", h.name)})
+	}
+	for _, op := range h.ops {
+		bh = op(bh)
+	}
+	return bh.Handle(ctx, r)
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) *handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{comp: h.comp, name: h.name, ops: append(ops, op)}
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(bh slog.Handler) slog.Handler { return bh.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(bh slog.Handler) slog.Handler { return bh.WithGroup(name) })
+}
@@ -0,0 +1,157 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+)
+
+// syncBuffer - буфер журнала, в который пишут из разных горутин
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// take возвращает записанное и очищает буфер
+func (b *syncBuffer) take() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := bytes.Clone(b.buf.Bytes())
+	b.buf.Reset()
+	return out
+}
+
+// capture направляет журнал в буфер в формате JSON
+func capture(t *testing.T) *syncBuffer {
+	t.Helper()
+
+	buf := &syncBuffer{}
+	h := slog.Handler(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.Level(-16)}))
+	prev := base.Swap(&h)
+	t.Cleanup(func() {
+		base.Store(prev)
+		_ = SetLevels(nil)
+	})
+	return buf
+}
+
+func records(t *testing.T, buf *syncBuffer) []map[string]any {
+	t.Helper()
+
+	var out []map[string]any
+	sc := bufio.NewScanner(bytes.NewReader(buf.take()))
+	for sc.Scan() {
+		var rec map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("%s: %v", sc.Text(), err)
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+func TestFields(t *testing.T) {
+	buf := capture(t)
+
+	log := For("sender").With("pipeline", "pl", "target", "127.0.0.1:9000")
+	log.Error("Ошибка WriteTo", Err(errors.New("boom")))
+
+	recs := records(t, buf)
+	if len(recs) != 1 {
+		t.Fatalf("записей %d", len(recs))
+	}
+	want := map[string]any{
+		"level": "ERROR", "msg": "Ошибка WriteTo", "component": "sender",
+		"pipeline": "pl", "target": "127.0.0.1:9000", "err": "boom",
+	}
+	for k, v := range want {
+		if recs[0][k] != v {
+			t.Errorf("%s = %v, ожидали %v", k, recs[0][k], v)
+		}
+	}
+}
+
+func TestComponentLevels(t *testing.T) {
+	buf := capture(t)
+
+	// журнал создан до настройки уровней, уровень применяется на лету
+	listener := For("listener")
+	sender := For("sender")
+
+	if err := SetLevels(&Config{Level: "warn", Components: map[string]string{"listener": "debug"}}); err != nil {
+		t.Fatal(err)
+	}
+	listener.Debug("listener debug")
+	sender.Info("sender info")
+	sender.Warn("sender warn")
+
+	recs := records(t, buf)
+	if len(recs) != 2 || recs[0]["msg"] != "listener debug" || recs[1]["msg"] != "sender warn" {
+		t.Fatalf("записи %v", recs)
+	}
+
+	// перезагрузка: компонент без настройки возвращается к уровню по умолчанию
+	if err := SetLevels(&Config{Level: "info"}); err != nil {
+		t.Fatal(err)
+	}
+	listener.Debug("listener debug")
+	sender.Info("sender info")
+
+	recs = records(t, buf)
+	if len(recs) != 1 || recs[0]["msg"] != "sender info" {
+		t.Fatalf("записи после перезагрузки %v", recs)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	cases := []*Config{
+		{Level: "verbose"},
+		{Components: map[string]string{"listener": "loud"}},
+		{Format: "xml"},
+		{Output: "kafka"},
+		{Output: OutputFile},
+	}
+	for _, cfg := range cases {
+		if err := Setup(cfg); err == nil {
+			t.Errorf("конфиг %+v принят", cfg)
+		}
+	}
+}
+
+func TestSetupFile(t *testing.T) {
+	path := t.TempDir() + "/udp_mirror.log"
+	prev := base.Load()
+	t.Cleanup(func() {
+		base.Store(prev)
+		slog.SetDefault(slog.New(defaultHandler))
+		_ = SetLevels(nil)
+	})
+
+	if err := Setup(&Config{Format: FormatJSON, Output: OutputFile, File: path}); err != nil {
+		t.Fatal(err)
+	}
+	For("main").Info("запуск", "pipeline", "pl")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec map[string]any
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	if rec["component"] != "main" || rec["pipeline"] != "pl" {
+		t.Fatalf("запись %v", rec)
+	}
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Результаты перезагрузки конфига
+const (
+	ReloadSuccess = "success"
+	ReloadFailure = "failure"
+)
+
+var (
+	configReloadsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "config_reloads_total",
+			Help: "Total number of config reloads by result",
+		},
+		[]string{"result"},
+	)
+
+	configLastReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "config_last_reload_successful",
+			Help: "Whether the last config reload attempt was successful",
+		},
+	)
+
+	configLastReloadTime = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful config load",
+		},
+	)
+
+	configInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "config_info",
+			Help: "Hash of the currently loaded config",
+		},
+		[]string{"hash"},
+	)
+)
+
+// ConfigLoaded отмечает загруженный конфиг: при запуске и после успешной перезагрузки
+func ConfigLoaded(hash string) {
+	configInfo.Reset()
+	configInfo.WithLabelValues(hash).Set(1)
+	configLastReloadSuccessful.Set(1)
+	configLastReloadTime.Set(float64(time.Now().Unix()))
+}
+
+// ConfigReload учитывает попытку перезагрузки конфига: ReloadSuccess или ReloadFailure
+func ConfigReload(result string) {
+	configReloadsCounter.WithLabelValues(result).Inc()
+	if result == ReloadFailure {
+		configLastReloadSuccessful.Set(0)
+	}
+}
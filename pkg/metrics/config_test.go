@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConfigMetrics(t *testing.T) {
+	ConfigLoaded("aaaa")
+	ConfigReload(ReloadFailure)
+	if v := testutil.ToFloat64(configLastReloadSuccessful); v != 0 {
+		t.Errorf("last_reload_successful %v после ошибки", v)
+	}
+
+	ConfigReload(ReloadSuccess)
+	ConfigLoaded("bbbb")
+	if v := testutil.ToFloat64(configLastReloadSuccessful); v != 1 {
+		t.Errorf("last_reload_successful %v после загрузки", v)
+	}
+	if n := testutil.CollectAndCount(configInfo); n != 1 {
+		t.Errorf("config_info: %d рядов, ожидали только текущий хеш", n)
+	}
+	if v := testutil.ToFloat64(configInfo.WithLabelValues("bbbb")); v != 1 {
+		t.Errorf("config_info{hash=bbbb} %v", v)
+	}
+	if v := testutil.ToFloat64(configReloadsCounter.WithLabelValues(ReloadFailure)); v != 1 {
+		t.Errorf("reloads_total{result=failure} %v", v)
+	}
+}
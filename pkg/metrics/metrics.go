@@ -1,8 +1,12 @@
 package metrics
 
 import (
-	"log"
+	"net"
 	"net/http"
+	"os"
+	"time"
+
+	"udp_mirror/pkg/logging"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -14,7 +18,7 @@ var (
 			Name: "received_packets_total",
 			Help: "Total number of received packets",
 		},
-		[]string{"pipeline_name", "sender", "lisneter_number"},
+		[]string{"pipeline_name", "lisneter_number"},
 	)
 
 	receivedBytesCounter = prometheus.NewCounterVec(
@@ -22,7 +26,7 @@ var (
 			Name: "received_bytes_total",
 			Help: "Total number of received bytes",
 		},
-		[]string{"pipeline_name", "sender", "lisneter_number"},
+		[]string{"pipeline_name", "lisneter_number"},
 	)
 
 	sentPacketsCounter = prometheus.NewCounterVec(
@@ -40,35 +44,205 @@ var (
 		},
 		[]string{"pipeline_name", "recipient"},
 	)
+
+	deliveryErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "delivery_errors_total",
+			Help: "Total number of datagrams that failed to be delivered to a target",
+		},
+		[]string{"pipeline_name", "recipient", "reason"},
+	)
+
+	droppedPacketsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dropped_packets_total",
+			Help: "Total number of datagrams dropped before reaching a target worker",
+		},
+		[]string{"pipeline_name", "recipient", "reason"},
+	)
+
+	truncatedPacketsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "truncated_packets_total",
+			Help: "Total number of datagrams larger than the listener buffer",
+		},
+		[]string{"pipeline_name", "action"},
+	)
+
+	sentFragmentsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sent_fragments_total",
+			Help: "Total number of IP fragments sent",
+		},
+		[]string{"pipeline_name", "recipient"},
+	)
+
+	queueLengthGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "queue_length",
+			Help: "Number of datagrams waiting in a target queue",
+		},
+		[]string{"pipeline_name", "recipient"},
+	)
+
+	queueCapacityGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "queue_capacity",
+			Help: "Capacity of a target queue",
+		},
+		[]string{"pipeline_name", "recipient"},
+	)
+
+	workersGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workers",
+			Help: "Number of running workers per target",
+		},
+		[]string{"pipeline_name", "recipient"},
+	)
+
+	mirrorLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mirror_latency_seconds",
+			Help:    "Time from receiving a datagram to handing it to the target",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		},
+		[]string{"pipeline_name", "recipient"},
+	)
+
+	httpBatchSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_batch_records",
+			Help:    "Number of datagrams per HTTP batch",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		},
+		[]string{"pipeline_name", "recipient"},
+	)
+
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Latency of HTTP batch requests",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"pipeline_name", "recipient"},
+	)
+
+	httpResponsesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_responses_total",
+			Help: "Total number of HTTP batch responses by status code",
+		},
+		[]string{"pipeline_name", "recipient", "code"},
+	)
 )
 
 // Register регистрирует метрики в Prometheus
 func Register() {
 	prometheus.MustRegister(receivedPacketsCounter)
 	prometheus.MustRegister(receivedBytesCounter)
+	prometheus.MustRegister(newTopSourcesCollector())
 
 	prometheus.MustRegister(sentPacketsCounter)
 	prometheus.MustRegister(sendBytesCounter)
+
+	prometheus.MustRegister(deliveryErrorsCounter)
+	prometheus.MustRegister(droppedPacketsCounter)
+	prometheus.MustRegister(truncatedPacketsCounter)
+	prometheus.MustRegister(sentFragmentsCounter)
+	prometheus.MustRegister(queueLengthGauge)
+	prometheus.MustRegister(queueCapacityGauge)
+	prometheus.MustRegister(workersGauge)
+	prometheus.MustRegister(mirrorLatency)
+
+	prometheus.MustRegister(httpBatchSize)
+	prometheus.MustRegister(httpRequestDuration)
+	prometheus.MustRegister(httpResponsesCounter)
+
+	prometheus.MustRegister(configReloadsCounter)
+	prometheus.MustRegister(configLastReloadSuccessful)
+	prometheus.MustRegister(configLastReloadTime)
+	prometheus.MustRegister(configInfo)
+}
+
+// Handle регистрирует дополнительный обработчик на сервере метрик
+func Handle(pattern string, handler http.Handler) {
+	http.Handle(pattern, handler)
 }
 
 // StartPrometheus запускает сервер для экспорта метрик
 func StartPrometheus(addr string) {
 	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Prometheus метрики доступны на %s/metrics", addr)
+	log := logging.For("metrics")
+	log.Info("Prometheus метрики доступны", "addr", addr, "path", "/metrics")
 
 	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("Ошибка запуска Prometheus: %v", err)
+		log.Error("Ошибка запуска Prometheus", logging.Err(err))
+		os.Exit(1)
+	}
+}
+
+// promRecorder передает события в метрики Prometheus
+type promRecorder struct{}
+
+// promReceiver - счетчики слушателя, найденные заранее: на пакет приходится
+// пара атомарных операций без поиска меток
+type promReceiver struct {
+	packets prometheus.Counter
+	bytes   prometheus.Counter
+}
+
+func (promRecorder) Receiver(plName, listener string) PacketCounter {
+	return promReceiver{
+		packets: receivedPacketsCounter.WithLabelValues(plName, listener),
+		bytes:   receivedBytesCounter.WithLabelValues(plName, listener),
 	}
 }
 
-// IncrementReceived увеличивает счетчик полученных пакетов и байтов
-func IncrementReceived(listName, plName, sender string, bytes int) {
-	receivedPacketsCounter.WithLabelValues(plName, sender, listName).Inc()
-	receivedBytesCounter.WithLabelValues(plName, sender, listName).Add(float64(bytes))
+func (r promReceiver) Add(_ net.IP, bytes int) {
+	r.packets.Inc()
+	r.bytes.Add(float64(bytes))
 }
 
-// IncrementSent увеличивает счетчик отправленных пакетов и байтов
-func IncrementSent(plName, recipient string, bytes int) {
+func (promRecorder) Sent(plName, recipient string, bytes int) {
 	sentPacketsCounter.WithLabelValues(plName, recipient).Inc()
 	sendBytesCounter.WithLabelValues(plName, recipient).Add(float64(bytes))
 }
+
+func (promRecorder) DeliveryErrors(plName, recipient, reason string, n int) {
+	deliveryErrorsCounter.WithLabelValues(plName, recipient, reason).Add(float64(n))
+}
+
+func (promRecorder) Dropped(plName, recipient, reason string) {
+	droppedPacketsCounter.WithLabelValues(plName, recipient, reason).Inc()
+}
+
+func (promRecorder) Truncated(plName, action string) {
+	truncatedPacketsCounter.WithLabelValues(plName, action).Inc()
+}
+
+func (promRecorder) Fragments(plName, recipient string, n int) {
+	sentFragmentsCounter.WithLabelValues(plName, recipient).Add(float64(n))
+}
+
+func (promRecorder) QueueDepth(plName, recipient string, length, capacity int) {
+	queueLengthGauge.WithLabelValues(plName, recipient).Set(float64(length))
+	queueCapacityGauge.WithLabelValues(plName, recipient).Set(float64(capacity))
+}
+
+func (promRecorder) Workers(plName, recipient string, delta int) {
+	workersGauge.WithLabelValues(plName, recipient).Add(float64(delta))
+}
+
+func (promRecorder) Latency(plName, recipient string, d time.Duration) {
+	mirrorLatency.WithLabelValues(plName, recipient).Observe(d.Seconds())
+}
+
+func (promRecorder) HTTPBatch(plName, recipient string, records int) {
+	httpBatchSize.WithLabelValues(plName, recipient).Observe(float64(records))
+}
+
+func (promRecorder) HTTPResponse(plName, recipient, code string, d time.Duration) {
+	httpRequestDuration.WithLabelValues(plName, recipient).Observe(d.Seconds())
+	httpResponsesCounter.WithLabelValues(plName, recipient, code).Inc()
+}
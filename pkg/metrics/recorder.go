@@ -0,0 +1,161 @@
+package metrics
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Recorder - приемник событий pipeline. Его реализуют экспортеры (Prometheus, OTLP)
+// и внутренние счетчики Stats. Слушатели, воркеры и отправители пишут события
+// только через Recorder, полученный из Default.
+type Recorder interface {
+	// Receiver возвращает учет приема для слушателя. Вызывается один раз при запуске,
+	// метки находятся заранее, чтобы не искать их на каждый пакет.
+	Receiver(plName, listener string) PacketCounter
+
+	Sent(plName, recipient string, bytes int)
+	DeliveryErrors(plName, recipient, reason string, n int)
+	Dropped(plName, recipient, reason string)
+	// Truncated учитывает датаграмму, обрезанную буфером слушателя; action - drop или forward
+	Truncated(plName, action string)
+	Fragments(plName, recipient string, n int)
+	QueueDepth(plName, recipient string, length, capacity int)
+	Workers(plName, recipient string, delta int)
+	Latency(plName, recipient string, d time.Duration)
+
+	HTTPBatch(plName, recipient string, records int)
+	// HTTPResponse учитывает время и код ответа; code - "error" для запросов без ответа
+	HTTPResponse(plName, recipient, code string, d time.Duration)
+}
+
+// PacketCounter учитывает принятые слушателем пакеты
+type PacketCounter interface {
+	Add(src net.IP, bytes int)
+}
+
+var (
+	recordersMu sync.Mutex
+	// дополнительные экспортеры, подключенные через AddRecorder
+	extraRecorders atomic.Pointer[[]Recorder]
+)
+
+// AddRecorder подключает экспортер ко всем последующим событиям.
+// Вызывается при старте, до запуска pipeline.
+func AddRecorder(r Recorder) {
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+
+	var list []Recorder
+	if cur := extraRecorders.Load(); cur != nil {
+		list = append(list, *cur...)
+	}
+	list = append(list, r)
+	extraRecorders.Store(&list)
+}
+
+// Default возвращает Recorder, который передает события в Stats, Prometheus
+// и подключенные экспортеры
+func Default() Recorder {
+	return fanout{}
+}
+
+// fanout рассылает события всем приемникам
+type fanout struct{}
+
+func (fanout) each(fn func(Recorder)) {
+	fn(statsRecorder{})
+	fn(promRecorder{})
+	if list := extraRecorders.Load(); list != nil {
+		for _, r := range *list {
+			fn(r)
+		}
+	}
+}
+
+func (f fanout) Receiver(plName, listener string) PacketCounter {
+	var counters packetCounters
+	f.each(func(r Recorder) { counters = append(counters, r.Receiver(plName, listener)) })
+	return counters
+}
+
+func (f fanout) Sent(plName, recipient string, bytes int) {
+	statsRecorder{}.Sent(plName, recipient, bytes)
+	promRecorder{}.Sent(plName, recipient, bytes)
+	for _, r := range f.exporters() {
+		r.Sent(plName, recipient, bytes)
+	}
+}
+
+func (f fanout) DeliveryErrors(plName, recipient, reason string, n int) {
+	statsRecorder{}.DeliveryErrors(plName, recipient, reason, n)
+	promRecorder{}.DeliveryErrors(plName, recipient, reason, n)
+	for _, r := range f.exporters() {
+		r.DeliveryErrors(plName, recipient, reason, n)
+	}
+}
+
+func (f fanout) Dropped(plName, recipient, reason string) {
+	statsRecorder{}.Dropped(plName, recipient, reason)
+	promRecorder{}.Dropped(plName, recipient, reason)
+	for _, r := range f.exporters() {
+		r.Dropped(plName, recipient, reason)
+	}
+}
+
+func (f fanout) Truncated(plName, action string) {
+	statsRecorder{}.Truncated(plName, action)
+	promRecorder{}.Truncated(plName, action)
+	for _, r := range f.exporters() {
+		r.Truncated(plName, action)
+	}
+}
+
+func (f fanout) Fragments(plName, recipient string, n int) {
+	statsRecorder{}.Fragments(plName, recipient, n)
+	promRecorder{}.Fragments(plName, recipient, n)
+	for _, r := range f.exporters() {
+		r.Fragments(plName, recipient, n)
+	}
+}
+
+func (f fanout) QueueDepth(plName, recipient string, length, capacity int) {
+	f.each(func(r Recorder) { r.QueueDepth(plName, recipient, length, capacity) })
+}
+
+func (f fanout) Workers(plName, recipient string, delta int) {
+	f.each(func(r Recorder) { r.Workers(plName, recipient, delta) })
+}
+
+func (f fanout) Latency(plName, recipient string, d time.Duration) {
+	statsRecorder{}.Latency(plName, recipient, d)
+	promRecorder{}.Latency(plName, recipient, d)
+	for _, r := range f.exporters() {
+		r.Latency(plName, recipient, d)
+	}
+}
+
+func (f fanout) HTTPBatch(plName, recipient string, records int) {
+	f.each(func(r Recorder) { r.HTTPBatch(plName, recipient, records) })
+}
+
+func (f fanout) HTTPResponse(plName, recipient, code string, d time.Duration) {
+	f.each(func(r Recorder) { r.HTTPResponse(plName, recipient, code, d) })
+}
+
+// exporters возвращает подключенные экспортеры без выделения памяти
+func (fanout) exporters() []Recorder {
+	if list := extraRecorders.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+type packetCounters []PacketCounter
+
+func (pc packetCounters) Add(src net.IP, bytes int) {
+	for _, c := range pc {
+		c.Add(src, bytes)
+	}
+}
@@ -0,0 +1,275 @@
+package metrics
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PipelineStats - снимок счетчиков pipeline.
+// Те же значения экспортируются в Prometheus, снимок нужен для тестов и диагностики.
+type PipelineStats struct {
+	Name          string
+	Received      uint64
+	ReceivedBytes uint64
+	Truncated     uint64 // обрезано буфером слушателя
+	Targets       map[string]TargetStats
+}
+
+// TargetStats - снимок счетчиков цели pipeline
+type TargetStats struct {
+	Sent      uint64
+	SentBytes uint64
+	Dropped   uint64 // отброшено при переполнении очереди
+	Errors    uint64 // ошибки доставки
+	Fragments uint64 // отправлено IP фрагментов
+
+	QueueLen int
+	QueueCap int
+	Workers  int
+
+	LatencyCount uint64
+	LatencySum   time.Duration
+}
+
+// MeanLatency возвращает среднюю задержку зеркалирования
+func (ts TargetStats) MeanLatency() time.Duration {
+	if ts.LatencyCount == 0 {
+		return 0
+	}
+	return ts.LatencySum / time.Duration(ts.LatencyCount)
+}
+
+type pipelineCounters struct {
+	received      atomic.Uint64
+	receivedBytes atomic.Uint64
+	truncated     atomic.Uint64
+
+	top atomic.Pointer[topSources] // nil, если учет источников выключен
+
+	mu      sync.RWMutex
+	targets map[string]*targetCounters
+}
+
+type targetCounters struct {
+	sent      atomic.Uint64
+	sentBytes atomic.Uint64
+	dropped   atomic.Uint64
+	errors    atomic.Uint64
+	fragments atomic.Uint64
+
+	queueLen atomic.Int64
+	queueCap atomic.Int64
+	workers  atomic.Int64
+
+	latencyCount atomic.Uint64
+	latencySum   atomic.Int64
+}
+
+var (
+	statsMu   sync.RWMutex
+	pipelines = map[string]*pipelineCounters{}
+
+	// размер таблицы самых активных источников, 0 - учет выключен
+	topSourcesSize int
+)
+
+const DefaultTopSources = 20
+
+// ConfigureSources включает или выключает учет самых активных источников.
+// topN - сколько источников хранить на pipeline.
+func ConfigureSources(enabled bool, topN int) {
+	if topN <= 0 {
+		topN = DefaultTopSources
+	}
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	if !enabled {
+		topN = 0
+	}
+	if topN == topSourcesSize {
+		return
+	}
+	topSourcesSize = topN
+
+	for _, pc := range pipelines {
+		pc.top.Store(newTopSourcesOrNil(topN))
+	}
+}
+
+func newTopSourcesOrNil(k int) *topSources {
+	if k <= 0 {
+		return nil
+	}
+	return newTopSources(k)
+}
+
+// TopSources возвращает самых активных источников pipeline по убыванию числа пакетов
+func TopSources(plName string) []SourceCount {
+	top := pipelineStats(plName).top.Load()
+	if top == nil {
+		return nil
+	}
+
+	out := top.snapshot()
+	sort.Slice(out, func(i, j int) bool { return out[i].Packets > out[j].Packets })
+	return out
+}
+
+func pipelineStats(plName string) *pipelineCounters {
+	statsMu.RLock()
+	pc, ok := pipelines[plName]
+	statsMu.RUnlock()
+	if ok {
+		return pc
+	}
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	if pc, ok = pipelines[plName]; !ok {
+		pc = &pipelineCounters{targets: map[string]*targetCounters{}}
+		pc.top.Store(newTopSourcesOrNil(topSourcesSize))
+		pipelines[plName] = pc
+	}
+	return pc
+}
+
+func targetStats(plName, recipient string) *targetCounters {
+	pc := pipelineStats(plName)
+
+	pc.mu.RLock()
+	tc, ok := pc.targets[recipient]
+	pc.mu.RUnlock()
+	if ok {
+		return tc
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if tc, ok = pc.targets[recipient]; !ok {
+		tc = &targetCounters{}
+		pc.targets[recipient] = tc
+	}
+	return tc
+}
+
+// Stats возвращает снимок счетчиков pipeline
+func Stats(plName string) PipelineStats {
+	pc := pipelineStats(plName)
+
+	st := PipelineStats{
+		Name:          plName,
+		Received:      pc.received.Load(),
+		ReceivedBytes: pc.receivedBytes.Load(),
+		Truncated:     pc.truncated.Load(),
+		Targets:       map[string]TargetStats{},
+	}
+
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+
+	for name, tc := range pc.targets {
+		st.Targets[name] = TargetStats{
+			Sent:         tc.sent.Load(),
+			SentBytes:    tc.sentBytes.Load(),
+			Dropped:      tc.dropped.Load(),
+			Errors:       tc.errors.Load(),
+			Fragments:    tc.fragments.Load(),
+			QueueLen:     int(tc.queueLen.Load()),
+			QueueCap:     int(tc.queueCap.Load()),
+			Workers:      int(tc.workers.Load()),
+			LatencyCount: tc.latencyCount.Load(),
+			LatencySum:   time.Duration(tc.latencySum.Load()),
+		}
+	}
+	return st
+}
+
+// AllStats возвращает снимки всех pipeline, по которым были события
+func AllStats() []PipelineStats {
+	statsMu.RLock()
+	names := make([]string, 0, len(pipelines))
+	for name := range pipelines {
+		names = append(names, name)
+	}
+	statsMu.RUnlock()
+
+	all := make([]PipelineStats, 0, len(names))
+	for _, name := range names {
+		all = append(all, Stats(name))
+	}
+	return all
+}
+
+// statsRecorder ведет счетчики для Stats и таблицу самых активных источников
+type statsRecorder struct{}
+
+type statsReceiver struct {
+	pc *pipelineCounters
+}
+
+func (statsRecorder) Receiver(plName, _ string) PacketCounter {
+	return statsReceiver{pc: pipelineStats(plName)}
+}
+
+// Add учитывает принятый пакет. Источник попадает в таблицу самых активных,
+// если учет источников включен.
+func (r statsReceiver) Add(src net.IP, bytes int) {
+	r.pc.received.Add(1)
+	r.pc.receivedBytes.Add(uint64(bytes))
+
+	if top := r.pc.top.Load(); top != nil {
+		if addr, ok := netip.AddrFromSlice(src); ok {
+			top.add(addr.Unmap(), bytes)
+		}
+	}
+}
+
+func (statsRecorder) Sent(plName, recipient string, bytes int) {
+	tc := targetStats(plName, recipient)
+	tc.sent.Add(1)
+	tc.sentBytes.Add(uint64(bytes))
+}
+
+func (statsRecorder) DeliveryErrors(plName, recipient, _ string, n int) {
+	targetStats(plName, recipient).errors.Add(uint64(n))
+}
+
+func (statsRecorder) Dropped(plName, recipient, _ string) {
+	targetStats(plName, recipient).dropped.Add(1)
+}
+
+func (statsRecorder) Truncated(plName, _ string) {
+	pipelineStats(plName).truncated.Add(1)
+}
+
+func (statsRecorder) Fragments(plName, recipient string, n int) {
+	targetStats(plName, recipient).fragments.Add(uint64(n))
+}
+
+func (statsRecorder) QueueDepth(plName, recipient string, length, capacity int) {
+	tc := targetStats(plName, recipient)
+	tc.queueLen.Store(int64(length))
+	tc.queueCap.Store(int64(capacity))
+}
+
+func (statsRecorder) Workers(plName, recipient string, delta int) {
+	targetStats(plName, recipient).workers.Add(int64(delta))
+}
+
+func (statsRecorder) Latency(plName, recipient string, d time.Duration) {
+	tc := targetStats(plName, recipient)
+	tc.latencyCount.Add(1)
+	tc.latencySum.Add(int64(d))
+}
+
+func (statsRecorder) HTTPBatch(string, string, int) {}
+
+func (statsRecorder) HTTPResponse(string, string, string, time.Duration) {}
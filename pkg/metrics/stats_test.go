@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsSnapshot(t *testing.T) {
+	const pl = "stats_snapshot"
+
+	rec := Default()
+	rec.Receiver(pl, "0").Add(net.IPv4(10, 0, 0, 1), 100)
+	rec.Receiver(pl, "1").Add(net.IPv4(10, 0, 0, 2), 50)
+
+	rec.Sent(pl, "a", 100)
+	rec.Dropped(pl, "a", "queue_full")
+	rec.DeliveryErrors(pl, "a", "write", 1)
+	rec.DeliveryErrors(pl, "b", "queue_full", 3)
+	rec.Fragments(pl, "a", 2)
+	rec.QueueDepth(pl, "a", 5, 1500)
+	rec.Workers(pl, "a", 2)
+	rec.Workers(pl, "a", -1)
+	rec.Latency(pl, "a", time.Millisecond)
+	rec.Latency(pl, "a", 3*time.Millisecond)
+
+	st := Stats(pl)
+	if st.Received != 2 || st.ReceivedBytes != 150 {
+		t.Fatalf("получено %d/%d", st.Received, st.ReceivedBytes)
+	}
+
+	a := st.Targets["a"]
+	want := TargetStats{
+		Sent: 1, SentBytes: 100, Dropped: 1, Errors: 1, Fragments: 2,
+		QueueLen: 5, QueueCap: 1500, Workers: 1,
+		LatencyCount: 2, LatencySum: 4 * time.Millisecond,
+	}
+	if a != want {
+		t.Fatalf("цель a: %+v, ожидали %+v", a, want)
+	}
+	if a.MeanLatency() != 2*time.Millisecond {
+		t.Fatalf("средняя задержка %v", a.MeanLatency())
+	}
+	if st.Targets["b"].Errors != 3 {
+		t.Fatalf("цель b: %+v", st.Targets["b"])
+	}
+
+	found := false
+	for _, s := range AllStats() {
+		found = found || s.Name == pl
+	}
+	if !found {
+		t.Fatal("pipeline нет в AllStats")
+	}
+}
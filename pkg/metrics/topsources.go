@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"container/heap"
+	"net/netip"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// topSources - таблица самых активных источников по алгоритму Space-Saving
+// (Metwally et al.). Хранит не более k источников; новый источник вытесняет
+// источник с наименьшим счетчиком и наследует его значение, поэтому счетчики
+// завышены не более чем на errPackets.
+type topSources struct {
+	mu      sync.Mutex
+	k       int
+	entries map[netip.Addr]*sourceEntry
+	heap    sourceHeap
+}
+
+type sourceEntry struct {
+	addr       netip.Addr
+	packets    uint64
+	bytes      uint64
+	errPackets uint64 // верхняя граница завышения packets
+	index      int    // позиция в куче
+}
+
+// SourceCount - оценка трафика источника
+type SourceCount struct {
+	Addr       netip.Addr
+	Packets    uint64
+	Bytes      uint64
+	ErrPackets uint64
+}
+
+func newTopSources(k int) *topSources {
+	return &topSources{
+		k:       k,
+		entries: make(map[netip.Addr]*sourceEntry, k),
+	}
+}
+
+// add учитывает пакет от источника
+func (ts *topSources) add(addr netip.Addr, bytes int) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if e, ok := ts.entries[addr]; ok {
+		e.packets++
+		e.bytes += uint64(bytes)
+		heap.Fix(&ts.heap, e.index)
+		return
+	}
+
+	if len(ts.entries) < ts.k {
+		e := &sourceEntry{addr: addr, packets: 1, bytes: uint64(bytes)}
+		ts.entries[addr] = e
+		heap.Push(&ts.heap, e)
+		return
+	}
+
+	// вытесняем минимальный источник, новый наследует его счетчики
+	e := ts.heap[0]
+	delete(ts.entries, e.addr)
+	e.addr = addr
+	e.errPackets = e.packets
+	e.packets++
+	e.bytes += uint64(bytes)
+	ts.entries[addr] = e
+	heap.Fix(&ts.heap, 0)
+}
+
+// snapshot возвращает текущие оценки
+func (ts *topSources) snapshot() []SourceCount {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	out := make([]SourceCount, 0, len(ts.entries))
+	for _, e := range ts.entries {
+		out = append(out, SourceCount{Addr: e.addr, Packets: e.packets, Bytes: e.bytes, ErrPackets: e.errPackets})
+	}
+	return out
+}
+
+// sourceHeap - min-куча по числу пакетов
+type sourceHeap []*sourceEntry
+
+func (h sourceHeap) Len() int           { return len(h) }
+func (h sourceHeap) Less(i, j int) bool { return h[i].packets < h[j].packets }
+func (h sourceHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *sourceHeap) Push(x any) {
+	e := x.(*sourceEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *sourceHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+// topSourcesCollector экспортирует таблицы источников при каждом опросе.
+// Число рядов ограничено top_sources на pipeline, вытесненные источники пропадают из выдачи.
+type topSourcesCollector struct {
+	packets *prometheus.Desc
+	bytes   *prometheus.Desc
+	errors  *prometheus.Desc
+}
+
+func newTopSourcesCollector() *topSourcesCollector {
+	labels := []string{"pipeline_name", "sender"}
+	return &topSourcesCollector{
+		packets: prometheus.NewDesc("received_top_source_packets",
+			"Estimated packets received from the most active sources", labels, nil),
+		bytes: prometheus.NewDesc("received_top_source_bytes",
+			"Estimated bytes received from the most active sources", labels, nil),
+		errors: prometheus.NewDesc("received_top_source_packets_error",
+			"Upper bound of overestimation of received_top_source_packets", labels, nil),
+	}
+}
+
+func (c *topSourcesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.packets
+	ch <- c.bytes
+	ch <- c.errors
+}
+
+func (c *topSourcesCollector) Collect(ch chan<- prometheus.Metric) {
+	statsMu.RLock()
+	defer statsMu.RUnlock()
+
+	for name, pc := range pipelines {
+		top := pc.top.Load()
+		if top == nil {
+			continue
+		}
+
+		for _, sc := range top.snapshot() {
+			addr := sc.Addr.String()
+			ch <- prometheus.MustNewConstMetric(c.packets, prometheus.GaugeValue, float64(sc.Packets), name, addr)
+			ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(sc.Bytes), name, addr)
+			ch <- prometheus.MustNewConstMetric(c.errors, prometheus.GaugeValue, float64(sc.ErrPackets), name, addr)
+		}
+	}
+}
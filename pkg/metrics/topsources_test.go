@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTopSourcesHeavyHitters(t *testing.T) {
+	ts := newTopSources(10)
+
+	heavy := []netip.Addr{
+		netip.MustParseAddr("10.0.0.1"),
+		netip.MustParseAddr("10.0.0.2"),
+		netip.MustParseAddr("10.0.0.3"),
+	}
+
+	// тяжелые источники перемешаны с тысячами одиночных пакетов;
+	// Space-Saving гарантирует сохранение источников с долей больше 1/k (1000 > 6000/10)
+	for i := range 3000 {
+		ts.add(heavy[i%len(heavy)], 10)
+		ts.add(netip.AddrFrom4([4]byte{192, 168, byte(i >> 8), byte(i)}), 10)
+	}
+
+	snap := ts.snapshot()
+	if len(snap) != 10 {
+		t.Fatalf("таблица должна быть ограничена 10 источниками, получили %d", len(snap))
+	}
+
+	found := map[netip.Addr]SourceCount{}
+	for _, sc := range snap {
+		found[sc.Addr] = sc
+	}
+	for _, addr := range heavy {
+		sc, ok := found[addr]
+		if !ok {
+			t.Fatalf("тяжелый источник %v вытеснен", addr)
+		}
+		// гарантия Space-Saving: packets - errPackets <= истинное значение <= packets
+		if sc.Packets < 1000 || sc.Packets-sc.ErrPackets > 1000 {
+			t.Fatalf("%v: оценка %d (ошибка %d) для 1000 пакетов", addr, sc.Packets, sc.ErrPackets)
+		}
+	}
+}
+
+func TestConfigureSources(t *testing.T) {
+	const pl = "configure_sources"
+	defer ConfigureSources(false, 0)
+
+	r := Default().Receiver(pl, "0")
+	r.Add(net.IPv4(10, 0, 0, 1), 1)
+	if TopSources(pl) != nil {
+		t.Fatal("учет источников выключен по умолчанию")
+	}
+
+	ConfigureSources(true, 2)
+	for range 3 {
+		r.Add(net.IPv4(10, 0, 0, 1), 100)
+	}
+	r.Add(net.IPv4(10, 0, 0, 2), 100)
+	r.Add(net.IPv4(10, 0, 0, 3), 100)
+
+	top := TopSources(pl)
+	if len(top) != 2 || top[0].Addr.String() != "10.0.0.1" || top[0].Packets != 3 {
+		t.Fatalf("top: %+v", top)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(newTopSourcesCollector())
+	// 3 ряда на источник: пакеты, байты, погрешность
+	if n := testutil.CollectAndCount(reg); n != 6 {
+		t.Fatalf("ожидали 6 рядов, получили %d", n)
+	}
+}
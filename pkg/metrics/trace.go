@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// packetTracer - выборочная трассировка пакетов, nil - трассировка выключена
+type packetTracer struct {
+	tracer trace.Tracer
+	ratio  float64
+}
+
+var tracing atomic.Pointer[packetTracer]
+
+// SetTracing включает трассировку доли ratio принятых пакетов.
+// tp == nil или ratio <= 0 выключают трассировку.
+func SetTracing(tp trace.TracerProvider, ratio float64) {
+	if tp == nil || ratio <= 0 {
+		tracing.Store(nil)
+		return
+	}
+	tracing.Store(&packetTracer{tracer: tp.Tracer("udp_mirror"), ratio: min(ratio, 1)})
+}
+
+// PacketTrace - контекст трассировки пакета, попавшего в выборку.
+// Нулевое значение означает, что пакет не трассируется, и ничего не стоит.
+type PacketTrace struct {
+	pt *packetTracer
+	sc trace.SpanContext
+}
+
+// TraceReceive решает, попадает ли пакет в выборку, и записывает span приема
+// от received до текущего момента
+func TraceReceive(plName, listener string, src *net.UDPAddr, bytes int, received time.Time) PacketTrace {
+	pt := tracing.Load()
+	if pt == nil || rand.Float64() >= pt.ratio { // #nosec G404 -- выборка, не криптография
+		return PacketTrace{}
+	}
+
+	_, span := pt.tracer.Start(context.Background(), "receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithTimestamp(received),
+		trace.WithAttributes(
+			attribute.String("pipeline", plName),
+			attribute.String("listener", listener),
+			attribute.String("src", src.String()),
+			attribute.Int("bytes", bytes),
+		))
+	span.End()
+
+	return PacketTrace{pt: pt, sc: span.SpanContext()}
+}
+
+// Sampled сообщает, попал ли пакет в выборку
+func (t PacketTrace) Sampled() bool {
+	return t.pt != nil
+}
+
+// Enqueue записывает span постановки пакета в очередь цели
+func (t PacketTrace) Enqueue(plName, recipient string, start time.Time, dropped bool) {
+	if t.pt == nil {
+		return
+	}
+
+	span := t.child("enqueue", trace.SpanKindInternal, plName, recipient, start)
+	if dropped {
+		span.SetStatus(codes.Error, "queue_full")
+	}
+	span.End()
+}
+
+// Send записывает span передачи пакета цели
+func (t PacketTrace) Send(plName, recipient string, start time.Time) {
+	if t.pt == nil {
+		return
+	}
+
+	t.child("send", trace.SpanKindProducer, plName, recipient, start).End()
+}
+
+func (t PacketTrace) child(name string, kind trace.SpanKind, plName, recipient string, start time.Time) trace.Span {
+	ctx := trace.ContextWithSpanContext(context.Background(), t.sc)
+	_, span := t.pt.tracer.Start(ctx, name,
+		trace.WithSpanKind(kind),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			attribute.String("pipeline", plName),
+			attribute.String("target", recipient),
+		))
+	return span
+}
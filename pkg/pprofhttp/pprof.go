@@ -9,9 +9,11 @@ go tool pprof -http=10.133.132.20:8080 goprofex http://127.0.0.1:6060/debug/ppro
 package pprofhttp
 
 import (
-	"log"
 	"net/http"
 	"net/http/pprof" // подключаем pprof
+	"os"
+
+	"udp_mirror/pkg/logging"
 )
 
 // Start запускает pprof-сервер на указанном адресе
@@ -25,8 +27,10 @@ func Start(addr string) {
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
-	log.Printf("pprof запущен на %s/debug/pprof/", addr)
+	log := logging.For("pprof")
+	log.Info("pprof запущен", "addr", addr, "path", "/debug/pprof/")
 	if err := http.ListenAndServe(addr, mux); err != nil {
-		log.Fatalf("Ошибка запуска pprof: %v", err)
+		log.Error("Ошибка запуска pprof", logging.Err(err))
+		os.Exit(1)
 	}
 }
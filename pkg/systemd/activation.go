@@ -0,0 +1,86 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenFdsStart - первый дескриптор, переданный systemd
+const listenFdsStart = 3
+
+// UDPListeners возвращает UDP сокеты, переданные через LISTEN_FDS, сгруппированные
+// по имени из FileDescriptorName= (LISTEN_FDNAMES). Сокеты без имени попадают под
+// имя "unknown", как в sd_listen_fds_with_names. Переменные окружения очищаются,
+// чтобы дочерние процессы их не унаследовали. Если сокеты не переданы, возвращает nil.
+func UDPListeners() (map[string][]*net.UDPConn, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	var names []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+
+	out := map[string][]*net.UDPConn{}
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		unix.CloseOnExec(fd)
+
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		conn, err := udpConn(fd, name)
+		if err != nil {
+			closeAll(out)
+			return nil, err
+		}
+		out[name] = append(out[name], conn)
+	}
+	return out, nil
+}
+
+// udpConn оборачивает переданный дескриптор в *net.UDPConn
+func udpConn(fd int, name string) (*net.UDPConn, error) {
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close() // FilePacketConn дублирует дескриптор
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("сокет %s (fd %d): %w", name, fd, err)
+	}
+
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("сокет %s (fd %d) не UDP: %s", name, fd, pc.LocalAddr().Network())
+	}
+	return conn, nil
+}
+
+func closeAll(conns map[string][]*net.UDPConn) {
+	for _, list := range conns {
+		for _, c := range list {
+			c.Close()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Package systemd реализует протокол sd_notify, watchdog и активацию сокетов
+// без зависимости от libsystemd.
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Состояния sd_notify
+const (
+	StateReady    = "READY=1"
+	StateStopping = "STOPPING=1"
+	StateWatchdog = "WATCHDOG=1"
+)
+
+// Notify отправляет состояние в сокет из NOTIFY_SOCKET.
+// Возвращает false без ошибки, если процесс запущен не systemd.
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+
+	// абстрактный сокет задается с @ в начале
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("ошибка подключения к NOTIFY_SOCKET: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("ошибка отправки в NOTIFY_SOCKET: %w", err)
+	}
+	return true, nil
+}
+
+// Enabled сообщает, ожидает ли systemd уведомлений от процесса
+func Enabled() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// Ready сообщает о завершении запуска
+func Ready() (bool, error) {
+	return Notify(StateReady)
+}
+
+// Reloading сообщает о начале перезагрузки конфига. После перезагрузки нужно вызвать Ready.
+// MONOTONIC_USEC обязателен для Type=notify-reload.
+func Reloading() (bool, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return false, err
+	}
+	usec := ts.Nano() / int64(time.Microsecond)
+	return Notify("RELOADING=1\nMONOTONIC_USEC=" + strconv.FormatInt(usec, 10))
+}
+
+// Stopping сообщает о начале остановки
+func Stopping() (bool, error) {
+	return Notify(StateStopping)
+}
+
+// Status передает строку состояния для systemctl status
+func Status(status string) (bool, error) {
+	return Notify("STATUS=" + status)
+}
+
+// WatchdogInterval возвращает период watchdog из WATCHDOG_USEC.
+// Если watchdog не включен или предназначен другому процессу, возвращает 0.
+func WatchdogInterval() (time.Duration, error) {
+	s := os.Getenv("WATCHDOG_USEC")
+	if s == "" {
+		return 0, nil
+	}
+
+	usec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, fmt.Errorf("некорректный WATCHDOG_USEC %q", s)
+	}
+
+	if p := os.Getenv("WATCHDOG_PID"); p != "" {
+		pid, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, fmt.Errorf("некорректный WATCHDOG_PID %q", p)
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// RunWatchdog отправляет WATCHDOG=1 каждые interval/2, пока alive возвращает true.
+// Если alive возвращает false, пинги прекращаются и systemd перезапускает сервис
+// по истечении WatchdogSec. Завершается при отмене контекста.
+func RunWatchdog(ctx context.Context, interval time.Duration, alive func() bool, onErr func(error)) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !alive() {
+			continue
+		}
+		if _, err := Notify(StateWatchdog); err != nil && onErr != nil {
+			onErr(err)
+		}
+	}
+}
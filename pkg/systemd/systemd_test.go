@@ -0,0 +1,194 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket создает сокет, который слушает уведомления вместо systemd
+func fakeNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+
+	path := t.TempDir() + "/notify.sock"
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func read(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+
+	buf := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	conn := fakeNotifySocket(t)
+
+	if sent, err := Ready(); !sent || err != nil {
+		t.Fatalf("Ready: %v %v", sent, err)
+	}
+	if msg := read(t, conn); msg != "READY=1" {
+		t.Fatalf("получено %q", msg)
+	}
+
+	if _, err := Reloading(); err != nil {
+		t.Fatal(err)
+	}
+	msg := read(t, conn)
+	lines := strings.Split(msg, "\n")
+	if len(lines) != 2 || lines[0] != "RELOADING=1" || !strings.HasPrefix(lines[1], "MONOTONIC_USEC=") {
+		t.Fatalf("получено %q", msg)
+	}
+
+	if _, err := Stopping(); err != nil {
+		t.Fatal(err)
+	}
+	if msg := read(t, conn); msg != "STOPPING=1" {
+		t.Fatalf("получено %q", msg)
+	}
+}
+
+func TestNotifyDisabled(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	if sent, err := Ready(); sent || err != nil {
+		t.Fatalf("без NOTIFY_SOCKET: %v %v", sent, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if d, err := WatchdogInterval(); d != 0 || err != nil {
+		t.Fatalf("без watchdog: %v %v", d, err)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "3000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if d, err := WatchdogInterval(); d != 3*time.Second || err != nil {
+		t.Fatalf("watchdog: %v %v", d, err)
+	}
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if d, _ := WatchdogInterval(); d != 0 {
+		t.Fatalf("watchdog другого процесса: %v", d)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "abc")
+	if _, err := WatchdogInterval(); err == nil {
+		t.Fatal("некорректный WATCHDOG_USEC принят")
+	}
+}
+
+func TestRunWatchdog(t *testing.T) {
+	conn := fakeNotifySocket(t)
+
+	var alive atomic.Bool
+	alive.Store(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go RunWatchdog(ctx, 40*time.Millisecond, alive.Load, func(err error) { t.Error(err) })
+
+	if msg := read(t, conn); msg != "WATCHDOG=1" {
+		t.Fatalf("получено %q", msg)
+	}
+
+	// pipeline неисправен - пинги прекращаются
+	alive.Store(false)
+	time.Sleep(50 * time.Millisecond)
+	buf := make([]byte, 64)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := conn.Read(buf); err != nil {
+			break // очередь пуста и новых пингов нет
+		}
+	}
+
+	alive.Store(true)
+	if msg := read(t, conn); msg != "WATCHDOG=1" {
+		t.Fatalf("после восстановления получено %q", msg)
+	}
+}
+
+// TestUDPListeners запускает тест в дочернем процессе с UDP сокетами на fd 3 и 4,
+// как это делает systemd
+func TestUDPListeners(t *testing.T) {
+	if os.Getenv("UDP_MIRROR_ACTIVATION_CHILD") == "1" {
+		activationChild()
+		return
+	}
+
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		f, err := conn.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, conn.LocalAddr().String())
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestUDPListeners$")
+	cmd.Env = append(os.Environ(),
+		"UDP_MIRROR_ACTIVATION_CHILD=1",
+		"LISTEN_FDS=2",
+		"LISTEN_FDNAMES=dp_2088:dp_2088",
+	)
+	cmd.ExtraFiles = files
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	want := fmt.Sprintf("dp_2088 %s\ndp_2088 %s\n", addrs[0], addrs[1])
+	if !strings.Contains(string(out), want) {
+		t.Fatalf("получено %q, ожидали %q", out, want)
+	}
+}
+
+func activationChild() {
+	// LISTEN_PID известен только после запуска процесса
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	conns, err := UDPListeners()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for name, list := range conns {
+		for _, c := range list {
+			fmt.Printf("%s %s\n", name, c.LocalAddr())
+		}
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		fmt.Println("LISTEN_FDS не очищен")
+		os.Exit(1)
+	}
+}